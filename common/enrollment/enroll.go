@@ -21,9 +21,12 @@ import (
 	"fmt"
 	"github.com/openziti/sdk-golang/ziti"
 	"github.com/openziti/ziti/ziti/cmd/common"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/foundation/v2/term"
@@ -37,26 +40,33 @@ import (
 // global state used by all subcommands are located here for easy discovery
 
 const verboseDesc = "Enable verbose logging."
-const outpathDesc = "Output configuration file."
-const jwtpathDesc = "Enrollment token (JWT file). Required"
+const outpathDesc = "Output configuration file. Use - to write the identity to stdout"
+const jwtpathDesc = "Enrollment token (JWT file). Use - to read the token from stdin"
 const certDesc = "The certificate to present when establishing a connection."
 const idnameDesc = "Names the identity. Ignored if not 3rd party auto enrollment"
 
 const outFlag = "out"
+const identityDirFlag = "identity-dir"
 
 // EnrollOptions contains the command line options
 type EnrollOptions struct {
 	common.CommonOptions
-	RemoveJwt  bool
-	KeyAlg     ziti.KeyAlgVar
-	JwtPath    string
-	OutputPath string
-	KeyPath    string
-	CertPath   string
-	IdName     string
-	CaOverride string
-	Username   string
-	Password   string
+	RemoveJwt   bool
+	KeyAlg      ziti.KeyAlgVar
+	JwtPath     string
+	JwtString   string
+	JwtUrl      string
+	OutputPath  string
+	IdentityDir string
+	KeyPath     string
+	CertPath    string
+	IdName      string
+	CaOverride  string
+	Username    string
+	Password    string
+
+	// In is where the JWT is read from when the JWT path is -, defaults to stdin
+	In io.Reader
 }
 
 type EnrollAction struct {
@@ -72,7 +82,7 @@ func NewEnrollCommand(p common.OptionsProvider) *cobra.Command {
 	var enrollSubCmd = &cobra.Command{
 		SilenceErrors: true,
 		SilenceUsage:  false,
-		Use:           "enroll path/to/jwt",
+		Use:           "enroll [path/to/jwt | -]",
 		Short:         "enroll an identity",
 		Args:          cobra.MaximumNArgs(1),
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
@@ -92,7 +102,7 @@ func NewEnrollCommand(p common.OptionsProvider) *cobra.Command {
 			if len(args) > 0 {
 				action.JwtPath = args[0]
 			}
-			if action.JwtPath == "" {
+			if action.JwtPath == "" && action.JwtString == "" && action.JwtUrl == "" {
 				defer fmt.Printf("\nERROR: no jwt provided\n")
 				return cmd.Help()
 			}
@@ -104,13 +114,16 @@ func NewEnrollCommand(p common.OptionsProvider) *cobra.Command {
 
 	//enrollSubCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, verboseDesc)
 	enrollSubCmd.Flags().StringVarP(&action.JwtPath, "jwt", "j", "", jwtpathDesc)
+	enrollSubCmd.Flags().StringVar(&action.JwtString, "jwt-string", "", "Enrollment token given as a string")
+	enrollSubCmd.Flags().StringVar(&action.JwtUrl, "jwt-url", "", "URL to fetch the enrollment token from, such as a one-time enrollment link")
 	enrollSubCmd.Flags().StringVarP(&action.OutputPath, outFlag, "o", "", outpathDesc)
+	enrollSubCmd.Flags().StringVar(&action.IdentityDir, identityDirFlag, "", "Write the identity file into this directory, as used by ziti tunnel --identity-dir")
 	enrollSubCmd.Flags().StringVarP(&action.IdName, "idname", "n", "", idnameDesc)
 	enrollSubCmd.Flags().StringVarP(&action.CertPath, "cert", "c", "", certDesc)
 	enrollSubCmd.Flags().StringVarP(&action.CaOverride, "ca", "", "", "Additional trusted certificates")
 	enrollSubCmd.Flags().StringVarP(&action.Username, "username", "u", "", "Username for updb enrollment, prompted if not provided and necessary")
 	enrollSubCmd.Flags().StringVarP(&action.Password, "password", "p", "", "Password for updb enrollment, prompted if not provided and necessary")
-	enrollSubCmd.Flags().BoolVar(&action.RemoveJwt, "rm", false, "Remove the JWT on success")
+	enrollSubCmd.Flags().BoolVar(&action.RemoveJwt, "rm", false, "Remove the JWT file on success")
 	enrollSubCmd.Flags().BoolVarP(&action.Verbose, "verbose", "v", false, "Enable verbose logging")
 
 	action.KeyAlg.Set("RSA") // set default
@@ -129,34 +142,19 @@ func NewEnrollCommand(p common.OptionsProvider) *cobra.Command {
 }
 
 func (e *EnrollAction) Run() error {
-	if strings.TrimSpace(e.OutputPath) == "" {
-		out, outErr := outPathFromJwt(e.JwtPath)
-		if outErr != nil {
-			return fmt.Errorf("could not set the output path: %s", outErr)
-		}
-		e.OutputPath = out
-	}
-
-	if e.JwtPath != "" {
-		if _, err := os.Stat(e.JwtPath); os.IsNotExist(err) {
-			return fmt.Errorf("the provided jwt file does not exist: %s", e.JwtPath)
-		}
-	}
-
 	if e.CaOverride != "" {
 		if _, err := os.Stat(e.CaOverride); os.IsNotExist(err) {
 			return fmt.Errorf("the provided ca file does not exist: %s", e.CaOverride)
 		}
 	}
 
-	if strings.TrimSpace(e.OutputPath) == strings.TrimSpace(e.JwtPath) {
-		return fmt.Errorf("the output path must not be the same as the jwt path")
+	tokenStr, err := e.readJwt()
+	if err != nil {
+		return err
 	}
 
-	tokenStr, _ := ioutil.ReadFile(e.JwtPath)
-
 	pfxlog.Logger().Debugf("jwt to parse: %s", tokenStr)
-	tkn, _, err := enroll.ParseToken(string(tokenStr))
+	tkn, _, err := enroll.ParseToken(tokenStr)
 
 	if err != nil {
 		return fmt.Errorf("failed to parse JWT: %s", err.Error())
@@ -200,37 +198,169 @@ func (e *EnrollAction) Run() error {
 
 		err = enroll.EnrollUpdb(flags)
 		if err == nil {
-			if rmErr := os.Remove(e.JwtPath); rmErr != nil {
-				pfxlog.Logger().WithError(rmErr).Warnf("unable to remove JWT file as requested: %v", e.JwtPath)
-			}
+			e.removeJwt()
 		}
 		return err
 	}
 
+	outputPath, err := e.getOutputPath(tkn)
+	if err != nil {
+		return err
+	}
+
 	conf, err := enroll.Enroll(flags)
 	if err != nil {
 		return fmt.Errorf("failed to enroll: %v", err)
 	}
 
-	output, err := os.Create(e.OutputPath)
-	if err != nil {
-		return fmt.Errorf("failed to open file '%s': %s", e.OutputPath, err.Error())
+	var output io.Writer
+	if outputPath == "-" {
+		output = e.Out
+	} else {
+		file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open file '%s': %s", outputPath, err.Error())
+		}
+		defer func() { _ = file.Close() }()
+		output = file
 	}
-	defer func() { _ = output.Close() }()
 
 	enc := json.NewEncoder(output)
 	enc.SetEscapeHTML(false)
 	encErr := enc.Encode(&conf)
 
-	if err = os.Remove(e.JwtPath); err != nil {
-		pfxlog.Logger().WithError(err).Warnf("unable to remove JWT file as requested: %v", e.JwtPath)
+	if encErr != nil {
+		return fmt.Errorf("enrollment successful but the identity file was not able to be written to: %s [%s]", outputPath, encErr)
 	}
 
-	if encErr == nil {
-		pfxlog.Logger().Infof("enrolled successfully. identity file written to: %s", e.OutputPath)
-		return nil
+	e.removeJwt()
+
+	if outputPath == "-" {
+		pfxlog.Logger().Info("enrolled successfully")
 	} else {
-		return fmt.Errorf("enrollment successful but the identity file was not able to be written to: %s [%s]", e.OutputPath, encErr)
+		pfxlog.Logger().Infof("enrolled successfully. identity file written to: %s", outputPath)
+	}
+	return nil
+}
+
+// readJwt returns the enrollment token from the one JWT source given: a file, stdin, a string or a URL
+func (e *EnrollAction) readJwt() (string, error) {
+	sources := 0
+	for _, source := range []string{e.JwtPath, e.JwtString, e.JwtUrl} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources == 0 {
+		return "", errors.New("no jwt provided")
+	}
+
+	if sources > 1 {
+		return "", errors.New("only one of a jwt file, --jwt-string or --jwt-url may be provided")
+	}
+
+	if e.JwtString != "" {
+		return strings.TrimSpace(e.JwtString), nil
+	}
+
+	if e.JwtUrl != "" {
+		return e.fetchJwt()
+	}
+
+	if e.JwtPath == "-" {
+		in := e.In
+		if in == nil {
+			in = os.Stdin
+		}
+		tokenStr, err := io.ReadAll(in)
+		if err != nil {
+			return "", fmt.Errorf("failed to read jwt from stdin: %v", err)
+		}
+		return strings.TrimSpace(string(tokenStr)), nil
+	}
+
+	if _, err := os.Stat(e.JwtPath); os.IsNotExist(err) {
+		return "", fmt.Errorf("the provided jwt file does not exist: %s", e.JwtPath)
+	}
+
+	tokenStr, err := os.ReadFile(e.JwtPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read jwt file %s: %v", e.JwtPath, err)
+	}
+	return strings.TrimSpace(string(tokenStr)), nil
+}
+
+func (e *EnrollAction) fetchJwt() (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(e.JwtUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch jwt from %s: %v", e.JwtUrl, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch jwt from %s: %v", e.JwtUrl, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch jwt from %s: %s", e.JwtUrl, resp.Status)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// getOutputPath determines where the identity file is written. An explicit --out wins, followed by --identity-dir,
+// and finally a path derived from the jwt file name. The path - means stdout
+func (e *EnrollAction) getOutputPath(tkn *ziti.EnrollmentClaims) (string, error) {
+	outputPath := strings.TrimSpace(e.OutputPath)
+
+	if outputPath != "" && e.IdentityDir != "" {
+		return "", errors.Errorf("only one of --%s and --%s may be provided", outFlag, identityDirFlag)
+	}
+
+	if e.IdentityDir != "" {
+		if err := os.MkdirAll(e.IdentityDir, 0700); err != nil {
+			return "", fmt.Errorf("unable to create identity directory %s: %v", e.IdentityDir, err)
+		}
+
+		name := e.IdName
+		if name == "" && e.JwtPath != "" && e.JwtPath != "-" {
+			name = strings.TrimSuffix(filepath.Base(e.JwtPath), filepath.Ext(e.JwtPath))
+		}
+		if name == "" {
+			name = tkn.Subject
+		}
+		outputPath = filepath.Join(e.IdentityDir, name+".json")
+	}
+
+	if outputPath == "" {
+		if e.JwtPath == "" || e.JwtPath == "-" {
+			return "", errors.Errorf("the --%s or --%s flag is required when the jwt is not read from a file", outFlag, identityDirFlag)
+		}
+
+		var err error
+		if outputPath, err = outPathFromJwt(e.JwtPath); err != nil {
+			return "", fmt.Errorf("could not set the output path: %s", err)
+		}
+	}
+
+	if e.JwtPath != "" && outputPath == strings.TrimSpace(e.JwtPath) {
+		return "", fmt.Errorf("the output path must not be the same as the jwt path")
+	}
+
+	return outputPath, nil
+}
+
+// removeJwt deletes the jwt file after a successful enrollment, if requested with --rm
+func (e *EnrollAction) removeJwt() {
+	if !e.RemoveJwt || e.JwtPath == "" || e.JwtPath == "-" {
+		return
+	}
+
+	if err := os.Remove(e.JwtPath); err != nil {
+		pfxlog.Logger().WithError(err).Warnf("unable to remove JWT file as requested: %v", e.JwtPath)
 	}
 }
 
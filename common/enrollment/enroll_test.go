@@ -0,0 +1,117 @@
+package enrollment
+
+import (
+	"github.com/golang-jwt/jwt"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadJwt(t *testing.T) {
+	req := require.New(t)
+
+	jwtFile := filepath.Join(t.TempDir(), "test.jwt")
+	req.NoError(os.WriteFile(jwtFile, []byte("from-file\n"), 0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("from-url\n"))
+	}))
+	defer server.Close()
+
+	action := &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: jwtFile}}
+	token, err := action.readJwt()
+	req.NoError(err)
+	req.Equal("from-file", token)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: "-", In: strings.NewReader(" from-stdin\n")}}
+	token, err = action.readJwt()
+	req.NoError(err)
+	req.Equal("from-stdin", token)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtString: "from-string"}}
+	token, err = action.readJwt()
+	req.NoError(err)
+	req.Equal("from-string", token)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtUrl: server.URL + "/token"}}
+	token, err = action.readJwt()
+	req.NoError(err)
+	req.Equal("from-url", token)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtUrl: server.URL + "/missing"}}
+	_, err = action.readJwt()
+	req.ErrorContains(err, "404")
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: jwtFile, JwtString: "from-string"}}
+	_, err = action.readJwt()
+	req.ErrorContains(err, "only one of")
+
+	action = &EnrollAction{}
+	_, err = action.readJwt()
+	req.ErrorContains(err, "no jwt provided")
+}
+
+func TestGetOutputPath(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	tkn := &ziti.EnrollmentClaims{StandardClaims: jwt.StandardClaims{Subject: "identity-id"}}
+
+	action := &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: filepath.Join(dir, "test.jwt")}}
+	outputPath, err := action.getOutputPath(tkn)
+	req.NoError(err)
+	req.Equal(filepath.Join(dir, "test.json"), outputPath)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtString: "token", OutputPath: "-"}}
+	outputPath, err = action.getOutputPath(tkn)
+	req.NoError(err)
+	req.Equal("-", outputPath)
+
+	identityDir := filepath.Join(dir, "identities")
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: filepath.Join(dir, "laptop.jwt"), IdentityDir: identityDir}}
+	outputPath, err = action.getOutputPath(tkn)
+	req.NoError(err)
+	req.Equal(filepath.Join(identityDir, "laptop.json"), outputPath)
+	req.DirExists(identityDir)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: "-", IdentityDir: identityDir}}
+	outputPath, err = action.getOutputPath(tkn)
+	req.NoError(err)
+	req.Equal(filepath.Join(identityDir, "identity-id.json"), outputPath)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtUrl: "https://example.com", IdentityDir: identityDir, IdName: "named"}}
+	outputPath, err = action.getOutputPath(tkn)
+	req.NoError(err)
+	req.Equal(filepath.Join(identityDir, "named.json"), outputPath)
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtString: "token"}}
+	_, err = action.getOutputPath(tkn)
+	req.ErrorContains(err, "--out or --identity-dir flag is required")
+
+	action = &EnrollAction{EnrollOptions: EnrollOptions{JwtString: "token", OutputPath: "x.json", IdentityDir: identityDir}}
+	_, err = action.getOutputPath(tkn)
+	req.ErrorContains(err, "only one of")
+}
+
+func TestRemoveJwtOnlyWhenRequested(t *testing.T) {
+	req := require.New(t)
+
+	jwtFile := filepath.Join(t.TempDir(), "test.jwt")
+	req.NoError(os.WriteFile(jwtFile, []byte("token"), 0600))
+
+	action := &EnrollAction{EnrollOptions: EnrollOptions{JwtPath: jwtFile}}
+	action.removeJwt()
+	req.FileExists(jwtFile)
+
+	action.RemoveJwt = true
+	action.removeJwt()
+	req.NoFileExists(jwtFile)
+}
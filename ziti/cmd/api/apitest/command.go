@@ -0,0 +1,101 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package apitest
+
+import (
+	"bytes"
+	"flag"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files with the actual output")
+
+// CommandFactory creates a root command writing to the given streams, such as edge.NewCmdEdge
+type CommandFactory func(out io.Writer, errOut io.Writer) *cobra.Command
+
+type fatalError struct {
+	msg  string
+	code int
+}
+
+// Execute runs the command line against a freshly created command tree and returns what was written to stdout.
+// Errors reported through helpers.CheckErr, which would normally exit the process, are returned as errors. State
+// which normally lasts for a single invocation, such as cached entity ids, is reset first
+func Execute(newCmd CommandFactory, args ...string) (output string, err error) {
+	api.ResetIdCache()
+
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+
+	cmd := newCmd(out, errOut)
+	cmd.SetArgs(args)
+	cmd.SetOut(out)
+	cmd.SetErr(errOut)
+
+	helpers.BehaviorOnFatal(func(msg string, code int) {
+		panic(fatalError{msg: msg, code: code})
+	})
+	defer helpers.DefaultBehaviorOnFatal()
+
+	defer func() {
+		if r := recover(); r != nil {
+			fatal, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			output = out.String()
+			err = errors.Errorf("exit code %v: %v", fatal.code, strings.TrimSpace(fatal.msg))
+		}
+	}()
+
+	err = cmd.Execute()
+	return out.String(), err
+}
+
+// AssertGolden compares actual with the contents of testdata/<name>.golden, failing the test if they differ. When
+// the tests are run with -update, the golden file is rewritten instead
+func AssertGolden(t testing.TB, name string, actual string) {
+	t.Helper()
+	goldenFile := filepath.Join("testdata", name+".golden")
+
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(goldenFile), 0755); err != nil {
+			t.Fatalf("unable to create golden file dir: %v", err)
+		}
+		if err := os.WriteFile(goldenFile, []byte(actual), 0644); err != nil {
+			t.Fatalf("unable to write golden file %v: %v", goldenFile, err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("unable to read golden file %v (run with -update to create it): %v", goldenFile, err)
+	}
+
+	if string(expected) != actual {
+		t.Errorf("output does not match %v (run with -update to accept)\n--- expected ---\n%v\n--- actual ---\n%v", goldenFile, string(expected), actual)
+	}
+}
@@ -0,0 +1,476 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package apitest
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query is a parsed filter in the subset of the Ziti query language supported by the fake API: comparisons
+// (=, !=, <, <=, >, >=, contains, icontains, startswith, endswith, in), anyOf(), not, and, or, parentheses and
+// the trailing sort by, skip and limit clauses
+type Query struct {
+	predicate predicate
+	sortField string
+	sortDesc  bool
+	skip      int64
+	limit     int64
+	hasLimit  bool
+}
+
+type predicate func(entity map[string]interface{}) bool
+
+// ParseQuery parses a filter expression. An empty filter matches everything
+func ParseQuery(filter string) (*Query, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	query := &Query{
+		predicate: func(map[string]interface{}) bool { return true },
+		skip:      -1,
+		limit:     -1,
+	}
+
+	if !p.done() && !p.atClause() {
+		if query.predicate, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+
+	for !p.done() {
+		switch strings.ToLower(p.next()) {
+		case "sort":
+			if err = p.expectKeyword("by"); err != nil {
+				return nil, err
+			}
+			query.sortField = p.next()
+			if !p.done() && (p.peekKeyword("asc") || p.peekKeyword("desc")) {
+				query.sortDesc = strings.EqualFold(p.next(), "desc")
+			}
+		case "skip":
+			if query.skip, err = strconv.ParseInt(p.next(), 10, 64); err != nil {
+				return nil, errors.Wrap(err, "invalid skip")
+			}
+		case "limit":
+			query.hasLimit = true
+			val := p.next()
+			if strings.EqualFold(val, "none") {
+				query.limit = -1
+			} else if query.limit, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return nil, errors.Wrap(err, "invalid limit")
+			}
+		default:
+			return nil, errors.Errorf("unexpected token '%v' in filter '%v'", p.tokens[p.pos-1], filter)
+		}
+	}
+
+	return query, nil
+}
+
+func (self *Query) Matches(entity map[string]interface{}) bool {
+	return self.predicate(entity)
+}
+
+// Sort orders the given entities according to the query's sort clause, if it has one
+func (self *Query) Sort(entities []map[string]interface{}) {
+	if self.sortField == "" {
+		return
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		c := compareValues(lookup(entities[i], self.sortField), lookup(entities[j], self.sortField))
+		if self.sortDesc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+type token struct {
+	val    string
+	quoted bool
+}
+
+func tokenize(filter string) ([]token, error) {
+	var result []token
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.Errorf("unterminated string in filter '%v'", filter)
+			}
+			i++
+			result = append(result, token{val: sb.String(), quoted: true})
+		case strings.ContainsRune("()[],", r):
+			result = append(result, token{val: string(r)})
+			i++
+		case strings.ContainsRune("=!<>", r):
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				result = append(result, token{val: string(runes[i : i+2])})
+				i += 2
+			} else {
+				result = append(result, token{val: string(r)})
+				i++
+			}
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()[],=!<>\"", runes[i]) {
+				i++
+			}
+			result = append(result, token{val: string(runes[start:i])})
+		}
+	}
+	return result, nil
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (self *queryParser) done() bool {
+	return self.pos >= len(self.tokens)
+}
+
+func (self *queryParser) peek() string {
+	if self.done() {
+		return ""
+	}
+	return self.tokens[self.pos].val
+}
+
+func (self *queryParser) peekKeyword(keyword string) bool {
+	return !self.done() && !self.tokens[self.pos].quoted && strings.EqualFold(self.peek(), keyword)
+}
+
+func (self *queryParser) next() string {
+	val := self.peek()
+	self.pos++
+	return val
+}
+
+func (self *queryParser) expectKeyword(keyword string) error {
+	if !self.peekKeyword(keyword) {
+		return errors.Errorf("expected '%v', found '%v'", keyword, self.peek())
+	}
+	self.pos++
+	return nil
+}
+
+func (self *queryParser) atClause() bool {
+	return self.peekKeyword("sort") || self.peekKeyword("skip") || self.peekKeyword("limit")
+}
+
+func (self *queryParser) parseOr() (predicate, error) {
+	left, err := self.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for self.peekKeyword("or") {
+		self.pos++
+		right, err := self.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e map[string]interface{}) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (self *queryParser) parseAnd() (predicate, error) {
+	left, err := self.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for self.peekKeyword("and") {
+		self.pos++
+		right, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e map[string]interface{}) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (self *queryParser) parseUnary() (predicate, error) {
+	if self.peekKeyword("not") {
+		self.pos++
+		inner, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(e map[string]interface{}) bool { return !inner(e) }, nil
+	}
+
+	if self.peek() == "(" {
+		self.pos++
+		inner, err := self.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if self.next() != ")" {
+			return nil, errors.New("expected ')'")
+		}
+		return inner, nil
+	}
+
+	if self.peekKeyword("true") || self.peekKeyword("false") {
+		val := strings.EqualFold(self.next(), "true")
+		return func(map[string]interface{}) bool { return val }, nil
+	}
+
+	return self.parseComparison()
+}
+
+func (self *queryParser) parseComparison() (predicate, error) {
+	if self.done() {
+		return nil, errors.New("unexpected end of filter")
+	}
+
+	field := self.next()
+	anyOf := false
+	if strings.EqualFold(field, "anyOf") && self.peek() == "(" {
+		self.pos++
+		field = self.next()
+		if self.next() != ")" {
+			return nil, errors.New("expected ')' after anyOf field")
+		}
+		anyOf = true
+	}
+
+	negate := false
+	if self.peekKeyword("not") {
+		self.pos++
+		negate = true
+	}
+
+	op := strings.ToLower(self.next())
+	var compare func(actual interface{}) bool
+
+	switch op {
+	case "in":
+		values, err := self.parseList()
+		if err != nil {
+			return nil, err
+		}
+		compare = func(actual interface{}) bool {
+			for _, v := range values {
+				if compareValues(actual, v) == 0 {
+					return true
+				}
+			}
+			return false
+		}
+	case "=", "!=", "<", "<=", ">", ">=":
+		expected, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		compare = func(actual interface{}) bool {
+			c := compareValues(actual, expected)
+			switch op {
+			case "=":
+				return c == 0
+			case "!=":
+				return c != 0
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			}
+			return c >= 0
+		}
+	case "contains", "icontains", "startswith", "endswith":
+		expected, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		compare = func(actual interface{}) bool {
+			return stringMatch(op, actual, expected)
+		}
+	default:
+		return nil, errors.Errorf("unsupported operator '%v'", op)
+	}
+
+	return func(e map[string]interface{}) bool {
+		actual := lookup(e, field)
+		var result bool
+		if list, ok := actual.([]interface{}); ok && (anyOf || op == "contains" || op == "icontains") {
+			for _, v := range list {
+				if compare(v) {
+					result = true
+					break
+				}
+			}
+		} else {
+			result = compare(actual)
+		}
+		return result != negate
+	}, nil
+}
+
+func (self *queryParser) parseList() ([]interface{}, error) {
+	if self.next() != "[" {
+		return nil, errors.New("expected '[' after in")
+	}
+	var result []interface{}
+	for self.peek() != "]" {
+		if self.done() {
+			return nil, errors.New("expected ']'")
+		}
+		val, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, val)
+		if self.peek() == "," {
+			self.pos++
+		}
+	}
+	self.pos++
+	return result, nil
+}
+
+func (self *queryParser) parseValue() (interface{}, error) {
+	if self.done() {
+		return nil, errors.New("expected value")
+	}
+	t := self.tokens[self.pos]
+	self.pos++
+	if t.quoted {
+		return t.val, nil
+	}
+	switch strings.ToLower(t.val) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if f, err := strconv.ParseFloat(t.val, 64); err == nil {
+		return f, nil
+	}
+	return nil, errors.Errorf("invalid value '%v'", t.val)
+}
+
+// lookup resolves a dotted path, such as type.name, in the given entity. As in the controller, a path ending at a
+// reference to another entity, such as identity, compares using the id of the referenced entity
+func lookup(entity map[string]interface{}, path string) interface{} {
+	var current interface{} = entity
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	if ref, ok := current.(map[string]interface{}); ok && ref["entity"] != nil {
+		return ref["id"]
+	}
+	return current
+}
+
+func compareValues(a, b interface{}) int {
+	switch av := a.(type) {
+	case float64:
+		if bv, ok := toFloat(b); ok {
+			switch {
+			case av < bv:
+				return -1
+			case av > bv:
+				return 1
+			}
+			return 0
+		}
+	case int64, int:
+		if f, ok := toFloat(av); ok {
+			return compareValues(f, b)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			if av == bv {
+				return 0
+			}
+			if !av {
+				return -1
+			}
+			return 1
+		}
+	case nil:
+		if b == nil {
+			return 0
+		}
+		return -1
+	}
+	if b == nil {
+		return 1
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func stringMatch(op string, actual, expected interface{}) bool {
+	a, ok := actual.(string)
+	if !ok {
+		return false
+	}
+	e := fmt.Sprintf("%v", expected)
+	switch op {
+	case "contains":
+		return strings.Contains(a, e)
+	case "icontains":
+		return strings.Contains(strings.ToLower(a), strings.ToLower(e))
+	case "startswith":
+		return strings.HasPrefix(a, e)
+	}
+	return strings.HasSuffix(a, e)
+}
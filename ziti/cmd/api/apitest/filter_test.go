@@ -0,0 +1,56 @@
+package apitest
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	entity := map[string]interface{}{
+		"name":           "echo",
+		"cost":           float64(10),
+		"disabled":       false,
+		"roleAttributes": []interface{}{"demo", "web"},
+		"type":           map[string]interface{}{"name": "User"},
+	}
+
+	tests := map[string]bool{
+		``:                                            true,
+		`name = "echo"`:                               true,
+		`name != "echo"`:                              false,
+		`id = "echo" or name = "echo"`:                true,
+		`name = "echo" and cost > 10`:                 false,
+		`cost >= 10 and not disabled = true`:          true,
+		`name in ["ssh", "echo"]`:                     true,
+		`name not in ["ssh", "echo"]`:                 false,
+		`name contains "ch"`:                          true,
+		`name icontains "ECH"`:                        true,
+		`name startswith "ec" and name endswith "ho"`: true,
+		`anyOf(roleAttributes) = "web"`:               true,
+		`anyOf(roleAttributes) in ["admin"]`:          false,
+		`type.name = "User"`:                          true,
+		`(name = "ssh" or cost < 20) and true`:        true,
+		`true limit 5`:                                true,
+	}
+
+	for filter, expected := range tests {
+		query, err := ParseQuery(filter)
+		require.NoError(t, err, filter)
+		require.Equal(t, expected, query.Matches(entity), filter)
+	}
+
+	_, err := ParseQuery(`name = `)
+	require.Error(t, err)
+}
+
+func TestQuerySortAndLimit(t *testing.T) {
+	query, err := ParseQuery(`name != "x" sort by name desc skip 1 limit 2`)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), query.skip)
+	require.Equal(t, int64(2), query.limit)
+
+	entities := []map[string]interface{}{{"name": "a"}, {"name": "c"}, {"name": "b"}}
+	query.Sort(entities)
+	require.Equal(t, "c", entities[0]["name"])
+	require.Equal(t, "a", entities[2]["name"])
+}
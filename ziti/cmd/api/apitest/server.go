@@ -0,0 +1,469 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package apitest provides an in-process fake of the controller's Edge Management and Fabric REST APIs, backed by an
+// in-memory store, so CLI commands can be tested end-to-end without a running controller
+package apitest
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/openziti/edge/controller/env"
+	"github.com/openziti/ziti/ziti/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	EdgeManagementPath = "/edge/management/v1"
+	FabricPath         = "/fabric/v1"
+
+	// Token is the session token the fake API accepts. It is saved in the CLI config written by NewServer
+	Token = "apitest-session-token"
+
+	// Username and Password are the credentials the fake API accepts for password authentication
+	Username = "admin"
+	Password = "apitest-password"
+
+	defaultLimit = 10
+)
+
+// Request records a request received by the fake API
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   map[string]interface{}
+}
+
+// Server is a fake controller serving the Edge Management API under /edge/management/v1 and the Fabric API under
+// /fabric/v1
+type Server struct {
+	*httptest.Server
+	*Store
+
+	requestsLock sync.Mutex
+	requests     []Request
+}
+
+// NewServer starts a fake controller and points the CLI at it, by writing a CLI config containing a default login for
+// the server into a temporary ZITI_HOME. The server is shut down when the test completes
+func NewServer(t testing.TB) *Server {
+	result := &Server{
+		Store: NewStore(),
+	}
+	result.Server = httptest.NewTLSServer(http.HandlerFunc(result.handle))
+	t.Cleanup(result.Close)
+
+	result.Create("auth-policies", map[string]interface{}{"id": "default", "name": "Default"})
+
+	home := t.TempDir()
+	caFile := filepath.Join(home, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: result.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatalf("unable to write server certificate: %v", err)
+	}
+
+	t.Setenv("ZITI_HOME", home)
+	config := &util.RestClientConfig{
+		EdgeIdentities: map[string]*util.RestClientEdgeIdentity{
+			"default": {
+				Url:       result.URL + EdgeManagementPath,
+				Username:  Username,
+				Token:     Token,
+				LoginTime: Timestamp,
+				CaCert:    caFile,
+			},
+		},
+		FabricIdentities: map[string]*util.RestClientFabricIdentity{},
+	}
+	if err := util.PersistRestClientConfig(config); err != nil {
+		t.Fatalf("unable to write cli config: %v", err)
+	}
+	util.ClearSelectedIdentity()
+	t.Cleanup(util.ClearSelectedIdentity)
+
+	return result
+}
+
+// Requests returns the requests the server has received so far, in order
+func (self *Server) Requests() []Request {
+	self.requestsLock.Lock()
+	defer self.requestsLock.Unlock()
+	return append([]Request(nil), self.requests...)
+}
+
+// RequestsTo returns the received requests with the given method for paths under the given prefix, for example
+// RequestsTo(http.MethodGet, "/edge/management/v1/services")
+func (self *Server) RequestsTo(method, pathPrefix string) []Request {
+	var result []Request
+	for _, r := range self.Requests() {
+		if r.Method == method && strings.HasPrefix(r.Path, pathPrefix) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func (self *Server) handle(w http.ResponseWriter, r *http.Request) {
+	request := Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+	}
+
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request.Body); err != nil {
+			writeError(w, http.StatusBadRequest, "COULD_NOT_PARSE_BODY", err.Error())
+			return
+		}
+	}
+
+	self.requestsLock.Lock()
+	self.requests = append(self.requests, request)
+	self.requestsLock.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == EdgeManagementPath+"/authenticate" {
+		self.handleAuthenticate(w, request)
+		return
+	}
+
+	if r.Header.Get(env.ZitiSession) != Token {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "The request could not be completed. The session is not authorized or the credentials are invalid")
+		return
+	}
+
+	var path string
+	if strings.HasPrefix(r.URL.Path, EdgeManagementPath+"/") {
+		path = strings.TrimPrefix(r.URL.Path, EdgeManagementPath+"/")
+	} else if strings.HasPrefix(r.URL.Path, FabricPath+"/") {
+		path = strings.TrimPrefix(r.URL.Path, FabricPath+"/")
+	} else {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "The resource requested was not found or is no longer available")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	entityType := parts[0]
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		self.handleList(w, request, self.List(entityType))
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		self.handleCreate(w, entityType, request.Body)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		self.handleDetail(w, entityType, parts[1])
+	case len(parts) == 2 && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+		self.handleUpdate(w, entityType, parts[1], request.Body, r.Method == http.MethodPatch)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		if !self.Delete(entityType, parts[1]) {
+			writeNotFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{}, "meta": map[string]interface{}{}})
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		if self.Get(entityType, parts[1]) == nil {
+			writeNotFound(w)
+			return
+		}
+		self.handleList(w, request, self.related(entityType, parts[1], parts[2]))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", fmt.Sprintf("%v %v is not supported", r.Method, r.URL.Path))
+	}
+}
+
+// handleAuthenticate issues the session token for password authentication with the fake API's credentials
+func (self *Server) handleAuthenticate(w http.ResponseWriter, request Request) {
+	username, _ := request.Body["username"].(string)
+	password, _ := request.Body["password"].(string)
+	if request.Query.Get("method") != "password" || username != Username || password != Password {
+		writeError(w, http.StatusUnauthorized, "INVALID_AUTH", "The authentication request failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"token": Token, "_links": map[string]interface{}{}},
+		"meta": map[string]interface{}{},
+	})
+}
+
+func (self *Server) handleList(w http.ResponseWriter, request Request, entities []map[string]interface{}) {
+	query, err := ParseQuery(request.Query.Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_FILTER", err.Error())
+		return
+	}
+
+	var roleFilters []interface{}
+	for _, role := range request.Query["roleFilter"] {
+		roleFilters = append(roleFilters, role)
+	}
+
+	var matched []map[string]interface{}
+	self.Lock()
+	for _, entity := range entities {
+		if len(roleFilters) > 0 && !matchesRoles(roleFilters, request.Query.Get("roleSemantic"), entity) {
+			continue
+		}
+		decorated := self.decorate(entity)
+		if query.Matches(decorated) {
+			matched = append(matched, decorated)
+		}
+	}
+	self.Unlock()
+	query.Sort(matched)
+
+	limit := int64(defaultLimit)
+	offset := int64(0)
+	if val := request.Query.Get("limit"); val != "" {
+		limit, _ = strconv.ParseInt(val, 10, 64)
+	}
+	if val := request.Query.Get("offset"); val != "" {
+		offset, _ = strconv.ParseInt(val, 10, 64)
+	}
+	if query.hasLimit {
+		limit = query.limit
+	}
+	if query.skip != -1 {
+		offset = query.skip
+	}
+
+	total := int64(len(matched))
+	page := []map[string]interface{}{}
+	for idx := offset; idx < total && (limit < 0 || idx < offset+limit); idx++ {
+		page = append(page, matched[idx])
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": page,
+		"meta": map[string]interface{}{
+			"filterableFields": []string{},
+			"pagination": map[string]interface{}{
+				"limit":      limit,
+				"offset":     offset,
+				"totalCount": total,
+			},
+		},
+	})
+}
+
+func (self *Server) handleCreate(w http.ResponseWriter, entityType string, body map[string]interface{}) {
+	if body == nil {
+		writeError(w, http.StatusBadRequest, "COULD_NOT_PARSE_BODY", "request body is required")
+		return
+	}
+
+	self.Lock()
+	if name, ok := body["name"].(string); ok && self.hasName(entityType, name, "") {
+		self.Unlock()
+		writeError(w, http.StatusBadRequest, "COULD_NOT_VALIDATE", fmt.Sprintf("name is must be unique, %v already in use", name))
+		return
+	}
+	if entityType == "enrollments" {
+		identityId, _ := body["identityId"].(string)
+		method, _ := body["method"].(string)
+		if self.hasEnrollment(identityId, method) {
+			self.Unlock()
+			writeError(w, http.StatusConflict, "ENROLLMENT_EXISTS", fmt.Sprintf("an enrollment for method %v already exists for identity %v", method, identityId))
+			return
+		}
+	}
+	id := self.create(entityType, body)
+	self.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"data": map[string]interface{}{"id": id, "_links": map[string]interface{}{}},
+		"meta": map[string]interface{}{},
+	})
+}
+
+func (self *Server) handleDetail(w http.ResponseWriter, entityType, id string) {
+	self.Lock()
+	entity := self.get(entityType, id)
+	if entity != nil {
+		entity = self.decorate(entity)
+	}
+	self.Unlock()
+
+	if entity == nil {
+		writeNotFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": entity, "meta": map[string]interface{}{}})
+}
+
+func (self *Server) handleUpdate(w http.ResponseWriter, entityType, id string, body map[string]interface{}, patch bool) {
+	if body == nil {
+		writeError(w, http.StatusBadRequest, "COULD_NOT_PARSE_BODY", "request body is required")
+		return
+	}
+
+	self.Lock()
+	name, ok := body["name"].(string)
+	conflict := ok && self.hasName(entityType, name, id)
+	self.Unlock()
+
+	if conflict {
+		writeError(w, http.StatusBadRequest, "COULD_NOT_VALIDATE", fmt.Sprintf("name is must be unique, %v already in use", name))
+		return
+	}
+
+	if !self.Update(entityType, id, body, patch) {
+		writeNotFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{}, "meta": map[string]interface{}{}})
+}
+
+// related implements the sub-resource endpoints, such as service-policies/<id>/identities,
+// identities/<id>/service-policies, identities/<id>/services and services/<id>/configs
+func (self *Server) related(entityType, id, relatedType string) []map[string]interface{} {
+	self.Lock()
+	defer self.Unlock()
+
+	entity := self.get(entityType, id)
+	var result []map[string]interface{}
+
+	// policy -> members
+	if roleFieldsForType, found := policyTypes[entityType]; found {
+		for _, field := range roleFieldsForType {
+			if roleFields[field] == relatedType {
+				return self.membersOf(entity, field, relatedType)
+			}
+		}
+	}
+
+	// member -> policies
+	if _, found := policyTypes[relatedType]; found {
+		return self.policiesFor(entityType, entity, relatedType)
+	}
+
+	// member -> member, through the policy type linking the two
+	for policyType, fields := range policyTypes {
+		entityField := roleFieldFor(fields, entityType)
+		relatedField := roleFieldFor(fields, relatedType)
+		if entityField == "" || relatedField == "" || entityField == relatedField {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, policy := range self.policiesFor(entityType, entity, policyType) {
+			for _, member := range self.membersOf(policy, relatedField, relatedType) {
+				if memberId := member["id"].(string); !seen[memberId] {
+					seen[memberId] = true
+					result = append(result, member)
+				}
+			}
+		}
+		return result
+	}
+
+	// services/<id>/configs lists the configs the service references
+	if configIds, ok := entity["configs"].([]interface{}); ok && relatedType == "configs" {
+		for _, configId := range configIds {
+			if config := self.get(relatedType, fmt.Sprintf("%v", configId)); config != nil {
+				result = append(result, config)
+			}
+		}
+		return result
+	}
+
+	// otherwise, children which reference the parent, such as config-types/<id>/configs or services/<id>/terminators
+	refField := strings.TrimSuffix(entityType, "s")
+	if strings.HasSuffix(entityType, "ies") {
+		refField = strings.TrimSuffix(entityType, "ies") + "y"
+	}
+	refField = toCamelCase(refField) + "Id"
+	for _, child := range self.entities[relatedType] {
+		if child[refField] == id {
+			result = append(result, child)
+		}
+	}
+	return result
+}
+
+func (self *Server) membersOf(policy map[string]interface{}, roleField, memberType string) []map[string]interface{} {
+	var result []map[string]interface{}
+	roles, _ := policy[roleField].([]interface{})
+	semantic, _ := policy["semantic"].(string)
+	for _, member := range self.entities[memberType] {
+		if matchesRoles(roles, semantic, member) {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func (self *Server) policiesFor(entityType string, entity map[string]interface{}, policyType string) []map[string]interface{} {
+	field := roleFieldFor(policyTypes[policyType], entityType)
+	if field == "" {
+		return nil
+	}
+	var result []map[string]interface{}
+	for _, policy := range self.entities[policyType] {
+		roles, _ := policy[field].([]interface{})
+		semantic, _ := policy["semantic"].(string)
+		if matchesRoles(roles, semantic, entity) {
+			result = append(result, policy)
+		}
+	}
+	return result
+}
+
+func roleFieldFor(fields []string, entityType string) string {
+	for _, field := range fields {
+		if roleFields[field] == entityType {
+			return field
+		}
+	}
+	return ""
+}
+
+func toCamelCase(val string) string {
+	parts := strings.Split(val, "-")
+	for idx := 1; idx < len(parts); idx++ {
+		if parts[idx] != "" {
+			parts[idx] = strings.ToUpper(parts[idx][:1]) + parts[idx][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "NOT_FOUND", "The resource requested was not found or is no longer available")
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+		"meta": map[string]interface{}{},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,371 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package apitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Timestamp is used for the createdAt and updatedAt fields of every entity, so that output is stable across runs
+const Timestamp = "2023-01-01T00:00:00.000Z"
+
+// refFields maps fields which hold a reference to another entity to the type of the referenced entity. On write,
+// a string value is stored as <field>Id. On read, <field> is filled in with an entity ref containing the name
+var refFields = map[string]string{
+	"authPolicy": "auth-policies",
+	"ca":         "cas",
+	"configType": "config-types",
+	"identity":   "identities",
+	"router":     "routers",
+	"service":    "services",
+	"type":       "identity-types",
+}
+
+// refFieldOwners restricts reference fields which only hold a reference on some entity types. Elsewhere, such as the
+// type of service policies, the field is a plain value
+var refFieldOwners = map[string]string{
+	"type": "identities",
+}
+
+// roleFields maps the role fields used by policies to the type of entity the roles select
+var roleFields = map[string]string{
+	"edgeRouterRoles":   "edge-routers",
+	"identityRoles":     "identities",
+	"postureCheckRoles": "posture-checks",
+	"serviceRoles":      "services",
+}
+
+// policyTypes lists the policy entity types and the role fields each one has
+var policyTypes = map[string][]string{
+	"edge-router-policies":         {"identityRoles", "edgeRouterRoles"},
+	"service-edge-router-policies": {"serviceRoles", "edgeRouterRoles"},
+	"service-policies":             {"identityRoles", "serviceRoles", "postureCheckRoles"},
+}
+
+// Store holds the entities served by the fake API. Edge and fabric endpoints share a single store, as they do in
+// the controller, so a service created through one API is visible through the other
+type Store struct {
+	sync.Mutex
+	nextId   int
+	entities map[string][]map[string]interface{}
+}
+
+func NewStore() *Store {
+	return &Store{
+		entities: map[string][]map[string]interface{}{},
+	}
+}
+
+// Create adds an entity of the given type and returns its id. If fields contains an id, it is used, otherwise one
+// is generated
+func (self *Store) Create(entityType string, fields map[string]interface{}) string {
+	self.Lock()
+	defer self.Unlock()
+	return self.create(entityType, fields)
+}
+
+func (self *Store) create(entityType string, fields map[string]interface{}) string {
+	entity := copyEntity(fields)
+	normalizeRefs(entityType, entity)
+
+	id, _ := entity["id"].(string)
+	if id == "" {
+		self.nextId++
+		id = fmt.Sprintf("id%d", self.nextId)
+		entity["id"] = id
+	}
+
+	entity["createdAt"] = Timestamp
+	entity["updatedAt"] = Timestamp
+	if _, found := entity["tags"]; !found {
+		entity["tags"] = map[string]interface{}{}
+	}
+	if entityType == "identities" {
+		if _, found := entity["authPolicyId"]; !found {
+			entity["authPolicyId"] = "default"
+		}
+		if enrollment, ok := entity["enrollment"].(map[string]interface{}); ok {
+			for method, val := range enrollment {
+				details := map[string]interface{}{
+					"id":        id + "-" + method,
+					"jwt":       "jwt-" + method + "-" + id,
+					"token":     "token-" + method + "-" + id,
+					"expiresAt": Timestamp,
+				}
+				if s, ok := val.(string); ok && method == "updb" {
+					details["username"] = s
+				} else if ok {
+					details["caId"] = s
+				}
+				enrollment[method] = details
+			}
+		}
+	}
+
+	// as in the controller, a new enrollment is also listed in the enrollment details of its identity
+	if entityType == "enrollments" {
+		method, _ := entity["method"].(string)
+		entity["jwt"] = "jwt-" + method + "-" + id
+		entity["token"] = "token-" + method + "-" + id
+		if identity := self.get("identities", fmt.Sprintf("%v", entity["identityId"])); identity != nil {
+			enrollment, _ := identity["enrollment"].(map[string]interface{})
+			if enrollment == nil {
+				enrollment = map[string]interface{}{}
+				identity["enrollment"] = enrollment
+			}
+			enrollment[method] = map[string]interface{}{
+				"id":        id,
+				"jwt":       entity["jwt"],
+				"token":     entity["token"],
+				"expiresAt": entity["expiresAt"],
+			}
+		}
+	}
+
+	self.entities[entityType] = append(self.entities[entityType], entity)
+	return id
+}
+
+// Get returns a copy of the entity with the given id, or nil if it doesn't exist
+func (self *Store) Get(entityType string, id string) map[string]interface{} {
+	self.Lock()
+	defer self.Unlock()
+	if entity := self.get(entityType, id); entity != nil {
+		return copyEntity(entity)
+	}
+	return nil
+}
+
+func (self *Store) get(entityType string, id string) map[string]interface{} {
+	for _, entity := range self.entities[entityType] {
+		if entity["id"] == id {
+			return entity
+		}
+	}
+	return nil
+}
+
+// List returns copies of all entities of the given type, in creation order
+func (self *Store) List(entityType string) []map[string]interface{} {
+	self.Lock()
+	defer self.Unlock()
+	var result []map[string]interface{}
+	for _, entity := range self.entities[entityType] {
+		result = append(result, copyEntity(entity))
+	}
+	return result
+}
+
+// Update changes the fields of the given entity. If patch is false, fields not present are removed. Returns false if
+// the entity doesn't exist
+func (self *Store) Update(entityType string, id string, fields map[string]interface{}, patch bool) bool {
+	self.Lock()
+	defer self.Unlock()
+
+	entity := self.get(entityType, id)
+	if entity == nil {
+		return false
+	}
+
+	fields = copyEntity(fields)
+	normalizeRefs(entityType, fields)
+
+	if !patch {
+		for k := range entity {
+			if k != "id" && k != "createdAt" && k != "authPolicyId" && k != "enrollment" {
+				delete(entity, k)
+			}
+		}
+	}
+	for k, v := range fields {
+		if k != "id" {
+			entity[k] = v
+		}
+	}
+	return true
+}
+
+// Delete removes the given entity. Returns false if the entity doesn't exist
+func (self *Store) Delete(entityType string, id string) bool {
+	self.Lock()
+	defer self.Unlock()
+
+	list := self.entities[entityType]
+	for idx, entity := range list {
+		if entity["id"] == id {
+			self.entities[entityType] = append(list[:idx:idx], list[idx+1:]...)
+			if entityType == "enrollments" {
+				if identity := self.get("identities", fmt.Sprintf("%v", entity["identityId"])); identity != nil {
+					if enrollment, ok := identity["enrollment"].(map[string]interface{}); ok {
+						delete(enrollment, fmt.Sprintf("%v", entity["method"]))
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// nameOf returns the name of the referenced entity, falling back to the id. Routers and edge routers are the same
+// entities in the controller, so each is checked for the other
+func (self *Store) nameOf(entityType, id string) string {
+	types := []string{entityType}
+	if entityType == "routers" {
+		types = append(types, "edge-routers", "transit-routers")
+	} else if entityType == "edge-routers" {
+		types = append(types, "routers")
+	}
+	for _, t := range types {
+		if entity := self.get(t, id); entity != nil {
+			if name, ok := entity["name"].(string); ok {
+				return name
+			}
+		}
+	}
+	return id
+}
+
+// hasEnrollment returns true if the identity already has an enrollment for the method. As in the controller, an
+// identity can only have one enrollment per method
+func (self *Store) hasEnrollment(identityId, method string) bool {
+	for _, entity := range self.entities["enrollments"] {
+		if entity["identityId"] == identityId && entity["method"] == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Store) hasName(entityType, name, excludeId string) bool {
+	for _, entity := range self.entities[entityType] {
+		if entity["name"] == name && entity["id"] != excludeId {
+			return true
+		}
+	}
+	return false
+}
+
+// decorate returns a copy of the entity with the computed fields the controller includes in responses: entity refs
+// for referenced entities, display values for policy roles and an empty _links section
+func (self *Store) decorate(entity map[string]interface{}) map[string]interface{} {
+	result := copyEntity(entity)
+	result["_links"] = map[string]interface{}{}
+
+	for field, refType := range refFields {
+		if id, ok := result[field+"Id"].(string); ok {
+			result[field] = map[string]interface{}{
+				"id":     id,
+				"name":   self.nameOf(refType, id),
+				"entity": refType,
+				"_links": map[string]interface{}{},
+			}
+		}
+	}
+
+	for field, roleType := range roleFields {
+		roles, ok := result[field].([]interface{})
+		if !ok {
+			continue
+		}
+		display := []interface{}{}
+		for _, role := range roles {
+			roleStr, _ := role.(string)
+			name := roleStr
+			if strings.HasPrefix(roleStr, "@") {
+				name = "@" + self.nameOf(roleType, strings.TrimPrefix(roleStr, "@"))
+			}
+			display = append(display, map[string]interface{}{"role": roleStr, "name": name})
+		}
+		result[field+"Display"] = display
+	}
+
+	return result
+}
+
+// matchesRoles reports whether the given entity is selected by the roles. Entities referenced by @id are always
+// selected. Attribute roles are evaluated according to the semantic, AllOf by default, with #all selecting everything
+func matchesRoles(roles []interface{}, semantic string, entity map[string]interface{}) bool {
+	id, _ := entity["id"].(string)
+	attrs := map[string]bool{}
+	if roleAttributes, ok := entity["roleAttributes"].([]interface{}); ok {
+		for _, attr := range roleAttributes {
+			if s, ok := attr.(string); ok {
+				attrs[s] = true
+			}
+		}
+	}
+
+	var attrRoles []string
+	for _, role := range roles {
+		roleStr, _ := role.(string)
+		if roleStr == "#all" {
+			return true
+		}
+		if roleStr == "@"+id {
+			return true
+		}
+		if strings.HasPrefix(roleStr, "#") {
+			attrRoles = append(attrRoles, strings.TrimPrefix(roleStr, "#"))
+		}
+	}
+
+	if len(attrRoles) == 0 {
+		return false
+	}
+
+	anyOf := strings.EqualFold(semantic, "AnyOf")
+	for _, attr := range attrRoles {
+		if attrs[attr] && anyOf {
+			return true
+		}
+		if !attrs[attr] && !anyOf {
+			return false
+		}
+	}
+	return !anyOf
+}
+
+// normalizeRefs stores string values of reference fields as <field>Id, as the controller accepts either on write
+func normalizeRefs(entityType string, entity map[string]interface{}) {
+	for field := range refFields {
+		if owner, found := refFieldOwners[field]; found && owner != entityType {
+			continue
+		}
+		if id, ok := entity[field].(string); ok {
+			entity[field+"Id"] = id
+			delete(entity, field)
+		}
+	}
+}
+
+// copyEntity makes a deep copy by round-tripping through JSON, which also normalizes numbers to float64, matching
+// what is decoded from request bodies
+func copyEntity(entity map[string]interface{}) map[string]interface{} {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		panic(err)
+	}
+	result := map[string]interface{}{}
+	if err = json.Unmarshal(data, &result); err != nil {
+		panic(err)
+	}
+	return result
+}
@@ -0,0 +1,174 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"github.com/openziti/ziti/ziti/util"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// idLookupBatchSize is the number of values resolved per list request. Each value can match at most two entities,
+// one by id and one by name, so the page size is set to twice this
+const idLookupBatchSize = 50
+
+// EntityIds holds the ids and names of entities of one type which have been looked up during this invocation of the
+// CLI. It is shared by all name to id mappings, so each entity is only fetched once, no matter how many times it is
+// referenced
+type EntityIds struct {
+	lock      sync.Mutex
+	namesById map[string]string
+	idsByName map[string]string
+	missing   map[string]bool
+}
+
+// IsId returns true if an entity with the given id exists
+func (self *EntityIds) IsId(val string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, found := self.namesById[val]
+	return found
+}
+
+// IdForName returns the id of the entity with the given name
+func (self *EntityIds) IdForName(name string) (string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	id, found := self.idsByName[name]
+	return id, found
+}
+
+// NameForId returns the name of the entity with the given id
+func (self *EntityIds) NameForId(id string) (string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	name, found := self.namesById[id]
+	return name, found
+}
+
+func (self *EntityIds) isKnown(val string) bool {
+	_, isId := self.namesById[val]
+	_, isName := self.idsByName[val]
+	return isId || isName || self.missing[val]
+}
+
+var entityIdCache = struct {
+	sync.Mutex
+	entityTypes map[string]*EntityIds
+}{
+	entityTypes: map[string]*EntityIds{},
+}
+
+// ResetIdCache discards all cached ids and names. Each invocation of the CLI starts with an empty cache, so this is
+// only needed when running several commands in one process, as tests do
+func ResetIdCache() {
+	entityIdCache.Lock()
+	defer entityIdCache.Unlock()
+	entityIdCache.entityTypes = map[string]*EntityIds{}
+}
+
+func getEntityIds(api util.API, entityType string) *EntityIds {
+	entityIdCache.Lock()
+	defer entityIdCache.Unlock()
+
+	key := string(api) + "/" + entityType
+	result, found := entityIdCache.entityTypes[key]
+	if !found {
+		result = &EntityIds{
+			namesById: map[string]string{},
+			idsByName: map[string]string{},
+			missing:   map[string]bool{},
+		}
+		entityIdCache.entityTypes[key] = result
+	}
+	return result
+}
+
+// GetEntityIds makes sure the given values, which may be ids or names, optionally prefixed with id: or name:, have
+// been looked up. Values which haven't been seen yet are resolved with a single `id in [...] or name in [...]` query
+// per batch, rather than one query per value
+func GetEntityIds(api util.API, entityType string, o *Options, idsOrNames ...string) (*EntityIds, error) {
+	entityIds := getEntityIds(api, entityType)
+
+	entityIds.lock.Lock()
+	defer entityIds.lock.Unlock()
+
+	var unknown []string
+	seen := map[string]bool{}
+	for _, val := range idsOrNames {
+		if strings.HasPrefix(val, "id:") {
+			continue
+		}
+		val = strings.TrimPrefix(val, "name:")
+		if !seen[val] && !entityIds.isKnown(val) {
+			seen[val] = true
+			unknown = append(unknown, val)
+		}
+	}
+
+	for len(unknown) > 0 {
+		batch := unknown
+		if len(batch) > idLookupBatchSize {
+			batch = unknown[:idLookupBatchSize]
+		}
+		unknown = unknown[len(batch):]
+
+		quoted := make([]string, 0, len(batch))
+		for _, val := range batch {
+			quoted = append(quoted, quoteFilterString(val))
+		}
+		values := strings.Join(quoted, ",")
+
+		params := url.Values{}
+		params.Add("filter", fmt.Sprintf("id in [%s] or name in [%s]", values, values))
+		params.Add("limit", strconv.Itoa(2*len(batch)))
+
+		list, _, err := ListEntitiesOfType(api, entityType, params, false, nil, o.Timeout, o.Verbose)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entity := range list {
+			id, _ := entity.Path("id").Data().(string)
+			name, _ := entity.Path("name").Data().(string)
+			entityIds.namesById[id] = name
+			if name != "" {
+				entityIds.idsByName[name] = id
+			}
+			if val, found := os.LookupEnv("ZITI_CLI_DEBUG"); found && strings.EqualFold("true", val) {
+				fmt.Printf("Found %v with id %v for name %v\n", entityType, id, name)
+			}
+		}
+
+		for _, val := range batch {
+			if !entityIds.isKnown(val) {
+				entityIds.missing[val] = true
+			}
+		}
+	}
+
+	return entityIds, nil
+}
+
+func quoteFilterString(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	return `"` + strings.ReplaceAll(val, `"`, `\"`) + `"`
+}
@@ -0,0 +1,161 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package api
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EvalJsonPath evaluates a JSONPath expression against decoded JSON and returns the matching values. The supported
+// subset covers the root ($), child access by name (.name or ['name']), array indexes including negative ones ([n]),
+// wildcards (.* or [*]) and recursive descent (..name). The leading $ is optional, so data[*].name is accepted
+func EvalJsonPath(data interface{}, path string) ([]interface{}, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		path = "." + path
+	}
+
+	current := []interface{}{data}
+	for path != "" {
+		var next []interface{}
+		var err error
+
+		switch {
+		case strings.HasPrefix(path, ".."):
+			var name string
+			name, path = readJsonPathName(path[2:])
+			if name == "" {
+				return nil, errors.New("invalid JSONPath: recursive descent requires a field name or *")
+			}
+			for _, val := range current {
+				next = append(next, jsonPathDescend(val, name)...)
+			}
+		case path[0] == '.':
+			var name string
+			name, path = readJsonPathName(path[1:])
+			if name == "" {
+				return nil, errors.New("invalid JSONPath: expected a field name after .")
+			}
+			for _, val := range current {
+				next = append(next, jsonPathChild(val, name)...)
+			}
+		case path[0] == '[':
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, errors.New("invalid JSONPath: missing ]")
+			}
+			selector := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+			if next, err = jsonPathSelect(current, selector); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("invalid JSONPath: unexpected %q", path)
+		}
+
+		current = next
+	}
+
+	return current, nil
+}
+
+func readJsonPathName(path string) (string, string) {
+	end := strings.IndexAny(path, ".[")
+	if end < 0 {
+		return path, ""
+	}
+	return path[:end], path[end:]
+}
+
+func jsonPathSelect(current []interface{}, selector string) ([]interface{}, error) {
+	var result []interface{}
+
+	if selector == "*" {
+		for _, val := range current {
+			result = append(result, jsonPathChild(val, "*")...)
+		}
+		return result, nil
+	}
+
+	if len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+		name := selector[1 : len(selector)-1]
+		for _, val := range current {
+			if m, ok := val.(map[string]interface{}); ok {
+				if child, found := m[name]; found {
+					result = append(result, child)
+				}
+			}
+		}
+		return result, nil
+	}
+
+	idx, err := strconv.Atoi(selector)
+	if err != nil {
+		return nil, errors.Errorf("invalid JSONPath: unsupported selector [%v]", selector)
+	}
+
+	for _, val := range current {
+		if arr, ok := val.([]interface{}); ok {
+			i := idx
+			if i < 0 {
+				i += len(arr)
+			}
+			if i >= 0 && i < len(arr) {
+				result = append(result, arr[i])
+			}
+		}
+	}
+	return result, nil
+}
+
+func jsonPathChild(val interface{}, name string) []interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if name == "*" {
+			var keys []string
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var result []interface{}
+			for _, k := range keys {
+				result = append(result, v[k])
+			}
+			return result
+		}
+		if child, found := v[name]; found {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if name == "*" {
+			return v
+		}
+	}
+	return nil
+}
+
+func jsonPathDescend(val interface{}, name string) []interface{} {
+	result := jsonPathChild(val, name)
+	for _, child := range jsonPathChild(val, "*") {
+		result = append(result, jsonPathDescend(child, name)...)
+	}
+	return result
+}
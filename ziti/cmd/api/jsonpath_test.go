@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEvalJsonPath(t *testing.T) {
+	var data interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"data": [
+			{"name": "a", "tags": {"env": "prod"}},
+			{"name": "b", "tags": {"env": "dev", "team": "x"}}
+		],
+		"meta": {"pagination": {"totalCount": 2}}
+	}`), &data))
+
+	tests := []struct {
+		path     string
+		expected []interface{}
+	}{
+		{"$.data[*].name", []interface{}{"a", "b"}},
+		{"data[*].name", []interface{}{"a", "b"}},
+		{"$.data[0].name", []interface{}{"a"}},
+		{"$.data[-1].name", []interface{}{"b"}},
+		{"$['meta']['pagination'].totalCount", []interface{}{float64(2)}},
+		{"$.data[1].tags.*", []interface{}{"dev", "x"}},
+		{"$..env", []interface{}{"prod", "dev"}},
+		{"$.data[5].name", nil},
+		{"$.missing", nil},
+	}
+
+	for _, test := range tests {
+		result, err := EvalJsonPath(data, test.path)
+		require.NoError(t, err, test.path)
+		require.Equal(t, test.expected, result, test.path)
+	}
+
+	_, err := EvalJsonPath(data, "$.data[?(@.name)]")
+	require.Error(t, err)
+	_, err = EvalJsonPath(data, "$.data[0")
+	require.Error(t, err)
+}
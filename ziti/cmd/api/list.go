@@ -25,7 +25,6 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"net/url"
-	"os"
 	"reflect"
 	"strings"
 )
@@ -119,33 +118,30 @@ func MapNameToID(api util.API, entityType string, o *Options, idOrName string) (
 }
 
 func MapNamesToIDs(api util.API, entityType string, o *Options, list ...string) ([]string, error) {
+	entityIds, err := GetEntityIds(api, entityType, o, list...)
+	if err != nil {
+		return nil, err
+	}
+
 	var result []string
 	for _, val := range list {
-		if strings.HasPrefix(val, "id") {
-			id := strings.TrimPrefix(val, "id:")
-			result = append(result, id)
-		} else {
-			query := fmt.Sprintf(`id = "%s" or name="%s"`, val, val)
-			if strings.HasPrefix(val, "name") {
-				name := strings.TrimPrefix(val, "name:")
-				query = fmt.Sprintf(`name="%s"`, name)
+		if strings.HasPrefix(val, "id:") {
+			result = append(result, strings.TrimPrefix(val, "id:"))
+		} else if strings.HasPrefix(val, "name:") {
+			if id, found := entityIds.IdForName(strings.TrimPrefix(val, "name:")); found {
+				result = append(result, id)
 			}
-			list, _, err := FilterEntitiesOfType(api, entityType, query, false, nil, o.Timeout, o.Verbose)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(list) > 1 {
+		} else {
+			id, isName := entityIds.IdForName(val)
+			isId := entityIds.IsId(val)
+			if isId && isName && id != val {
 				fmt.Printf("Found multiple %v matching %v. Please specify which you want by prefixing with id: or name:\n", entityType, val)
 				return nil, errors.Errorf("ambigous if %v is id or name", val)
 			}
-
-			for _, entity := range list {
-				entityId, _ := entity.Path("id").Data().(string)
-				result = append(result, entityId)
-				if val, found := os.LookupEnv("ZITI_CLI_DEBUG"); found && strings.EqualFold("true", val) {
-					fmt.Printf("Found %v with id %v for name %v\n", entityType, entityId, val)
-				}
+			if isId {
+				result = append(result, val)
+			} else if isName {
+				result = append(result, id)
 			}
 		}
 	}
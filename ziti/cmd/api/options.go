@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"github.com/Jeffail/gabs"
 	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/openziti/ziti/ziti/util"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"io"
+	"time"
 )
 
 // Options are common options for edge controller commands
@@ -50,12 +52,27 @@ func (options *Options) ErrOutputWriter() io.Writer {
 	return options.CommonOptions.Err
 }
 
+func (options *Options) RequestTimeout() time.Duration {
+	return time.Duration(options.Timeout) * time.Second
+}
+
+func (options *Options) RequestRetryPolicy() util.RetryPolicy {
+	return util.CliRetryPolicy()
+}
+
+func (options *Options) IsVerbose() bool {
+	return options.Verbose
+}
+
 func (options *Options) AddCommonFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&common.CliIdentity, "cli-identity", "i", "", "Specify the saved identity you want the CLI to use when connect to the controller with")
 	cmd.Flags().BoolVarP(&options.OutputJSONResponse, "output-json", "j", false, "Output the full JSON response from the Ziti Edge Controller")
 	cmd.Flags().BoolVar(&options.OutputJSONRequest, "output-request-json", false, "Output the full JSON request to the Ziti Edge Controller")
-	cmd.Flags().IntVarP(&options.Timeout, "timeout", "", 5, "Timeout for REST operations (specified in seconds)")
+	cmd.Flags().IntVarP(&options.Timeout, "timeout", "", int(util.DefaultRequestTimeout/time.Second), "Timeout for REST operations (specified in seconds)")
+	cmd.Flags().IntVar(&common.CliMaxRetries, "max-retries", util.DefaultMaxRetries, "Maximum number of times idempotent REST operations are retried after a transient failure")
 	cmd.Flags().BoolVarP(&options.Verbose, "verbose", "", false, "Enable verbose logging")
+	cmd.Flags().StringVar(&common.CliRecordFile, "record", "", "Record REST requests and responses to the given HAR file. Session tokens are redacted")
+	cmd.Flags().StringVar(&common.CliReplayFile, "replay", "", "Answer REST requests from the given HAR file instead of contacting the controller")
 }
 
 func (options *Options) LogCreateResult(entityType string, result *gabs.Container, err error) error {
@@ -0,0 +1,387 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const rawRequestPageLimit = 500
+
+// RawRequestOptions are the options for sending a raw request to a controller API
+type RawRequestOptions struct {
+	Options
+	api      util.API
+	method   string
+	body     string
+	bodyFile string
+	headers  []string
+	paginate bool
+	query    string
+	include  bool
+
+	// In is where the body is read from when the body file is -, defaults to stdin
+	In io.Reader
+}
+
+// NewRawRequestCmd creates a command which sends requests to any endpoint of the given API, using the selected login
+func NewRawRequestCmd(api util.API, p common.OptionsProvider) *cobra.Command {
+	options := &RawRequestOptions{
+		Options: Options{CommonOptions: p()},
+		api:     api,
+	}
+
+	baseUrl := "/edge/management/v1"
+	example := "  ziti edge api 'identities?filter=name contains \"test\"' --paginate -q '$.data[*].name'\n" +
+		"  ziti edge api POST /services -f body.json"
+	if api == util.FabricAPI {
+		baseUrl = "/fabric/v1"
+		example = "  ziti fabric api routers --paginate -q '$.data[*].id'\n" +
+			"  ziti fabric api DELETE /circuits/<circuitId>"
+	}
+
+	cmd := &cobra.Command{
+		Use:   "api [method] <path>",
+		Short: "sends a request to the " + string(api) + " API and prints the response",
+		Long: "Sends a request to the " + string(api) + " API using the selected login and prints the response. " +
+			"The path is relative to " + baseUrl + ", unless it starts with /edge/ or /fabric/. The method defaults to GET, " +
+			"or POST when a body is given. Lists can be fetched in full with --paginate, and values can be extracted " +
+			"from the response with a JSONPath expression using -q, for example: -q '$.data[*].name'",
+		Example: example,
+		Args:    cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := options.Run()
+			cmdhelper.CheckErr(err)
+		},
+	}
+
+	// allow interspersing positional args and flags
+	cmd.Flags().SetInterspersed(true)
+	cmd.Flags().StringVarP(&options.method, "method", "X", "", "The HTTP method to use. Defaults to GET, or POST if a body is given")
+	cmd.Flags().StringVar(&options.body, "body", "", "The request body")
+	cmd.Flags().StringVarP(&options.bodyFile, "file", "f", "", "Read the request body from the given file, or from stdin if -")
+	cmd.Flags().StringArrayVarP(&options.headers, "header", "H", nil, "Add a request header, in the form key:value")
+	cmd.Flags().BoolVar(&options.paginate, "paginate", false, "Fetch all pages of a list and combine their data into a single response")
+	cmd.Flags().StringVarP(&options.query, "query", "q", "", "Print the values selected by the given JSONPath expression instead of the full response")
+	cmd.Flags().BoolVar(&options.include, "include", false, "Print the response status line and headers")
+	options.AddCommonFlags(cmd)
+
+	return cmd
+}
+
+// Run implements the command
+func (o *RawRequestOptions) Run() error {
+	method, path := "", o.Args[0]
+	if len(o.Args) == 2 {
+		method, path = strings.ToUpper(o.Args[0]), o.Args[1]
+	}
+
+	if o.method != "" {
+		if method != "" && !strings.EqualFold(method, o.method) {
+			return errors.Errorf("method given as both %v and --method %v", method, o.method)
+		}
+		method = strings.ToUpper(o.method)
+	}
+
+	body, err := o.getBody()
+	if err != nil {
+		return err
+	}
+
+	if method == "" {
+		method = http.MethodGet
+		if body != nil {
+			method = http.MethodPost
+		}
+	}
+
+	if o.paginate && method != http.MethodGet {
+		return errors.New("--paginate may only be used with GET requests")
+	}
+
+	restClientIdentity, err := util.LoadSelectedIdentityForApi(o.api)
+	if err != nil {
+		return err
+	}
+
+	baseUrl, err := restClientIdentity.GetBaseUrlForApi(o.api)
+	if err != nil {
+		return err
+	}
+
+	requestUrl, err := resolveRawRequestUrl(baseUrl, path)
+	if err != nil {
+		return err
+	}
+
+	client, err := util.NewRestClientHttpClient(o, restClientIdentity)
+	if err != nil {
+		return err
+	}
+
+	header := restClientIdentity.NewWsHeader()
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	for _, h := range o.headers {
+		key, value, found := strings.Cut(h, ":")
+		if !found {
+			return errors.Errorf("invalid header %q, expected key:value", h)
+		}
+		header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	send := func(requestUrl *url.URL) (*http.Response, []byte, error) {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, requestUrl.String(), bodyReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header = header.Clone()
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to read response body of %v %v", method, requestUrl)
+		}
+
+		if o.include {
+			o.printResponseHeader(resp)
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			if len(respBody) > 0 {
+				util.OutputJson(o.Out, respBody)
+				_, _ = fmt.Fprintln(o.Out)
+			}
+			return nil, nil, errors.Errorf("%v %v failed: %v", method, requestUrl, resp.Status)
+		}
+
+		return resp, respBody, nil
+	}
+
+	var respBody []byte
+	if o.paginate {
+		respBody, err = o.fetchAllPages(requestUrl, send)
+	} else {
+		_, respBody, err = send(requestUrl)
+	}
+	if err != nil {
+		return err
+	}
+
+	return o.outputResponse(respBody)
+}
+
+func (o *RawRequestOptions) getBody() ([]byte, error) {
+	if o.body != "" && o.bodyFile != "" {
+		return nil, errors.New("only one of --body and --file may be given")
+	}
+
+	if o.body != "" {
+		return []byte(o.body), nil
+	}
+
+	if o.bodyFile == "-" {
+		in := o.In
+		if in == nil {
+			in = os.Stdin
+		}
+		body, err := io.ReadAll(in)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read request body from stdin")
+		}
+		return body, nil
+	}
+
+	if o.bodyFile != "" {
+		body, err := os.ReadFile(o.bodyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read request body from %v", o.bodyFile)
+		}
+		return body, nil
+	}
+
+	return nil, nil
+}
+
+// fetchAllPages follows the offset based paging of list responses, combining the data of every page
+func (o *RawRequestOptions) fetchAllPages(requestUrl *url.URL, send func(*url.URL) (*http.Response, []byte, error)) ([]byte, error) {
+	pageUrl := *requestUrl
+	query := pageUrl.Query()
+
+	limit := rawRequestPageLimit
+	if val := query.Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			return nil, errors.Errorf("invalid limit %v", val)
+		}
+	}
+
+	offset := 0
+	if val := query.Get("offset"); val != "" {
+		var err error
+		if offset, err = strconv.Atoi(val); err != nil || offset < 0 {
+			return nil, errors.Errorf("invalid offset %v", val)
+		}
+	}
+
+	var result map[string]interface{}
+	var data []interface{}
+
+	for {
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		pageUrl.RawQuery = query.Encode()
+
+		_, respBody, err := send(&pageUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		page := map[string]interface{}{}
+		if err = json.Unmarshal(respBody, &page); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse response of %v as JSON", pageUrl.String())
+		}
+
+		pageData, ok := page["data"].([]interface{})
+		if !ok {
+			return nil, errors.Errorf("response of %v is not a list, it can't be paginated", pageUrl.String())
+		}
+
+		data = append(data, pageData...)
+		result = page
+		offset += len(pageData)
+
+		meta, _ := page["meta"].(map[string]interface{})
+		pagination, _ := meta["pagination"].(map[string]interface{})
+		totalCount, _ := pagination["totalCount"].(float64)
+		if len(pageData) == 0 || pagination == nil || offset >= int(totalCount) {
+			break
+		}
+	}
+
+	result["data"] = data
+	if meta, ok := result["meta"].(map[string]interface{}); ok {
+		if pagination, ok := meta["pagination"].(map[string]interface{}); ok {
+			pagination["offset"] = 0
+			pagination["limit"] = len(data)
+		}
+	}
+
+	return json.Marshal(result)
+}
+
+func (o *RawRequestOptions) outputResponse(respBody []byte) error {
+	if o.query == "" {
+		if len(respBody) > 0 {
+			util.OutputJson(o.Out, respBody)
+			_, _ = fmt.Fprintln(o.Out)
+		}
+		return nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(respBody, &data); err != nil {
+		return errors.Wrap(err, "unable to parse response as JSON")
+	}
+
+	values, err := EvalJsonPath(data, o.query)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range values {
+		if s, ok := val.(string); ok {
+			_, _ = fmt.Fprintln(o.Out, s)
+			continue
+		}
+		encoded, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(o.Out, string(encoded))
+	}
+	return nil
+}
+
+func (o *RawRequestOptions) printResponseHeader(resp *http.Response) {
+	_, _ = fmt.Fprintf(o.Out, "%v %v\n", resp.Proto, resp.Status)
+	var keys []string
+	for k := range resp.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range resp.Header[k] {
+			_, _ = fmt.Fprintf(o.Out, "%v: %v\n", k, v)
+		}
+	}
+	_, _ = fmt.Fprintln(o.Out)
+}
+
+// resolveRawRequestUrl resolves the path against the API base url. Paths starting with /edge/ or /fabric/ are
+// resolved against the controller root instead, so any controller API can be reached
+func resolveRawRequestUrl(baseUrl, path string) (*url.URL, error) {
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid base url %v", baseUrl)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if !strings.HasPrefix(path, "/edge/") && !strings.HasPrefix(path, "/fabric/") {
+		path = strings.TrimSuffix(base.Path, "/") + path
+	}
+
+	rel, err := url.Parse(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid path %v", path)
+	}
+
+	result := *base
+	result.Path = rel.Path
+	result.RawPath = rel.RawPath
+	result.RawQuery = rel.Query().Encode()
+	return &result, nil
+}
@@ -0,0 +1,164 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/openziti/channel/v2"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"time"
+)
+
+// StreamRejectedError is returned by a stream's subscribe function when the controller refuses the subscription.
+// Retrying wouldn't help, so it ends the stream instead of triggering a reconnect
+type StreamRejectedError struct {
+	Message string
+}
+
+func (self *StreamRejectedError) Error() string {
+	return self.Message
+}
+
+// StreamGap describes a period during which the stream was disconnected and messages may have been missed
+type StreamGap struct {
+	DisconnectedAt time.Time
+	ReconnectedAt  time.Time
+	Attempts       int
+}
+
+// StreamOptions are the reconnect options shared by the commands which stream from the management channel
+type StreamOptions struct {
+	Reconnect         bool
+	ReconnectMaxDelay time.Duration
+	ReconnectAttempts int
+}
+
+func (self *StreamOptions) AddStreamFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&self.Reconnect, "reconnect", false, "Reconnect and resubscribe when the connection to the controller is lost, such as during a controller restart")
+	cmd.Flags().DurationVar(&self.ReconnectMaxDelay, "reconnect-max-delay", 30*time.Second, "The longest time to wait between reconnect attempts")
+	cmd.Flags().IntVar(&self.ReconnectAttempts, "reconnect-attempts", 0, "Give up after this many failed reconnect attempts in a row. 0 retries forever")
+}
+
+// MgmtStream keeps a subscription on the websocket management channel running. When the channel closes and
+// reconnects are enabled, it reconnects with exponential backoff and subscribes again
+type MgmtStream struct {
+	StreamOptions
+
+	// Bind registers the receive handlers on each new channel
+	Bind func(binding channel.Binding)
+
+	// Subscribe sends the subscription request on each new channel
+	Subscribe func(ch channel.Channel) error
+
+	// OnGap is called when the channel has been reconnected, before subscribing again, so the gap can be marked in
+	// the output. If the subscription then fails, the next reconnect reports a gap with the same start
+	OnGap func(gap *StreamGap)
+
+	ErrOut io.Writer
+
+	// connect creates the channel, defaults to NewWsMgmtChannel
+	connect func(bindHandler channel.BindHandler) (channel.Channel, error)
+}
+
+// Run streams until the context is cancelled, the channel closes without reconnects enabled, or reconnecting fails
+func (self *MgmtStream) Run(ctx context.Context) error {
+	connect := self.connect
+	if connect == nil {
+		connect = NewWsMgmtChannel
+	}
+
+	policy := util.RetryPolicy{
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     self.ReconnectMaxDelay,
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = 30 * time.Second
+	}
+
+	var disconnectedAt time.Time
+	connected := false
+	attempt := 0
+
+	for {
+		closeNotify := make(chan struct{})
+		bindHandler := func(binding channel.Binding) error {
+			self.Bind(binding)
+			binding.AddCloseHandler(channel.CloseHandlerF(func(ch channel.Channel) {
+				close(closeNotify)
+			}))
+			return nil
+		}
+
+		ch, err := connect(channel.BindHandlerF(bindHandler))
+		if err == nil {
+			// report the gap before subscribing, so it's handled before any messages from the new subscription
+			if connected && self.OnGap != nil {
+				self.OnGap(&StreamGap{
+					DisconnectedAt: disconnectedAt,
+					ReconnectedAt:  time.Now(),
+					Attempts:       attempt + 1,
+				})
+			}
+			if err = self.Subscribe(ch); err != nil {
+				_ = ch.Close()
+			}
+		}
+
+		if err != nil {
+			var rejected *StreamRejectedError
+			if !connected || !self.Reconnect || errors.As(err, &rejected) {
+				return err
+			}
+
+			delay := policy.Delay(attempt, nil)
+			attempt++
+			if self.ReconnectAttempts > 0 && attempt >= self.ReconnectAttempts {
+				return errors.Wrapf(err, "unable to reconnect after %v attempts", attempt)
+			}
+			_, _ = fmt.Fprintf(self.ErrOut, "reconnect attempt %v failed (%v), retrying in %v\n", attempt, err, delay.Round(time.Millisecond))
+
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		connected = true
+		attempt = 0
+
+		select {
+		case <-closeNotify:
+		case <-ctx.Done():
+			_ = ch.Close()
+			<-closeNotify
+			return nil
+		}
+
+		if !self.Reconnect {
+			return nil
+		}
+
+		disconnectedAt = time.Now()
+		_, _ = fmt.Fprintln(self.ErrOut, "connection to controller lost, reconnecting")
+	}
+}
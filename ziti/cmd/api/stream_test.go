@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"github.com/openziti/channel/v2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeStreamChannel struct {
+	channel.Channel
+	once          sync.Once
+	closeHandlers []channel.CloseHandler
+}
+
+func (self *fakeStreamChannel) Close() error {
+	self.once.Do(func() {
+		for _, h := range self.closeHandlers {
+			h.HandleClose(self)
+		}
+	})
+	return nil
+}
+
+type fakeStreamBinding struct {
+	channel.Binding
+	ch *fakeStreamChannel
+}
+
+func (self *fakeStreamBinding) AddCloseHandler(h channel.CloseHandler) {
+	self.ch.closeHandlers = append(self.ch.closeHandlers, h)
+}
+
+// fakeStreamConnector hands out channels, failing the connects listed in failures
+type fakeStreamConnector struct {
+	sync.Mutex
+	connects int
+	failures map[int]bool
+	channels chan *fakeStreamChannel
+}
+
+func (self *fakeStreamConnector) connect(bindHandler channel.BindHandler) (channel.Channel, error) {
+	self.Lock()
+	self.connects++
+	connectNumber := self.connects
+	self.Unlock()
+
+	if self.failures[connectNumber] {
+		return nil, errors.New("connection refused")
+	}
+
+	ch := &fakeStreamChannel{}
+	if err := bindHandler.BindChannel(&fakeStreamBinding{ch: ch}); err != nil {
+		return nil, err
+	}
+	self.channels <- ch
+	return ch, nil
+}
+
+func TestMgmtStreamReconnects(t *testing.T) {
+	connector := &fakeStreamConnector{
+		failures: map[int]bool{2: true},
+		channels: make(chan *fakeStreamChannel, 10),
+	}
+
+	var gaps []*StreamGap
+	subscribes := 0
+	errOut := &bytes.Buffer{}
+
+	stream := &MgmtStream{
+		StreamOptions: StreamOptions{Reconnect: true, ReconnectMaxDelay: 10 * time.Millisecond},
+		Bind:          func(channel.Binding) {},
+		Subscribe: func(channel.Channel) error {
+			subscribes++
+			return nil
+		},
+		OnGap: func(gap *StreamGap) {
+			gaps = append(gaps, gap)
+		},
+		ErrOut:  errOut,
+		connect: connector.connect,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Run(ctx)
+	}()
+
+	// lose the first connection, the first reconnect fails, the second succeeds
+	first := <-connector.channels
+	_ = first.Close()
+	<-connector.channels
+
+	cancel()
+	require.NoError(t, <-done)
+
+	require.Equal(t, 3, connector.connects)
+	require.Equal(t, 2, subscribes)
+	require.Len(t, gaps, 1)
+	require.Equal(t, 2, gaps[0].Attempts)
+	require.False(t, gaps[0].ReconnectedAt.Before(gaps[0].DisconnectedAt))
+	require.Contains(t, errOut.String(), "connection to controller lost, reconnecting")
+	require.Contains(t, errOut.String(), "reconnect attempt 1 failed (connection refused)")
+}
+
+func TestMgmtStreamStopsWithoutReconnect(t *testing.T) {
+	connector := &fakeStreamConnector{channels: make(chan *fakeStreamChannel, 10)}
+
+	stream := &MgmtStream{
+		Bind:      func(channel.Binding) {},
+		Subscribe: func(channel.Channel) error { return nil },
+		ErrOut:    &bytes.Buffer{},
+		connect:   connector.connect,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Run(context.Background())
+	}()
+
+	_ = (<-connector.channels).Close()
+	require.NoError(t, <-done)
+	require.Equal(t, 1, connector.connects)
+}
+
+func TestMgmtStreamRejectedSubscription(t *testing.T) {
+	connector := &fakeStreamConnector{channels: make(chan *fakeStreamChannel, 10)}
+
+	subscribes := 0
+	stream := &MgmtStream{
+		StreamOptions: StreamOptions{Reconnect: true, ReconnectMaxDelay: 10 * time.Millisecond},
+		Bind:          func(channel.Binding) {},
+		Subscribe: func(channel.Channel) error {
+			subscribes++
+			if subscribes > 1 {
+				return &StreamRejectedError{Message: "invalid subscription"}
+			}
+			return nil
+		},
+		ErrOut:  &bytes.Buffer{},
+		connect: connector.connect,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Run(context.Background())
+	}()
+
+	_ = (<-connector.channels).Close()
+	err := <-done
+	require.EqualError(t, err, "invalid subscription")
+	require.Equal(t, 2, connector.connects)
+}
+
+func TestMgmtStreamGivesUpAfterAttempts(t *testing.T) {
+	connector := &fakeStreamConnector{
+		failures: map[int]bool{2: true, 3: true, 4: true},
+		channels: make(chan *fakeStreamChannel, 10),
+	}
+
+	stream := &MgmtStream{
+		StreamOptions: StreamOptions{Reconnect: true, ReconnectMaxDelay: 10 * time.Millisecond, ReconnectAttempts: 2},
+		Bind:          func(channel.Binding) {},
+		Subscribe:     func(channel.Channel) error { return nil },
+		ErrOut:        &bytes.Buffer{},
+		connect:       connector.connect,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Run(context.Background())
+	}()
+
+	_ = (<-connector.channels).Close()
+	err := <-done
+	require.ErrorContains(t, err, "unable to reconnect after 2 attempts")
+	require.Equal(t, 3, connector.connects)
+	require.Equal(t, 1, strings.Count(stream.ErrOut.(*bytes.Buffer).String(), "retrying in"))
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/channel/v2"
+	trace_pb "github.com/openziti/channel/v2/trace/pb"
+	"reflect"
+	"sort"
+)
+
+// FormatTraceMessage renders a traced channel message as a single line
+func FormatTraceMessage(event *trace_pb.ChannelMessage) string {
+	flow := "->"
+	if event.IsRx {
+		flow = "<-"
+	}
+	replyFor := ""
+	if event.ReplyFor != -1 {
+		replyFor = fmt.Sprintf(">%d", event.ReplyFor)
+	}
+	meta := DecodeTraceAndFormat(event.Decode)
+	if meta == "" {
+		meta = fmt.Sprintf("missing decode, content-type=%v", event.ContentType)
+	}
+	return fmt.Sprintf("%8d: %-16s %8s %s #%-5d %5s | %s\n",
+		event.Timestamp, event.Identity, event.Channel, flow, event.Sequence, replyFor, meta)
+}
+
+// DecodeTraceMeta returns the decoded fields of a traced message, or nil if the message has none
+func DecodeTraceMeta(decode []byte) (map[string]interface{}, error) {
+	if len(decode) == 0 {
+		return nil, nil
+	}
+	meta := make(map[string]interface{})
+	if err := json.Unmarshal(decode, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// DecodeTraceAndFormat renders the decoded fields of a traced message, returning an empty string if there are none
+func DecodeTraceAndFormat(decode []byte) string {
+	meta, err := DecodeTraceMeta(decode)
+	if err != nil {
+		return fmt.Sprintf("invalid decode: %v", err)
+	}
+	if meta == nil {
+		return ""
+	}
+
+	out := fmt.Sprintf("%-24s", fmt.Sprintf("%-8s %s", meta[channel.DecoderFieldName], meta[channel.MessageFieldName]))
+
+	if len(meta) > 2 {
+		keys := make([]string, 0)
+		for k := range meta {
+			if k != channel.DecoderFieldName && k != channel.MessageFieldName {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		out += " {"
+		for i := 0; i < len(keys); i++ {
+			k := keys[i]
+			if i > 0 {
+				out += " "
+			}
+			out += k
+			out += "=["
+			v := meta[k]
+			switch v.(type) {
+			case string:
+				out += v.(string)
+			case float64:
+				out += fmt.Sprintf("%0.0f", v.(float64))
+			case bool:
+				out += fmt.Sprintf("%t", v.(bool))
+			default:
+				out += fmt.Sprintf("<%s>", reflect.TypeOf(v))
+			}
+			out += "]"
+		}
+		out += "}"
+	}
+
+	return out
+}
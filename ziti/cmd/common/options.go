@@ -94,3 +94,11 @@ func (options *CommonOptions) Println(s interface{}) {
 }
 
 var CliIdentity string
+
+// CliRecordFile and CliReplayFile name HAR files which REST traffic is recorded to or replayed from
+var CliRecordFile string
+var CliReplayFile string
+
+// CliMaxRetries is how often idempotent REST requests are retried after a transient failure. The default matches
+// util.DefaultMaxRetries
+var CliMaxRetries = 3
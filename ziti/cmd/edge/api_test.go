@@ -0,0 +1,61 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApiRawRequests(t *testing.T) {
+	req := require.New(t)
+	server := apitest.NewServer(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		server.Create("identities", map[string]interface{}{"name": name, "type": "User"})
+	}
+
+	out, err := apitest.Execute(NewCmdEdge, "api", `identities?filter=true sort by name&limit=2`, "--paginate", "-q", "$.data[*].name")
+	req.NoError(err)
+	req.Equal("alice\nbob\ncarol\n", out)
+	req.Len(server.RequestsTo(http.MethodGet, "/edge/management/v1/identities"), 2)
+
+	out, err = apitest.Execute(NewCmdEdge, "api", "GET", "/edge/management/v1/identities", "-q", "meta.pagination.totalCount")
+	req.NoError(err)
+	req.Equal("3\n", out)
+
+	bodyFile := filepath.Join(t.TempDir(), "body.json")
+	req.NoError(os.WriteFile(bodyFile, []byte(`{"name": "echo", "encryptionRequired": true}`), 0600))
+
+	out, err = apitest.Execute(NewCmdEdge, "api", "/services", "-f", bodyFile)
+	req.NoError(err)
+	req.Contains(out, `"id"`)
+	services := server.List("services")
+	req.Len(services, 1)
+	req.Equal("echo", services[0]["name"])
+
+	out, err = apitest.Execute(NewCmdEdge, "api", "/services/missing")
+	req.Error(err)
+	req.Contains(err.Error(), "404")
+	req.Contains(out, "NOT_FOUND")
+
+	_, err = apitest.Execute(NewCmdEdge, "api", "DELETE", "/services/x", "--paginate")
+	req.Error(err)
+
+	// read-only logins may only send GET requests
+	config, _, err := util.LoadRestClientConfig()
+	req.NoError(err)
+	config.EdgeIdentities["default"].ReadOnly = true
+	req.NoError(util.PersistRestClientConfig(config))
+	util.ClearSelectedIdentity()
+
+	_, err = apitest.Execute(NewCmdEdge, "api", "DELETE", "/services/"+services[0]["id"].(string))
+	req.Error(err)
+	req.Contains(err.Error(), "read-only")
+	req.Len(server.RequestsTo(http.MethodDelete, "/edge/management/v1/services"), 0)
+
+	_, err = apitest.Execute(NewCmdEdge, "api", "services")
+	req.NoError(err)
+}
@@ -19,93 +19,125 @@ package edge
 import (
 	"fmt"
 	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/util"
 	"github.com/pkg/errors"
-	"os"
+	"math"
 	"strings"
 )
 
 func mapNameToID(entityType string, val string, o api.Options) (string, error) {
-	list, _, err := filterEntitiesOfType(entityType, fmt.Sprintf("id=\"%s\"", val), false, nil, o.Timeout, o.Verbose)
+	entityIds, err := api.GetEntityIds(util.EdgeAPI, entityType, &o, val)
 	if err != nil {
 		return "", err
 	}
 
-	if len(list) > 0 {
+	if entityIds.IsId(val) {
 		return val, nil
 	}
 
-	list, _, err = filterEntitiesOfType(entityType, fmt.Sprintf("name=\"%s\"", val), false, nil, o.Timeout, o.Verbose)
-	if err != nil {
-		return "", err
+	if id, found := entityIds.IdForName(val); found {
+		return id, nil
 	}
 
-	if len(list) < 1 {
-		return "", errors.Errorf("no %v found with id or name %v", entityType, val)
+	return "", errors.Errorf("no %v found with id or name %v", entityType, val)
+}
+
+// mapServiceHostingToIDs returns the hosting costs and precedences keyed by service id rather than by service name or
+// id, validating them along the way. The services are looked up in a single batch
+func mapServiceHostingToIDs(costs map[string]int, precedences map[string]string, o api.Options) (map[string]int, map[string]string, error) {
+	var serviceNames []string
+	for k := range costs {
+		serviceNames = append(serviceNames, k)
+	}
+	for k := range precedences {
+		serviceNames = append(serviceNames, k)
+	}
+	if _, err := api.GetEntityIds(util.EdgeAPI, "services", &o, serviceNames...); err != nil {
+		return nil, nil, err
 	}
 
-	if len(list) > 1 {
-		return "", errors.Errorf("multiple %v found for name %v, please use id instead", entityType, val)
+	costsById := map[string]int{}
+	for k, v := range costs {
+		if v < 0 || v > math.MaxUint16 {
+			return nil, nil, errors.Errorf("hosting costs must be in the range %v-%v", 0, math.MaxUint16)
+		}
+		id, err := mapNameToID("services", k, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		costsById[id] = v
 	}
 
-	entity := list[0]
-	entityId, _ := entity.Path("id").Data().(string)
-	if val, found := os.LookupEnv("ZITI_CLI_DEBUG"); found && strings.EqualFold("true", val) {
-		fmt.Printf("Found %v with id %v for name %v\n", entityType, entityId, val)
+	precedencesById := map[string]string{}
+	for k, v := range precedences {
+		id, err := mapNameToID("services", k, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		prec, err := normalizeAndValidatePrecedence(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		precedencesById[id] = prec
 	}
-	return entityId, nil
+
+	return costsById, precedencesById, nil
 }
 
 func mapIdToName(entityType string, val string, o api.Options) (string, error) {
-	list, _, err := filterEntitiesOfType(entityType, fmt.Sprintf(`id="%s"`, val), false, nil, o.Timeout, o.Verbose)
+	entityIds, err := api.GetEntityIds(util.EdgeAPI, entityType, &o, val)
 	if err != nil {
 		return "", err
 	}
 
-	if len(list) < 1 {
-		return "", errors.Errorf("no %v found for id %v", entityType, val)
+	if name, found := entityIds.NameForId(val); found {
+		return name, nil
 	}
 
-	entity := list[0]
-	name, _ := entity.Path("name").Data().(string)
-	return name, nil
+	return "", errors.Errorf("no %v found for id %v", entityType, val)
 }
 
 func mapNamesToIDs(entityType string, o api.Options, skipNotFound bool, list ...string) ([]string, error) {
+	entityIds, err := api.GetEntityIds(util.EdgeAPI, entityType, &o, list...)
+	if err != nil {
+		return nil, err
+	}
+
 	var result []string
 	for _, val := range list {
 		if strings.HasPrefix(val, "id:") {
-			id := strings.TrimPrefix(val, "id:")
-			result = append(result, id)
+			result = append(result, strings.TrimPrefix(val, "id:"))
+			continue
+		}
+
+		var matches []string
+		if strings.HasPrefix(val, "name:") {
+			if id, found := entityIds.IdForName(strings.TrimPrefix(val, "name:")); found {
+				matches = append(matches, id)
+			}
 		} else {
-			query := fmt.Sprintf(`id = "%s" or name="%s"`, val, val)
-			if strings.HasPrefix(val, "name:") {
-				name := strings.TrimPrefix(val, "name:")
-				query = fmt.Sprintf(`name="%s"`, name)
+			if entityIds.IsId(val) {
+				matches = append(matches, val)
 			}
-			list, _, err := filterEntitiesOfType(entityType, query, false, nil, o.Timeout, o.Verbose)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(list) == 0 {
-				fmt.Printf("Found 0 %v with id or name matching %v\n", entityType, val)
-				if skipNotFound {
-					continue
-				}
-				return nil, errors.Errorf("no %v with id or name matching %v", entityType, val)
+			if id, found := entityIds.IdForName(val); found && id != val {
+				matches = append(matches, id)
 			}
+		}
 
-			if len(list) > 1 {
-				fmt.Printf("Found multiple %v matching %v. Please specify which you want by prefixing with id: or name:\n", entityType, val)
-				return nil, errors.Errorf("ambigous if %v is id or name", val)
+		if len(matches) == 0 {
+			fmt.Printf("Found 0 %v with id or name matching %v\n", entityType, val)
+			if skipNotFound {
+				continue
 			}
+			return nil, errors.Errorf("no %v with id or name matching %v", entityType, val)
+		}
 
-			entityId, _ := list[0].Path("id").Data().(string)
-			result = append(result, entityId)
-			if val, found := os.LookupEnv("ZITI_CLI_DEBUG"); found && strings.EqualFold("true", val) {
-				fmt.Printf("Found %v with id %v for name %v\n", entityType, entityId, val)
-			}
+		if len(matches) > 1 {
+			fmt.Printf("Found multiple %v matching %v. Please specify which you want by prefixing with id: or name:\n", entityType, val)
+			return nil, errors.Errorf("ambigous if %v is id or name", val)
 		}
+
+		result = append(result, matches[0])
 	}
 	return result, nil
 }
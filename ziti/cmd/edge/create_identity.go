@@ -18,11 +18,12 @@ package edge
 
 import (
 	"fmt"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/ziti/common/enrollment"
 	"github.com/openziti/ziti/ziti/cmd/api"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
 	"github.com/pkg/errors"
 	"io"
-	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -44,6 +45,8 @@ type createIdentityOptions struct {
 	appData                  map[string]string
 	externalId               string
 	authPolicyNameOrId       string
+	enrollTo                 string
+	keyAlg                   ziti.KeyAlgVar
 }
 
 // newCreateIdentityCmd creates the 'edge controller create identity' command
@@ -95,6 +98,9 @@ func newCreateIdentityOfTypeCmd(idType string, options *createIdentityOptions) *
 	cmd.Flags().StringToStringVar(&options.servicePrecedences, "service-precedences", map[string]string{}, "Per-service hosting precedences")
 	cmd.Flags().StringToStringVar(&options.appData, "app-data", nil, "Custom application data")
 	cmd.Flags().StringVarP(&options.authPolicyNameOrId, "auth-policy", "P", "default", "The name or id of the auth policy to assign to the identity")
+	cmd.Flags().StringVar(&options.enrollTo, "enroll-to", "", "Enroll the new identity locally and write the identity file to the given path. The identity is deleted if enrollment fails")
+	options.keyAlg.Set("RSA") // set default
+	cmd.Flags().Var(&options.keyAlg, "key-alg", "Crypto algorithm to use when generating the private key for --enroll-to, RSA or EC")
 
 	options.AddCommonFlags(cmd)
 
@@ -102,6 +108,15 @@ func newCreateIdentityOfTypeCmd(idType string, options *createIdentityOptions) *
 }
 
 func runCreateIdentity(idType string, o *createIdentityOptions) error {
+	if o.enrollTo != "" {
+		if strings.TrimSpace(o.username) != "" {
+			return errors.New("--enroll-to can not be used with --updb, updb identities are enrolled with a password")
+		}
+		if o.jwtOutputFile != "" {
+			return errors.New("--enroll-to can not be used with --jwt-output-file, the JWT is never written when enrolling locally")
+		}
+	}
+
 	entityData := gabs.New()
 	api.SetJSONValue(entityData, o.Args[0], "name")
 	api.SetJSONValue(entityData, strings.Title(idType), "type")
@@ -131,35 +146,12 @@ func runCreateIdentity(idType string, o *createIdentityOptions) error {
 
 	api.SetJSONValue(entityData, o.defaultHostingCost, "defaultHostingCost")
 
-	for k, v := range o.serviceCosts {
-		if v < 0 || v > math.MaxUint16 {
-			return errors.Errorf("hosting costs must be in the range %v-%v", 0, math.MaxUint16)
-		}
-		id, err := mapNameToID("services", k, o.Options)
-		if err != nil {
-			return err
-		}
-		delete(o.serviceCosts, k)
-		o.serviceCosts[id] = v
-	}
-	api.SetJSONValue(entityData, o.serviceCosts, "serviceHostingCosts")
-
-	for k, v := range o.servicePrecedences {
-		id, err := mapNameToID("services", k, o.Options)
-		if err != nil {
-			return err
-		}
-
-		prec, err := normalizeAndValidatePrecedence(v)
-		if err != nil {
-			return err
-		}
-
-		delete(o.servicePrecedences, k)
-		o.servicePrecedences[id] = prec
+	serviceCosts, servicePrecedences, err := mapServiceHostingToIDs(o.serviceCosts, o.servicePrecedences, o.Options)
+	if err != nil {
+		return err
 	}
-
-	api.SetJSONValue(entityData, o.servicePrecedences, "serviceHostingPrecedences")
+	api.SetJSONValue(entityData, serviceCosts, "serviceHostingCosts")
+	api.SetJSONValue(entityData, servicePrecedences, "serviceHostingPrecedences")
 
 	authPolicyId, err := mapNameToID("auth-policies", o.authPolicyNameOrId, o.Options)
 
@@ -186,18 +178,46 @@ func runCreateIdentity(idType string, o *createIdentityOptions) error {
 			return err
 		}
 	}
+
+	if o.enrollTo != "" {
+		id := result.S("data", "id").Data().(string)
+		if err := enrollIdentity(o, id); err != nil {
+			if deleteErr := deleteEntityOfType("identities", id, &o.Options); deleteErr != nil {
+				return errors.Wrapf(err, "enrollment failed and identity %v could not be deleted: %v", id, deleteErr)
+			}
+			return errors.Wrapf(err, "enrollment failed, identity %v deleted", id)
+		}
+	}
 	return err
 }
 
-func getIdentityJwt(o *createIdentityOptions, id string, timeout int, verbose bool) error {
+// enrollIdentity enrolls the new identity in process, passing the JWT straight to the enroller so it never
+// touches the disk
+func enrollIdentity(o *createIdentityOptions, id string) error {
+	_, jwt, err := readIdentityJwt(o, id, o.Options.Timeout, o.Options.Verbose)
+	if err != nil {
+		return err
+	}
+
+	action := &enrollment.EnrollAction{
+		EnrollOptions: enrollment.EnrollOptions{
+			CommonOptions: o.CommonOptions,
+			KeyAlg:        o.keyAlg,
+			JwtString:     jwt,
+			OutputPath:    o.enrollTo,
+		},
+	}
+	return action.Run()
+}
 
+func readIdentityJwt(o *createIdentityOptions, id string, timeout int, verbose bool) (*gabs.Container, string, error) {
 	newIdentity, err := DetailEntityOfType("identities", id, o.OutputJSONResponse, o.Out, timeout, verbose)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	if newIdentity == nil {
-		return fmt.Errorf("no error during identity creation, but identity with id %v not found... unable to extract JWT", id)
+		return nil, "", fmt.Errorf("no error during identity creation, but identity with id %v not found... unable to extract JWT", id)
 	}
 
 	var dataContainer *gabs.Container
@@ -211,11 +231,20 @@ func getIdentityJwt(o *createIdentityOptions, id string, timeout int, verbose bo
 	jwt, ok := dataContainer.Data().(string)
 
 	if !ok {
-		return fmt.Errorf("could not read enrollment.ott.jwt as a string encountered %v", reflect.TypeOf(data))
+		return nil, "", fmt.Errorf("could not read enrollment.ott.jwt as a string encountered %v", reflect.TypeOf(data))
 	}
 
 	if jwt == "" {
-		return fmt.Errorf("enrollment JWT not present for new identity")
+		return nil, "", fmt.Errorf("enrollment JWT not present for new identity")
+	}
+
+	return newIdentity, jwt, nil
+}
+
+func getIdentityJwt(o *createIdentityOptions, id string, timeout int, verbose bool) error {
+	newIdentity, jwt, err := readIdentityJwt(o, id, timeout, verbose)
+	if err != nil {
+		return err
 	}
 
 	if err := os.WriteFile(o.jwtOutputFile, []byte(jwt), 0600); err != nil {
@@ -0,0 +1,59 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateIdentityEnrollToDeletesIdentityOnFailure(t *testing.T) {
+	req := require.New(t)
+	server := apitest.NewServer(t)
+	server.Create("auth-policies", map[string]interface{}{"name": "default"})
+
+	identityFile := filepath.Join(t.TempDir(), "svc.json")
+
+	// the fake controller hands out placeholder JWTs, so enrollment fails after the identity is created
+	_, err := apitest.Execute(NewCmdEdge, "create", "identity", "service", "svc", "--enroll-to", identityFile, "--key-alg", "EC")
+	req.Error(err)
+	req.Contains(err.Error(), "enrollment failed")
+
+	req.Len(server.RequestsTo(http.MethodPost, "/edge/management/v1/identities"), 1)
+	req.Len(server.List("identities"), 0)
+	req.NoFileExists(identityFile)
+
+	_, err = apitest.Execute(NewCmdEdge, "create", "identity", "user", "bob", "--enroll-to", identityFile, "--updb", "bob")
+	req.Error(err)
+	_, err = apitest.Execute(NewCmdEdge, "create", "identity", "user", "bob", "--enroll-to", identityFile, "-o", "bob.jwt")
+	req.Error(err)
+	req.Len(server.RequestsTo(http.MethodPost, "/edge/management/v1/identities"), 1)
+}
+
+func TestIdentityServiceHostingResolvesNamesInOneQuery(t *testing.T) {
+	req := require.New(t)
+	server := apitest.NewServer(t)
+	seedServices(server)
+	echoId := server.List("services")[0]["id"].(string)
+	sshId := server.List("services")[1]["id"].(string)
+
+	_, err := apitest.Execute(NewCmdEdge, "create", "identity", "device", "host1",
+		"--service-costs", "echo=5,"+sshId+"=7", "--service-precedences", "echo=required")
+	req.NoError(err)
+	req.Len(server.RequestsTo(http.MethodGet, "/edge/management/v1/services"), 1)
+
+	identities := server.List("identities")
+	req.Len(identities, 1)
+	req.Equal(map[string]interface{}{echoId: 5.0, sshId: 7.0}, identities[0]["serviceHostingCosts"])
+	req.Equal(map[string]interface{}{echoId: "required"}, identities[0]["serviceHostingPrecedences"])
+
+	_, err = apitest.Execute(NewCmdEdge, "update", "identity", "host1", "--service-costs", "ssh=3")
+	req.NoError(err)
+	req.Equal(map[string]interface{}{sshId: 3.0}, server.List("identities")[0]["serviceHostingCosts"])
+	req.Equal(map[string]interface{}{echoId: "required"}, server.List("identities")[0]["serviceHostingPrecedences"])
+
+	_, err = apitest.Execute(NewCmdEdge, "update", "identity", "host1", "--service-costs", "ssh=70000")
+	req.Error(err)
+	req.Contains(err.Error(), "hosting costs must be in the range 0-65535")
+}
@@ -19,6 +19,7 @@ package edge
 import (
 	"github.com/openziti/ziti/ziti/cmd/api"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
 	"io"
 	"strings"
 
@@ -106,6 +107,18 @@ func runCreateServicePolicy(o *createServicePolicyOptions) error {
 }
 
 func convertNamesToIds(roles []string, entityType string, o api.Options) ([]string, error) {
+	var idsOrNames []string
+	for _, val := range roles {
+		if strings.HasPrefix(val, "@") {
+			idsOrNames = append(idsOrNames, strings.TrimPrefix(val, "@"))
+		}
+	}
+
+	// look up all referenced entities at once, so the mapping below is served from the cache
+	if _, err := api.GetEntityIds(util.EdgeAPI, entityType, &o, idsOrNames...); err != nil {
+		return nil, err
+	}
+
 	var result []string
 	for _, val := range roles {
 		if strings.HasPrefix(val, "@") {
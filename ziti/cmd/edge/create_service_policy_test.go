@@ -0,0 +1,30 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestCreateServicePolicyResolvesNamesInOneQuery(t *testing.T) {
+	server := apitest.NewServer(t)
+	seedServices(server)
+	aliceId := server.Create("identities", map[string]interface{}{"name": "alice", "type": "User"})
+
+	_, err := apitest.Execute(NewCmdEdge, "create", "service-policy", "dial-all", "Dial",
+		"--service-roles", "@echo,@ssh,@id3,#web",
+		"--identity-roles", "@alice,@"+aliceId)
+	require.NoError(t, err)
+
+	require.Len(t, server.RequestsTo(http.MethodGet, "/edge/management/v1/services"), 1)
+	require.Len(t, server.RequestsTo(http.MethodGet, "/edge/management/v1/identities"), 1)
+
+	policies := server.List("service-policies")
+	require.Len(t, policies, 1)
+	require.Equal(t, []interface{}{"@id1", "@id2", "@id3", "#web"}, policies[0]["serviceRoles"])
+	require.Equal(t, []interface{}{"@" + aliceId, "@" + aliceId}, policies[0]["identityRoles"])
+
+	_, err = apitest.Execute(NewCmdEdge, "create", "service-policy", "dial-missing", "Dial", "--service-roles", "@missing")
+	require.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func seedServices(server *apitest.Server) {
+	server.Create("services", map[string]interface{}{
+		"name":               "echo",
+		"encryptionRequired": true,
+		"terminatorStrategy": "smartrouting",
+		"roleAttributes":     []interface{}{"demo", "web"},
+	})
+	server.Create("services", map[string]interface{}{
+		"name":               "ssh",
+		"encryptionRequired": false,
+		"terminatorStrategy": "weighted",
+		"roleAttributes":     []interface{}{"admin"},
+	})
+	server.Create("services", map[string]interface{}{
+		"name":               "web-app",
+		"encryptionRequired": true,
+		"terminatorStrategy": "smartrouting",
+		"roleAttributes":     []interface{}{"web"},
+	})
+}
+
+func TestListServices(t *testing.T) {
+	server := apitest.NewServer(t)
+	seedServices(server)
+
+	output, err := apitest.Execute(NewCmdEdge, "list", "services")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_services", output)
+
+	output, err = apitest.Execute(NewCmdEdge, "list", "services", "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_services_csv", output)
+}
+
+func TestListServicesWithFilterAndPaging(t *testing.T) {
+	server := apitest.NewServer(t)
+	seedServices(server)
+
+	output, err := apitest.Execute(NewCmdEdge, "list", "services", `anyOf(roleAttributes) = "web" sort by name desc limit 1`)
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_services_filtered", output)
+
+	requests := server.RequestsTo(http.MethodGet, "/edge/management/v1/services")
+	require.Len(t, requests, 1)
+	require.Equal(t, `anyOf(roleAttributes) = "web" sort by name desc limit 1`, requests[0].Query.Get("filter"))
+}
+
+func TestListIdentities(t *testing.T) {
+	server := apitest.NewServer(t)
+	server.Create("identities", map[string]interface{}{"name": "alice", "type": "User", "roleAttributes": []interface{}{"admins"}})
+	server.Create("identities", map[string]interface{}{"name": "router-host", "type": "Device"})
+
+	output, err := apitest.Execute(NewCmdEdge, "list", "identities")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_identities", output)
+}
+
+func TestListServicePoliciesAndMembers(t *testing.T) {
+	server := apitest.NewServer(t)
+	seedServices(server)
+	aliceId := server.Create("identities", map[string]interface{}{"name": "alice", "type": "User", "roleAttributes": []interface{}{"admins"}})
+	server.Create("identities", map[string]interface{}{"name": "bob", "type": "User"})
+	server.Create("service-policies", map[string]interface{}{
+		"name":              "web-dial",
+		"type":              "Dial",
+		"semantic":          "AnyOf",
+		"serviceRoles":      []interface{}{"#web"},
+		"identityRoles":     []interface{}{"@" + aliceId},
+		"postureCheckRoles": []interface{}{},
+	})
+
+	output, err := apitest.Execute(NewCmdEdge, "list", "service-policies")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_service_policies", output)
+
+	output, err = apitest.Execute(NewCmdEdge, "list", "service-policy", "services", "web-dial", "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_service_policy_services_csv", output)
+
+	output, err = apitest.Execute(NewCmdEdge, "list", "identity", "services", "alice", "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_identity_services_csv", output)
+
+	output, err = apitest.Execute(NewCmdEdge, "list", "identity", "services", "bob", "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_identity_services_none_csv", output)
+}
+
+func TestCreateAndDeleteService(t *testing.T) {
+	server := apitest.NewServer(t)
+
+	_, err := apitest.Execute(NewCmdEdge, "create", "service", "echo", "--role-attributes", "demo")
+	require.NoError(t, err)
+
+	services := server.List("services")
+	require.Len(t, services, 1)
+	require.Equal(t, "echo", services[0]["name"])
+	require.Equal(t, []interface{}{"demo"}, services[0]["roleAttributes"])
+
+	_, err = apitest.Execute(NewCmdEdge, "create", "service", "echo")
+	require.Error(t, err)
+
+	_, err = apitest.Execute(NewCmdEdge, "delete", "service", "echo")
+	require.NoError(t, err)
+	require.Empty(t, server.List("services"))
+}
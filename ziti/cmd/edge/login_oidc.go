@@ -0,0 +1,427 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// OidcOptions are the flags used when logging in through an OIDC provider, via an external JWT signer
+type OidcOptions struct {
+	Signer       string
+	ClientId     string
+	Scopes       []string
+	DeviceCode   bool
+	CallbackPort int
+	TokenType    string
+}
+
+// oidcSigner holds what is needed from an external JWT signer to authenticate with its OIDC provider
+type oidcSigner struct {
+	name     string
+	issuer   string
+	clientId string
+	scopes   []string
+}
+
+type oidcProvider struct {
+	AuthorizationEndpoint       string
+	TokenEndpoint               string
+	DeviceAuthorizationEndpoint string
+}
+
+// openBrowser tries to open the given URL in the user's browser. The URL is always printed as well, so failures are
+// ignored
+var openBrowser = func(target string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", target).Start()
+	case "darwin":
+		return exec.Command("open", target).Start()
+	default:
+		return exec.Command("xdg-open", target).Start()
+	}
+}
+
+// getOidcToken authenticates with the OIDC provider of the selected external JWT signer and returns the token to
+// present to the controller
+func (o *LoginOptions) getOidcToken(ctrlHost string) (string, error) {
+	signer, err := o.getOidcSigner(ctrlHost)
+	if err != nil {
+		return "", err
+	}
+
+	provider, err := o.discoverOidcProvider(signer.issuer)
+	if err != nil {
+		return "", err
+	}
+
+	var tokens *gabs.Container
+	if o.Oidc.DeviceCode {
+		tokens, err = o.runOidcDeviceCodeFlow(signer, provider)
+	} else {
+		tokens, err = o.runOidcAuthCodeFlow(signer, provider)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	tokenField := "access_token"
+	if strings.EqualFold(o.Oidc.TokenType, "id") {
+		tokenField = "id_token"
+	}
+
+	token, _ := tokens.S(tokenField).Data().(string)
+	if token == "" {
+		return "", errors.Errorf("OIDC provider did not return an %v", tokenField)
+	}
+	return token, nil
+}
+
+// getOidcSigner looks up the external JWT signer through the unauthenticated client API, which lists the signers
+// available for login. Controllers which don't report the issuer or client id fall back to the external auth URL
+// and --client-id
+func (o *LoginOptions) getOidcSigner(ctrlHost string) (*oidcSigner, error) {
+	signersUrl := ctrlHost + "/edge/client/v1/external-jwt-signers"
+	resp, err := o.newOidcRequest(o.CaCert).Get(signersUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list external JWT signers at %v", signersUrl)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("unable to list external JWT signers at %v. Status code: %v, Server returned: %v", signersUrl, resp.Status(), util.PrettyPrintResponse(resp))
+	}
+
+	jsonParsed, err := gabs.ParseJSON(resp.Body())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse external JWT signers from %v", signersUrl)
+	}
+
+	children, _ := jsonParsed.S("data").Children()
+	var names []string
+	for _, child := range children {
+		name, _ := child.S("name").Data().(string)
+		id, _ := child.S("id").Data().(string)
+		names = append(names, name)
+		if name != o.Oidc.Signer && id != o.Oidc.Signer {
+			continue
+		}
+
+		signer := &oidcSigner{name: name, clientId: o.Oidc.ClientId, scopes: o.Oidc.Scopes}
+		if signer.issuer, _ = child.S("issuer").Data().(string); signer.issuer == "" {
+			signer.issuer, _ = child.S("externalAuthUrl").Data().(string)
+		}
+		if clientId, _ := child.S("clientId").Data().(string); clientId != "" && signer.clientId == "" {
+			signer.clientId = clientId
+		}
+		if scopes, ok := child.S("scopes").Data().([]interface{}); ok && len(signer.scopes) == 0 {
+			for _, scope := range scopes {
+				signer.scopes = append(signer.scopes, fmt.Sprintf("%v", scope))
+			}
+		}
+
+		if signer.issuer == "" {
+			return nil, errors.Errorf("external JWT signer %v has no issuer or external auth URL", name)
+		}
+		if signer.clientId == "" {
+			return nil, errors.Errorf("external JWT signer %v has no client id, provide one with --client-id", name)
+		}
+		if len(signer.scopes) == 0 {
+			signer.scopes = []string{"openid"}
+		}
+		return signer, nil
+	}
+
+	return nil, errors.Errorf("no external JWT signer named %v found, available signers: %v", o.Oidc.Signer, strings.Join(names, ", "))
+}
+
+func (o *LoginOptions) discoverOidcProvider(issuer string) (*oidcProvider, error) {
+	discoveryUrl := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := o.newOidcRequest("").Get(discoveryUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch OIDC configuration from %v", discoveryUrl)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("unable to fetch OIDC configuration from %v. Status code: %v", discoveryUrl, resp.Status())
+	}
+
+	jsonParsed, err := gabs.ParseJSON(resp.Body())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse OIDC configuration from %v", discoveryUrl)
+	}
+
+	result := &oidcProvider{}
+	result.AuthorizationEndpoint, _ = jsonParsed.S("authorization_endpoint").Data().(string)
+	result.TokenEndpoint, _ = jsonParsed.S("token_endpoint").Data().(string)
+	result.DeviceAuthorizationEndpoint, _ = jsonParsed.S("device_authorization_endpoint").Data().(string)
+
+	if result.TokenEndpoint == "" {
+		return nil, errors.Errorf("OIDC configuration from %v has no token endpoint", discoveryUrl)
+	}
+	return result, nil
+}
+
+// runOidcAuthCodeFlow runs the authorization code flow with PKCE, receiving the code on a temporary listener on
+// localhost
+func (o *LoginOptions) runOidcAuthCodeFlow(signer *oidcSigner, provider *oidcProvider) (*gabs.Container, error) {
+	if provider.AuthorizationEndpoint == "" {
+		return nil, errors.New("OIDC provider has no authorization endpoint, try --device-code")
+	}
+
+	verifier, err := randomUrlString(32)
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomUrlString(16)
+	if err != nil {
+		return nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", o.Oidc.CallbackPort))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start listener for OIDC callback")
+	}
+	redirectUri := fmt.Sprintf("http://%v/auth/callback", listener.Addr().String())
+
+	type callbackResult struct {
+		code string
+		err  error
+	}
+	results := make(chan callbackResult, 1)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/auth/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			query := r.URL.Query()
+			result := callbackResult{code: query.Get("code")}
+			if query.Get("state") != state {
+				result.err = errors.New("OIDC callback has an invalid state")
+			} else if errCode := query.Get("error"); errCode != "" {
+				result.err = errors.Errorf("OIDC provider returned %v: %v", errCode, query.Get("error_description"))
+			} else if result.code == "" {
+				result.err = errors.New("OIDC callback has no code")
+			}
+
+			if result.err != nil {
+				http.Error(w, result.err.Error(), http.StatusBadRequest)
+			} else {
+				_, _ = fmt.Fprintln(w, "Login complete, you may close this window and return to the ziti CLI.")
+			}
+
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", signer.clientId)
+	params.Set("redirect_uri", redirectUri)
+	params.Set("scope", strings.Join(signer.scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	authUrl := provider.AuthorizationEndpoint
+	if strings.Contains(authUrl, "?") {
+		authUrl += "&" + params.Encode()
+	} else {
+		authUrl += "?" + params.Encode()
+	}
+
+	o.Printf("Open the following URL in a browser to log in with %v:\n\n  %v\n\n", signer.name, authUrl)
+	_ = openBrowser(authUrl)
+
+	timeout := time.Duration(o.Timeout) * time.Second
+	if timeout < 2*time.Minute {
+		timeout = 5 * time.Minute
+	}
+
+	var result callbackResult
+	select {
+	case result = <-results:
+	case <-time.After(timeout):
+		return nil, errors.Errorf("timed out after %v waiting for OIDC login to complete", timeout)
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return o.requestOidcToken(provider.TokenEndpoint, map[string]string{
+		"grant_type":    "authorization_code",
+		"client_id":     signer.clientId,
+		"code":          result.code,
+		"redirect_uri":  redirectUri,
+		"code_verifier": verifier,
+	})
+}
+
+// runOidcDeviceCodeFlow runs the device authorization flow, for hosts without a browser
+func (o *LoginOptions) runOidcDeviceCodeFlow(signer *oidcSigner, provider *oidcProvider) (*gabs.Container, error) {
+	if provider.DeviceAuthorizationEndpoint == "" {
+		return nil, errors.New("OIDC provider does not support the device code flow")
+	}
+
+	resp, err := o.newOidcRequest("").
+		SetFormData(map[string]string{
+			"client_id": signer.clientId,
+			"scope":     strings.Join(signer.scopes, " "),
+		}).
+		Post(provider.DeviceAuthorizationEndpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start OIDC device authorization")
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("unable to start OIDC device authorization. Status code: %v, Server returned: %v", resp.Status(), resp.String())
+	}
+
+	device, err := gabs.ParseJSON(resp.Body())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse OIDC device authorization response")
+	}
+
+	deviceCode, _ := device.S("device_code").Data().(string)
+	userCode, _ := device.S("user_code").Data().(string)
+	verificationUri, _ := device.S("verification_uri").Data().(string)
+	if complete, _ := device.S("verification_uri_complete").Data().(string); complete != "" {
+		o.Printf("To log in with %v, visit:\n\n  %v\n\nand confirm the code %v\n\n", signer.name, complete, userCode)
+	} else {
+		o.Printf("To log in with %v, visit:\n\n  %v\n\nand enter the code %v\n\n", signer.name, verificationUri, userCode)
+	}
+
+	interval := 5 * time.Second
+	if val, ok := device.S("interval").Data().(float64); ok && val > 0 {
+		interval = time.Duration(val * float64(time.Second))
+	}
+	expiresIn := 10 * time.Minute
+	if val, ok := device.S("expires_in").Data().(float64); ok && val > 0 {
+		expiresIn = time.Duration(val) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), expiresIn)
+	defer cancel()
+
+	for {
+		tokens, err := o.requestOidcToken(provider.TokenEndpoint, map[string]string{
+			"grant_type":  "urn:ietf:params:oauth:grant-type:device_code",
+			"client_id":   signer.clientId,
+			"device_code": deviceCode,
+		})
+		if err == nil {
+			return tokens, nil
+		}
+
+		var oidcErr *oidcTokenError
+		if !errors.As(err, &oidcErr) {
+			return nil, err
+		}
+		switch oidcErr.code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("OIDC device code expired before login was completed")
+		case <-time.After(interval):
+		}
+	}
+}
+
+type oidcTokenError struct {
+	code        string
+	description string
+}
+
+func (e *oidcTokenError) Error() string {
+	if e.description != "" {
+		return fmt.Sprintf("OIDC token request failed: %v: %v", e.code, e.description)
+	}
+	return fmt.Sprintf("OIDC token request failed: %v", e.code)
+}
+
+func (o *LoginOptions) requestOidcToken(tokenEndpoint string, form map[string]string) (*gabs.Container, error) {
+	resp, err := o.newOidcRequest("").SetFormData(form).Post(tokenEndpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to request token from %v", tokenEndpoint)
+	}
+
+	jsonParsed, err := gabs.ParseJSON(resp.Body())
+	if err != nil {
+		return nil, errors.Errorf("unable to parse token response from %v. Status code: %v", tokenEndpoint, resp.Status())
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		code, _ := jsonParsed.S("error").Data().(string)
+		description, _ := jsonParsed.S("error_description").Data().(string)
+		if code == "" {
+			code = resp.Status()
+		}
+		return nil, &oidcTokenError{code: code, description: description}
+	}
+
+	return jsonParsed, nil
+}
+
+// newOidcRequest creates a request trusting the given CA, if any. Requests to the OIDC provider use the system roots,
+// as the provider isn't expected to use the controller's CA. Requests are never retried, as authorization and device
+// codes may only be exchanged once, and a resent exchange would fail with invalid_grant, hiding the original error
+func (o *LoginOptions) newOidcRequest(caCert string) *resty.Request {
+	client := resty.New().SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+	if caCert != "" {
+		client.SetRootCertificate(caCert)
+	}
+	return client.
+		SetTimeout(time.Duration(o.Timeout)*time.Second).
+		SetDebug(o.Verbose).
+		R().
+		SetHeader("Accept", "application/json")
+}
+
+func randomUrlString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,170 @@
+package edge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// fakeOidcProvider serves the client API signer list as well as a minimal OIDC provider supporting the
+// authorization code flow with PKCE and the device code flow
+type fakeOidcProvider struct {
+	*httptest.Server
+	sync.Mutex
+	challenges   map[string]string
+	devicePolls  int
+	tokenRequest url.Values
+}
+
+func newFakeOidcProvider(t *testing.T) *fakeOidcProvider {
+	p := &fakeOidcProvider{challenges: map[string]string{}}
+	writeJson := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/edge/client/v1/external-jwt-signers", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"data": []interface{}{
+				map[string]interface{}{"id": "s1", "name": "other", "externalAuthUrl": "https://other.example.com"},
+				map[string]interface{}{"id": "s2", "name": "idp", "externalAuthUrl": p.URL, "clientId": "ziti-cli"},
+			},
+		})
+	})
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"authorization_endpoint":        p.URL + "/authorize",
+			"token_endpoint":                p.URL + "/token",
+			"device_authorization_endpoint": p.URL + "/device",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		require.Equal(t, "ziti-cli", query.Get("client_id"))
+		require.Equal(t, "S256", query.Get("code_challenge_method"))
+		p.Lock()
+		p.challenges["code-1"] = query.Get("code_challenge")
+		p.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=code-1&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"device_code":      "device-1",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": p.URL + "/activate",
+			"interval":         0.001,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		p.Lock()
+		defer p.Unlock()
+		p.tokenRequest = r.PostForm
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if p.challenges[r.PostForm.Get("code")] != base64.RawURLEncoding.EncodeToString(sum[:]) {
+				writeJson(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+				return
+			}
+			writeJson(w, http.StatusOK, map[string]interface{}{"access_token": "access-from-code", "id_token": "id-from-code"})
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			p.devicePolls++
+			if p.devicePolls < 2 {
+				writeJson(w, http.StatusBadRequest, map[string]interface{}{"error": "authorization_pending"})
+				return
+			}
+			writeJson(w, http.StatusOK, map[string]interface{}{"access_token": "access-from-device"})
+		}
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func newTestLoginOptions(signer string) *LoginOptions {
+	return &LoginOptions{
+		Options: api.Options{
+			CommonOptions: common.CommonOptions{Out: &bytes.Buffer{}, Err: &bytes.Buffer{}, Timeout: 5},
+		},
+		Oidc: OidcOptions{Signer: signer, TokenType: "access"},
+	}
+}
+
+func TestOidcAuthCodeLogin(t *testing.T) {
+	provider := newFakeOidcProvider(t)
+
+	defer func(f func(string) error) { openBrowser = f }(openBrowser)
+	openBrowser = func(target string) error {
+		go func() {
+			resp, err := http.Get(target)
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	o := newTestLoginOptions("idp")
+	token, err := o.getOidcToken(provider.URL)
+	require.NoError(t, err)
+	require.Equal(t, "access-from-code", token)
+
+	o.Oidc.TokenType = "id"
+	token, err = o.getOidcToken(provider.URL)
+	require.NoError(t, err)
+	require.Equal(t, "id-from-code", token)
+}
+
+func TestOidcDeviceCodeLogin(t *testing.T) {
+	provider := newFakeOidcProvider(t)
+
+	o := newTestLoginOptions("idp")
+	o.Oidc.DeviceCode = true
+	token, err := o.getOidcToken(provider.URL)
+	require.NoError(t, err)
+	require.Equal(t, "access-from-device", token)
+	require.Equal(t, 2, provider.devicePolls)
+	require.Contains(t, o.Out.(*bytes.Buffer).String(), "ABCD-EFGH")
+}
+
+func TestOidcSignerWithoutClientId(t *testing.T) {
+	provider := newFakeOidcProvider(t)
+
+	_, err := newTestLoginOptions("other").getOidcSigner(provider.URL)
+	require.ErrorContains(t, err, "--client-id")
+
+	_, err = newTestLoginOptions("missing").getOidcSigner(provider.URL)
+	require.ErrorContains(t, err, "available signers: other, idp")
+}
+
+func TestOidcTokenRequestIsNotRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	_, err := newTestLoginOptions("idp").requestOidcToken(server.URL+"/token", map[string]string{
+		"grant_type": "authorization_code",
+		"code":       "code-1",
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,45 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoginRecordAndReplay(t *testing.T) {
+	req := require.New(t)
+	server := apitest.NewServer(t)
+	config, _, err := util.LoadRestClientConfig()
+	req.NoError(err)
+	caCert := config.EdgeIdentities["default"].CaCert
+	ctrlUrl := server.URL + apitest.EdgeManagementPath
+
+	harFile := filepath.Join(t.TempDir(), "login.har")
+	output, err := apitest.Execute(NewCmdEdge, "login", ctrlUrl, "-u", apitest.Username, "-p", apitest.Password, "--ca", caCert, "--record", harFile)
+	req.NoError(err, output)
+	req.Contains(output, "Token: "+apitest.Token)
+	req.Len(server.RequestsTo(http.MethodPost, apitest.EdgeManagementPath+"/authenticate"), 1)
+
+	// the login exchange is recorded, with the password and session token redacted
+	har, err := util.LoadHar(harFile)
+	req.NoError(err)
+	req.Len(har.Log.Entries, 1)
+	req.Equal(http.MethodPost, har.Log.Entries[0].Request.Method)
+	req.Equal(ctrlUrl+"/authenticate?method=password", har.Log.Entries[0].Request.Url)
+
+	recorded, err := os.ReadFile(harFile)
+	req.NoError(err)
+	req.NotContains(string(recorded), apitest.Password)
+	req.NotContains(string(recorded), apitest.Token)
+
+	// replaying the login doesn't contact the controller
+	server.Close()
+	output, err = apitest.Execute(NewCmdEdge, "login", ctrlUrl, "-u", apitest.Username, "-p", apitest.Password, "--ca", caCert, "--replay", harFile)
+	req.NoError(err, output)
+	req.Contains(output, "Token: REDACTED")
+	req.Len(server.RequestsTo(http.MethodPost, apitest.EdgeManagementPath+"/authenticate"), 1)
+}
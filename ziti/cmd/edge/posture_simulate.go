@@ -0,0 +1,603 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"github.com/blang/semver"
+	"github.com/go-openapi/runtime"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/foundation/v2/stringz"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mfaPromptGracePeriod matches the controller: a wake or unlock only requires a new MFA code once it is this old
+const mfaPromptGracePeriod = 5 * time.Minute
+
+// newPostureCmd creates a command object for the "edge posture" command
+func newPostureCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "posture",
+		Short: "tools for working with posture checks",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdhelper.CheckErr(cmd.Help())
+		},
+	}
+
+	cmd.AddCommand(newPostureSimulateCmd(out, errOut))
+	return cmd
+}
+
+type postureSimulateOptions struct {
+	api.Options
+	identity    string
+	postureData string
+}
+
+func newPostureSimulateCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &postureSimulateOptions{
+		Options: api.Options{
+			CommonOptions: common.CommonOptions{Out: out, Err: errOut},
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "simulate --identity <identity name or id> --posture-data <file>",
+		Short: "evaluates the posture checks which apply to an identity against the given posture data",
+		Long: "Evaluates every posture check attached to the service policies of an identity against posture data read\n" +
+			"from a file (or stdin, if the file is -) and reports which checks and services would pass.\n\n" +
+			"The posture data is a JSON document. Sections which are left out are treated as not reported:\n\n" +
+			"  {\n" +
+			"    \"os\": {\"type\": \"Windows\", \"version\": \"10.0.19041\"},\n" +
+			"    \"macAddresses\": [\"00:11:22:33:44:55\"],\n" +
+			"    \"domain\": \"corp.example.com\",\n" +
+			"    \"processes\": [{\"path\": \"C:\\\\av.exe\", \"isRunning\": true, \"hash\": \"...\", \"signerFingerprints\": [\"...\"]}],\n" +
+			"    \"mfa\": {\"passedAt\": \"2023-01-01T12:00:00Z\", \"wokenAt\": \"...\", \"unlockedAt\": \"...\"}\n" +
+			"  }",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := runPostureSimulate(options)
+			cmdhelper.CheckErr(err)
+		},
+		SuggestFor: []string{},
+	}
+
+	// allow interspersing positional args and flags
+	cmd.Flags().SetInterspersed(true)
+	cmd.Flags().StringVar(&options.identity, "identity", "", "Name or id of the identity whose posture checks to evaluate")
+	cmd.Flags().StringVar(&options.postureData, "posture-data", "", "JSON file containing the posture data to evaluate, or - for stdin")
+	_ = cmd.MarkFlagRequired("identity")
+	_ = cmd.MarkFlagRequired("posture-data")
+	options.AddCommonFlags(cmd)
+
+	return cmd
+}
+
+// postureData is the device state posture checks are evaluated against. It mirrors what an SDK reports in its posture
+// responses, with the MFA state of the API session folded in
+type postureData struct {
+	Os           *postureDataOs        `json:"os"`
+	MacAddresses []string              `json:"macAddresses"`
+	Domain       *string               `json:"domain"`
+	Processes    []*postureDataProcess `json:"processes"`
+	Mfa          *postureDataMfa       `json:"mfa"`
+	processes    map[string]*postureDataProcess
+}
+
+type postureDataOs struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+}
+
+type postureDataProcess struct {
+	Path               string   `json:"path"`
+	IsRunning          bool     `json:"isRunning"`
+	Hash               string   `json:"hash"`
+	SignerFingerprints []string `json:"signerFingerprints"`
+}
+
+type postureDataMfa struct {
+	PassedAt   *time.Time `json:"passedAt"`
+	WokenAt    *time.Time `json:"wokenAt"`
+	UnlockedAt *time.Time `json:"unlockedAt"`
+}
+
+func loadPostureData(path string) (*postureData, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read posture data from %v", path)
+	}
+
+	result := &postureData{}
+	if err = json.Unmarshal(data, result); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse posture data from %v", path)
+	}
+
+	result.processes = map[string]*postureDataProcess{}
+	for _, process := range result.Processes {
+		result.processes[strings.ToLower(process.Path)] = process
+	}
+	return result, nil
+}
+
+// postureCheckResult is the outcome of evaluating a single posture check
+type postureCheckResult struct {
+	id       string
+	name     string
+	typeId   string
+	passed   bool
+	reason   string
+	policies []string
+}
+
+type postureSimulatePolicy struct {
+	id       string
+	name     string
+	typeId   string
+	services []string
+	checks   []*postureCheckResult
+}
+
+func (self *postureSimulatePolicy) failedChecks() []string {
+	var result []string
+	for _, check := range self.checks {
+		if !check.passed {
+			result = append(result, check.name)
+		}
+	}
+	return result
+}
+
+func runPostureSimulate(o *postureSimulateOptions) error {
+	pd, err := loadPostureData(o.postureData)
+	if err != nil {
+		return err
+	}
+
+	identityId, err := mapNameToID("identities", o.identity, o.Options)
+	if err != nil {
+		return err
+	}
+
+	policyEntities, err := listAllSubEntities("identities", "service-policies", identityId, o)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	checks := map[string]*postureCheckResult{}
+	serviceNames := map[string]string{}
+	var policies []*postureSimulatePolicy
+
+	for _, policyEntity := range policyEntities {
+		policy := &postureSimulatePolicy{}
+		policy.id, _ = policyEntity.S("id").Data().(string)
+		policy.name, _ = policyEntity.S("name").Data().(string)
+		policy.typeId, _ = policyEntity.S("type").Data().(string)
+
+		services, err := listAllSubEntities("service-policies", "services", policy.id, o)
+		if err != nil {
+			return err
+		}
+		for _, service := range services {
+			serviceId, _ := service.S("id").Data().(string)
+			serviceNames[serviceId], _ = service.S("name").Data().(string)
+			policy.services = append(policy.services, serviceId)
+		}
+
+		postureChecks, err := listAllSubEntities("service-policies", "posture-checks", policy.id, o)
+		if err != nil {
+			return err
+		}
+		for _, postureCheck := range postureChecks {
+			checkId, _ := postureCheck.S("id").Data().(string)
+			result, found := checks[checkId]
+			if !found {
+				result = evaluatePostureCheck(postureCheck, pd, now)
+				checks[checkId] = result
+			}
+			result.policies = append(result.policies, policy.name)
+			policy.checks = append(policy.checks, result)
+		}
+
+		policies = append(policies, policy)
+	}
+
+	identityName, err := mapIdToName("identities", identityId, o.Options)
+	if err != nil {
+		return err
+	}
+
+	if len(policies) == 0 {
+		_, err = fmt.Fprintf(o.Out, "Identity %v is not in any service policies\n", identityName)
+		return err
+	}
+
+	return outputPostureSimulation(o, identityName, checks, policies, serviceNames)
+}
+
+func outputPostureSimulation(o *postureSimulateOptions, identityName string, checks map[string]*postureCheckResult, policies []*postureSimulatePolicy, serviceNames map[string]string) error {
+	if _, err := fmt.Fprintf(o.Out, "\nPosture checks for identity %v:\n", identityName); err != nil {
+		return err
+	}
+
+	if len(checks) == 0 {
+		if _, err := fmt.Fprintln(o.Out, "No posture checks apply to this identity"); err != nil {
+			return err
+		}
+	} else {
+		var sortedChecks []*postureCheckResult
+		for _, check := range checks {
+			sortedChecks = append(sortedChecks, check)
+		}
+		sort.Slice(sortedChecks, func(i, j int) bool {
+			return sortedChecks[i].name < sortedChecks[j].name
+		})
+
+		checkTable := table.NewWriter()
+		checkTable.SetStyle(table.StyleRounded)
+		checkTable.AppendHeader(table.Row{"Name", "Type", "Result", "Reason", "Service Policies"})
+		for _, check := range sortedChecks {
+			sort.Strings(check.policies)
+			checkTable.AppendRow(table.Row{check.name, check.typeId, passOrFail(check.passed), check.reason, strings.Join(check.policies, ", ")})
+		}
+		if _, err := fmt.Fprintln(o.Out, checkTable.Render()); err != nil {
+			return err
+		}
+	}
+
+	type serviceResult struct {
+		name   string
+		access map[string][]*postureSimulatePolicy
+	}
+
+	services := map[string]*serviceResult{}
+	for _, policy := range policies {
+		for _, serviceId := range policy.services {
+			result, found := services[serviceId]
+			if !found {
+				result = &serviceResult{name: serviceNames[serviceId], access: map[string][]*postureSimulatePolicy{}}
+				services[serviceId] = result
+			}
+			result.access[policy.typeId] = append(result.access[policy.typeId], policy)
+		}
+	}
+
+	var sortedServices []*serviceResult
+	for _, service := range services {
+		sortedServices = append(sortedServices, service)
+	}
+	sort.Slice(sortedServices, func(i, j int) bool {
+		return sortedServices[i].name < sortedServices[j].name
+	})
+
+	// a service may be dialed or bound if any one of the policies granting that access has all its posture checks pass
+	evaluateAccess := func(policies []*postureSimulatePolicy) (string, string) {
+		if len(policies) == 0 {
+			return "-", ""
+		}
+		var failures []string
+		for _, policy := range policies {
+			failed := policy.failedChecks()
+			if len(failed) == 0 {
+				return passOrFail(true), "via " + policy.name
+			}
+			failures = append(failures, fmt.Sprintf("%v failed %v", policy.name, strings.Join(failed, ", ")))
+		}
+		sort.Strings(failures)
+		return passOrFail(false), strings.Join(failures, "; ")
+	}
+
+	if _, err := fmt.Fprintf(o.Out, "\nService access for identity %v:\n", identityName); err != nil {
+		return err
+	}
+
+	serviceTable := table.NewWriter()
+	serviceTable.SetStyle(table.StyleRounded)
+	serviceTable.AppendHeader(table.Row{"Service", "Dial", "Dial Reason", "Bind", "Bind Reason"})
+	for _, service := range sortedServices {
+		dial, dialReason := evaluateAccess(service.access["Dial"])
+		bind, bindReason := evaluateAccess(service.access["Bind"])
+		serviceTable.AppendRow(table.Row{service.name, dial, dialReason, bind, bindReason})
+	}
+	_, err := fmt.Fprintln(o.Out, serviceTable.Render())
+	return err
+}
+
+func passOrFail(passed bool) string {
+	if passed {
+		return "PASS"
+	}
+	return "FAIL"
+}
+
+// listAllSubEntities pages through all the entities of subType related to the given entity
+func listAllSubEntities(entityType, subType, entityId string, o *postureSimulateOptions) ([]*gabs.Container, error) {
+	var result []*gabs.Container
+	for {
+		filter := fmt.Sprintf(`true skip %v limit 100`, len(result))
+		jsonParsed, err := util.EdgeControllerListSubEntities(entityType, subType, entityId, filter, false, o.Out, o.Timeout, o.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		children, err := jsonParsed.S("data").Children()
+		if err != nil && err != gabs.ErrNotObjOrArray {
+			return nil, err
+		}
+		result = append(result, children...)
+		if len(children) == 0 {
+			return result, nil
+		}
+		if paging := api.GetPaging(jsonParsed); paging != nil && int64(len(result)) >= paging.Count {
+			return result, nil
+		}
+	}
+}
+
+// evaluatePostureCheck evaluates a posture check the same way the controller would, returning the reason it passed
+// or failed
+func evaluatePostureCheck(entity *gabs.Container, pd *postureData, now time.Time) *postureCheckResult {
+	result := &postureCheckResult{}
+	result.id, _ = entity.S("id").Data().(string)
+	result.name, _ = entity.S("name").Data().(string)
+	result.typeId, _ = entity.S("typeId").Data().(string)
+
+	detail, err := rest_model.UnmarshalPostureCheckDetail(bytes.NewBuffer(entity.EncodeJSON()), runtime.JSONConsumer())
+	if err != nil {
+		result.reason = fmt.Sprintf("unable to parse posture check: %v", err)
+		return result
+	}
+
+	switch check := detail.(type) {
+	case *rest_model.PostureCheckOperatingSystemDetail:
+		result.passed, result.reason = evaluateOsCheck(check, pd)
+	case *rest_model.PostureCheckMacAddressDetail:
+		result.passed, result.reason = evaluateMacCheck(check, pd)
+	case *rest_model.PostureCheckDomainDetail:
+		result.passed, result.reason = evaluateDomainCheck(check, pd)
+	case *rest_model.PostureCheckProcessDetail:
+		result.passed, result.reason = evaluateProcessCheck(check, pd)
+	case *rest_model.PostureCheckProcessMultiDetail:
+		result.passed, result.reason = evaluateProcessMultiCheck(check, pd)
+	case *rest_model.PostureCheckMfaDetail:
+		result.passed, result.reason = evaluateMfaCheck(check, pd, now)
+	default:
+		result.reason = fmt.Sprintf("unsupported posture check type %v", result.typeId)
+	}
+
+	return result
+}
+
+func evaluateOsCheck(check *rest_model.PostureCheckOperatingSystemDetail, pd *postureData) (bool, string) {
+	if pd.Os == nil {
+		return false, "no operating system reported"
+	}
+
+	// as on the controller, the last definition for an os type wins
+	var allowedTypes []string
+	var versions []string
+	allowed := false
+	for _, operatingSystem := range check.OperatingSystems {
+		if operatingSystem.Type == nil {
+			continue
+		}
+		allowedTypes = append(allowedTypes, string(*operatingSystem.Type))
+		if strings.EqualFold(string(*operatingSystem.Type), pd.Os.Type) {
+			allowed = true
+			versions = operatingSystem.Versions
+		}
+	}
+
+	if !allowed {
+		return false, fmt.Sprintf("os type %v is not one of %v", pd.Os.Type, strings.Join(allowedTypes, ", "))
+	}
+
+	if len(versions) == 0 {
+		return true, fmt.Sprintf("os type %v allowed with any version", pd.Os.Type)
+	}
+
+	// parsed strictly, as the controller does, so versions such as 10.0.19045.1234 fail here as they would there
+	version, err := semver.Make(pd.Os.Version)
+	if err != nil {
+		return false, fmt.Sprintf("os version %v is not a valid semantic version: %v", pd.Os.Version, err)
+	}
+
+	for _, strVersion := range versions {
+		versionRange, err := semver.ParseRange(strVersion)
+		if err != nil {
+			continue
+		}
+		if versionRange(version) {
+			return true, fmt.Sprintf("%v %v matches %v", pd.Os.Type, pd.Os.Version, strVersion)
+		}
+	}
+
+	return false, fmt.Sprintf("%v %v does not match %v", pd.Os.Type, pd.Os.Version, strings.Join(versions, " or "))
+}
+
+// normalizeMacAddress lets addresses such as AA:BB:CC:DD:EE:FF and aa-bb-cc-dd-ee-ff match, as they do on the controller
+func normalizeMacAddress(address string) string {
+	return strings.NewReplacer(":", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(address)))
+}
+
+func evaluateMacCheck(check *rest_model.PostureCheckMacAddressDetail, pd *postureData) (bool, string) {
+	if len(pd.MacAddresses) == 0 {
+		return false, "no mac addresses reported"
+	}
+
+	for _, address := range pd.MacAddresses {
+		for _, validAddress := range check.MacAddresses {
+			if normalizeMacAddress(address) == normalizeMacAddress(validAddress) {
+				return true, fmt.Sprintf("mac address %v is allowed", address)
+			}
+		}
+	}
+
+	return false, fmt.Sprintf("none of the reported mac addresses %v are allowed", strings.Join(pd.MacAddresses, ", "))
+}
+
+func evaluateDomainCheck(check *rest_model.PostureCheckDomainDetail, pd *postureData) (bool, string) {
+	if pd.Domain == nil {
+		return false, "no domain reported"
+	}
+
+	for _, domain := range check.Domains {
+		if strings.EqualFold(domain, *pd.Domain) {
+			return true, fmt.Sprintf("domain %v is allowed", *pd.Domain)
+		}
+	}
+
+	return false, fmt.Sprintf("domain '%v' is not one of %v", *pd.Domain, strings.Join(check.Domains, ", "))
+}
+
+func evaluateProcessCheck(check *rest_model.PostureCheckProcessDetail, pd *postureData) (bool, string) {
+	if check.Process == nil {
+		return false, "posture check has no process"
+	}
+
+	var signers []string
+	if check.Process.SignerFingerprint != "" {
+		signers = []string{check.Process.SignerFingerprint}
+	}
+
+	return evaluateProcess(stringz.OrEmpty(check.Process.Path), check.Process.Hashes, signers, pd)
+}
+
+func evaluateProcessMultiCheck(check *rest_model.PostureCheckProcessMultiDetail, pd *postureData) (bool, string) {
+	allOf := check.Semantic != nil && *check.Semantic == rest_model.SemanticAllOf
+
+	var failures []string
+	for _, process := range check.Processes {
+		passed, reason := evaluateProcess(stringz.OrEmpty(process.Path), process.Hashes, process.SignerFingerprints, pd)
+		if passed && !allOf {
+			return true, reason
+		}
+		if !passed {
+			if allOf {
+				return false, reason
+			}
+			failures = append(failures, reason)
+		}
+	}
+
+	if allOf {
+		return true, "all processes are running and valid"
+	}
+
+	if len(failures) == 0 {
+		return false, "posture check has no processes"
+	}
+	return false, strings.Join(failures, "; ")
+}
+
+func evaluateProcess(path string, hashes []string, signers []string, pd *postureData) (bool, string) {
+	if path == "" {
+		return false, "posture check has a process without a path"
+	}
+
+	process, found := pd.processes[strings.ToLower(path)]
+	if !found {
+		return false, fmt.Sprintf("process %v not reported", path)
+	}
+
+	if !process.IsRunning {
+		return false, fmt.Sprintf("process %v is not running", path)
+	}
+
+	if len(hashes) > 0 && !containsFold(hashes, process.Hash) {
+		return false, fmt.Sprintf("process %v has hash %v, which is not allowed", path, process.Hash)
+	}
+
+	if len(signers) > 0 {
+		signed := false
+		for _, signer := range process.SignerFingerprints {
+			if containsFold(signers, signer) {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return false, fmt.Sprintf("process %v is not signed by an allowed signer", path)
+		}
+	}
+
+	return true, fmt.Sprintf("process %v is running and valid", path)
+}
+
+func evaluateMfaCheck(check *rest_model.PostureCheckMfaDetail, pd *postureData, now time.Time) (bool, string) {
+	if pd.Mfa == nil || pd.Mfa.PassedAt == nil {
+		return false, "mfa has not been passed"
+	}
+
+	passedAt := *pd.Mfa.PassedAt
+	if check.TimeoutSeconds > 0 {
+		expiresAt := passedAt.Add(time.Duration(check.TimeoutSeconds) * time.Second)
+		if expiresAt.Before(now) {
+			return false, fmt.Sprintf("mfa passed at %v timed out after %vs", passedAt.Format(time.RFC3339), check.TimeoutSeconds)
+		}
+	}
+
+	if check.PromptOnWake && needsMfaPrompt(pd.Mfa.WokenAt, passedAt, now) {
+		return false, fmt.Sprintf("endpoint woke at %v, after mfa was passed", pd.Mfa.WokenAt.Format(time.RFC3339))
+	}
+
+	if check.PromptOnUnlock && needsMfaPrompt(pd.Mfa.UnlockedAt, passedAt, now) {
+		return false, fmt.Sprintf("endpoint was unlocked at %v, after mfa was passed", pd.Mfa.UnlockedAt.Format(time.RFC3339))
+	}
+
+	return true, fmt.Sprintf("mfa passed at %v", passedAt.Format(time.RFC3339))
+}
+
+// needsMfaPrompt returns true if the endpoint woke or was unlocked after MFA was passed and the grace period for
+// re-entering a code has expired
+func needsMfaPrompt(eventAt *time.Time, passedAt time.Time, now time.Time) bool {
+	if eventAt == nil || eventAt.Before(passedAt) {
+		return false
+	}
+	return !now.Add(-mfaPromptGracePeriod).Before(*eventAt)
+}
+
+func containsFold(values []string, val string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
+}
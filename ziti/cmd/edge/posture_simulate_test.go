@@ -0,0 +1,141 @@
+package edge
+
+import (
+	"github.com/Jeffail/gabs"
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostureSimulate(t *testing.T) {
+	server := apitest.NewServer(t)
+	seedServices(server)
+	aliceId := server.Create("identities", map[string]interface{}{"name": "alice", "type": "User"})
+
+	server.Create("posture-checks", map[string]interface{}{
+		"name":           "windows-10",
+		"typeId":         "OS",
+		"roleAttributes": []interface{}{"corp"},
+		"operatingSystems": []interface{}{
+			map[string]interface{}{"type": "Windows", "versions": []interface{}{">=10.0.19041"}},
+			map[string]interface{}{"type": "Linux", "versions": []interface{}{}},
+		},
+	})
+	server.Create("posture-checks", map[string]interface{}{
+		"name":           "corp-domain",
+		"typeId":         "DOMAIN",
+		"roleAttributes": []interface{}{"corp"},
+		"domains":        []interface{}{"corp.example.com"},
+	})
+	server.Create("posture-checks", map[string]interface{}{
+		"name":           "antivirus",
+		"typeId":         "PROCESS_MULTI",
+		"roleAttributes": []interface{}{"admin"},
+		"semantic":       "AllOf",
+		"processes": []interface{}{
+			map[string]interface{}{"path": `C:\av.exe`, "osType": "Windows", "hashes": []interface{}{"abc"}},
+		},
+	})
+	server.Create("posture-checks", map[string]interface{}{
+		"name":           "mfa",
+		"typeId":         "MFA",
+		"roleAttributes": []interface{}{"admin"},
+		"timeoutSeconds": 3600,
+	})
+
+	server.Create("service-policies", map[string]interface{}{
+		"name":              "web-dial",
+		"type":              "Dial",
+		"semantic":          "AnyOf",
+		"serviceRoles":      []interface{}{"#web"},
+		"identityRoles":     []interface{}{"@" + aliceId},
+		"postureCheckRoles": []interface{}{"#corp"},
+	})
+	server.Create("service-policies", map[string]interface{}{
+		"name":              "admin-dial",
+		"type":              "Dial",
+		"semantic":          "AnyOf",
+		"serviceRoles":      []interface{}{"#admin", "#demo"},
+		"identityRoles":     []interface{}{"@" + aliceId},
+		"postureCheckRoles": []interface{}{"#admin"},
+	})
+	server.Create("service-policies", map[string]interface{}{
+		"name":              "echo-bind",
+		"type":              "Bind",
+		"semantic":          "AnyOf",
+		"serviceRoles":      []interface{}{"@echo"},
+		"identityRoles":     []interface{}{"@" + aliceId},
+		"postureCheckRoles": []interface{}{},
+	})
+
+	passedAt := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	postureData := filepath.Join(t.TempDir(), "device.json")
+	require.NoError(t, os.WriteFile(postureData, []byte(`{
+		"os": {"type": "windows", "version": "10.0.19045"},
+		"domain": "CORP.example.com",
+		"processes": [{"path": "c:\\av.exe", "isRunning": true, "hash": "ABC"}],
+		"mfa": {"passedAt": "`+passedAt+`"}
+	}`), 0600))
+
+	output, err := apitest.Execute(NewCmdEdge, "posture", "simulate", "--identity", "alice", "--posture-data", postureData)
+	require.NoError(t, err)
+	require.Contains(t, output, "timed out after 3600s")
+	require.Contains(t, output, "via web-dial")
+	require.Contains(t, output, "admin-dial failed mfa")
+}
+
+func TestEvaluateOsCheck(t *testing.T) {
+	evaluate := func(checkJson string, pd *postureData) *postureCheckResult {
+		entity, err := gabs.ParseJSON([]byte(checkJson))
+		require.NoError(t, err)
+		return evaluatePostureCheck(entity, pd, time.Now())
+	}
+
+	pd := &postureData{Os: &postureDataOs{Type: "Windows", Version: "10.0.17763"}}
+	check := evaluate(`{"id":"1","name":"os","typeId":"OS","operatingSystems":[{"type":"Windows","versions":[">=10.0.19041"]}]}`, pd)
+	require.False(t, check.passed)
+	require.Equal(t, "Windows 10.0.17763 does not match >=10.0.19041", check.reason)
+
+	pd.Os.Type = "macOS"
+	check = evaluate(`{"id":"1","name":"os","typeId":"OS","operatingSystems":[{"type":"Windows","versions":[]}]}`, pd)
+	require.False(t, check.passed)
+	require.Equal(t, "os type macOS is not one of Windows", check.reason)
+
+	check = evaluate(`{"id":"1","name":"os","typeId":"OS","operatingSystems":[{"type":"macOS","versions":[]}]}`, pd)
+	require.True(t, check.passed)
+
+	// the controller only accepts semantic versions, so four part and partial versions fail
+	for _, version := range []string{"10.0.19045.1234", "10"} {
+		pd = &postureData{Os: &postureDataOs{Type: "Windows", Version: version}}
+		check = evaluate(`{"id":"1","name":"os","typeId":"OS","operatingSystems":[{"type":"Windows","versions":[">=10.0.19041"]}]}`, pd)
+		require.False(t, check.passed)
+		require.Contains(t, check.reason, "os version "+version+" is not a valid semantic version: ")
+	}
+}
+
+func TestEvaluateMacCheck(t *testing.T) {
+	entity, err := gabs.ParseJSON([]byte(`{"id":"1","name":"mac","typeId":"MAC","macAddresses":["AA:BB:CC:DD:EE:FF"]}`))
+	require.NoError(t, err)
+
+	check := evaluatePostureCheck(entity, &postureData{MacAddresses: []string{"11-22-33-44-55-66", "aa-bb-cc-dd-ee-ff"}}, time.Now())
+	require.True(t, check.passed, check.reason)
+
+	check = evaluatePostureCheck(entity, &postureData{MacAddresses: []string{"aa:bb:cc:dd:ee:00"}}, time.Now())
+	require.False(t, check.passed)
+}
+
+func TestNeedsMfaPrompt(t *testing.T) {
+	now := time.Now()
+	passedAt := now.Add(-time.Hour)
+
+	require.False(t, needsMfaPrompt(nil, passedAt, now))
+	wokenAt := passedAt.Add(-time.Minute)
+	require.False(t, needsMfaPrompt(&wokenAt, passedAt, now))
+	wokenAt = now.Add(-time.Minute)
+	require.False(t, needsMfaPrompt(&wokenAt, passedAt, now))
+	wokenAt = now.Add(-10 * time.Minute)
+	require.True(t, needsMfaPrompt(&wokenAt, passedAt, now))
+}
@@ -0,0 +1,370 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"github.com/fatih/color"
+	nfpem "github.com/openziti/foundation/v2/pem"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type reEnrollIdentityOptions struct {
+	api.Options
+	where          string
+	expiringWithin time.Duration
+	method         string
+	ca             string
+	username       string
+	duration       int64
+	jwtOutputDir   string
+	dryRun         bool
+}
+
+func newReEnrollIdentityCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &reEnrollIdentityOptions{
+		Options: api.Options{
+			CommonOptions: common.CommonOptions{Out: out, Err: errOut},
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "identity <idOrName>... [--where <filter>] [--expiring-within <duration>]",
+		Aliases: []string{"identities"},
+		Short:   "re-enrolls identities managed by the Ziti Edge Controller",
+		Long: "Re-enrolls identities by replacing any pending enrollment for the method with a new one and then deleting their " +
+			"certificate authenticators. " +
+			"Identities can be given by id or name, selected with a filter using --where, or selected by the expiry of " +
+			"their authenticator certificates using --expiring-within. When more than one selector is given, only " +
+			"identities matching all of them are re-enrolled. The enrollment JWTs are written to --jwt-output-dir, " +
+			"one file per identity, or to stdout",
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := runReEnrollIdentity(options)
+			cmdhelper.CheckErr(err)
+		},
+		SuggestFor: []string{},
+	}
+
+	// allow interspersing positional args and flags
+	cmd.Flags().SetInterspersed(true)
+	cmd.Flags().StringVar(&options.where, "where", "", "Re-enroll the identities matching the given filter")
+	cmd.Flags().DurationVar(&options.expiringWithin, "expiring-within", 0, "Re-enroll the identities with an authenticator certificate expiring within the given duration, such as 720h")
+	cmd.Flags().StringVarP(&options.method, "method", "m", "ott", "The enrollment method to use: ott, ottca or updb")
+	cmd.Flags().StringVar(&options.ca, "ca", "", "The id or name of the CA to use for ottca enrollments")
+	cmd.Flags().StringVar(&options.username, "username", "", "The username to use for updb enrollments. Defaults to the identity name")
+	cmd.Flags().Int64VarP(&options.duration, "duration", "d", 30, "the duration of time, in minutes, the enrollment should valid for")
+	cmd.Flags().StringVar(&options.jwtOutputDir, "jwt-output-dir", "", "Directory to write an <identity name>.jwt file to for each re-enrolled identity")
+	cmd.Flags().BoolVar(&options.dryRun, "dry-run", false, "List the identities which would be re-enrolled, without changing them")
+	options.AddCommonFlags(cmd)
+
+	return cmd
+}
+
+func runReEnrollIdentity(o *reEnrollIdentityOptions) error {
+	o.method = strings.ToLower(o.method)
+	if o.method != "ott" && o.method != "ottca" && o.method != "updb" {
+		return errors.Errorf("invalid enrollment method %v, expected ott, ottca or updb", o.method)
+	}
+
+	var caId string
+	if o.method == "ottca" {
+		if o.ca == "" {
+			return errors.New("--ca is required for ottca enrollments")
+		}
+		var err error
+		if caId, err = mapCaNameToID(o.ca, o.Options); err != nil {
+			return err
+		}
+	}
+
+	if len(o.Args) == 0 && o.where == "" && o.expiringWithin == 0 {
+		return errors.New("no identities selected, provide identity ids or names, --where or --expiring-within")
+	}
+
+	identities, err := o.selectIdentities()
+	if err != nil {
+		return err
+	}
+
+	if len(identities) == 0 {
+		o.Println("no identities selected for re-enrollment")
+		return nil
+	}
+
+	if o.jwtOutputDir != "" && !o.dryRun {
+		if err = os.MkdirAll(o.jwtOutputDir, 0700); err != nil {
+			return errors.Wrapf(err, "unable to create jwt output directory %v", o.jwtOutputDir)
+		}
+	}
+
+	for _, identity := range identities {
+		if o.dryRun {
+			o.Printf("would re-enroll identity %v (%v)\n", identity.name, identity.id)
+			continue
+		}
+
+		jwt, err := o.reEnroll(identity, caId)
+		if err != nil {
+			o.Printf("re-enroll identity %v: %v\n", identity.name, color.New(color.FgRed, color.Bold).Sprint("FAIL"))
+			return err
+		}
+
+		if o.jwtOutputDir != "" {
+			jwtFile := filepath.Join(o.jwtOutputDir, identity.jwtFileName())
+			if err = os.WriteFile(jwtFile, []byte(jwt), 0600); err != nil {
+				return errors.Wrapf(err, "unable to write jwt for identity %v to %v", identity.name, jwtFile)
+			}
+			o.Printf("re-enroll identity %v: %v, jwt written to %v\n", identity.name, color.New(color.FgGreen, color.Bold).Sprint("OK"), jwtFile)
+		} else {
+			o.Printf("re-enroll identity %v: %v\n%v\n", identity.name, color.New(color.FgGreen, color.Bold).Sprint("OK"), jwt)
+		}
+	}
+
+	return nil
+}
+
+type reEnrollIdentity struct {
+	id   string
+	name string
+}
+
+// jwtFileName returns the file name to write the identity's enrollment JWT to. Identity names may contain characters
+// which aren't valid in file names, or path separators, so anything other than letters, digits, '.', '-' and '_' is
+// replaced. Names which don't leave a usable file name fall back to the identity id
+func (self *reEnrollIdentity) jwtFileName() string {
+	name := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			return r
+		}
+		return '_'
+	}, self.name)
+
+	if strings.Trim(name, "._") == "" {
+		name = self.id
+	}
+	return name + ".jwt"
+}
+
+// selectIdentities returns the identities matching all the given selectors, sorted by name
+func (o *reEnrollIdentityOptions) selectIdentities() ([]*reEnrollIdentity, error) {
+	var selected map[string]*reEnrollIdentity
+
+	intersect := func(matches map[string]*reEnrollIdentity) {
+		if selected == nil {
+			selected = matches
+			return
+		}
+		for id := range selected {
+			if _, found := matches[id]; !found {
+				delete(selected, id)
+			}
+		}
+	}
+
+	if len(o.Args) > 0 {
+		entityIds, err := api.GetEntityIds(util.EdgeAPI, "identities", &o.Options, o.Args...)
+		if err != nil {
+			return nil, err
+		}
+		matches := map[string]*reEnrollIdentity{}
+		for _, val := range o.Args {
+			id, err := mapNameToID("identities", val, o.Options)
+			if err != nil {
+				return nil, err
+			}
+			name, _ := entityIds.NameForId(id)
+			matches[id] = &reEnrollIdentity{id: id, name: name}
+		}
+		intersect(matches)
+	}
+
+	if o.where != "" {
+		matches := map[string]*reEnrollIdentity{}
+		err := o.forEachEntity("identities", o.where, func(entity *gabs.Container) {
+			id, _ := entity.S("id").Data().(string)
+			name, _ := entity.S("name").Data().(string)
+			matches[id] = &reEnrollIdentity{id: id, name: name}
+		})
+		if err != nil {
+			return nil, err
+		}
+		intersect(matches)
+	}
+
+	if o.expiringWithin != 0 {
+		matches, err := o.getIdentitiesWithExpiringCerts()
+		if err != nil {
+			return nil, err
+		}
+		intersect(matches)
+	}
+
+	var result []*reEnrollIdentity
+	for _, identity := range selected {
+		result = append(result, identity)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result, nil
+}
+
+// getIdentitiesWithExpiringCerts finds the identities with a cert authenticator whose certificate expires before the
+// cutoff given by --expiring-within
+func (o *reEnrollIdentityOptions) getIdentitiesWithExpiringCerts() (map[string]*reEnrollIdentity, error) {
+	cutoff := time.Now().Add(o.expiringWithin)
+	result := map[string]*reEnrollIdentity{}
+
+	err := o.forEachEntity("authenticators", `method = "cert"`, func(entity *gabs.Container) {
+		certPem, _ := entity.S("certPem").Data().(string)
+		certs := nfpem.PemStringToCertificates(certPem)
+		if len(certs) == 0 || certs[0].NotAfter.After(cutoff) {
+			return
+		}
+
+		identityId, _ := entity.S("identityId").Data().(string)
+		identityName, _ := entity.S("identity", "name").Data().(string)
+		if _, found := result[identityId]; !found {
+			o.Printf("identity %v has a certificate expiring at %v\n", identityName, certs[0].NotAfter.UTC().Format(time.RFC3339))
+		}
+		result[identityId] = &reEnrollIdentity{id: identityId, name: identityName}
+	})
+
+	return result, err
+}
+
+// reEnroll creates a new enrollment for the identity, returning its JWT. The controller only allows one enrollment per
+// method, so any pending enrollment for the method is deleted first. The identity's authenticators are only removed
+// once the new enrollment exists, so an identity is never left without a way to authenticate if creating it fails
+func (o *reEnrollIdentityOptions) reEnroll(identity *reEnrollIdentity, caId string) (string, error) {
+	identityFilter := fmt.Sprintf(`identity = "%v"`, identity.id)
+
+	authenticatorFilter := identityFilter + ` and method = "cert"`
+	if o.method == "updb" {
+		authenticatorFilter = identityFilter + ` and (method = "cert" or method = "updb")`
+	}
+
+	authenticatorIds, err := o.listIds("authenticators", authenticatorFilter)
+	if err != nil {
+		return "", err
+	}
+
+	enrollmentIds, err := o.listIds("enrollments", fmt.Sprintf(`%v and method = "%v"`, identityFilter, o.method))
+	if err != nil {
+		return "", err
+	}
+
+	if err = o.deleteAll("enrollments", enrollmentIds); err != nil {
+		return "", err
+	}
+
+	enrollment := gabs.New()
+	api.SetJSONValue(enrollment, identity.id, "identityId")
+	api.SetJSONValue(enrollment, o.method, "method")
+	api.SetJSONValue(enrollment, time.Now().Add(time.Duration(o.duration)*time.Minute).UTC().Format(time.RFC3339), "expiresAt")
+	if o.method == "ottca" {
+		api.SetJSONValue(enrollment, caId, "caId")
+	}
+	if o.method == "updb" {
+		username := o.username
+		if username == "" {
+			username = identity.name
+		}
+		api.SetJSONValue(enrollment, username, "username")
+	}
+
+	result, err := CreateEntityOfType("enrollments", enrollment.String(), &o.Options)
+	if err != nil {
+		return "", err
+	}
+
+	enrollmentId, _ := result.S("data", "id").Data().(string)
+	detail, err := DetailEntityOfType("enrollments", enrollmentId, o.OutputJSONResponse, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
+		return "", err
+	}
+
+	jwt, _ := detail.S("jwt").Data().(string)
+	if jwt == "" {
+		return "", errors.Errorf("enrollment JWT not present for enrollment %v of identity %v", enrollmentId, identity.name)
+	}
+
+	if err = o.deleteAll("authenticators", authenticatorIds); err != nil {
+		return "", err
+	}
+	return jwt, nil
+}
+
+func (o *reEnrollIdentityOptions) listIds(entityType, filter string) ([]string, error) {
+	var ids []string
+	err := o.forEachEntity(entityType, filter, func(entity *gabs.Container) {
+		id, _ := entity.S("id").Data().(string)
+		ids = append(ids, id)
+	})
+	return ids, err
+}
+
+func (o *reEnrollIdentityOptions) deleteAll(entityType string, ids []string) error {
+	for _, id := range ids {
+		if err := deleteEntityOfType(entityType, id, &o.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachEntity pages through the entities of the given type matching the filter
+func (o *reEnrollIdentityOptions) forEachEntity(entityType, filter string, f func(entity *gabs.Container)) error {
+	offset := 0
+	for {
+		params := url.Values{}
+		params.Add("filter", filter)
+		params.Add("limit", "500")
+		params.Add("offset", fmt.Sprintf("%v", offset))
+
+		children, paging, err := api.ListEntitiesOfType(util.EdgeAPI, entityType, params, false, o.Out, o.Timeout, o.Verbose)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			f(child)
+		}
+
+		offset += len(children)
+		if len(children) == 0 || paging == nil || int64(offset) >= paging.Count {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package edge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCertPem(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestReEnrollIdentity(t *testing.T) {
+	server := apitest.NewServer(t)
+	aliceId := server.Create("identities", map[string]interface{}{"name": "alice", "type": "Device", "roleAttributes": []interface{}{"devices"}})
+	bobId := server.Create("identities", map[string]interface{}{"name": "bob", "type": "Device", "roleAttributes": []interface{}{"devices"}})
+	server.Create("identities", map[string]interface{}{"name": "carol", "type": "User"})
+
+	server.Create("authenticators", map[string]interface{}{"method": "cert", "identityId": aliceId, "certPem": newTestCertPem(t, time.Now().Add(24*time.Hour))})
+	server.Create("authenticators", map[string]interface{}{"method": "cert", "identityId": bobId, "certPem": newTestCertPem(t, time.Now().Add(365*24*time.Hour))})
+	pendingId := server.Create("enrollments", map[string]interface{}{"method": "ott", "identityId": aliceId, "expiresAt": apitest.Timestamp})
+
+	output, err := apitest.Execute(NewCmdEdge, "re-enroll", "identity", "--expiring-within", "720h", "--dry-run")
+	require.NoError(t, err)
+	require.Contains(t, output, "would re-enroll identity alice")
+	require.NotContains(t, output, "bob")
+	require.Len(t, server.List("authenticators"), 2)
+	require.Len(t, server.List("enrollments"), 1)
+
+	jwtDir := t.TempDir()
+	_, err = apitest.Execute(NewCmdEdge, "re-enroll", "identity", "--expiring-within", "720h", "--jwt-output-dir", jwtDir)
+	require.NoError(t, err)
+
+	authenticators := server.List("authenticators")
+	require.Len(t, authenticators, 1)
+	require.Equal(t, bobId, authenticators[0]["identityId"])
+
+	enrollments := server.List("enrollments")
+	require.Len(t, enrollments, 1)
+	require.NotEqual(t, pendingId, enrollments[0]["id"])
+	require.Equal(t, aliceId, enrollments[0]["identityId"])
+	require.Equal(t, "ott", enrollments[0]["method"])
+
+	jwt, err := os.ReadFile(filepath.Join(jwtDir, "alice.jwt"))
+	require.NoError(t, err)
+	require.Equal(t, enrollments[0]["jwt"], string(jwt))
+
+	// the controller allows one enrollment per method, so the pending one is deleted before the new one is created,
+	// while the old authenticator is only deleted once the new enrollment exists
+	var calls []string
+	for _, r := range server.Requests() {
+		if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+			calls = append(calls, r.Method+" "+strings.TrimPrefix(r.Path, apitest.EdgeManagementPath))
+		}
+	}
+	require.Len(t, calls, 3)
+	require.Equal(t, "DELETE /enrollments/"+pendingId, calls[0])
+	require.Equal(t, "POST /enrollments", calls[1])
+	require.True(t, strings.HasPrefix(calls[2], "DELETE /authenticators/"), calls[2])
+
+	output, err = apitest.Execute(NewCmdEdge, "re-enroll", "identity", "bob", "carol", "--where", `anyOf(roleAttributes) = "devices"`, "--method", "updb")
+	require.NoError(t, err)
+	require.Contains(t, output, "re-enroll identity bob: ")
+	require.NotContains(t, output, "carol")
+	require.Empty(t, server.List("authenticators"))
+
+	enrollments = server.List("enrollments")
+	require.Len(t, enrollments, 2)
+	require.Equal(t, "bob", enrollments[1]["username"])
+	require.Contains(t, output, enrollments[1]["jwt"])
+}
+
+func TestReEnrollJwtFileName(t *testing.T) {
+	require.Equal(t, "alice.jwt", (&reEnrollIdentity{id: "a1", name: "alice"}).jwtFileName())
+	require.Equal(t, "_etc_passwd.jwt", (&reEnrollIdentity{id: "a1", name: "/etc/passwd"}).jwtFileName())
+	require.Equal(t, ".._team_bob_1_.jwt", (&reEnrollIdentity{id: "a1", name: `../team\bob 1?`}).jwtFileName())
+	require.Equal(t, "a1.jwt", (&reEnrollIdentity{id: "a1", name: ".."}).jwtFileName())
+}
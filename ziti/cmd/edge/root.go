@@ -17,6 +17,7 @@
 package edge
 
 import (
+	"github.com/openziti/ziti/ziti/cmd/api"
 	"github.com/openziti/ziti/ziti/cmd/common"
 	"github.com/openziti/ziti/ziti/util"
 	"io"
@@ -44,15 +45,18 @@ func populateEdgeCommands(out io.Writer, errOut io.Writer, cmd *cobra.Command) *
 	cmd.AddCommand(newUpdateCmd(out, errOut))
 	cmd.AddCommand(newVersionCmd(out, errOut))
 	cmd.AddCommand(newPolicyAdivsorCmd(out, errOut))
+	cmd.AddCommand(newPostureCmd(out, errOut))
 	cmd.AddCommand(newVerifyCmd(out, errOut))
 	cmd.AddCommand(newDbCmd(out, errOut))
 	cmd.AddCommand(newTraceCmd(out, errOut))
 	cmd.AddCommand(newTraceRouteCmd(out, errOut))
 	cmd.AddCommand(newShowCmd(out, errOut))
 	cmd.AddCommand(newReEnrollCmd(out, errOut))
+	cmd.AddCommand(newSyncCmd(out, errOut))
 
 	p := common.NewOptionsProvider(out, errOut)
 	cmd.AddCommand(enrollment.NewEnrollCommand(p))
+	cmd.AddCommand(api.NewRawRequestCmd(util.EdgeAPI, p))
 	for _, cmdF := range ExtraEdgeCommands {
 		cmd.AddCommand(cmdF(p))
 	}
@@ -0,0 +1,666 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"encoding/json"
+	"github.com/Jeffail/gabs"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/openziti/storage/boltz"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/resty.v1"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	syncConflictSkip      = "skip"
+	syncConflictOverwrite = "overwrite"
+	syncConflictFail      = "fail"
+
+	syncPageSize = 500
+)
+
+// syncEntityType describes how entities of a given type are copied between controllers and which of their
+// fields reference other entities, so those references can be remapped by name
+type syncEntityType struct {
+	entityType string
+	idRefs     map[string]string
+	idListRefs map[string]string
+	roleRefs   map[string]string
+	omit       []string
+}
+
+// syncEntityTypes are listed in dependency order, so that entities created earlier in a sync can be referenced
+// by entities created later in the same sync
+var syncEntityTypes = []*syncEntityType{
+	{
+		entityType: "config-types",
+	},
+	{
+		entityType: "configs",
+		idRefs:     map[string]string{"configTypeId": "config-types"},
+		omit:       []string{"configType"},
+	},
+	{
+		entityType: "services",
+		idListRefs: map[string]string{"configs": "configs"},
+		omit:       []string{"config", "permissions", "postureQueries"},
+	},
+	{
+		entityType: "posture-checks",
+		omit:       []string{"version"},
+	},
+	{
+		entityType: "service-policies",
+		roleRefs: map[string]string{
+			"identityRoles":     "identities",
+			"serviceRoles":      "services",
+			"postureCheckRoles": "posture-checks",
+		},
+	},
+	{
+		entityType: "edge-router-policies",
+		roleRefs: map[string]string{
+			"identityRoles":   "identities",
+			"edgeRouterRoles": "edge-routers",
+		},
+		omit: []string{"isSystem"},
+	},
+	{
+		entityType: "service-edge-router-policies",
+		roleRefs: map[string]string{
+			"serviceRoles":    "services",
+			"edgeRouterRoles": "edge-routers",
+		},
+	},
+}
+
+type syncOptions struct {
+	api.Options
+	from        string
+	to          string
+	entityTypes []string
+	onConflict  string
+	dryRun      bool
+}
+
+// newSyncCmd creates the 'edge sync' command
+func newSyncCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &syncOptions{
+		Options: api.Options{
+			CommonOptions: common.CommonOptions{Out: out, Err: errOut},
+		},
+	}
+
+	var typeNames []string
+	for _, t := range syncEntityTypes {
+		typeNames = append(typeNames, t.entityType)
+	}
+
+	cmd := &cobra.Command{
+		Use:   "sync --from <login> --to <login> <filter>?",
+		Short: "copies configs, config types, services, policies and posture checks from one controller to another",
+		Long: "copies configs, config types, services, policies and posture checks from the controller of one saved login to the controller of another.\n" +
+			"Entities are matched by name and references between entities are remapped to the ids used by the target controller.\n" +
+			"Identities and edge routers are not copied, but must exist on the target if they are referenced by policies.\n" +
+			"If a filter is given, only entities matching the filter are copied.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := options.Run()
+			cmdhelper.CheckErr(err)
+		},
+		SuggestFor: []string{},
+	}
+
+	// allow interspersing positional args and flags
+	cmd.Flags().SetInterspersed(true)
+	cmd.Flags().StringVar(&options.from, "from", "", "Saved login of the controller to copy entities from")
+	cmd.Flags().StringVar(&options.to, "to", "", "Saved login of the controller to copy entities to")
+	cmd.Flags().StringSliceVar(&options.entityTypes, "type", typeNames, "Entity types to copy")
+	cmd.Flags().StringVar(&options.onConflict, "on-conflict", syncConflictSkip, "What to do when an entity with the same name but different content exists on the target. Valid values: skip, overwrite, fail")
+	cmd.Flags().BoolVar(&options.dryRun, "dry-run", false, "Report what would be changed without changing the target controller")
+	cmd.Flags().BoolVar(&options.OutputCSV, "csv", false, "Output the report as CSV instead of a formatted table")
+	options.AddCommonFlags(cmd)
+
+	return cmd
+}
+
+// Run implements the 'edge sync' command
+func (o *syncOptions) Run() error {
+	if o.from == "" || o.to == "" {
+		return errors.New("both --from and --to must be provided")
+	}
+
+	if o.from == o.to {
+		return errors.Errorf("--from and --to both refer to login '%v'", o.from)
+	}
+
+	if o.onConflict != syncConflictSkip && o.onConflict != syncConflictOverwrite && o.onConflict != syncConflictFail {
+		return errors.Errorf("invalid --on-conflict value '%v'. Valid values: skip, overwrite, fail", o.onConflict)
+	}
+
+	entityTypes, err := o.getEntityTypes()
+	if err != nil {
+		return err
+	}
+
+	source, err := newSyncEndpoint(o.from, o)
+	if err != nil {
+		return err
+	}
+
+	target, err := newSyncEndpoint(o.to, o)
+	if err != nil {
+		return err
+	}
+
+	if !o.dryRun && target.identity.IsReadOnly() {
+		return errors.Errorf("login '%v' is marked read-only, unable to sync to it", o.to)
+	}
+
+	filter := ""
+	if len(o.Args) > 0 {
+		filter = o.Args[0]
+	}
+
+	report := &syncReport{}
+	for _, entityType := range entityTypes {
+		if err = entityType.sync(source, target, filter, o, report); err != nil {
+			break
+		}
+	}
+
+	report.output(o)
+
+	if err != nil {
+		return err
+	}
+
+	if report.errors > 0 {
+		return errors.Errorf("%v entities could not be synced", report.errors)
+	}
+	return nil
+}
+
+func (o *syncOptions) getEntityTypes() ([]*syncEntityType, error) {
+	requested := map[string]bool{}
+	for _, name := range o.entityTypes {
+		requested[name] = true
+	}
+
+	var result []*syncEntityType
+	for _, entityType := range syncEntityTypes {
+		if requested[entityType.entityType] {
+			result = append(result, entityType)
+			delete(requested, entityType.entityType)
+		}
+	}
+
+	for name := range requested {
+		return nil, errors.Errorf("unsupported entity type '%v'", name)
+	}
+
+	return result, nil
+}
+
+func (self *syncEntityType) sync(source, target *syncEndpoint, filter string, o *syncOptions, report *syncReport) error {
+	entities, err := source.list(self.entityType, filter)
+	if err != nil {
+		return err
+	}
+
+	singular := boltz.GetSingularEntityType(self.entityType)
+
+	for _, entity := range entities {
+		wrapper := api.Wrap(entity)
+		name := wrapper.String("name")
+
+		if wrapper.Bool("isSystem") {
+			continue
+		}
+
+		body, err := self.newTargetBody(entity, source, target)
+		if err != nil {
+			report.add(self.entityType, name, "error", err.Error())
+			continue
+		}
+
+		existing, err := target.getByName(self.entityType, name)
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			if o.dryRun {
+				target.register(self.entityType, name, "dry-run:"+name)
+				report.add(self.entityType, name, "create", "")
+				continue
+			}
+
+			id, err := target.create(self.entityType, body)
+			if err != nil {
+				report.add(self.entityType, name, "error", err.Error())
+				continue
+			}
+			target.register(self.entityType, name, id)
+			report.add(self.entityType, name, "create", "new id: "+id)
+			continue
+		}
+
+		if isSyncBodyUnchanged(body, existing) {
+			report.add(self.entityType, name, "unchanged", "")
+			continue
+		}
+
+		targetId := api.Wrap(existing).String("id")
+
+		switch o.onConflict {
+		case syncConflictSkip:
+			report.add(self.entityType, name, "skip", "differs from "+target.name)
+		case syncConflictFail:
+			report.add(self.entityType, name, "conflict", "differs from "+target.name)
+			return errors.Errorf("%v '%v' differs between '%v' and '%v', aborting sync", singular, name, source.name, target.name)
+		case syncConflictOverwrite:
+			if o.dryRun {
+				report.add(self.entityType, name, "update", "id: "+targetId)
+				continue
+			}
+			if err = target.update(self.entityType, targetId, body); err != nil {
+				report.add(self.entityType, name, "error", err.Error())
+				continue
+			}
+			report.add(self.entityType, name, "update", "id: "+targetId)
+		}
+	}
+
+	return nil
+}
+
+// newTargetBody copies the writable fields of the given source entity and remaps any references to other entities
+// to the ids of the entities with the same names on the target
+func (self *syncEntityType) newTargetBody(entity *gabs.Container, source, target *syncEndpoint) (*gabs.Container, error) {
+	fields, ok := entity.Data().(map[string]interface{})
+	if !ok {
+		return nil, errors.New("entity is not a JSON object")
+	}
+
+	omit := map[string]bool{"id": true, "createdAt": true, "updatedAt": true, "_links": true}
+	for _, field := range self.omit {
+		omit[field] = true
+	}
+
+	bodyFields := map[string]interface{}{}
+	for k, v := range fields {
+		if !omit[k] && !strings.HasSuffix(k, "Display") {
+			bodyFields[k] = v
+		}
+	}
+	body, err := gabs.Consume(bodyFields)
+	if err != nil {
+		return nil, err
+	}
+
+	for field, refType := range self.idRefs {
+		sourceId := api.Wrap(entity).String(field)
+		if sourceId == "" {
+			continue
+		}
+		targetId, err := remapSyncId(refType, sourceId, source, target)
+		if err != nil {
+			return nil, err
+		}
+		api.SetJSONValue(body, targetId, field)
+	}
+
+	for field, refType := range self.idListRefs {
+		if !body.Exists(field) {
+			continue
+		}
+		targetIds := []string{}
+		for _, sourceId := range api.Wrap(entity).StringSlice(field) {
+			targetId, err := remapSyncId(refType, sourceId, source, target)
+			if err != nil {
+				return nil, err
+			}
+			targetIds = append(targetIds, targetId)
+		}
+		api.SetJSONValue(body, targetIds, field)
+	}
+
+	for field, refType := range self.roleRefs {
+		if !body.Exists(field) || body.S(field).Data() == nil {
+			continue
+		}
+		roles, err := remapSyncRoles(entity, field, refType, source, target)
+		if err != nil {
+			return nil, err
+		}
+		api.SetJSONValue(body, roles, field)
+	}
+
+	return body, nil
+}
+
+func remapSyncId(entityType, sourceId string, source, target *syncEndpoint) (string, error) {
+	name, found, err := source.lookupName(entityType, sourceId)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.Errorf("%v with id %v not found on '%v'", boltz.GetSingularEntityType(entityType), sourceId, source.name)
+	}
+	return remapSyncName(entityType, name, target)
+}
+
+func remapSyncName(entityType, name string, target *syncEndpoint) (string, error) {
+	targetId, found, err := target.lookupId(entityType, name)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.Errorf("referenced %v '%v' does not exist on '%v'", boltz.GetSingularEntityType(entityType), name, target.name)
+	}
+	return targetId, nil
+}
+
+// remapSyncRoles maps @id roles to the ids of the same named entities on the target. Attribute roles are copied as is
+func remapSyncRoles(entity *gabs.Container, field, entityType string, source, target *syncEndpoint) ([]string, error) {
+	displayNames := map[string]string{}
+	if children, err := entity.Path(field + "Display").Children(); err == nil {
+		for _, child := range children {
+			// the display names of @id roles are @name
+			wrapper := api.Wrap(child)
+			displayNames[wrapper.String("role")] = strings.TrimPrefix(wrapper.String("name"), "@")
+		}
+	}
+
+	result := []string{}
+	for _, role := range api.Wrap(entity).StringSlice(field) {
+		if !strings.HasPrefix(role, "@") {
+			result = append(result, role)
+			continue
+		}
+
+		var targetId string
+		var err error
+		if name, found := displayNames[role]; found {
+			targetId, err = remapSyncName(entityType, name, target)
+		} else {
+			targetId, err = remapSyncId(entityType, strings.TrimPrefix(role, "@"), source, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, "@"+targetId)
+	}
+	return result, nil
+}
+
+// isSyncBodyUnchanged returns true if every field to be written already has the same value on the target entity
+func isSyncBodyUnchanged(body, existing *gabs.Container) bool {
+	fields, err := body.ChildrenMap()
+	if err != nil {
+		return false
+	}
+
+	for k, v := range fields {
+		if !reflect.DeepEqual(normalizeSyncValue(v.Data()), normalizeSyncValue(existing.S(k).Data())) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeSyncValue(val interface{}) interface{} {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	var result interface{}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return val
+	}
+	return result
+}
+
+type syncIndex struct {
+	byName   map[string]*gabs.Container
+	nameById map[string]string
+}
+
+// syncEndpoint is one side of a sync, backed by a saved login rather than the currently selected one
+type syncEndpoint struct {
+	name     string
+	identity util.RestClientIdentity
+	baseUrl  string
+	options  *syncOptions
+	indexes  map[string]*syncIndex
+}
+
+func newSyncEndpoint(name string, o *syncOptions) (*syncEndpoint, error) {
+	identity, err := util.LoadEdgeIdentity(name)
+	if err != nil {
+		return nil, err
+	}
+
+	baseUrl, err := identity.GetBaseUrlForApi(util.EdgeAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncEndpoint{
+		name:     name,
+		identity: identity,
+		baseUrl:  baseUrl,
+		options:  o,
+		indexes:  map[string]*syncIndex{},
+	}, nil
+}
+
+func (self *syncEndpoint) newRequest() (*resty.Request, error) {
+	return util.NewRequest(self.identity, self.options.Timeout, self.options.Verbose)
+}
+
+// list returns all entities of the given type matching the filter, following pagination
+func (self *syncEndpoint) list(entityType, filter string) ([]*gabs.Container, error) {
+	var result []*gabs.Container
+	offset := 0
+	for {
+		params := url.Values{}
+		if filter != "" {
+			params.Set("filter", filter)
+		}
+		params.Set("limit", strconv.Itoa(syncPageSize))
+		params.Set("offset", strconv.Itoa(offset))
+
+		req, err := self.newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		queryUrl := self.baseUrl + "/" + entityType + "?" + params.Encode()
+		resp, err := req.Get(queryUrl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list %v on '%v'", entityType, self.name)
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return nil, errors.Errorf("error listing %v on '%v'. Status code: %v, Server returned: %v",
+				entityType, self.name, resp.Status(), util.PrettyPrintResponse(resp))
+		}
+
+		jsonParsed, err := gabs.ParseJSON(resp.Body())
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse response from %v", queryUrl)
+		}
+
+		children, err := jsonParsed.S("data").Children()
+		if err != nil && err != gabs.ErrNotObjOrArray {
+			return nil, err
+		}
+		result = append(result, children...)
+
+		paging := api.GetPaging(jsonParsed)
+		if paging.HasError() {
+			return nil, paging.Err
+		}
+
+		offset += len(children)
+		if len(children) == 0 || int64(offset) >= paging.Count {
+			return result, nil
+		}
+	}
+}
+
+func (self *syncEndpoint) index(entityType string) (*syncIndex, error) {
+	if index, found := self.indexes[entityType]; found {
+		return index, nil
+	}
+
+	entities, err := self.list(entityType, "")
+	if err != nil {
+		return nil, err
+	}
+
+	index := &syncIndex{
+		byName:   map[string]*gabs.Container{},
+		nameById: map[string]string{},
+	}
+	for _, entity := range entities {
+		wrapper := api.Wrap(entity)
+		index.byName[wrapper.String("name")] = entity
+		index.nameById[wrapper.String("id")] = wrapper.String("name")
+	}
+	self.indexes[entityType] = index
+	return index, nil
+}
+
+func (self *syncEndpoint) getByName(entityType, name string) (*gabs.Container, error) {
+	index, err := self.index(entityType)
+	if err != nil {
+		return nil, err
+	}
+	return index.byName[name], nil
+}
+
+func (self *syncEndpoint) lookupId(entityType, name string) (string, bool, error) {
+	entity, err := self.getByName(entityType, name)
+	if err != nil || entity == nil {
+		return "", false, err
+	}
+	return api.Wrap(entity).String("id"), true, nil
+}
+
+func (self *syncEndpoint) lookupName(entityType, id string) (string, bool, error) {
+	index, err := self.index(entityType)
+	if err != nil {
+		return "", false, err
+	}
+	name, found := index.nameById[id]
+	return name, found, nil
+}
+
+// register records a newly created entity, so that entities synced later can reference it
+func (self *syncEndpoint) register(entityType, name, id string) {
+	index, found := self.indexes[entityType]
+	if !found {
+		return
+	}
+	entity := gabs.New()
+	api.SetJSONValue(entity, id, "id")
+	api.SetJSONValue(entity, name, "name")
+	index.byName[name] = entity
+	index.nameById[id] = name
+}
+
+func (self *syncEndpoint) create(entityType string, body *gabs.Container) (string, error) {
+	req, err := self.newRequest()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := req.SetBody(body.String()).Post(self.baseUrl + "/" + entityType)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create %v on '%v'", boltz.GetSingularEntityType(entityType), self.name)
+	}
+
+	if resp.StatusCode() != http.StatusCreated {
+		return "", errors.Errorf("status code: %v, server returned: %v", resp.Status(), util.PrettyPrintResponse(resp))
+	}
+
+	jsonParsed, err := gabs.ParseJSON(resp.Body())
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse response from '%v'", self.name)
+	}
+
+	return api.Wrap(jsonParsed).String("data.id"), nil
+}
+
+func (self *syncEndpoint) update(entityType, id string, body *gabs.Container) error {
+	req, err := self.newRequest()
+	if err != nil {
+		return err
+	}
+
+	resp, err := req.SetBody(body.String()).Put(self.baseUrl + "/" + entityType + "/" + id)
+	if err != nil {
+		return errors.Wrapf(err, "unable to update %v on '%v'", boltz.GetSingularEntityType(entityType), self.name)
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return errors.Errorf("status code: %v, server returned: %v", resp.Status(), util.PrettyPrintResponse(resp))
+	}
+	return nil
+}
+
+type syncReport struct {
+	rows   []table.Row
+	errors int
+}
+
+func (self *syncReport) add(entityType, name, action, detail string) {
+	if action == "error" {
+		self.errors++
+	}
+	self.rows = append(self.rows, table.Row{boltz.GetSingularEntityType(entityType), name, action, detail})
+}
+
+func (self *syncReport) output(o *syncOptions) {
+	t := table.NewWriter()
+	t.SetStyle(table.StyleRounded)
+	t.AppendHeader(table.Row{"Type", "Name", "Action", "Detail"})
+	t.AppendRows(self.rows)
+	api.RenderTable(&o.Options, t, nil)
+
+	if o.dryRun && !o.OutputCSV {
+		o.Printf("dry run: no changes were made to '%v'\n", o.to)
+	} else if !o.OutputCSV {
+		o.Printf("%v entities processed, %v errors\n", len(self.rows), self.errors)
+	}
+}
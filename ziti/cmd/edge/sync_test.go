@@ -0,0 +1,122 @@
+package edge
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// newSyncServers starts two fake controllers and saves logins named source and target for them
+func newSyncServers(t *testing.T) (*apitest.Server, *apitest.Server) {
+	source := apitest.NewServer(t)
+	config, _, err := util.LoadRestClientConfig()
+	require.NoError(t, err)
+	sourceLogin := config.EdgeIdentities["default"]
+
+	target := apitest.NewServer(t)
+	config, _, err = util.LoadRestClientConfig()
+	require.NoError(t, err)
+	config.EdgeIdentities["source"] = sourceLogin
+	config.EdgeIdentities["target"] = config.EdgeIdentities["default"]
+	require.NoError(t, util.PersistRestClientConfig(config))
+	util.ClearSelectedIdentity()
+
+	return source, target
+}
+
+func getByName(server *apitest.Server, entityType, name string) map[string]interface{} {
+	for _, entity := range server.List(entityType) {
+		if entity["name"] == name {
+			return entity
+		}
+	}
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	req := require.New(t)
+	source, target := newSyncServers(t)
+
+	// entities which only exist on the target shift its ids, so references have to be remapped
+	target.Create("config-types", map[string]interface{}{"name": "other"})
+	target.Create("identities", map[string]interface{}{"name": "bob", "type": "User"})
+	targetAliceId := target.Create("identities", map[string]interface{}{"name": "alice", "type": "User"})
+	target.Create("services", map[string]interface{}{"name": "ssh", "encryptionRequired": true, "roleAttributes": []interface{}{"old"}})
+
+	aliceId := source.Create("identities", map[string]interface{}{"name": "alice", "type": "User"})
+	configTypeId := source.Create("config-types", map[string]interface{}{"name": "intercept"})
+	configId := source.Create("configs", map[string]interface{}{"name": "echo-intercept", "configTypeId": configTypeId, "data": map[string]interface{}{"port": 80}})
+	echoId := source.Create("services", map[string]interface{}{"name": "echo", "encryptionRequired": true, "configs": []interface{}{configId}, "roleAttributes": []interface{}{"web"}})
+	sshId := source.Create("services", map[string]interface{}{"name": "ssh", "encryptionRequired": true, "roleAttributes": []interface{}{"new"}})
+	source.Create("service-policies", map[string]interface{}{
+		"name":          "dial",
+		"type":          "Dial",
+		"semantic":      "AnyOf",
+		"serviceRoles":  []interface{}{"@" + echoId, "#web"},
+		"identityRoles": []interface{}{"@" + aliceId},
+	})
+
+	writes := func() int {
+		return len(target.RequestsTo(http.MethodPost, apitest.EdgeManagementPath)) +
+			len(target.RequestsTo(http.MethodPut, apitest.EdgeManagementPath)) +
+			len(target.RequestsTo(http.MethodPatch, apitest.EdgeManagementPath)) +
+			len(target.RequestsTo(http.MethodDelete, apitest.EdgeManagementPath))
+	}
+
+	// a dry run reports the changes without making them
+	output, err := apitest.Execute(NewCmdEdge, "sync", "--from", "source", "--to", "target", "--dry-run")
+	req.NoError(err, output)
+	req.Contains(output, "dry run: no changes were made to 'target'")
+	req.Contains(output, "echo-intercept")
+	req.Equal(0, writes())
+	req.Nil(getByName(target, "services", "echo"))
+
+	// conflicts are skipped by default, everything else is created with references remapped to the target's ids
+	output, err = apitest.Execute(NewCmdEdge, "sync", "--from", "source", "--to", "target", "--csv")
+	req.NoError(err)
+	req.Contains(output, "service,ssh,skip,differs from target")
+
+	targetConfigType := getByName(target, "config-types", "intercept")
+	req.NotNil(targetConfigType)
+	req.NotEqual(configTypeId, targetConfigType["id"])
+
+	targetConfig := getByName(target, "configs", "echo-intercept")
+	req.NotNil(targetConfig)
+	req.Equal(targetConfigType["id"], targetConfig["configTypeId"])
+
+	targetEcho := getByName(target, "services", "echo")
+	req.NotNil(targetEcho)
+	req.NotEqual(echoId, targetEcho["id"])
+	req.Equal([]interface{}{targetConfig["id"]}, targetEcho["configs"])
+
+	targetPolicy := getByName(target, "service-policies", "dial")
+	req.NotNil(targetPolicy)
+	req.Equal([]interface{}{"@" + targetEcho["id"].(string), "#web"}, targetPolicy["serviceRoles"])
+	req.Equal([]interface{}{"@" + targetAliceId}, targetPolicy["identityRoles"])
+
+	req.Equal([]interface{}{"old"}, getByName(target, "services", "ssh")["roleAttributes"])
+
+	// a second sync finds nothing to do
+	created := len(target.RequestsTo(http.MethodPost, apitest.EdgeManagementPath))
+	output, err = apitest.Execute(NewCmdEdge, "sync", "--from", "source", "--to", "target", "--csv")
+	req.NoError(err)
+	req.Contains(output, "service,echo,unchanged,")
+	req.Len(target.RequestsTo(http.MethodPost, apitest.EdgeManagementPath), created)
+
+	// conflicts can abort the sync
+	output, err = apitest.Execute(NewCmdEdge, "sync", "--from", "source", "--to", "target", "--on-conflict", "fail", "--csv")
+	req.ErrorContains(err, "service 'ssh' differs between 'source' and 'target', aborting sync")
+	req.Contains(output, "service,ssh,conflict,differs from target")
+	req.Empty(target.RequestsTo(http.MethodPut, apitest.EdgeManagementPath))
+
+	// or overwrite the target
+	output, err = apitest.Execute(NewCmdEdge, "sync", "--from", "source", "--to", "target", "--on-conflict", "overwrite", "--csv")
+	req.NoError(err)
+	targetSsh := getByName(target, "services", "ssh")
+	req.Contains(output, "service,ssh,update,id: "+targetSsh["id"].(string))
+	req.Equal([]interface{}{"new"}, targetSsh["roleAttributes"])
+	req.NotEqual(sshId, targetSsh["id"])
+	req.Len(target.RequestsTo(http.MethodPut, apitest.EdgeManagementPath+"/services/"), 1)
+}
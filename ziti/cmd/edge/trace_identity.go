@@ -17,13 +17,26 @@
 package edge
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Jeffail/gabs"
+	"github.com/openziti/channel/v2"
+	trace_pb "github.com/openziti/channel/v2/trace/pb"
+	"github.com/openziti/fabric/pb/mgmt_pb"
 	"github.com/openziti/ziti/ziti/cmd/api"
 	"github.com/openziti/ziti/ziti/cmd/common"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
 	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
 )
 
 type traceIdentityOptions struct {
@@ -31,6 +44,7 @@ type traceIdentityOptions struct {
 	disable  bool
 	duration string
 	traceId  string
+	follow   bool
 }
 
 // newCreateIdentityCmd creates the 'edge controller create identity' command
@@ -53,9 +67,13 @@ func newTraceIdentityCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 	}
 
 	cmd := &cobra.Command{
-		Use:   "identity",
+		Use:   "identity <id or name> [channels...]",
 		Short: "enables/disables tracing for sessions from an identity managed by the Ziti Edge Controller",
-		Args:  cobra.MinimumNArgs(1),
+		Long: "Enables or disables tracing for sessions from an identity. With --follow, tracing is enabled and the " +
+			"trace messages for the identity's sessions and circuits are streamed from the controller until " +
+			"interrupted, then tracing is disabled. Messages are attributed to the identity using the controller's " +
+			"session and circuit events",
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			options.Cmd = cmd
 			options.Args = args
@@ -70,6 +88,7 @@ func newTraceIdentityCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 	cmd.Flags().BoolVar(&options.disable, "disable", false, "Disables tracing for the identity (default false)")
 	cmd.Flags().StringVarP(&options.duration, "duration", "d", "10m", "how long to enable tracing for (default 10 minutes)")
 	cmd.Flags().StringVar(&options.traceId, "trace-id", "", "Unique id to use when tracing")
+	cmd.Flags().BoolVarP(&options.follow, "follow", "f", false, "Stream the traced messages until interrupted, then disable tracing")
 
 	options.AddCommonFlags(cmd)
 
@@ -77,13 +96,54 @@ func newTraceIdentityCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 }
 
 func runTraceIdentity(o *traceIdentityOptions) error {
+	if o.follow && o.disable {
+		return errors.New("--follow and --disable may not be used together")
+	}
+
 	id, err := mapNameToID("identities", o.Args[0], o.Options)
 	if err != nil {
 		return err
 	}
 
+	result, err := setIdentityTrace(o, id, !o.disable)
+	if err != nil {
+		return err
+	}
+
+	traceId := result.S("data", "traceId").Data().(string)
+	until := result.S("data", "until").Data().(string)
+	enabled := result.S("data", "enabled").Data().(bool)
+
+	if !enabled {
+		_, err = fmt.Fprintf(o.Out, "tracing disabled for identity %v\n", id)
+		return err
+	}
+
+	if _, err = fmt.Fprintf(o.Out, "tracing enabled for identity %v until %v with id: %v\n", id, until, traceId); err != nil {
+		return err
+	}
+
+	if !o.follow {
+		return nil
+	}
+
+	followErr := followIdentityTrace(o, id, until)
+
+	if _, err = setIdentityTrace(o, id, false); err != nil {
+		logrus.WithError(err).Errorf("failed to disable tracing for identity %v", id)
+		if followErr == nil {
+			followErr = err
+		}
+	} else {
+		_, _ = fmt.Fprintf(o.Out, "tracing disabled for identity %v\n", id)
+	}
+
+	return followErr
+}
+
+func setIdentityTrace(o *traceIdentityOptions, id string, enabled bool) (*gabs.Container, error) {
 	entityData := gabs.New()
-	api.SetJSONValue(entityData, !o.disable, "enabled")
+	api.SetJSONValue(entityData, enabled, "enabled")
 	api.SetJSONValue(entityData, o.duration, "duration")
 
 	if o.traceId != "" {
@@ -94,21 +154,335 @@ func runTraceIdentity(o *traceIdentityOptions) error {
 		api.SetJSONValue(entityData, o.Args[1:], "channels")
 	}
 
-	result, err := putEntityOfType("identities/"+id+"/trace", entityData.String(), &o.Options)
+	return putEntityOfType("identities/"+id+"/trace", entityData.String(), &o.Options)
+}
+
+// followIdentityTrace streams trace messages from the controller, printing those which belong to the identity, until
+// interrupted, the trace expires or the connection to the controller is lost
+func followIdentityTrace(o *traceIdentityOptions, identityId string, until string) error {
+	filter := newIdentityTraceFilter(identityId)
+
+	outputLock := sync.Mutex{}
+	output := func(messages []*trace_pb.ChannelMessage) {
+		outputLock.Lock()
+		defer outputLock.Unlock()
+		for _, message := range messages {
+			_, _ = fmt.Fprint(o.Out, api.FormatTraceMessage(message))
+		}
+	}
+
+	closeNotify := make(chan struct{})
+
+	bindHandler := func(binding channel.Binding) error {
+		binding.AddReceiveHandlerF(int32(mgmt_pb.ContentType_StreamTracesEventType), func(msg *channel.Message, _ channel.Channel) {
+			event := &trace_pb.ChannelMessage{}
+			if err := proto.Unmarshal(msg.Body, event); err != nil {
+				logrus.WithError(err).Error("unable to decode trace message")
+				return
+			}
+			output(filter.acceptTrace(event))
+		})
+		binding.AddReceiveHandlerF(int32(mgmt_pb.ContentType_StreamEventsEventType), func(msg *channel.Message, _ channel.Channel) {
+			output(filter.acceptEvent(msg.Body))
+		})
+		binding.AddCloseHandler(channel.CloseHandlerF(func(ch channel.Channel) {
+			close(closeNotify)
+		}))
+		return nil
+	}
+
+	ch, err := api.NewWsMgmtChannel(channel.BindHandlerF(bindHandler))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
 
+	body, err := proto.Marshal(&mgmt_pb.StreamTracesRequest{})
 	if err != nil {
 		return err
 	}
 
-	traceId := result.S("data", "traceId").Data().(string)
-	until := result.S("data", "until").Data().(string)
-	enabled := result.S("data", "enabled").Data().(bool)
+	timeout := time.Duration(o.Timeout) * time.Second
+	requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamTracesRequestType), body)
+	if err = requestMsg.WithTimeout(timeout).SendAndWaitForWire(ch); err != nil {
+		return err
+	}
+
+	if err = subscribeToIdentityTraceEvents(ch, timeout); err != nil {
+		return err
+	}
+
+	// sessions and circuits created before the events were subscribed to are looked up instead
+	if err = loadIdentityTraceCircuits(o, filter, output); err != nil {
+		return err
+	}
+
+	var expired <-chan time.Time
+	if untilTime, err := time.Parse(time.RFC3339, until); err == nil {
+		expired = time.After(time.Until(untilTime))
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	select {
+	case <-interrupted:
+		return nil
+	case <-expired:
+		_, _ = fmt.Fprintln(o.Out, "trace duration expired")
+		return nil
+	case <-closeNotify:
+		return errors.New("connection to the controller was closed")
+	}
+}
+
+// subscribeToIdentityTraceEvents subscribes to the session and circuit events used to attribute trace messages to the
+// identity
+func subscribeToIdentityTraceEvents(ch channel.Channel, timeout time.Duration) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"format": "json",
+		"subscriptions": []map[string]interface{}{
+			{"type": "edge.sessions"},
+			{"type": "fabric.circuits"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamEventsRequestType), request)
+	responseMsg, err := requestMsg.WithTimeout(timeout).SendForReply(ch)
+	if err != nil {
+		return err
+	}
 
-	if enabled {
-		_, err = fmt.Fprintf(o.Out, "tracing enabled for identity %v until %v with id: %v\n", id, until, traceId)
+	if responseMsg.ContentType != channel.ContentTypeResultType {
+		return errors.Errorf("unexpected response type %v", responseMsg.ContentType)
+	}
+
+	result := channel.UnmarshalResult(responseMsg)
+	if !result.Success {
+		return errors.Errorf("error starting event streaming [%s]", result.Message)
+	}
+	return nil
+}
+
+// loadIdentityTraceCircuits adds the identity's current sessions, and the circuits created for them, to the filter,
+// outputting any messages for them which were held back in the meantime
+func loadIdentityTraceCircuits(o *traceIdentityOptions, filter *identityTraceFilter, output func([]*trace_pb.ChannelMessage)) error {
+	sessions, _, err := filterEntitiesOfType("sessions", fmt.Sprintf(`identity = "%v" limit none`, filter.identityId), false, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
 		return err
 	}
+	for _, session := range sessions {
+		id, _ := session.S("id").Data().(string)
+		token, _ := session.S("token").Data().(string)
+		output(filter.addSession(id, token))
+	}
+
+	circuits, _, err := api.ListEntitiesOfType(util.FabricAPI, "circuits", url.Values{}, false, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
+		return err
+	}
+	for _, circuit := range circuits {
+		circuitId, _ := circuit.S("id").Data().(string)
+		clientId, _ := circuit.S("clientId").Data().(string)
+		if filter.hasSession(clientId) {
+			output(filter.addCircuit(circuitId))
+		}
+	}
+	return nil
+}
+
+// maxHeldTraceMessages bounds the trace messages held back while waiting to learn which circuits belong to the identity
+const maxHeldTraceMessages = 1000
+
+// identityTraceFilter selects the trace messages belonging to an identity. Trace messages don't name the identity, so
+// they're attributed through the identity's service sessions. Session events give the session ids and tokens, circuit
+// events give the circuits created for those sessions, since a circuit's client id is the session id. Edge create
+// circuit requests carry the session token, and their responses the circuit id. Routing messages for a circuit are
+// sent before its circuit event, and session events are sent asynchronously, so messages and circuits which haven't
+// been attributed yet are held back, and released once they turn out to belong to the identity
+type identityTraceFilter struct {
+	sync.Mutex
+	identityId    string
+	sessionIds    map[string]bool
+	sessionTokens map[string]bool
+	circuitIds    map[string]bool
+	requests      map[string]bool
+	held          []*trace_pb.ChannelMessage
+	heldCircuits  []heldTraceCircuit
+}
+
+// heldTraceCircuit is a circuit from a circuit event whose session isn't known yet
+type heldTraceCircuit struct {
+	circuitId string
+	sessionId string
+}
+
+func newIdentityTraceFilter(identityId string) *identityTraceFilter {
+	return &identityTraceFilter{
+		identityId:    identityId,
+		sessionIds:    map[string]bool{},
+		sessionTokens: map[string]bool{},
+		circuitIds:    map[string]bool{},
+		requests:      map[string]bool{},
+	}
+}
+
+// addSession adds one of the identity's sessions, returning the held back messages for its circuits
+func (self *identityTraceFilter) addSession(id, token string) []*trace_pb.ChannelMessage {
+	self.Lock()
+	defer self.Unlock()
+
+	if token != "" {
+		self.sessionTokens[token] = true
+	}
+	if id == "" {
+		return nil
+	}
+	self.sessionIds[id] = true
+
+	var released []*trace_pb.ChannelMessage
+	heldCircuits := self.heldCircuits[:0]
+	for _, circuit := range self.heldCircuits {
+		if circuit.sessionId == id {
+			released = append(released, self.addCircuitLocked(circuit.circuitId)...)
+		} else {
+			heldCircuits = append(heldCircuits, circuit)
+		}
+	}
+	self.heldCircuits = heldCircuits
+	return released
+}
+
+func (self *identityTraceFilter) hasSession(id string) bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.sessionIds[id]
+}
+
+// addCircuit attributes the circuit to the identity, returning the held back messages for it
+func (self *identityTraceFilter) addCircuit(circuitId string) []*trace_pb.ChannelMessage {
+	self.Lock()
+	defer self.Unlock()
+	return self.addCircuitLocked(circuitId)
+}
+
+func (self *identityTraceFilter) addCircuitLocked(circuitId string) []*trace_pb.ChannelMessage {
+	self.circuitIds[circuitId] = true
+
+	var released []*trace_pb.ChannelMessage
+	held := self.held[:0]
+	for _, message := range self.held {
+		if traceCircuitId(message) == circuitId {
+			released = append(released, message)
+		} else {
+			held = append(held, message)
+		}
+	}
+	self.held = held
+	return released
+}
+
+// acceptEvent tracks the identity's sessions and circuits from the event stream. It returns the held back trace
+// messages for circuits which are now known to belong to the identity
+func (self *identityTraceFilter) acceptEvent(data []byte) []*trace_pb.ChannelMessage {
+	event := &struct {
+		Namespace  string `json:"namespace"`
+		EventType  string `json:"event_type"`
+		Id         string `json:"id"`
+		Token      string `json:"token"`
+		IdentityId string `json:"identity_id"`
+		CircuitId  string `json:"circuit_id"`
+		ClientId   string `json:"client_id"`
+	}{}
+	if err := json.Unmarshal(data, event); err != nil {
+		logrus.WithError(err).Error("unable to decode event")
+		return nil
+	}
+
+	switch event.Namespace {
+	case "edge.sessions":
+		if event.EventType == "created" && event.IdentityId == self.identityId {
+			return self.addSession(event.Id, event.Token)
+		}
+	case "fabric.circuits":
+		if event.CircuitId == "" || event.ClientId == "" {
+			return nil
+		}
+
+		self.Lock()
+		defer self.Unlock()
+
+		if self.sessionIds[event.ClientId] {
+			return self.addCircuitLocked(event.CircuitId)
+		}
+		if event.EventType == "created" {
+			self.heldCircuits = append(self.heldCircuits, heldTraceCircuit{circuitId: event.CircuitId, sessionId: event.ClientId})
+			if len(self.heldCircuits) > maxHeldTraceMessages {
+				self.heldCircuits = append(self.heldCircuits[:0], self.heldCircuits[1:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// acceptTrace returns the trace messages to output for the given message. This is the message itself if it belongs
+// to the identity, along with any held back messages for a circuit it attributes to the identity
+func (self *identityTraceFilter) acceptTrace(message *trace_pb.ChannelMessage) []*trace_pb.ChannelMessage {
+	meta, err := api.DecodeTraceMeta(message.Decode)
+	if err != nil || meta == nil {
+		return nil
+	}
+
+	self.Lock()
+	defer self.Unlock()
+
+	if token, _ := meta["sessionToken"].(string); token != "" {
+		if !self.sessionTokens[token] {
+			return nil
+		}
+		self.requests[traceRequestKey(message, message.Sequence)] = true
+		return []*trace_pb.ChannelMessage{message}
+	}
+
+	circuitId, _ := meta["circuitId"].(string)
+
+	if message.ReplyFor != -1 && self.requests[traceRequestKey(message, message.ReplyFor)] {
+		delete(self.requests, traceRequestKey(message, message.ReplyFor))
+		var result []*trace_pb.ChannelMessage
+		if circuitId != "" && !self.circuitIds[circuitId] {
+			result = self.addCircuitLocked(circuitId)
+		}
+		return append(result, message)
+	}
+
+	if circuitId == "" {
+		return nil
+	}
+
+	if self.circuitIds[circuitId] {
+		return []*trace_pb.ChannelMessage{message}
+	}
+
+	self.held = append(self.held, message)
+	if len(self.held) > maxHeldTraceMessages {
+		self.held = append(self.held[:0], self.held[1:]...)
+	}
+	return nil
+}
+
+// traceRequestKey identifies a message by its sequence on the traced channel, so replies can be matched to it
+func traceRequestKey(message *trace_pb.ChannelMessage, sequence int32) string {
+	return fmt.Sprintf("%v/%v/%v", message.Identity, message.Channel, sequence)
+}
 
-	_, err = fmt.Fprintf(o.Out, "tracing disabled for identity %v\n", id)
-	return err
+func traceCircuitId(message *trace_pb.ChannelMessage) string {
+	meta, _ := api.DecodeTraceMeta(message.Decode)
+	circuitId, _ := meta["circuitId"].(string)
+	return circuitId
 }
@@ -0,0 +1,98 @@
+package edge
+
+import (
+	"encoding/json"
+	"github.com/openziti/channel/v2"
+	trace_pb "github.com/openziti/channel/v2/trace/pb"
+	edgeEvents "github.com/openziti/edge/events"
+	"github.com/openziti/edge/pb/edge_ctrl_pb"
+	"github.com/openziti/fabric/event"
+	"github.com/openziti/fabric/pb/ctrl_pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+type traceMessageDecoder interface {
+	Decode(msg *channel.Message) ([]byte, bool)
+}
+
+// newTraceMessage builds a trace message the way the controller does, with the decode produced by the given decoder
+func newTraceMessage(t *testing.T, decoder traceMessageDecoder, contentType int32, body proto.Message, sequence, replyFor int32) *trace_pb.ChannelMessage {
+	data, err := proto.Marshal(body)
+	require.NoError(t, err)
+	decode, ok := decoder.Decode(channel.NewMessage(contentType, data))
+	require.True(t, ok)
+	require.NotEmpty(t, decode)
+	return &trace_pb.ChannelMessage{
+		Identity:    "router1",
+		Channel:     "ctrl",
+		ContentType: contentType,
+		Sequence:    sequence,
+		ReplyFor:    replyFor,
+		Decode:      decode,
+	}
+}
+
+func marshalEvent(t *testing.T, e interface{}) []byte {
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+	return data
+}
+
+func TestIdentityTraceFilter(t *testing.T) {
+	req := require.New(t)
+	filter := newIdentityTraceFilter("alice")
+
+	route := func(circuitId string, sequence int32) *trace_pb.ChannelMessage {
+		return newTraceMessage(t, ctrl_pb.Decoder{}, int32(ctrl_pb.ContentType_RouteType), &ctrl_pb.Route{CircuitId: circuitId}, sequence, -1)
+	}
+	unroute := func(circuitId string, sequence int32) *trace_pb.ChannelMessage {
+		return newTraceMessage(t, ctrl_pb.Decoder{}, int32(ctrl_pb.ContentType_UnrouteType), &ctrl_pb.Unroute{CircuitId: circuitId}, sequence, -1)
+	}
+	sessionCreated := func(id, token, identityId string) []byte {
+		return marshalEvent(t, &edgeEvents.SessionEvent{Namespace: edgeEvents.SessionEventNS, EventType: edgeEvents.SessionEventTypeCreated, Id: id, Token: token, IdentityId: identityId})
+	}
+	circuitCreated := func(circuitId, clientId string) []byte {
+		return marshalEvent(t, &event.CircuitEvent{Namespace: event.CircuitEventsNs, EventType: event.CircuitCreated, CircuitId: circuitId, ClientId: clientId})
+	}
+
+	// the create circuit request for one of alice's sessions is matched by its session token, and its response
+	// attributes the circuit, releasing the routing messages sent before it
+	req.Empty(filter.acceptEvent(sessionCreated("s1", "token1", "alice")))
+	req.Empty(filter.acceptEvent(sessionCreated("s2", "token2", "bob")))
+
+	createCircuit := newTraceMessage(t, edge_ctrl_pb.Decoder{}, int32(edge_ctrl_pb.ContentType_CreateCircuitRequestType), &edge_ctrl_pb.CreateCircuitRequest{SessionToken: "token1"}, 10, -1)
+	req.Equal([]*trace_pb.ChannelMessage{createCircuit}, filter.acceptTrace(createCircuit))
+
+	otherCreateCircuit := newTraceMessage(t, edge_ctrl_pb.Decoder{}, int32(edge_ctrl_pb.ContentType_CreateCircuitRequestType), &edge_ctrl_pb.CreateCircuitRequest{SessionToken: "token2"}, 11, -1)
+	req.Empty(filter.acceptTrace(otherCreateCircuit))
+
+	routeC1 := route("c1", 20)
+	routeC2 := route("c2", 21)
+	req.Empty(filter.acceptTrace(routeC1))
+	req.Empty(filter.acceptTrace(routeC2))
+
+	response := newTraceMessage(t, edge_ctrl_pb.Decoder{}, int32(edge_ctrl_pb.ContentType_CreateCircuitResponseType), &edge_ctrl_pb.CreateCircuitResponse{CircuitId: "c1"}, 30, 10)
+	req.Equal([]*trace_pb.ChannelMessage{routeC1, response}, filter.acceptTrace(response))
+
+	unrouteC1 := unroute("c1", 31)
+	req.Equal([]*trace_pb.ChannelMessage{unrouteC1}, filter.acceptTrace(unrouteC1))
+
+	// bob's circuit is never released
+	req.Empty(filter.acceptEvent(circuitCreated("c2", "s2")))
+	req.Empty(filter.acceptTrace(unroute("c2", 32)))
+
+	// circuits are also attributed by circuit events, whose client id is the session id, even when the session event
+	// arrives after the circuit event
+	routeC3 := route("c3", 40)
+	req.Empty(filter.acceptTrace(routeC3))
+	req.Empty(filter.acceptEvent(circuitCreated("c3", "s3")))
+	req.Equal([]*trace_pb.ChannelMessage{routeC3}, filter.acceptEvent(sessionCreated("s3", "token3", "alice")))
+
+	routeC4 := route("c4", 41)
+	req.Empty(filter.acceptTrace(routeC4))
+	req.Equal([]*trace_pb.ChannelMessage{routeC4}, filter.acceptEvent(circuitCreated("c4", "s1")))
+
+	req.Empty(filter.acceptTrace(&trace_pb.ChannelMessage{ReplyFor: -1}))
+}
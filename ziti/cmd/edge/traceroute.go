@@ -1,8 +1,14 @@
 package edge
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"github.com/mattn/go-isatty"
 	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/sdk-golang/ziti/edge"
 	"github.com/openziti/ziti/ziti/cmd/api"
 	"github.com/openziti/ziti/ziti/cmd/common"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
@@ -11,6 +17,8 @@ import (
 	"github.com/spf13/cobra"
 	"io"
 	"math"
+	"os"
+	"os/signal"
 	"time"
 )
 
@@ -21,6 +29,12 @@ type traceRouteOptions struct {
 	configFile       string
 	timeout          time.Duration
 	lookupRouterName bool
+	count            uint
+	interval         time.Duration
+	output           string
+
+	routerNames             map[string]string
+	routerNameLookupsFailed bool
 }
 
 func newTraceRouteCmd(out io.Writer, errOut io.Writer) *cobra.Command {
@@ -33,7 +47,10 @@ func newTraceRouteCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "traceroute <service> ",
 		Short: "runs a traceroute on the service",
-		Args:  cobra.ExactArgs(1),
+		Long: "Runs a traceroute on the service. By default a single pass is made. With --count, the path is probed " +
+			"repeatedly and per-hop loss, latency and jitter statistics are shown in a table which is redrawn after " +
+			"every pass, similar to mtr",
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			options.Cmd = cmd
 			options.Args = args
@@ -52,12 +69,19 @@ func newTraceRouteCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 	cmd.Flags().DurationVarP(&options.timeout, "timeout", "t", 5*time.Second, "Trace route response timeout")
 	cmd.Flags().BoolVarP(&options.Verbose, "verbose", "", false, "Enable verbose logging")
 	cmd.Flags().BoolVarP(&options.lookupRouterName, "get-router-names", "n", false, "Lookup and output router names instead of ids. Requires admin privileges")
+	cmd.Flags().UintVar(&options.count, "count", 1, "Number of times to probe the path. 0 probes until interrupted")
+	cmd.Flags().DurationVar(&options.interval, "interval", time.Second, "Time to wait between probes of the path")
+	cmd.Flags().StringVarP(&options.output, "output", "o", "table", "Output format. One of: table, json")
 
 	return cmd
 }
 
 // Run implements this command
 func (o *traceRouteOptions) Run() error {
+	if o.output != "table" && o.output != "json" {
+		return errors.Errorf("unsupported output format '%v', must be one of: table, json", o.output)
+	}
+
 	var ctx ziti.Context
 	if o.configFile != "" {
 		cfg, err := ziti.NewConfigFromFile(o.configFile)
@@ -82,6 +106,21 @@ func (o *traceRouteOptions) Run() error {
 		}
 	}()
 
+	o.routerNames = map[string]string{}
+
+	if o.count == 1 && o.output == "table" {
+		err = o.traceOnce(conn)
+	} else {
+		err = o.traceContinuously(conn)
+	}
+
+	if o.routerNameLookupsFailed {
+		_, _ = fmt.Fprintln(o.Err, "Router name lookup failed. For this to work you must use ziti edge login first and be an administrator.")
+	}
+	return err
+}
+
+func (o *traceRouteOptions) hopRange() (uint32, uint32) {
 	hops := uint32(o.hops)
 	if hops == 0 {
 		hops = math.MaxUint32
@@ -90,8 +129,12 @@ func (o *traceRouteOptions) Run() error {
 	if o.skipIntermediate {
 		currentHop = hops
 	}
+	return currentHop, hops
+}
 
-	routerNameLookupsFailed := false
+// traceOnce makes a single pass along the path, printing each hop as it responds
+func (o *traceRouteOptions) traceOnce(conn edge.Conn) error {
+	currentHop, hops := o.hopRange()
 	for currentHop <= hops {
 		result, err := conn.TraceRoute(currentHop, o.timeout)
 		if err != nil {
@@ -102,16 +145,7 @@ func (o *traceRouteOptions) Run() error {
 			break
 		}
 
-		hopLabel := result.HopId
-		if result.HopType == "forwarder" {
-			if o.lookupRouterName {
-				hopLabel, err = mapIdToName("transit-routers", result.HopId, o.Options)
-				if err != nil {
-					hopLabel = result.HopId
-					routerNameLookupsFailed = true
-				}
-			}
-		}
+		hopLabel := o.getHopLabel(result)
 
 		hopErr := ""
 		if result.Error != "" {
@@ -119,9 +153,9 @@ func (o *traceRouteOptions) Run() error {
 		}
 
 		if hopLabel == "" {
-			fmt.Printf("%2v %25v %6v %v\n", currentHop, result.HopType, result.Time, hopErr)
+			_, _ = fmt.Fprintf(o.Out, "%2v %25v %6v %v\n", currentHop, result.HopType, result.Time, hopErr)
 		} else {
-			fmt.Printf("%2v %25v %6v %v\n", currentHop, fmt.Sprintf("%v[%v]", result.HopType, hopLabel), result.Time, hopErr)
+			_, _ = fmt.Fprintf(o.Out, "%2v %25v %6v %v\n", currentHop, fmt.Sprintf("%v[%v]", result.HopType, hopLabel), result.Time, hopErr)
 		}
 
 		currentHop++
@@ -129,9 +163,237 @@ func (o *traceRouteOptions) Run() error {
 			break
 		}
 	}
+	return nil
+}
+
+// traceContinuously probes the path count times, or until interrupted, and reports per-hop statistics
+func (o *traceRouteOptions) traceContinuously(conn edge.Conn) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-	if routerNameLookupsFailed {
-		fmt.Println("Router name lookup failed. For this to work you must use ziti edge login first and be an administrator.")
+	live := o.output == "table" && isTerminal(o.Out)
+	report := &traceRouteReport{
+		Service: o.Args[0],
+	}
+
+	for report.Probes = 0; o.count == 0 || report.Probes < o.count; {
+		o.probePath(conn, report)
+		report.Probes++
+
+		if live {
+			_, _ = fmt.Fprint(o.Out, "\033[H\033[2J")
+			o.renderTable(report)
+		}
+
+		if o.count != 0 && report.Probes >= o.count {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(o.interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if o.output == "json" {
+		data, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(o.Out, string(data))
+		return err
+	}
+
+	if !live {
+		o.renderTable(report)
 	}
 	return nil
 }
+
+// probePath makes one pass along the path, recording the result for each hop. A hop which errors or doesn't
+// respond is counted as lost and ends the pass, since later hops can't be reached
+func (o *traceRouteOptions) probePath(conn edge.Conn, report *traceRouteReport) {
+	currentHop, hops := o.hopRange()
+	for currentHop <= hops {
+		result, err := conn.TraceRoute(currentHop, o.timeout)
+		if err != nil {
+			report.getHop(currentHop).recordLoss(err.Error())
+			return
+		}
+
+		if result.Hops > 0 && result.Error == "" {
+			return
+		}
+
+		stats := report.getHop(currentHop)
+		stats.Type = result.HopType
+		stats.Id = result.HopId
+		if label := o.getHopLabel(result); label != result.HopId {
+			stats.Name = label
+		}
+
+		if result.Error != "" {
+			stats.recordLoss(result.Error)
+			return
+		}
+		stats.recordTime(result.Time)
+		currentHop++
+	}
+}
+
+// getHopLabel returns the router name for forwarder hops, if names were requested, otherwise the hop id. Names are
+// looked up once per router
+func (o *traceRouteOptions) getHopLabel(result *edge.TraceRouteResult) string {
+	if result.HopType != "forwarder" || !o.lookupRouterName {
+		return result.HopId
+	}
+
+	if name, found := o.routerNames[result.HopId]; found {
+		return name
+	}
+
+	name := result.HopId
+	if routerName, err := mapIdToName("transit-routers", result.HopId, o.Options); err == nil {
+		name = routerName
+	} else if routerName, err = mapIdToName("edge-routers", result.HopId, o.Options); err == nil {
+		name = routerName
+	} else {
+		o.routerNameLookupsFailed = true
+	}
+	o.routerNames[result.HopId] = name
+	return name
+}
+
+func (o *traceRouteOptions) renderTable(report *traceRouteReport) {
+	t := table.NewWriter()
+	t.SetStyle(table.StyleRounded)
+	t.SetTitle(fmt.Sprintf("traceroute to %v, %v probes", report.Service, report.Probes))
+	t.AppendHeader(table.Row{"Hop", "Host", "Loss%", "Sent", "Last", "Avg", "Best", "Worst", "StDev", "Jitter", "Last Error"})
+
+	var columnConfigs []table.ColumnConfig
+	for i := 3; i <= 10; i++ {
+		columnConfigs = append(columnConfigs, table.ColumnConfig{Number: i, Align: text.AlignRight})
+	}
+	t.SetColumnConfigs(columnConfigs)
+
+	for _, hop := range report.Hops {
+		label := hop.Name
+		if label == "" {
+			label = hop.Id
+		}
+		host := hop.Type
+		if label != "" {
+			host = fmt.Sprintf("%v[%v]", hop.Type, label)
+		}
+		t.AppendRow(table.Row{
+			hop.Hop,
+			host,
+			fmt.Sprintf("%.1f%%", hop.LossPercent),
+			hop.Sent,
+			formatMs(hop.LastMs, hop.Received),
+			formatMs(hop.AvgMs, hop.Received),
+			formatMs(hop.MinMs, hop.Received),
+			formatMs(hop.MaxMs, hop.Received),
+			formatMs(hop.StdDevMs, hop.Received),
+			formatMs(hop.JitterMs, hop.Received),
+			hop.LastError,
+		})
+	}
+
+	_, _ = fmt.Fprintln(o.Out, t.Render())
+}
+
+func formatMs(val float64, received uint) string {
+	if received == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", val)
+}
+
+func isTerminal(w io.Writer) bool {
+	if f, ok := w.(*os.File); ok {
+		return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+	}
+	return false
+}
+
+type traceRouteReport struct {
+	Service string                `json:"service"`
+	Probes  uint                  `json:"probes"`
+	Hops    []*traceRouteHopStats `json:"hops"`
+}
+
+func (self *traceRouteReport) getHop(hop uint32) *traceRouteHopStats {
+	for _, stats := range self.Hops {
+		if stats.Hop == hop {
+			return stats
+		}
+	}
+	stats := &traceRouteHopStats{Hop: hop}
+	self.Hops = append(self.Hops, stats)
+	return stats
+}
+
+// traceRouteHopStats accumulates the results of probing a single hop. Jitter is the mean difference between
+// consecutive response times
+type traceRouteHopStats struct {
+	Hop         uint32  `json:"hop"`
+	Type        string  `json:"type"`
+	Id          string  `json:"id"`
+	Name        string  `json:"name,omitempty"`
+	Sent        uint    `json:"sent"`
+	Received    uint    `json:"received"`
+	LossPercent float64 `json:"lossPercent"`
+	LastMs      float64 `json:"lastMs"`
+	MinMs       float64 `json:"minMs"`
+	AvgMs       float64 `json:"avgMs"`
+	MaxMs       float64 `json:"maxMs"`
+	StdDevMs    float64 `json:"stdDevMs"`
+	JitterMs    float64 `json:"jitterMs"`
+	LastError   string  `json:"lastError,omitempty"`
+
+	sum         float64
+	sumSquares  float64
+	jitterSum   float64
+	jitterCount uint
+}
+
+func (self *traceRouteHopStats) recordLoss(reason string) {
+	self.Sent++
+	self.LastError = reason
+	self.updateLoss()
+}
+
+func (self *traceRouteHopStats) recordTime(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	if self.Received > 0 {
+		self.jitterSum += math.Abs(ms - self.LastMs)
+		self.jitterCount++
+		self.JitterMs = self.jitterSum / float64(self.jitterCount)
+	}
+
+	self.Sent++
+	self.Received++
+	self.LastMs = ms
+	if self.Received == 1 || ms < self.MinMs {
+		self.MinMs = ms
+	}
+	if ms > self.MaxMs {
+		self.MaxMs = ms
+	}
+
+	self.sum += ms
+	self.sumSquares += ms * ms
+	n := float64(self.Received)
+	self.AvgMs = self.sum / n
+	self.StdDevMs = math.Sqrt(math.Max(0, self.sumSquares/n-self.AvgMs*self.AvgMs))
+	self.updateLoss()
+}
+
+func (self *traceRouteHopStats) updateLoss() {
+	self.LossPercent = 100 * float64(self.Sent-self.Received) / float64(self.Sent)
+}
@@ -0,0 +1,28 @@
+package edge
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTraceRouteHopStats(t *testing.T) {
+	req := require.New(t)
+
+	stats := &traceRouteHopStats{Hop: 1}
+	stats.recordTime(10 * time.Millisecond)
+	stats.recordTime(20 * time.Millisecond)
+	stats.recordLoss("timeout")
+	stats.recordTime(15 * time.Millisecond)
+
+	req.Equal(uint(4), stats.Sent)
+	req.Equal(uint(3), stats.Received)
+	req.Equal(25.0, stats.LossPercent)
+	req.Equal(15.0, stats.LastMs)
+	req.Equal(10.0, stats.MinMs)
+	req.Equal(20.0, stats.MaxMs)
+	req.Equal(15.0, stats.AvgMs)
+	req.InDelta(4.08, stats.StdDevMs, 0.01)
+	req.Equal(7.5, stats.JitterMs)
+	req.Equal("timeout", stats.LastError)
+}
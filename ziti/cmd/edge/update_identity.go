@@ -22,7 +22,6 @@ import (
 	"github.com/openziti/ziti/ziti/cmd/api"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
 	"io"
-	"math"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -131,38 +130,18 @@ func runUpdateIdentity(o *updateIdentityOptions) error {
 		change = true
 	}
 
+	serviceCosts, servicePrecedences, err := mapServiceHostingToIDs(o.serviceCosts, o.servicePrecedences, o.Options)
+	if err != nil {
+		return err
+	}
+
 	if o.Cmd.Flags().Changed("service-costs") {
-		for k, v := range o.serviceCosts {
-			if v < 0 || v > math.MaxUint16 {
-				return errors.Errorf("hosting costs must be in the range %v-%v", 0, math.MaxUint16)
-			}
-			id, err := mapNameToID("services", k, o.Options)
-			if err != nil {
-				return err
-			}
-			delete(o.serviceCosts, k)
-			o.serviceCosts[id] = v
-		}
-		api.SetJSONValue(entityData, o.serviceCosts, "serviceHostingCosts")
+		api.SetJSONValue(entityData, serviceCosts, "serviceHostingCosts")
 		change = true
 	}
 
 	if o.Cmd.Flags().Changed("service-precedences") {
-		for k, v := range o.servicePrecedences {
-			id, err := mapNameToID("services", k, o.Options)
-			if err != nil {
-				return err
-			}
-
-			prec, err := normalizeAndValidatePrecedence(v)
-			if err != nil {
-				return err
-			}
-
-			delete(o.servicePrecedences, k)
-			o.servicePrecedences[id] = prec
-		}
-		api.SetJSONValue(entityData, o.servicePrecedences, "serviceHostingPrecedences")
+		api.SetJSONValue(entityData, servicePrecedences, "serviceHostingPrecedences")
 		change = true
 	}
 
@@ -38,6 +38,7 @@ func newVerifyCmd(out io.Writer, errOut io.Writer) *cobra.Command {
 	}
 
 	cmd.AddCommand(newVerifyCaCmd(out, errOut))
+	cmd.AddCommand(newVerifyExtJwtSignerCmd(out, errOut))
 
 	return cmd
 }
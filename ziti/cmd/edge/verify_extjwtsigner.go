@@ -0,0 +1,384 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"github.com/golang-jwt/jwt"
+	nfpem "github.com/openziti/foundation/v2/pem"
+	"github.com/openziti/jwks"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type verifyExtJwtSignerOptions struct {
+	api.Options
+	token    string
+	jwksFile string
+}
+
+// newVerifyExtJwtSignerCmd creates the 'edge verify ext-jwt-signer' command
+func newVerifyExtJwtSignerCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &verifyExtJwtSignerOptions{
+		Options: api.Options{
+			CommonOptions: common.CommonOptions{
+				Out: out,
+				Err: errOut,
+			},
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "ext-jwt-signer <name> --token <jwt> [--jwks <file>]",
+		Short: "verifies a JWT against an external JWT signer, without authenticating",
+		Long: "Verifies a JWT the same way the controller does when authenticating with --ext-jwt: the signature, issuer, " +
+			"audience, expiry and claims property are checked locally against the configuration of the external JWT signer, " +
+			"and the identity the token maps to is reported. For signers using a JWKS endpoint, --jwks can supply the keys " +
+			"from a local file instead of fetching them. If --token is -, the token is read from stdin.",
+		Args:    cobra.ExactArgs(1),
+		Aliases: []string{"external-jwt-signer"},
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := runVerifyExtJwtSigner(options)
+			cmdhelper.CheckErr(err)
+		},
+		SuggestFor: []string{},
+	}
+
+	// allow interspersing positional args and flags
+	cmd.Flags().SetInterspersed(true)
+	cmd.Flags().StringVarP(&options.token, "token", "t", "", "The JWT to verify, or - to read it from stdin")
+	cmd.Flags().StringVar(&options.jwksFile, "jwks", "", "A JWKS file to use instead of the signer's JWKS endpoint")
+	_ = cmd.MarkFlagRequired("token")
+	options.AddCommonFlags(cmd)
+
+	return cmd
+}
+
+// extJwtVerification collects the outcome of each step of verifying a token, so all problems can be reported at once
+type extJwtVerification struct {
+	out    io.Writer
+	failed bool
+}
+
+func (self *extJwtVerification) pass(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(self.out, "[OK]   "+format+"\n", args...)
+}
+
+func (self *extJwtVerification) fail(format string, args ...interface{}) {
+	self.failed = true
+	_, _ = fmt.Fprintf(self.out, "[FAIL] "+format+"\n", args...)
+}
+
+func runVerifyExtJwtSigner(o *verifyExtJwtSignerOptions) error {
+	token := strings.TrimSpace(o.token)
+	if token == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return errors.Wrap(err, "unable to read token from stdin")
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	signerId, err := mapNameToID("external-jwt-signers", o.Args[0], o.Options)
+	if err != nil {
+		return err
+	}
+
+	result, err := util.ControllerDetailEntity(util.EdgeAPI, "external-jwt-signers", signerId, o.OutputJSONResponse, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
+		return err
+	}
+	signer := result.S("data")
+	signerName, _ := signer.S("name").Data().(string)
+
+	v := &extJwtVerification{out: o.Out}
+	_, _ = fmt.Fprintf(o.Out, "Verifying token against external JWT signer %v (%v)\n", signerName, signerId)
+
+	if enabled, _ := signer.S("enabled").Data().(bool); enabled {
+		v.pass("signer is enabled")
+	} else {
+		v.fail("signer is disabled")
+	}
+
+	keys, keySource, err := o.getSignerKeys(signer)
+	if err != nil {
+		v.fail("unable to load signer keys from %v: %v", keySource, err)
+	}
+
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+	parsed, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token header has no kid")
+		}
+		key, found := keys[kid]
+		if !found {
+			return nil, errors.Errorf("kid %v not found in keys from %v", kid, keySource)
+		}
+		return key, nil
+	})
+
+	if parsed == nil {
+		return errors.Wrap(err, "unable to parse token")
+	}
+
+	kid, _ := parsed.Header["kid"].(string)
+	if err == nil && parsed.Valid {
+		v.pass("signature verified with kid %v (%v) from %v", kid, parsed.Method.Alg(), keySource)
+	} else if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner != nil {
+		v.fail("signature not verified: %v", validationErr.Inner)
+	} else {
+		v.fail("signature not verified: %v", err)
+	}
+
+	issuer, _ := claims["iss"].(string)
+	if expected, ok := signer.S("issuer").Data().(string); ok && expected != "" {
+		if issuer == expected {
+			v.pass("issuer is %v", issuer)
+		} else {
+			v.fail("issuer is %v, expected %v", issuer, expected)
+		}
+	}
+
+	if expected, ok := signer.S("audience").Data().(string); ok && expected != "" {
+		audiences := getJwtAudiences(claims["aud"])
+		found := false
+		for _, audience := range audiences {
+			if audience == expected {
+				found = true
+				break
+			}
+		}
+		if found {
+			v.pass("audience contains %v", expected)
+		} else {
+			v.fail("audience %v does not contain %v", audiences, expected)
+		}
+	}
+
+	now := time.Now().Unix()
+	if _, hasExp := claims["exp"]; !hasExp {
+		v.pass("token has no expiry")
+	} else if claims.VerifyExpiresAt(now, true) {
+		v.pass("token expires at %v", formatJwtTime(claims["exp"]))
+	} else {
+		v.fail("token expired at %v", formatJwtTime(claims["exp"]))
+	}
+
+	if !claims.VerifyNotBefore(now, false) {
+		v.fail("token is not valid before %v", formatJwtTime(claims["nbf"]))
+	}
+
+	if !claims.VerifyIssuedAt(now, false) {
+		v.fail("token was issued in the future, at %v", formatJwtTime(claims["iat"]))
+	}
+
+	claimsProperty, _ := signer.S("claimsProperty").Data().(string)
+	if claimsProperty == "" {
+		claimsProperty = "sub"
+	}
+
+	claimsId, _ := claims[claimsProperty].(string)
+	if claimsId == "" {
+		v.fail("claims property %v is missing or not a string", claimsProperty)
+	} else {
+		v.pass("claims property %v is %v", claimsProperty, claimsId)
+		useExternalId, _ := signer.S("useExternalId").Data().(bool)
+		if err = o.checkIdentity(v, claimsId, useExternalId, signerId); err != nil {
+			return err
+		}
+	}
+
+	if v.failed {
+		return errors.New("token would not be accepted by the controller")
+	}
+
+	_, err = fmt.Fprintln(o.Out, "Token would be accepted by the controller")
+	return err
+}
+
+// getSignerKeys returns the public keys of the signer, indexed by kid, along with where they were loaded from
+func (o *verifyExtJwtSignerOptions) getSignerKeys(signer *gabs.Container) (map[string]interface{}, string, error) {
+	keys := map[string]interface{}{}
+
+	if certPem, _ := signer.S("certPem").Data().(string); certPem != "" && o.jwksFile == "" {
+		certs := nfpem.PemStringToCertificates(certPem)
+		if len(certs) == 0 {
+			return keys, "certPem", errors.New("PEM did not contain any certificates")
+		}
+
+		// as on the controller, only the first certificate is used
+		kid, _ := signer.S("kid").Data().(string)
+		if kid == "" {
+			kid = nfpem.FingerprintFromCertificate(certs[0])
+		}
+		keys[kid] = certs[0].PublicKey
+		return keys, "certPem", nil
+	}
+
+	var response *jwks.Response
+	var source string
+
+	if o.jwksFile != "" {
+		source = o.jwksFile
+		data, err := os.ReadFile(o.jwksFile)
+		if err != nil {
+			return keys, source, err
+		}
+		response = &jwks.Response{}
+		if err = json.Unmarshal(data, response); err != nil {
+			return keys, source, err
+		}
+	} else {
+		endpoint, _ := signer.S("jwksEndpoint").Data().(string)
+		if endpoint == "" {
+			return keys, "signer", errors.New("signer has neither a certificate nor a JWKS endpoint")
+		}
+		source = endpoint
+		resolver := &jwks.HttpResolver{}
+		var err error
+		if response, _, err = resolver.Get(endpoint); err != nil {
+			return keys, source, err
+		}
+	}
+
+	for _, key := range response.Keys {
+		// if there's an x509 chain, the first certificate holds the signing key
+		if len(key.X509Chain) != 0 {
+			der, err := base64.StdEncoding.DecodeString(key.X509Chain[0])
+			if err != nil {
+				return keys, source, errors.Wrapf(err, "invalid x5c for kid %v", key.KeyId)
+			}
+			certs, err := x509.ParseCertificates(der)
+			if err != nil || len(certs) == 0 {
+				return keys, source, errors.Wrapf(err, "invalid certificate for kid %v", key.KeyId)
+			}
+			keys[key.KeyId] = certs[0].PublicKey
+		} else {
+			pubKey, err := jwks.KeyToPublicKey(key)
+			if err != nil {
+				return keys, source, errors.Wrapf(err, "invalid key for kid %v", key.KeyId)
+			}
+			keys[key.KeyId] = pubKey
+		}
+	}
+
+	return keys, source, nil
+}
+
+// checkIdentity reports the identity the claims id maps to and whether its auth policy permits the signer
+func (o *verifyExtJwtSignerOptions) checkIdentity(v *extJwtVerification, claimsId string, useExternalId bool, signerId string) error {
+	field := "id"
+	if useExternalId {
+		field = "externalId"
+	}
+
+	identities, _, err := filterEntitiesOfType("identities", fmt.Sprintf(`%v = "%v"`, field, strings.ReplaceAll(claimsId, `"`, `\"`)), false, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
+		return err
+	}
+
+	if len(identities) == 0 {
+		v.fail("no identity has %v %v", field, claimsId)
+		return nil
+	}
+
+	identity := identities[0]
+	identityName, _ := identity.S("name").Data().(string)
+	identityId, _ := identity.S("id").Data().(string)
+	v.pass("maps to identity %v (%v) by %v", identityName, identityId, field)
+
+	if disabled, _ := identity.S("disabled").Data().(bool); disabled {
+		v.fail("identity %v is disabled", identityName)
+	}
+
+	authPolicyId, _ := identity.S("authPolicyId").Data().(string)
+	if authPolicyId == "" {
+		return nil
+	}
+
+	result, err := util.ControllerDetailEntity(util.EdgeAPI, "auth-policies", authPolicyId, false, o.Out, o.Timeout, o.Verbose)
+	if err != nil {
+		return err
+	}
+	authPolicyName, _ := result.S("data", "name").Data().(string)
+	extJwt := result.S("data", "primary", "extJwt")
+
+	if allowed, _ := extJwt.S("allowed").Data().(bool); !allowed {
+		v.fail("auth policy %v does not allow external JWT authentication", authPolicyName)
+		return nil
+	}
+
+	allowedSigners, _ := extJwt.S("allowedSigners").Data().([]interface{})
+	if len(allowedSigners) > 0 {
+		for _, allowedSigner := range allowedSigners {
+			if allowedSigner == signerId {
+				v.pass("auth policy %v allows this signer", authPolicyName)
+				return nil
+			}
+		}
+		v.fail("auth policy %v does not allow this signer", authPolicyName)
+		return nil
+	}
+
+	v.pass("auth policy %v allows external JWT authentication", authPolicyName)
+	return nil
+}
+
+func getJwtAudiences(aud interface{}) []string {
+	switch val := aud.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var result []string
+		for _, v := range val {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func formatJwtTime(val interface{}) string {
+	switch t := val.(type) {
+	case float64:
+		return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return time.Unix(i, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return fmt.Sprintf("%v", val)
+}
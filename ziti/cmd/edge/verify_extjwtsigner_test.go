@@ -0,0 +1,109 @@
+package edge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt"
+	"github.com/openziti/jwks"
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyExtJwtSigner(t *testing.T) {
+	server := apitest.NewServer(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	signerId := server.Create("external-jwt-signers", map[string]interface{}{
+		"name":           "idp",
+		"enabled":        true,
+		"issuer":         "https://idp.example.com",
+		"audience":       "ziti",
+		"claimsProperty": "email",
+		"useExternalId":  true,
+		"kid":            "key-1",
+		"certPem":        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	})
+	server.Create("auth-policies", map[string]interface{}{
+		"id":      "ext-jwt",
+		"name":    "ext-jwt-only",
+		"primary": map[string]interface{}{"extJwt": map[string]interface{}{"allowed": true, "allowedSigners": []interface{}{signerId}}},
+	})
+	server.Create("identities", map[string]interface{}{"name": "alice", "type": "User", "externalId": "alice@example.com", "authPolicy": "ext-jwt"})
+
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "key-1"
+		result, err := token.SignedString(key)
+		require.NoError(t, err)
+		return result
+	}
+
+	output, err := apitest.Execute(NewCmdEdge, "verify", "ext-jwt-signer", "idp", "--token", sign(jwt.MapClaims{
+		"iss":   "https://idp.example.com",
+		"aud":   []interface{}{"other", "ziti"},
+		"email": "alice@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}))
+	require.NoError(t, err, output)
+	require.Contains(t, output, "[OK]   signature verified with kid key-1 (ES256) from certPem")
+	require.Contains(t, output, "[OK]   maps to identity alice (")
+	require.Contains(t, output, "[OK]   auth policy ext-jwt-only allows this signer")
+	require.NotContains(t, output, "[FAIL]")
+
+	output, err = apitest.Execute(NewCmdEdge, "verify", "ext-jwt-signer", "idp", "--token", sign(jwt.MapClaims{
+		"iss":   "https://other.example.com",
+		"aud":   "other",
+		"email": "bob@example.com",
+		"exp":   time.Now().Add(-time.Hour).Unix(),
+	}))
+	require.Error(t, err)
+	require.Contains(t, output, "[FAIL] issuer is https://other.example.com, expected https://idp.example.com")
+	require.Contains(t, output, "[FAIL] audience [other] does not contain ziti")
+	require.Contains(t, output, "[FAIL] token expired at ")
+	require.Contains(t, output, "[FAIL] no identity has externalId bob@example.com")
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	jwksKey, err := jwks.NewKey("key-1", cert, nil)
+	require.NoError(t, err)
+	jwksJson, err := json.Marshal(&jwks.Response{Keys: []jwks.Key{*jwksKey}})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwksJson, 0600))
+
+	server.Create("external-jwt-signers", map[string]interface{}{
+		"name":          "air-gapped",
+		"enabled":       true,
+		"issuer":        "https://idp.example.com",
+		"useExternalId": true,
+		"jwksEndpoint":  "https://unreachable.example.com/jwks",
+	})
+
+	output, err = apitest.Execute(NewCmdEdge, "verify", "ext-jwt-signer", "air-gapped", "--jwks", jwksFile, "--token", sign(jwt.MapClaims{
+		"iss": "https://idp.example.com",
+		"sub": "alice@example.com",
+	}))
+	require.Error(t, err)
+	require.Contains(t, output, "[OK]   signature verified with kid key-1 (ES256) from "+jwksFile)
+	require.Contains(t, output, "[FAIL] auth policy ext-jwt-only does not allow this signer")
+}
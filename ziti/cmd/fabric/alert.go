@@ -0,0 +1,335 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	alertEvaluateInterval = time.Second
+	alertExecTimeout      = 30 * time.Second
+	alertExecQueueSize    = 1000
+)
+
+type alertAction struct {
+	streamEventsAction
+	rulesFile string
+	check     bool
+	replay    string
+	speed     string
+}
+
+func newAlertCmd(p common.OptionsProvider) *cobra.Command {
+	action := &alertAction{
+		streamEventsAction: streamEventsAction{
+			Options: api.Options{
+				CommonOptions: p(),
+			},
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "alert",
+		Short: "Send alerts based on rules over the event stream",
+		Long: "Evaluates the rules in the rules file against the event stream and notifies the configured outputs " +
+			"when alerts fire and when they resolve. A rule selects events with a match expression, in the syntax of " +
+			"ziti fabric stream events --where, and groups them by the group_by fields. A rule with a condition fires " +
+			"when the condition has held for the latest matching event of a group for at least the for duration, and " +
+			"resolves when a matching event doesn't meet the condition. A rule with a window and above fires when more " +
+			"than above events of a group match within the window, and resolves when the count drops again.\n\n" +
+			"Example rules file:\n\n" +
+			"rules:\n" +
+			"  - name: router-offline\n" +
+			"    match: namespace == \"fabric.routers\"\n" +
+			"    condition: event_type == \"router-offline\"\n" +
+			"    for: 2m\n" +
+			"    group_by: [router_id]\n" +
+			"    severity: critical\n" +
+			"  - name: failed-circuits\n" +
+			"    match: namespace == \"fabric.circuits\" && event_type == \"failed\"\n" +
+			"    window: 5m\n" +
+			"    above: 50\n" +
+			"    group_by: [service_id]\n" +
+			"  - name: link-latency\n" +
+			"    match: namespace == \"metrics\" && metric == \"link.latency\"\n" +
+			"    condition: metrics.p95 > 200000000\n" +
+			"    group_by: [source_entity_id]\n" +
+			"outputs:\n" +
+			"  - type: stdout\n" +
+			"  - type: webhook\n" +
+			"    url: https://alerts.example.com/hook\n" +
+			"  - type: exec\n" +
+			"    command: [/usr/local/bin/page-oncall]\n" +
+			"repeat: 1h\n\n" +
+			"Webhooks get JSON arrays of notifications. Exec commands get the notification as JSON on stdin, with the " +
+			"rule and status in the ZITI_ALERT_RULE and ZITI_ALERT_STATUS environment variables. Latencies are in " +
+			"nanoseconds",
+		Example: "ziti fabric alert -f rules.yml\n" +
+			"ziti fabric alert -f rules.yml --check\n" +
+			"ziti fabric alert -f rules.yml --replay-events incident.zev --speed max",
+		Args: cobra.ExactArgs(0),
+		RunE: action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	action.AddStreamFlags(cmd)
+	action.addSubscriptionFlags(cmd)
+	cmd.Flags().StringVarP(&action.rulesFile, "rules-file", "f", "", "The rules file")
+	cmd.Flags().BoolVar(&action.check, "check", false, "Check the rules file and exit")
+	cmd.Flags().StringVar(&action.replay, "replay-events", "", "Evaluate the rules against a recording made with ziti fabric stream events --record-events, "+
+		"instead of connecting to the controller")
+	cmd.Flags().StringVar(&action.speed, "speed", "max", "How fast to replay a recording, such as 10x, or max")
+	_ = cmd.MarkFlagRequired("rules-file")
+
+	// alerting is meant to run unattended, so it reconnects by default
+	reconnectFlag := cmd.Flags().Lookup("reconnect")
+	reconnectFlag.DefValue = "true"
+	_ = reconnectFlag.Value.Set("true")
+	return cmd
+}
+
+func (self *alertAction) run(cmd *cobra.Command, _ []string) error {
+	config, err := loadAlertConfig(self.rulesFile)
+	if err != nil {
+		return err
+	}
+
+	if self.check {
+		_, _ = fmt.Fprintf(self.Out, "%v: %v rules ok\n", self.rulesFile, len(config.Rules))
+		return nil
+	}
+
+	outputs, err := newAlertOutputs(config.Outputs, self.Out, self.Err)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = outputs.Close() }()
+
+	engine := newAlertEngine(config, func(notification *alertNotification) {
+		if data, err := json.Marshal(notification); err == nil {
+			_ = outputs.AcceptEvent(data)
+		}
+	})
+
+	if self.replay != "" {
+		speed, err := parseReplaySpeed(self.speed)
+		if err != nil {
+			return err
+		}
+
+		// windows and durations are measured against the time events were recorded
+		clock := &replayClock{}
+		engine.now = clock.now
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		return replayRecording(ctx, self.replay, speed, self.Err, func(evt *recordedEvent) error {
+			// evaluate up to the time of the event first, so alerts fire and resolve in the recorded order
+			clock.set(evt.received)
+			engine.evaluate()
+			return engine.AcceptEvent(evt.event)
+		})
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(alertEvaluateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				engine.evaluate()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	self.sink = engine
+	return self.streamEvents(cmd, nil)
+}
+
+// newAlertOutputs creates the outputs of the rules file, writing to stdout if there are none
+func newAlertOutputs(outputs []*alertOutput, out, errOut io.Writer) (*eventSinks, error) {
+	if len(outputs) == 0 {
+		outputs = []*alertOutput{{Type: "stdout"}}
+	}
+
+	result := &eventSinks{errOut: errOut}
+	for _, output := range outputs {
+		var sink eventSink
+		var name string
+
+		switch output.Type {
+		case "stdout":
+			writer := &writerEventSink{out: out}
+			if output.Format != "json" {
+				writer.format = formatAlertLine
+			}
+			sink, name = writer, "stdout"
+		case "webhook":
+			webhookUrl, err := url.Parse(output.Url)
+			if err != nil {
+				_ = result.Close()
+				return nil, errors.Wrapf(err, "invalid webhook url %v", output.Url)
+			}
+			if sink, err = newHttpEventSink(webhookUrl, errOut); err != nil {
+				_ = result.Close()
+				return nil, err
+			}
+			name = redactSinkSpec(output.Url)
+		case "exec":
+			sink, name = newExecAlertSink(output.Command, errOut), "exec:"+output.Command[0]
+		}
+
+		result.sinks = append(result.sinks, sink)
+		result.names = append(result.names, name)
+	}
+	return result, nil
+}
+
+// formatAlertLine renders a notification as a colorized line, such as
+//
+//	2023-05-01T10:02:00Z FIRING   router-offline [router_id=r1] critical: since 2023-05-01T10:00:00Z
+func formatAlertLine(data []byte) string {
+	notification := &alertNotification{}
+	if err := json.Unmarshal(data, notification); err != nil {
+		return string(data)
+	}
+
+	var status string
+	switch {
+	case notification.Status == alertStatusResolved:
+		status = util.ColorInfo("RESOLVED")
+	case notification.Repeat:
+		status = util.ColorWarning("FIRING  ")
+	default:
+		status = util.ColorError("FIRING  ")
+	}
+
+	var labels []string
+	for k, v := range notification.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+
+	line := &strings.Builder{}
+	_, _ = fmt.Fprintf(line, "%v %v %v", notification.Timestamp.UTC().Format(time.RFC3339), status, notification.Rule)
+	if len(labels) > 0 {
+		_, _ = fmt.Fprintf(line, " [%v]", strings.Join(labels, ","))
+	}
+	if notification.Severity != "" {
+		_, _ = fmt.Fprintf(line, " %v", notification.Severity)
+	}
+	if notification.Count > 0 {
+		_, _ = fmt.Fprintf(line, " count=%v", notification.Count)
+	}
+	if notification.ResolvedAt != nil {
+		_, _ = fmt.Fprintf(line, ": after %v", notification.ResolvedAt.Sub(notification.StartedAt).Round(time.Second))
+	} else {
+		_, _ = fmt.Fprintf(line, ": since %v", notification.StartedAt.UTC().Format(time.RFC3339))
+	}
+	if notification.Summary != "" {
+		_, _ = fmt.Fprintf(line, ", %v", notification.Summary)
+	}
+	return line.String()
+}
+
+// execAlertSink runs a command for each notification, with the notification as JSON on stdin. Commands run one at a
+// time, in the order of the notifications, so a slow command delays later notifications rather than running many
+// commands at once. If the queue fills up, notifications are dropped
+type execAlertSink struct {
+	command       []string
+	errOut        io.Writer
+	notifications chan []byte
+	done          chan struct{}
+}
+
+func newExecAlertSink(command []string, errOut io.Writer) *execAlertSink {
+	result := &execAlertSink{
+		command:       command,
+		errOut:        errOut,
+		notifications: make(chan []byte, alertExecQueueSize),
+		done:          make(chan struct{}),
+	}
+	go result.run()
+	return result
+}
+
+func (self *execAlertSink) AcceptEvent(event []byte) error {
+	select {
+	case self.notifications <- event:
+		return nil
+	default:
+		return errors.New("exec queue full, dropping notification")
+	}
+}
+
+func (self *execAlertSink) Close() error {
+	close(self.notifications)
+	<-self.done
+	return nil
+}
+
+func (self *execAlertSink) run() {
+	defer close(self.done)
+	for notification := range self.notifications {
+		if err := self.exec(notification); err != nil {
+			_, _ = fmt.Fprintf(self.errOut, "alert exec %v: %v\n", self.command[0], err)
+		}
+	}
+}
+
+func (self *execAlertSink) exec(notification []byte) error {
+	header := &struct {
+		Rule   string `json:"rule"`
+		Status string `json:"status"`
+	}{}
+	_ = json.Unmarshal(notification, header)
+
+	ctx, cancel := context.WithTimeout(context.Background(), alertExecTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, self.command[0], self.command[1:]...)
+	cmd.Stdin = bytes.NewReader(notification)
+	cmd.Env = append(os.Environ(), "ZITI_ALERT_RULE="+header.Rule, "ZITI_ALERT_STATUS="+header.Status)
+	output, err := cmd.CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return errors.Wrap(err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
@@ -0,0 +1,354 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	alertStatusFiring   = "firing"
+	alertStatusResolved = "resolved"
+)
+
+// alertConfig is the rules file of ziti fabric alert
+type alertConfig struct {
+	Rules   []*alertRule   `yaml:"rules"`
+	Outputs []*alertOutput `yaml:"outputs"`
+	// Repeat is how often notifications are repeated for alerts that are still firing. 0 only notifies once
+	Repeat time.Duration `yaml:"repeat"`
+}
+
+// alertRule is either a condition rule, which fires when the condition has held for the matching events of a group
+// for at least For, or a count rule, which fires when more than Above events of a group match within Window.
+//
+// Condition rules resolve when a matching event of the group no longer meets the condition. For example, with a
+// match of namespace == "fabric.routers" and a condition of event_type == "router-offline", a router coming back
+// online resolves the alert. Count rules resolve when the count within the window drops to Above or below
+type alertRule struct {
+	Name      string        `yaml:"name"`
+	Match     string        `yaml:"match"`
+	Condition string        `yaml:"condition"`
+	For       time.Duration `yaml:"for"`
+	Window    time.Duration `yaml:"window"`
+	Above     *int          `yaml:"above"`
+	GroupBy   []string      `yaml:"group_by"`
+	Severity  string        `yaml:"severity"`
+	Summary   string        `yaml:"summary"`
+
+	match     *eventFilter
+	condition *eventFilter
+	groupBy   [][]string
+}
+
+// alertOutput is where notifications go. Type is one of stdout, webhook or exec
+type alertOutput struct {
+	Type    string   `yaml:"type"`
+	Format  string   `yaml:"format"`
+	Url     string   `yaml:"url"`
+	Command []string `yaml:"command"`
+}
+
+func loadAlertConfig(path string) (*alertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseAlertConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid rules file %v", path)
+	}
+	return config, nil
+}
+
+func parseAlertConfig(data []byte) (*alertConfig, error) {
+	config := &alertConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Rules) == 0 {
+		return nil, errors.New("no rules defined")
+	}
+
+	names := map[string]struct{}{}
+	for idx, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, errors.Errorf("rule %v has no name", idx+1)
+		}
+		if _, found := names[rule.Name]; found {
+			return nil, errors.Errorf("rule name %v is used more than once", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrapf(err, "rule %v", rule.Name)
+		}
+	}
+
+	for _, output := range config.Outputs {
+		switch output.Type {
+		case "stdout":
+			if output.Format != "" && output.Format != "text" && output.Format != "json" {
+				return nil, errors.Errorf("unsupported stdout format '%v', must be one of: text, json", output.Format)
+			}
+		case "webhook":
+			if output.Url == "" {
+				return nil, errors.New("webhook output requires a url")
+			}
+		case "exec":
+			if len(output.Command) == 0 {
+				return nil, errors.New("exec output requires a command")
+			}
+		default:
+			return nil, errors.Errorf("unsupported output type '%v', must be one of: stdout, webhook, exec", output.Type)
+		}
+	}
+	return config, nil
+}
+
+func (self *alertRule) compile() error {
+	if self.Match == "" {
+		return errors.New("match is required")
+	}
+
+	var err error
+	if self.match, err = newEventFilter(self.Match); err != nil {
+		return err
+	}
+
+	if self.Condition != "" {
+		if self.Above != nil || self.Window != 0 {
+			return errors.New("a rule has either a condition, or a window and above, not both")
+		}
+		if self.condition, err = newEventFilter(self.Condition); err != nil {
+			return err
+		}
+	} else {
+		if self.Above == nil || self.Window <= 0 {
+			return errors.New("a rule needs either a condition, or a window and above")
+		}
+		if self.For != 0 {
+			return errors.New("for only applies to rules with a condition")
+		}
+	}
+
+	for _, field := range self.GroupBy {
+		self.groupBy = append(self.groupBy, strings.Split(field, "."))
+	}
+	return nil
+}
+
+// alertNotification is sent to the outputs when an alert fires, resolves or is repeated
+type alertNotification struct {
+	Rule       string            `json:"rule"`
+	Status     string            `json:"status"`
+	Severity   string            `json:"severity,omitempty"`
+	Summary    string            `json:"summary,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"`
+	StartedAt  time.Time         `json:"started_at"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+	Count      int               `json:"count,omitempty"`
+	Repeat     bool              `json:"repeat,omitempty"`
+	Event      json.RawMessage   `json:"event,omitempty"`
+}
+
+// alertState tracks a rule for one group of events
+type alertState struct {
+	rule         *alertRule
+	labels       map[string]string
+	since        time.Time
+	hits         []time.Time
+	firing       bool
+	firedAt      time.Time
+	lastNotified time.Time
+	event        []byte
+}
+
+// alertEngine evaluates rules against events. Notifications are deduplicated, so each alert notifies once when it
+// fires and once when it resolves, plus repeats if configured. Rules with a duration are also evaluated on a timer,
+// as they can fire without any new events
+type alertEngine struct {
+	lock   sync.Mutex
+	config *alertConfig
+	states map[string]*alertState
+	notify func(*alertNotification)
+	now    func() time.Time
+}
+
+func newAlertEngine(config *alertConfig, notify func(*alertNotification)) *alertEngine {
+	return &alertEngine{
+		config: config,
+		states: map[string]*alertState{},
+		notify: notify,
+		now:    time.Now,
+	}
+}
+
+func (self *alertEngine) AcceptEvent(data []byte) error {
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	for _, rule := range self.config.Rules {
+		if !rule.match.matchesDecoded(decoded) {
+			continue
+		}
+
+		state := self.getState(rule, decoded)
+		if rule.condition != nil {
+			if rule.condition.matchesDecoded(decoded) {
+				if state.since.IsZero() {
+					state.since = now
+				}
+				state.event = data
+			} else {
+				state.since = time.Time{}
+				if state.firing {
+					state.event = data
+					self.resolve(state, now)
+				}
+			}
+		} else {
+			state.hits = append(state.hits, now)
+			state.event = data
+		}
+	}
+
+	self.evaluateLocked(now)
+	return nil
+}
+
+func (self *alertEngine) Close() error {
+	return nil
+}
+
+func (self *alertEngine) getState(rule *alertRule, event map[string]interface{}) *alertState {
+	labels := map[string]string{}
+	key := rule.Name
+	for idx, path := range rule.groupBy {
+		var val string
+		if fieldVal := filterLookup(event, path); fieldVal != nil {
+			val = filterValueString(fieldVal)
+		}
+		labels[rule.GroupBy[idx]] = val
+		key += "\x00" + val
+	}
+
+	state, found := self.states[key]
+	if !found {
+		state = &alertState{rule: rule, labels: labels}
+		self.states[key] = state
+	}
+	return state
+}
+
+// evaluate checks durations and windows, which can fire or resolve alerts as time passes
+func (self *alertEngine) evaluate() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.evaluateLocked(self.now())
+}
+
+func (self *alertEngine) evaluateLocked(now time.Time) {
+	var keys []string
+	for key := range self.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		state := self.states[key]
+		rule := state.rule
+
+		if rule.condition != nil {
+			if !state.firing && !state.since.IsZero() && now.Sub(state.since) >= rule.For {
+				self.fire(state, state.since, now)
+			}
+		} else {
+			cutoff := now.Add(-rule.Window)
+			idx := 0
+			for idx < len(state.hits) && !state.hits[idx].After(cutoff) {
+				idx++
+			}
+			state.hits = state.hits[idx:]
+
+			if !state.firing && len(state.hits) > *rule.Above {
+				self.fire(state, now, now)
+			} else if state.firing && len(state.hits) <= *rule.Above {
+				self.resolve(state, now)
+			}
+		}
+
+		if state.firing && self.config.Repeat > 0 && now.Sub(state.lastNotified) >= self.config.Repeat {
+			notification := self.notification(state, alertStatusFiring, now)
+			notification.Repeat = true
+			state.lastNotified = now
+			self.notify(notification)
+		}
+
+		if !state.firing && state.since.IsZero() && len(state.hits) == 0 {
+			delete(self.states, key)
+		}
+	}
+}
+
+func (self *alertEngine) fire(state *alertState, startedAt, now time.Time) {
+	state.firing = true
+	state.firedAt = startedAt
+	state.lastNotified = now
+	self.notify(self.notification(state, alertStatusFiring, now))
+}
+
+func (self *alertEngine) resolve(state *alertState, now time.Time) {
+	state.firing = false
+	notification := self.notification(state, alertStatusResolved, now)
+	notification.ResolvedAt = &now
+	self.notify(notification)
+}
+
+func (self *alertEngine) notification(state *alertState, status string, now time.Time) *alertNotification {
+	result := &alertNotification{
+		Rule:      state.rule.Name,
+		Status:    status,
+		Severity:  state.rule.Severity,
+		Summary:   state.rule.Summary,
+		Timestamp: now,
+		StartedAt: state.firedAt,
+		Event:     state.event,
+	}
+	if len(state.labels) > 0 {
+		result.Labels = state.labels
+	}
+	if state.rule.condition == nil {
+		result.Count = len(state.hits)
+	}
+	return result
+}
@@ -0,0 +1,204 @@
+package fabric
+
+import (
+	"encoding/json"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testAlertRules = `
+rules:
+  - name: router-offline
+    match: namespace == "fabric.routers"
+    condition: event_type == "router-offline"
+    for: 2m
+    group_by: [router_id]
+    severity: critical
+  - name: failed-circuits
+    match: namespace == "fabric.circuits" && event_type == "failed"
+    window: 5m
+    above: 2
+    group_by: [service_id]
+  - name: link-latency
+    match: namespace == "metrics" && metric == "link.latency"
+    condition: metrics.p95 > 200000000
+    group_by: [source_entity_id]
+repeat: 10m
+`
+
+type testAlertEngine struct {
+	*alertEngine
+	now           time.Time
+	notifications []*alertNotification
+}
+
+func newTestAlertEngine(t *testing.T) *testAlertEngine {
+	config, err := parseAlertConfig([]byte(testAlertRules))
+	require.NoError(t, err)
+
+	result := &testAlertEngine{now: time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)}
+	result.alertEngine = newAlertEngine(config, func(notification *alertNotification) {
+		result.notifications = append(result.notifications, notification)
+	})
+	result.alertEngine.now = func() time.Time { return result.now }
+	return result
+}
+
+func (self *testAlertEngine) accept(t *testing.T, after time.Duration, event string) {
+	self.now = self.now.Add(after)
+	require.NoError(t, self.AcceptEvent([]byte(event)))
+}
+
+func (self *testAlertEngine) advance(d time.Duration) {
+	self.now = self.now.Add(d)
+	self.evaluate()
+}
+
+func (self *testAlertEngine) take() []string {
+	var result []string
+	for _, notification := range self.notifications {
+		result = append(result, notification.Rule+" "+notification.Status)
+	}
+	self.notifications = nil
+	return result
+}
+
+func TestAlertConditionForDuration(t *testing.T) {
+	req := require.New(t)
+	engine := newTestAlertEngine(t)
+
+	// a router which comes back within two minutes doesn't alert
+	engine.accept(t, 0, `{"namespace":"fabric.routers","event_type":"router-offline","router_id":"r1"}`)
+	engine.advance(time.Minute)
+	engine.accept(t, 0, `{"namespace":"fabric.routers","event_type":"router-online","router_id":"r1"}`)
+	engine.advance(5 * time.Minute)
+	req.Empty(engine.take())
+
+	engine.accept(t, 0, `{"namespace":"fabric.routers","event_type":"router-offline","router_id":"r1"}`)
+	started := engine.now
+	engine.advance(time.Minute)
+	req.Empty(engine.take())
+	engine.advance(time.Minute)
+	req.Equal(map[string]string{"router_id": "r1"}, engine.notifications[0].Labels)
+	req.Equal(started, engine.notifications[0].StartedAt)
+	req.Equal("critical", engine.notifications[0].Severity)
+	req.Equal([]string{"router-offline firing"}, engine.take())
+
+	// no duplicates while it stays offline, until the repeat interval
+	engine.accept(t, time.Minute, `{"namespace":"fabric.routers","event_type":"router-offline","router_id":"r1"}`)
+	engine.advance(5 * time.Minute)
+	req.Empty(engine.take())
+	engine.advance(5 * time.Minute)
+	req.True(engine.notifications[0].Repeat)
+	req.Equal([]string{"router-offline firing"}, engine.take())
+
+	engine.accept(t, time.Minute, `{"namespace":"fabric.routers","event_type":"router-online","router_id":"r1"}`)
+	req.Equal(alertStatusResolved, engine.notifications[0].Status)
+	req.NotNil(engine.notifications[0].ResolvedAt)
+	req.Equal([]string{"router-offline resolved"}, engine.take())
+	req.Empty(engine.states)
+}
+
+func TestAlertCountWindow(t *testing.T) {
+	req := require.New(t)
+	engine := newTestAlertEngine(t)
+
+	failed := func(service string) string {
+		return `{"namespace":"fabric.circuits","event_type":"failed","service_id":"` + service + `"}`
+	}
+
+	engine.accept(t, 0, failed("svc1"))
+	engine.accept(t, time.Minute, failed("svc1"))
+	engine.accept(t, time.Minute, failed("svc2"))
+	req.Empty(engine.take())
+
+	engine.accept(t, time.Minute, failed("svc1"))
+	req.Equal(3, engine.notifications[0].Count)
+	req.Equal(map[string]string{"service_id": "svc1"}, engine.notifications[0].Labels)
+	req.Equal([]string{"failed-circuits firing"}, engine.take())
+
+	engine.accept(t, time.Minute, failed("svc1"))
+	req.Empty(engine.take())
+
+	// the first two failures leave the window, leaving two
+	engine.advance(2*time.Minute + time.Second)
+	req.Equal([]string{"failed-circuits resolved"}, engine.take())
+}
+
+func TestAlertConditionResolves(t *testing.T) {
+	req := require.New(t)
+	engine := newTestAlertEngine(t)
+
+	latency := func(link string, p95 int) string {
+		return `{"namespace":"metrics","metric":"link.latency","source_entity_id":"` + link + `","metrics":{"p95":` + strconv.Itoa(p95) + `}}`
+	}
+
+	engine.accept(t, 0, latency("l1", 100000000))
+	engine.accept(t, time.Minute, latency("l1", 300000000))
+	engine.accept(t, 0, latency("l2", 300000000))
+	req.Equal([]string{"link-latency firing", "link-latency firing"}, engine.take())
+
+	engine.accept(t, time.Minute, latency("l1", 150000000))
+	req.Equal(map[string]string{"source_entity_id": "l1"}, engine.notifications[0].Labels)
+	req.Equal([]string{"link-latency resolved"}, engine.take())
+}
+
+func TestAlertConfigValidation(t *testing.T) {
+	invalid := map[string]string{
+		"rules: []": "no rules defined",
+		"rules:\n  - match: a == 1\n    condition: b == 1":                                         "rule 1 has no name",
+		"rules:\n  - name: a\n    condition: b == 1":                                               "rule a: match is required",
+		"rules:\n  - name: a\n    match: a == 1":                                                   "rule a: a rule needs either a condition, or a window and above",
+		"rules:\n  - name: a\n    match: a == 1\n    condition: b == 1\n    above: 1":              "rule a: a rule has either a condition, or a window and above, not both",
+		"rules:\n  - name: a\n    match: a == 1\n    window: 1m\n    above: 1\n    for: 1m":        "rule a: for only applies to rules with a condition",
+		"rules:\n  - name: a\n    match: a == 1\n    condition: b == 1\noutputs:\n  - type: email": "unsupported output type 'email', must be one of: stdout, webhook, exec",
+	}
+	for config, expected := range invalid {
+		_, err := parseAlertConfig([]byte(config))
+		require.EqualError(t, err, expected, config)
+	}
+
+	_, err := parseAlertConfig([]byte("rules:\n  - name: a\n    match: a == 1\n    condition: b == 1\n    unknown: 1"))
+	require.Error(t, err)
+}
+
+func TestFormatAlertLine(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	started := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	resolved := started.Add(150 * time.Second)
+
+	data, err := json.Marshal(&alertNotification{Rule: "router-offline", Status: alertStatusFiring, Severity: "critical",
+		Labels: map[string]string{"router_id": "r1"}, Timestamp: started.Add(2 * time.Minute), StartedAt: started})
+	require.NoError(t, err)
+	require.Equal(t, "2023-05-01T10:02:00Z FIRING   router-offline [router_id=r1] critical: since 2023-05-01T10:00:00Z", formatAlertLine(data))
+
+	data, err = json.Marshal(&alertNotification{Rule: "failed-circuits", Status: alertStatusResolved, Count: 2,
+		Timestamp: resolved, StartedAt: started, ResolvedAt: &resolved, Summary: "too many failures"})
+	require.NoError(t, err)
+	require.Equal(t, "2023-05-01T10:02:30Z RESOLVED failed-circuits count=2: after 2m30s, too many failures", formatAlertLine(data))
+}
+
+func TestExecAlertSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+
+	path := filepath.Join(t.TempDir(), "notification")
+	sink := newExecAlertSink([]string{"sh", "-c", `cat > "$0" && echo "$ZITI_ALERT_RULE $ZITI_ALERT_STATUS" >> "$0"`, path}, io.Discard)
+	require.NoError(t, sink.AcceptEvent([]byte(`{"rule":"r","status":"firing"}`)))
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "{\"rule\":\"r\",\"status\":\"firing\"}r firing\n", string(data))
+}
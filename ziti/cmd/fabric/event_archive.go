@@ -0,0 +1,436 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.etcd.io/bbolt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The event archive is a bbolt database. Events are stored in the events bucket, keyed by sequence number, with the
+// time they were received in front of the JSON event. The time bucket indexes events by receive time and the buckets
+// under indexes map values of commonly queried fields to the events holding them. Index keys are the value, a zero
+// byte and the sequence number, so all events for a value are found with a prefix scan, in the order they arrived
+var (
+	archiveEventsBucket  = []byte("events")
+	archiveTimeBucket    = []byte("time")
+	archiveIndexesBucket = []byte("indexes")
+)
+
+const (
+	archiveFlushInterval = time.Second
+	archivePruneInterval = time.Minute
+	archiveOpenTimeout   = 5 * time.Second
+	archiveMaxPending    = 100000
+
+	// archiveImportBatchSize is the number of events from a recording written per transaction
+	archiveImportBatchSize = 10000
+)
+
+// archiveIndexes lists, for each index, the event fields it covers. An index holds every event which has the value
+// in any of those fields, so it can be used to find candidates for an equality comparison on any of the fields
+var archiveIndexes = map[string][]string{
+	"namespace": {"namespace"},
+	"circuit":   {"circuit_id"},
+	"router":    {"router_id", "source_id", "src_router_id", "dst_router_id", "path.nodes"},
+	"identity":  {"client_id", "host_id", "identity_id", "tags.clientId", "tags.hostId"},
+	"link":      {"link_id", "path.links"},
+}
+
+// archiveIndexPreference orders the indexes from most to least selective, for picking one when a query could use
+// several
+var archiveIndexPreference = []string{"circuit", "link", "identity", "router", "namespace"}
+
+type eventArchiveAction struct {
+	streamEventsAction
+	db        string
+	retention time.Duration
+}
+
+func newEventArchiveCmd(p common.OptionsProvider) *cobra.Command {
+	action := &eventArchiveAction{
+		streamEventsAction: streamEventsAction{
+			Options: api.Options{
+				CommonOptions: p(),
+			},
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "archive [recording...]",
+		Short: "Archive events to a local database, for querying with ziti fabric events query",
+		Long: "Streams events from the controller into a local database, indexed by namespace, receive time, circuit, " +
+			"router, identity and link, so they can be queried after the fact with ziti fabric events query. By default " +
+			"all events are archived. If recordings made with ziti fabric stream events --record-events are given, their " +
+			"events are archived instead of streaming from the controller. The database can be queried while events " +
+			"are being archived",
+		Example: "ziti fabric events archive --db events.db --retention 168h\n" +
+			"ziti fabric events archive --db events.db --circuits --links --routers\n" +
+			"ziti fabric events archive --db incident.db incident.zev",
+		RunE: action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	action.AddStreamFlags(cmd)
+	action.addSubscriptionFlags(cmd)
+	cmd.Flags().StringVar(&action.db, "db", "", "The database to archive events to")
+	cmd.Flags().DurationVar(&action.retention, "retention", 0, "Remove events older than this. 0 keeps events forever")
+	_ = cmd.MarkFlagRequired("db")
+
+	// the archive is meant to run unattended, so it reconnects by default
+	reconnectFlag := cmd.Flags().Lookup("reconnect")
+	reconnectFlag.DefValue = "true"
+	_ = reconnectFlag.Value.Set("true")
+	return cmd
+}
+
+func (self *eventArchiveAction) run(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		query := url.Values{}
+		if self.retention > 0 {
+			query.Set("retention", self.retention.String())
+		}
+		self.sinkSpecs = []string{(&url.URL{Scheme: "archive", Opaque: self.db, RawQuery: query.Encode()}).String()}
+		return self.streamEvents(cmd, nil)
+	}
+
+	archive, err := newEventArchive(self.db, self.retention)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range args {
+		count := 0
+		err = replayRecording(context.Background(), path, 0, self.Err, func(evt *recordedEvent) error {
+			count++
+			if err := archive.archive(evt.received, evt.event); err != nil {
+				return err
+			}
+			if count%archiveImportBatchSize == 0 {
+				return archive.flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = archive.flush()
+		}
+		if err != nil {
+			_ = archive.Close()
+			return err
+		}
+		_, _ = fmt.Fprintf(self.Out, "archived %v events from %v\n", count, path)
+	}
+	return archive.Close()
+}
+
+type archivedEvent struct {
+	received time.Time
+	event    []byte
+}
+
+// eventArchive is an eventSink which stores events in an archive. Events are written once a second. The database is
+// only held open while writing, so the archive can be queried while events are being archived
+type eventArchive struct {
+	path      string
+	retention time.Duration
+	lock      sync.Mutex
+	pending   []*archivedEvent
+	dropped   int
+	// flushLock serializes flushes from the ticker and from imports, as update isn't safe for concurrent use
+	flushLock sync.Mutex
+	lastPrune time.Time
+	now       func() time.Time
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func newEventArchive(path string, retention time.Duration) (*eventArchive, error) {
+	result := &eventArchive{
+		path:      path,
+		retention: retention,
+		now:       time.Now,
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// create the database up front, so problems with the path are reported right away
+	if err := result.flush(); err != nil {
+		return nil, err
+	}
+
+	go result.flushPeriodically()
+	return result, nil
+}
+
+// newArchiveEventSink creates an archive sink from a url such as archive:events.db?retention=168h
+func newArchiveEventSink(sinkUrl *url.URL) (eventSink, error) {
+	var retention time.Duration
+	if val := sinkUrl.Query().Get("retention"); val != "" {
+		var err error
+		if retention, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Wrapf(err, "invalid retention %v", val)
+		}
+	}
+	return newEventArchive(sinkPath(sinkUrl), retention)
+}
+
+func (self *eventArchive) AcceptEvent(event []byte) error {
+	return self.archive(self.now(), event)
+}
+
+func (self *eventArchive) archive(received time.Time, event []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// the database may be held open by a long running query, buffer events until it's available, up to a point
+	if len(self.pending) >= archiveMaxPending {
+		self.dropped++
+		return errors.Errorf("archive %v unavailable, %v events dropped", self.path, self.dropped)
+	}
+	self.pending = append(self.pending, &archivedEvent{received: received, event: event})
+	return nil
+}
+
+func (self *eventArchive) flushPeriodically() {
+	defer close(self.done)
+
+	ticker := time.NewTicker(archiveFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = self.flush()
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *eventArchive) flush() error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+
+	self.lock.Lock()
+	pending := self.pending
+	self.pending = nil
+	self.lock.Unlock()
+
+	if err := self.update(pending); err != nil {
+		// put the events back, so they're written on the next attempt
+		self.lock.Lock()
+		self.pending = append(pending, self.pending...)
+		self.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// update writes the events and prunes the archive when due. It must only be called from flush, which serializes it
+func (self *eventArchive) update(events []*archivedEvent) error {
+	now := self.now()
+	prune := self.retention > 0 && now.Sub(self.lastPrune) >= archivePruneInterval
+	if len(events) == 0 && !prune && !self.lastPrune.IsZero() {
+		return nil
+	}
+
+	db, err := bbolt.Open(self.path, 0600, &bbolt.Options{Timeout: archiveOpenTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "unable to open archive %v", self.path)
+	}
+	defer func() { _ = db.Close() }()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, evt := range events {
+			if err := archiveEvent(tx, evt); err != nil {
+				return err
+			}
+		}
+		if prune {
+			return pruneArchive(tx, now.Add(-self.retention))
+		}
+		_, err := archiveBuckets(tx)
+		return err
+	})
+	if err == nil && (prune || self.lastPrune.IsZero()) {
+		self.lastPrune = now
+	}
+	return err
+}
+
+func (self *eventArchive) Close() error {
+	close(self.closed)
+	<-self.done
+	return self.flush()
+}
+
+type archiveBucketSet struct {
+	events  *bbolt.Bucket
+	time    *bbolt.Bucket
+	indexes map[string]*bbolt.Bucket
+}
+
+func archiveBuckets(tx *bbolt.Tx) (*archiveBucketSet, error) {
+	result := &archiveBucketSet{indexes: map[string]*bbolt.Bucket{}}
+
+	var err error
+	if result.events, err = tx.CreateBucketIfNotExists(archiveEventsBucket); err != nil {
+		return nil, err
+	}
+	if result.time, err = tx.CreateBucketIfNotExists(archiveTimeBucket); err != nil {
+		return nil, err
+	}
+	indexes, err := tx.CreateBucketIfNotExists(archiveIndexesBucket)
+	if err != nil {
+		return nil, err
+	}
+	for name := range archiveIndexes {
+		if result.indexes[name], err = indexes.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func archiveEvent(tx *bbolt.Tx, evt *archivedEvent) error {
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(evt.event, &decoded); err != nil {
+		// not something that can be queried, so not worth keeping
+		return nil
+	}
+
+	buckets, err := archiveBuckets(tx)
+	if err != nil {
+		return err
+	}
+
+	seq, err := buckets.events.NextSequence()
+	if err != nil {
+		return err
+	}
+	seqKey := archiveUint64(seq)
+
+	value := make([]byte, 8+len(evt.event))
+	binary.BigEndian.PutUint64(value, uint64(evt.received.UnixNano()))
+	copy(value[8:], evt.event)
+	if err = buckets.events.Put(seqKey, value); err != nil {
+		return err
+	}
+
+	if err = buckets.time.Put(archiveTimeKey(evt.received, seq), nil); err != nil {
+		return err
+	}
+
+	for name, values := range archiveIndexValues(decoded) {
+		for _, val := range values {
+			if err = buckets.indexes[name].Put(archiveIndexKey(val, seq), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneArchive removes events received before the cutoff, along with their index entries
+func pruneArchive(tx *bbolt.Tx, cutoff time.Time) error {
+	buckets, err := archiveBuckets(tx)
+	if err != nil {
+		return err
+	}
+
+	end := archiveUint64(uint64(cutoff.UnixNano()))
+	cursor := buckets.time.Cursor()
+	for k, _ := cursor.First(); k != nil && bytes.Compare(k[:8], end) < 0; k, _ = cursor.First() {
+		seq := binary.BigEndian.Uint64(k[8:])
+		seqKey := archiveUint64(seq)
+
+		if value := buckets.events.Get(seqKey); value != nil {
+			decoded := map[string]interface{}{}
+			if err = json.Unmarshal(value[8:], &decoded); err == nil {
+				for name, values := range archiveIndexValues(decoded) {
+					for _, val := range values {
+						if err = buckets.indexes[name].Delete(archiveIndexKey(val, seq)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err = buckets.events.Delete(seqKey); err != nil {
+				return err
+			}
+		}
+		if err = cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveIndexValues returns the values to index the event under, by index
+func archiveIndexValues(event map[string]interface{}) map[string][]string {
+	result := map[string][]string{}
+	for name, fields := range archiveIndexes {
+		seen := map[string]struct{}{}
+		for _, field := range fields {
+			filterAnyValue(filterLookup(event, strings.Split(field, ".")), func(val interface{}) bool {
+				if val == nil {
+					return false
+				}
+				if str := filterValueString(val); str != "" {
+					if _, found := seen[str]; !found {
+						seen[str] = struct{}{}
+						result[name] = append(result[name], str)
+					}
+				}
+				return false
+			})
+		}
+	}
+	return result
+}
+
+func archiveUint64(val uint64) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, val)
+	return result
+}
+
+func archiveTimeKey(received time.Time, seq uint64) []byte {
+	result := make([]byte, 16)
+	binary.BigEndian.PutUint64(result, uint64(received.UnixNano()))
+	binary.BigEndian.PutUint64(result[8:], seq)
+	return result
+}
+
+func archiveIndexKey(val string, seq uint64) []byte {
+	result := make([]byte, len(val)+9)
+	copy(result, val)
+	binary.BigEndian.PutUint64(result[len(val)+1:], seq)
+	return result
+}
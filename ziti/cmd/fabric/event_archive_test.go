@@ -0,0 +1,178 @@
+package fabric
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testArchiveEvents = []string{
+	`{"namespace":"fabric.routers","event_type":"router-online","router_id":"r1"}`,
+	`{"namespace":"fabric.links","event_type":"connected","link_id":"l1","src_router_id":"r1","dst_router_id":"r2"}`,
+	`{"namespace":"fabric.circuits","event_type":"created","circuit_id":"c1","client_id":"id1","path":{"nodes":["r1","r2"],"links":["l1"]}}`,
+	`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c1","usage":{"ingress.rx":10},"tags":{"clientId":"id1"}}`,
+	`{"namespace":"fabric.links","event_type":"fault","link_id":"l1","src_router_id":"r1","dst_router_id":"r2"}`,
+	`{"namespace":"fabric.circuits","event_type":"deleted","circuit_id":"c1","client_id":"id1","path":{"nodes":["r1","r2"],"links":["l1"]}}`,
+	`not json`,
+}
+
+func newTestArchive(t *testing.T) (*eventArchive, string) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	archive, err := newEventArchive(path, 0)
+	require.NoError(t, err)
+
+	start := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	for idx, evt := range testArchiveEvents {
+		require.NoError(t, archive.archive(start.Add(time.Duration(idx)*time.Minute), []byte(evt)))
+	}
+	require.NoError(t, archive.flush())
+	return archive, path
+}
+
+func runTestQuery(t *testing.T, path string, query *archiveQuery) []string {
+	// the archive only holds the database open while writing, so it can be read while archiving
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	var result []string
+	require.NoError(t, query.run(db, func(evt *archivedEvent) error {
+		result = append(result, string(evt.event))
+		return nil
+	}))
+	return result
+}
+
+func newTestQuery(t *testing.T, expr string) *archiveQuery {
+	filter, err := newEventFilter(expr)
+	require.NoError(t, err)
+	return &archiveQuery{filter: filter}
+}
+
+func TestEventArchiveQuery(t *testing.T) {
+	req := require.New(t)
+	archive, path := newTestArchive(t)
+	defer func() { req.NoError(archive.Close()) }()
+
+	query := newTestQuery(t, "circuit_id = 'c1' && namespace = 'fabric.circuits'")
+	indexName, val := query.plan()
+	req.Equal("circuit", indexName)
+	req.Equal("c1", val)
+	req.Equal([]string{testArchiveEvents[2], testArchiveEvents[5]}, runTestQuery(t, path, query))
+
+	// what happened to link l1
+	query = newTestQuery(t, "link_id = 'l1' && event_type = 'fault'")
+	req.Equal([]string{testArchiveEvents[4]}, runTestQuery(t, path, query))
+
+	// router ids are found in router, link, circuit and usage events alike
+	query = newTestQuery(t, `path.nodes == "r2" || dst_router_id == "r2"`)
+	indexName, _ = query.plan()
+	req.Equal("", indexName)
+	req.Equal([]string{testArchiveEvents[1], testArchiveEvents[2], testArchiveEvents[4], testArchiveEvents[5]}, runTestQuery(t, path, query))
+
+	query = newTestQuery(t, `tags.clientId = "id1"`)
+	indexName, _ = query.plan()
+	req.Equal("identity", indexName)
+	req.Equal([]string{testArchiveEvents[3]}, runTestQuery(t, path, query))
+
+	// time ranges, with and without an index
+	query = &archiveQuery{
+		since: time.Date(2023, 5, 1, 10, 2, 0, 0, time.UTC),
+		until: time.Date(2023, 5, 1, 10, 4, 0, 0, time.UTC),
+	}
+	req.Equal([]string{testArchiveEvents[2], testArchiveEvents[3]}, runTestQuery(t, path, query))
+
+	query = newTestQuery(t, "circuit_id = 'c1'")
+	query.since = time.Date(2023, 5, 1, 10, 4, 0, 0, time.UTC)
+	req.Equal([]string{testArchiveEvents[5]}, runTestQuery(t, path, query))
+
+	query = &archiveQuery{limit: 2}
+	req.Len(runTestQuery(t, path, query), 2)
+}
+
+func TestEventArchiveRetention(t *testing.T) {
+	req := require.New(t)
+	archive, path := newTestArchive(t)
+
+	archive.retention = time.Hour
+	archive.lastPrune = time.Time{}.Add(time.Second)
+	archive.now = func() time.Time { return time.Date(2023, 5, 1, 11, 3, 30, 0, time.UTC) }
+	req.NoError(archive.Close())
+
+	req.Equal([]string{testArchiveEvents[4], testArchiveEvents[5]}, runTestQuery(t, path, &archiveQuery{}))
+
+	// pruned events are removed from the indexes as well
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	req.NoError(err)
+	defer func() { _ = db.Close() }()
+	req.NoError(db.View(func(tx *bbolt.Tx) error {
+		var keys []string
+		err := tx.Bucket(archiveIndexesBucket).Bucket([]byte("namespace")).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k[:bytes.IndexByte(k, 0)]))
+			return nil
+		})
+		req.Equal([]string{"fabric.circuits", "fabric.links"}, keys)
+		return err
+	}))
+}
+
+func TestEventArchiveConcurrentFlushes(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.db")
+	archive, err := newEventArchive(path, 24*time.Hour)
+	req.NoError(err)
+
+	// imports flush while the ticker may be flushing as well. Time moves on quickly, so every flush prunes
+	start := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	var ticks int64
+	archive.now = func() time.Time {
+		return start.Add(time.Duration(atomic.AddInt64(&ticks, 1)) * archivePruneInterval)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				evt := fmt.Sprintf(`{"namespace":"fabric.routers","event_type":"router-online","router_id":"r%v-%v"}`, i, j)
+				req.NoError(archive.archive(start.Add(time.Duration(i*25+j)*time.Second), []byte(evt)))
+				req.NoError(archive.flush())
+			}
+		}(i)
+	}
+	wg.Wait()
+	req.NoError(archive.Close())
+
+	req.Len(runTestQuery(t, path, &archiveQuery{}), 100)
+}
+
+func TestEventFilterEqualities(t *testing.T) {
+	filter, err := newEventFilter(`circuit_id = 'c1' && (event_type == "a" || event_type == "b") && link_count == 2`)
+	require.NoError(t, err)
+	require.Equal(t, []eventFilterEquality{{field: "circuit_id", value: "c1"}, {field: "link_count", value: "2"}}, filter.equalities())
+
+	filter, err = newEventFilter(`circuit_id = 'c1' || link_id = 'l1'`)
+	require.NoError(t, err)
+	require.Empty(t, filter.equalities())
+}
+
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	val, err := parseQueryTime("2h", now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-2*time.Hour), val)
+
+	val, err = parseQueryTime("2023-05-01T08:30:00Z", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 5, 1, 8, 30, 0, 0, time.UTC), val)
+
+	_, err = parseQueryTime("yesterday", now)
+	require.True(t, strings.Contains(err.Error(), "neither a duration"))
+}
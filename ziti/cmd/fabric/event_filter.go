@@ -0,0 +1,469 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// eventFilter is a compiled --where expression, evaluated against each event on the client side.
+//
+// Expressions compare event fields with == (or =), !=, <, <=, >, >=, =~ (regex match) and !~ and combine them with
+// &&, ||, ! and parentheses. Fields are the JSON field names, with nested fields separated by dots, such as tags.serviceId.
+// Values are quoted strings, numbers, true, false and null. A missing field is null. When a field holds a list, a
+// comparison matches if any element matches, so path.nodes == "router1" finds circuits crossing router1.
+type eventFilter struct {
+	expr   string
+	eval   eventFilterNode
+	tokens []eventFilterToken
+}
+
+type eventFilterNode func(event map[string]interface{}) bool
+
+type eventFilterOperand func(event map[string]interface{}) interface{}
+
+func newEventFilter(expr string) (*eventFilter, error) {
+	parser := &eventFilterParser{}
+	if err := parser.tokenize(expr); err != nil {
+		return nil, errors.Wrapf(err, "invalid where expression %q", expr)
+	}
+
+	node, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = errors.Errorf("unexpected %v", parser.tokens[parser.pos].text)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid where expression %q", expr)
+	}
+
+	return &eventFilter{expr: expr, eval: node, tokens: parser.tokens}, nil
+}
+
+// eventFilterEquality is a field == value comparison
+type eventFilterEquality struct {
+	field string
+	value string
+}
+
+// equalities returns the field == value comparisons which every matching event satisfies, which are those joined to
+// the rest of the expression with && outside of any parentheses. The event archive uses them to pick an index
+func (self *eventFilter) equalities() []eventFilterEquality {
+	var result []eventFilterEquality
+	var term []eventFilterToken
+	depth := 0
+
+	addTerm := func() {
+		if len(term) == 3 && term[0].tokenType == filterTokenField && term[1].tokenType == filterTokenOp && term[1].text == "==" &&
+			(term[2].tokenType == filterTokenString || term[2].tokenType == filterTokenNumber) {
+			result = append(result, eventFilterEquality{field: term[0].text, value: filterValueString(term[2].value)})
+		}
+		term = nil
+	}
+
+	for _, token := range self.tokens {
+		switch {
+		case token.tokenType == filterTokenLParen:
+			depth++
+		case token.tokenType == filterTokenRParen:
+			depth--
+		case depth == 0 && token.tokenType == filterTokenOp && token.text == "||":
+			return nil
+		case depth == 0 && token.tokenType == filterTokenOp && token.text == "&&":
+			addTerm()
+			continue
+		}
+		term = append(term, token)
+	}
+	addTerm()
+	return result
+}
+
+// Matches returns true if the given JSON event matches the expression. Events which can't be parsed don't match
+func (self *eventFilter) Matches(event []byte) bool {
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(event, &decoded); err != nil {
+		return false
+	}
+	return self.eval(decoded)
+}
+
+// matchesDecoded is Matches for an event which has already been decoded, to avoid decoding it for each filter
+func (self *eventFilter) matchesDecoded(event map[string]interface{}) bool {
+	return self.eval(event)
+}
+
+type eventFilterTokenType int
+
+const (
+	filterTokenField eventFilterTokenType = iota
+	filterTokenString
+	filterTokenNumber
+	filterTokenOp
+	filterTokenLParen
+	filterTokenRParen
+)
+
+type eventFilterToken struct {
+	tokenType eventFilterTokenType
+	text      string
+	value     interface{}
+}
+
+type eventFilterParser struct {
+	tokens []eventFilterToken
+	pos    int
+}
+
+var eventFilterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "="}
+
+func (self *eventFilterParser) tokenize(expr string) error {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenLParen, text: "("})
+			i++
+		case c == ')':
+			self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenRParen, text: ")"})
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				sb.WriteByte(expr[j])
+			}
+			if j >= len(expr) {
+				return errors.Errorf("unterminated string starting at %v", i)
+			}
+			self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenString, text: expr[i : j+1], value: sb.String()})
+			i = j + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(expr) && strings.IndexByte("0123456789.eE+-", expr[j]) >= 0 {
+				j++
+			}
+			val, err := strconv.ParseFloat(expr[i:j], 64)
+			if err != nil {
+				return errors.Errorf("invalid number %v", expr[i:j])
+			}
+			self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenNumber, text: expr[i:j], value: val})
+			i = j
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || expr[j] == '.' ||
+				(expr[j] >= 'a' && expr[j] <= 'z') || (expr[j] >= 'A' && expr[j] <= 'Z') || (expr[j] >= '0' && expr[j] <= '9')) {
+				j++
+			}
+			self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenField, text: expr[i:j]})
+			i = j
+		default:
+			found := false
+			for _, op := range eventFilterOps {
+				if strings.HasPrefix(expr[i:], op) {
+					if op == "=" {
+						// allow SQL style equality, as in circuit_id = 'x'
+						op = "=="
+					}
+					self.tokens = append(self.tokens, eventFilterToken{tokenType: filterTokenOp, text: op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("unexpected character %q at %v", c, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (self *eventFilterParser) peekOp(ops ...string) string {
+	if self.pos < len(self.tokens) && self.tokens[self.pos].tokenType == filterTokenOp {
+		for _, op := range ops {
+			if self.tokens[self.pos].text == op {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func (self *eventFilterParser) parseOr() (eventFilterNode, error) {
+	left, err := self.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for self.peekOp("||") != "" {
+		self.pos++
+		right, err := self.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(event map[string]interface{}) bool {
+			return l(event) || right(event)
+		}
+	}
+	return left, nil
+}
+
+func (self *eventFilterParser) parseAnd() (eventFilterNode, error) {
+	left, err := self.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for self.peekOp("&&") != "" {
+		self.pos++
+		right, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(event map[string]interface{}) bool {
+			return l(event) && right(event)
+		}
+	}
+	return left, nil
+}
+
+func (self *eventFilterParser) parseUnary() (eventFilterNode, error) {
+	if self.peekOp("!") != "" {
+		self.pos++
+		node, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(event map[string]interface{}) bool {
+			return !node(event)
+		}, nil
+	}
+
+	if self.pos < len(self.tokens) && self.tokens[self.pos].tokenType == filterTokenLParen {
+		self.pos++
+		node, err := self.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if self.pos >= len(self.tokens) || self.tokens[self.pos].tokenType != filterTokenRParen {
+			return nil, errors.New("missing )")
+		}
+		self.pos++
+		return node, nil
+	}
+
+	return self.parseComparison()
+}
+
+func (self *eventFilterParser) parseComparison() (eventFilterNode, error) {
+	left, err := self.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := self.peekOp("==", "!=", "<=", ">=", "<", ">", "=~", "!~")
+	if op == "" {
+		// a bare operand is true if it's set and not false, zero or empty
+		return func(event map[string]interface{}) bool {
+			return filterValueTruthy(left(event))
+		}, nil
+	}
+	self.pos++
+
+	if op == "=~" || op == "!~" {
+		if self.pos >= len(self.tokens) || self.tokens[self.pos].tokenType != filterTokenString {
+			return nil, errors.Errorf("%v must be followed by a quoted regular expression", op)
+		}
+		re, err := regexp.Compile(self.tokens[self.pos].value.(string))
+		if err != nil {
+			return nil, err
+		}
+		self.pos++
+		return func(event map[string]interface{}) bool {
+			matched := filterAnyValue(left(event), func(val interface{}) bool {
+				return val != nil && re.MatchString(filterValueString(val))
+			})
+			return matched == (op == "=~")
+		}, nil
+	}
+
+	right, err := self.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "!=" {
+		return func(event map[string]interface{}) bool {
+			rightVal := right(event)
+			return !filterAnyValue(left(event), func(val interface{}) bool {
+				return filterCompare(val, rightVal) == 0
+			})
+		}, nil
+	}
+
+	return func(event map[string]interface{}) bool {
+		rightVal := right(event)
+		return filterAnyValue(left(event), func(val interface{}) bool {
+			cmp := filterCompare(val, rightVal)
+			switch op {
+			case "==":
+				return cmp == 0
+			case "<":
+				return cmp == -1
+			case "<=":
+				return cmp == -1 || cmp == 0
+			case ">":
+				return cmp == 1
+			default:
+				return cmp == 1 || cmp == 0
+			}
+		})
+	}, nil
+}
+
+func (self *eventFilterParser) parseOperand() (eventFilterOperand, error) {
+	if self.pos >= len(self.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	token := self.tokens[self.pos]
+	self.pos++
+
+	switch token.tokenType {
+	case filterTokenString, filterTokenNumber:
+		val := token.value
+		return func(map[string]interface{}) interface{} { return val }, nil
+	case filterTokenField:
+		switch token.text {
+		case "true", "false":
+			val := token.text == "true"
+			return func(map[string]interface{}) interface{} { return val }, nil
+		case "null":
+			return func(map[string]interface{}) interface{} { return nil }, nil
+		}
+		path := strings.Split(token.text, ".")
+		return func(event map[string]interface{}) interface{} {
+			return filterLookup(event, path)
+		}, nil
+	default:
+		return nil, errors.Errorf("unexpected %v", token.text)
+	}
+}
+
+func filterLookup(event map[string]interface{}, path []string) interface{} {
+	var current interface{} = event
+	for _, name := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[name]
+	}
+	return current
+}
+
+func filterAnyValue(val interface{}, f func(interface{}) bool) bool {
+	if list, ok := val.([]interface{}); ok {
+		for _, elem := range list {
+			if f(elem) {
+				return true
+			}
+		}
+		return false
+	}
+	return f(val)
+}
+
+// filterCompare returns -1, 0 or 1 when the values are ordered, or 2 if they can't be compared
+func filterCompare(a, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+		return 2
+	}
+
+	if aBool, ok := a.(bool); ok {
+		if bBool, ok := b.(bool); ok && aBool == bBool {
+			return 0
+		}
+		return 2
+	}
+
+	aNum, aIsNum := filterValueNumber(a)
+	bNum, bIsNum := filterValueNumber(b)
+	if aIsNum && bIsNum {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(filterValueString(a), filterValueString(b))
+}
+
+func filterValueNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func filterValueString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+func filterValueTruthy(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
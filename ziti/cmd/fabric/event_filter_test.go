@@ -0,0 +1,75 @@
+package fabric
+
+import (
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const testCircuitFailedEvent = `{"namespace":"fabric.circuits","version":2,"event_type":"failed","circuit_id":"c1",` +
+	`"timestamp":"2023-05-01T10:11:12.345Z","client_id":"cl1","service_id":"svc1","terminator_id":"",` +
+	`"path":{"nodes":["r1","r2"],"links":["l1"],"ingress_id":"","egress_id":""},"link_count":1,` +
+	`"failure_cause":"NO_TERMINATORS","creation_timespan":1500000}`
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		expr    string
+		matches bool
+	}{
+		{`namespace == "fabric.circuits" && event_type == "failed"`, true},
+		{`namespace == 'fabric.circuits' && event_type == 'created'`, false},
+		{`event_type == "created" || failure_cause == "NO_TERMINATORS"`, true},
+		{`!(event_type == "failed")`, false},
+		{`event_type != "failed"`, false},
+		{`path.nodes == "r2"`, true},
+		{`path.nodes != "r2"`, false},
+		{`path.nodes == "r3"`, false},
+		{`link_count >= 1 && link_count < 2`, true},
+		{`creation_timespan > 1e6`, true},
+		{`circuit_id =~ "^c[0-9]+$"`, true},
+		{`service_id !~ "svc"`, false},
+		{`path_cost == null`, true},
+		{`failure_cause`, true},
+		{`terminator_id`, false},
+		{`timestamp > "2023-05-01T10:00:00Z"`, true},
+		{`circuit_id = 'c1' && path.nodes = 'r1'`, true},
+	}
+
+	for _, test := range tests {
+		filter, err := newEventFilter(test.expr)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, test.matches, filter.Matches([]byte(testCircuitFailedEvent)), test.expr)
+	}
+
+	for _, invalid := range []string{`event_type ==`, `(event_type == "failed"`, `event_type = = "failed"`, `circuit_id =~ "["`, `"unterminated`} {
+		_, err := newEventFilter(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestFormatEventLine(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	line := formatEventLine([]byte(testCircuitFailedEvent))
+	require.True(t, strings.HasSuffix(line, "circuit     failed         c1 client=cl1 service=svc1 path=r1->r2 setup=1.5ms cause=NO_TERMINATORS"), line)
+
+	line = formatEventLine([]byte(`{"namespace":"fabric.links","event_type":"fault","timestamp":"2023-05-01T10:11:12Z",` +
+		`"link_id":"l1","src_router_id":"r1","dst_router_id":"r2","protocol":"tls","cost":2}`))
+	require.True(t, strings.HasSuffix(line, "link        fault          l1 r1->r2 protocol=tls cost=2"), line)
+
+	line = formatEventLine([]byte(`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c1",` +
+		`"usage":{"ingress.tx":100,"ingress.rx":20},"interval_start_utc":1682935872,"interval_length":60,` +
+		`"tags":{"clientId":"id1","serviceId":"svc1"}}`))
+	require.True(t, strings.HasSuffix(line, "usage       c1 source=r1 ingress.rx=20 ingress.tx=100 service=svc1 client=id1"), line)
+
+	line = formatEventLine([]byte(`{"namespace":"stream.gap","event_type":"reconnected","timestamp":"2023-05-01T10:11:12Z","gap_seconds":2.5}`))
+	require.Contains(t, line, "stream reconnected after 2.5s")
+
+	line = formatEventLine([]byte(`{"namespace":"metrics","timestamp":"2023-05-01T10:11:12Z","metric_type":"intValue"}`))
+	require.Contains(t, line, `metrics  {"namespace":"metrics"`)
+
+	require.Equal(t, "not json", formatEventLine([]byte("not json")))
+}
@@ -0,0 +1,193 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/ziti/ziti/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+// formatEventLine renders a JSON event as a single readable line. Event types without a specific format are shown
+// with their namespace and event type, followed by the compact JSON
+func formatEventLine(event []byte) string {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(event, &fields); err != nil {
+		return string(event)
+	}
+
+	ts := prettyTimestamp(fields["timestamp"])
+	eventType := prettyString(fields["event_type"])
+	var line string
+
+	switch prettyString(fields["namespace"]) {
+	case "fabric.circuits":
+		line = prettyCircuitEvent(eventType, fields)
+	case "fabric.links":
+		line = prettyLinkEvent(eventType, fields)
+	case "fabric.routers":
+		line = fmt.Sprintf("%v %v %v", util.ColorStatus("router     "), prettyEventType(eventType), fields["router_id"])
+	case "edge.sessions":
+		line = fmt.Sprintf("%v %v %v type=%v identity=%v service=%v", util.ColorStatus("session    "),
+			prettyEventType(eventType), fields["id"], fields["session_type"], fields["identity_id"], fields["service_id"])
+	case "edge.apiSessions":
+		line = fmt.Sprintf("%v %v %v identity=%v ip=%v", util.ColorStatus("api-session"),
+			prettyEventType(eventType), fields["id"], fields["identity_id"], fields["ip_address"])
+	case "fabric.usage":
+		ts = prettyUnixTimestamp(fields["interval_start_utc"])
+		line = prettyUsageEvent(eventType, fields)
+	case streamGapNamespace:
+		gap := time.Duration(prettyFloat(fields["gap_seconds"]) * float64(time.Second)).Round(time.Millisecond)
+		line = util.ColorWarning(fmt.Sprintf("--- stream reconnected after %v, events may have been missed ---", gap))
+	default:
+		line = fmt.Sprintf("%v %v %v", util.ColorStatus(prettyString(fields["namespace"])), eventType, string(event))
+	}
+
+	return ts + " " + line
+}
+
+func prettyCircuitEvent(eventType string, fields map[string]interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%v %v %v client=%v service=%v", util.ColorStatus("circuit    "),
+		prettyEventType(eventType), fields["circuit_id"], fields["client_id"], fields["service_id"]))
+
+	if path, ok := fields["path"].(map[string]interface{}); ok {
+		if nodes, ok := path["nodes"].([]interface{}); ok && len(nodes) > 0 {
+			var names []string
+			for _, node := range nodes {
+				names = append(names, prettyString(node))
+			}
+			sb.WriteString(" path=" + strings.Join(names, "->"))
+		}
+	}
+
+	if cost, found := fields["path_cost"]; found {
+		sb.WriteString(fmt.Sprintf(" cost=%v", cost))
+	}
+	if timespan, found := fields["creation_timespan"]; found {
+		sb.WriteString(fmt.Sprintf(" setup=%v", prettyDuration(timespan)))
+	}
+	if duration, found := fields["duration"]; found {
+		sb.WriteString(fmt.Sprintf(" duration=%v", prettyDuration(duration)))
+	}
+	if cause, found := fields["failure_cause"]; found {
+		sb.WriteString(" cause=" + util.ColorError(cause))
+	}
+	return sb.String()
+}
+
+func prettyLinkEvent(eventType string, fields map[string]interface{}) string {
+	line := fmt.Sprintf("%v %v %v %v->%v", util.ColorStatus("link       "), prettyEventType(eventType),
+		fields["link_id"], fields["src_router_id"], fields["dst_router_id"])
+	if protocol := prettyString(fields["protocol"]); protocol != "" {
+		line += " protocol=" + protocol
+	}
+	if cost, found := fields["cost"]; found {
+		line += fmt.Sprintf(" cost=%v", cost)
+	}
+	return line
+}
+
+func prettyUsageEvent(eventType string, fields map[string]interface{}) string {
+	line := fmt.Sprintf("%v", util.ColorStatus("usage      "))
+	if eventType != "" {
+		line += " " + eventType
+	}
+	line += fmt.Sprintf(" %v source=%v", fields["circuit_id"], fields["source_id"])
+
+	switch usage := fields["usage"].(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range usage {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			line += fmt.Sprintf(" %v=%v", k, prettyString(usage[k]))
+		}
+	default:
+		line += fmt.Sprintf(" usage=%v", prettyString(usage))
+	}
+
+	if tags, ok := fields["tags"].(map[string]interface{}); ok {
+		if serviceId, found := tags["serviceId"]; found {
+			line += fmt.Sprintf(" service=%v", serviceId)
+		}
+		if identityId, found := tags["clientId"]; found {
+			line += fmt.Sprintf(" client=%v", identityId)
+		}
+	}
+	return line
+}
+
+// prettyEventType colors event types red when something went wrong, green when something came up, and yellow
+// for changes in between
+func prettyEventType(eventType string) string {
+	padded := fmt.Sprintf("%-14v", eventType)
+	switch eventType {
+	case "failed", "fault", "router-offline", "routerLinkDisconnectedDest":
+		return util.ColorError(padded)
+	case "created", "connected", "dialed", "router-online", "routerLinkNew":
+		return util.ColorInfo(padded)
+	case "pathUpdated", "routerLinkKnown":
+		return util.ColorWarning(padded)
+	}
+	return padded
+}
+
+func prettyTimestamp(val interface{}) string {
+	if s, ok := val.(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return ts.Local().Format("15:04:05.000")
+		}
+	}
+	return "--:--:--.---"
+}
+
+func prettyUnixTimestamp(val interface{}) string {
+	if seconds, ok := val.(float64); ok {
+		return time.Unix(int64(seconds), 0).Local().Format("15:04:05.000")
+	}
+	return "--:--:--.---"
+}
+
+func prettyDuration(val interface{}) string {
+	if nanos, ok := val.(float64); ok {
+		return time.Duration(nanos).Round(time.Microsecond).String()
+	}
+	return prettyString(val)
+}
+
+func prettyFloat(val interface{}) float64 {
+	f, _ := val.(float64)
+	return f
+}
+
+func prettyString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return filterValueString(v)
+	}
+	return fmt.Sprintf("%v", val)
+}
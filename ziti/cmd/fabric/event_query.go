@@ -0,0 +1,215 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.etcd.io/bbolt"
+	"os"
+	"strings"
+	"time"
+)
+
+type eventQueryAction struct {
+	common.CommonOptions
+	db     string
+	since  string
+	until  string
+	limit  int
+	pretty bool
+	now    func() time.Time
+}
+
+func newEventQueryCmd(p common.OptionsProvider) *cobra.Command {
+	action := &eventQueryAction{
+		CommonOptions: p(),
+		now:           time.Now,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "query [where expression]",
+		Short: "Query events archived with ziti fabric events archive",
+		Long: "Outputs the archived events matching the expression, in the order they were received. Expressions are " +
+			"the same as for ziti fabric stream events --where, with = accepted as well as ==. Comparisons of " +
+			"namespace, circuit_id, link_id, path.nodes, path.links and the router and identity id fields with a value " +
+			"are answered from indexes, when they're not part of an || expression",
+		Example: "ziti fabric events query \"circuit_id = 'x'\" --since 2h\n" +
+			"ziti fabric events query \"link_id = 'L' && event_type = 'fault'\" --pretty\n" +
+			"ziti fabric events query \"namespace = 'fabric.routers' && router_id = 'r1'\" --since 2023-05-01T10:00:00Z --until 2023-05-01T12:00:00Z",
+		Args: cobra.MaximumNArgs(1),
+		RunE: action.run,
+	}
+
+	cmd.Flags().StringVar(&action.db, "db", "", "The archive to query")
+	cmd.Flags().StringVar(&action.since, "since", "", "Only include events received since then. Either a duration, such as 2h, or a time, such as 2023-05-01T10:00:00Z")
+	cmd.Flags().StringVar(&action.until, "until", "", "Only include events received before then. Either a duration, such as 30m, or a time")
+	cmd.Flags().IntVar(&action.limit, "limit", 0, "Maximum number of events to output. 0 outputs all matching events")
+	cmd.Flags().BoolVar(&action.pretty, "pretty", false, "Print a colorized one line summary of each event instead of JSON")
+	_ = cmd.MarkFlagRequired("db")
+	return cmd
+}
+
+func (self *eventQueryAction) run(_ *cobra.Command, args []string) error {
+	query := &archiveQuery{limit: self.limit}
+
+	if len(args) == 1 && strings.TrimSpace(args[0]) != "" {
+		filter, err := newEventFilter(args[0])
+		if err != nil {
+			return err
+		}
+		query.filter = filter
+	}
+
+	var err error
+	if query.since, err = parseQueryTime(self.since, self.now()); err != nil {
+		return errors.Wrap(err, "invalid --since")
+	}
+	if query.until, err = parseQueryTime(self.until, self.now()); err != nil {
+		return errors.Wrap(err, "invalid --until")
+	}
+
+	// bbolt would create a missing database, even when opening it read only
+	if _, err = os.Stat(self.db); err != nil {
+		return errors.Wrapf(err, "unable to open archive %v", self.db)
+	}
+
+	db, err := bbolt.Open(self.db, 0600, &bbolt.Options{ReadOnly: true, Timeout: archiveOpenTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "unable to open archive %v", self.db)
+	}
+	defer func() { _ = db.Close() }()
+
+	out := &writerEventSink{out: self.Out}
+	if self.pretty {
+		out.format = formatEventLine
+	}
+
+	return query.run(db, func(evt *archivedEvent) error {
+		return out.AcceptEvent(evt.event)
+	})
+}
+
+// parseQueryTime parses a time, or a duration before now. An empty string gives the zero time
+func parseQueryTime(val string, now time.Time) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.Errorf("%v is neither a duration, such as 2h, nor a time, such as 2023-05-01T10:00:00Z", val)
+}
+
+// archiveQuery finds archived events matching a where expression, received within a time range
+type archiveQuery struct {
+	filter *eventFilter
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+// plan picks the index to use, returning the index name and value, or empty strings if events have to be scanned
+// by time
+func (self *archiveQuery) plan() (string, string) {
+	if self.filter == nil {
+		return "", ""
+	}
+
+	candidates := map[string]string{}
+	for _, equality := range self.filter.equalities() {
+		for name, fields := range archiveIndexes {
+			for _, field := range fields {
+				if field == equality.field {
+					candidates[name] = equality.value
+				}
+			}
+		}
+	}
+
+	for _, name := range archiveIndexPreference {
+		if val, found := candidates[name]; found {
+			return name, val
+		}
+	}
+	return "", ""
+}
+
+// run calls the handler with each matching event, in the order they were received
+func (self *archiveQuery) run(db *bbolt.DB, handler func(*archivedEvent) error) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		events := tx.Bucket(archiveEventsBucket)
+		if events == nil {
+			return nil
+		}
+
+		count := 0
+		visit := func(seqKey []byte) (bool, error) {
+			value := events.Get(seqKey)
+			if value == nil {
+				return true, nil
+			}
+			received := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+			if (!self.since.IsZero() && received.Before(self.since)) || (!self.until.IsZero() && !received.Before(self.until)) {
+				return true, nil
+			}
+			if self.filter != nil && !self.filter.Matches(value[8:]) {
+				return true, nil
+			}
+			if err := handler(&archivedEvent{received: received, event: value[8:]}); err != nil {
+				return false, err
+			}
+			count++
+			return self.limit <= 0 || count < self.limit, nil
+		}
+
+		if indexName, val := self.plan(); indexName != "" {
+			index := tx.Bucket(archiveIndexesBucket).Bucket([]byte(indexName))
+			prefix := append([]byte(val), 0)
+			cursor := index.Cursor()
+			for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+8; k, _ = cursor.Next() {
+				if more, err := visit(k[len(prefix):]); !more || err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		cursor := tx.Bucket(archiveTimeBucket).Cursor()
+		var k []byte
+		if self.since.IsZero() {
+			k, _ = cursor.First()
+		} else {
+			k, _ = cursor.Seek(archiveUint64(uint64(self.since.UnixNano())))
+		}
+		for ; k != nil; k, _ = cursor.Next() {
+			if !self.until.IsZero() && bytes.Compare(k[:8], archiveUint64(uint64(self.until.UnixNano()))) >= 0 {
+				return nil
+			}
+			if more, err := visit(k[8:]); !more || err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
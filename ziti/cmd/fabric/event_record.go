@@ -0,0 +1,223 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event recordings (.zev files) start with recordingMagic, followed by a gzip stream of frames. Each frame holds the
+// time the event was received, as a signed varint of microseconds since the previous frame (since the unix epoch for
+// the first frame), the length of the event as an unsigned varint and the JSON encoded event itself
+var recordingMagic = []byte("ZEV\x01")
+
+const (
+	recordingFlushInterval = time.Second
+	recordingMaxEventSize  = 64 * 1024 * 1024
+)
+
+// errTruncatedRecording is returned when a recording ends in the middle of a frame, which happens when the recording
+// process was killed. All complete frames before that point are still readable
+var errTruncatedRecording = errors.New("recording ends with an incomplete event, it was probably not closed cleanly")
+
+// eventRecorder is an eventSink which writes events to a recording, stamped with the time they were received.
+// Buffered events are flushed every second, so at most a second of events is lost if the process is killed
+type eventRecorder struct {
+	lock     sync.Mutex
+	file     *os.File
+	zip      *gzip.Writer
+	out      *bufio.Writer
+	last     int64
+	dirty    bool
+	closed   chan struct{}
+	now      func() time.Time
+	frameBuf []byte
+}
+
+func newEventRecorder(path string) (*eventRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create recording %v", path)
+	}
+
+	if _, err = file.Write(recordingMagic); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "unable to write recording %v", path)
+	}
+
+	result := newEventRecordWriter(file)
+	result.file = file
+	go result.flushPeriodically()
+	return result, nil
+}
+
+func newEventRecordWriter(w io.Writer) *eventRecorder {
+	zip := gzip.NewWriter(w)
+	return &eventRecorder{
+		zip:      zip,
+		out:      bufio.NewWriter(zip),
+		closed:   make(chan struct{}),
+		now:      time.Now,
+		frameBuf: make([]byte, 2*binary.MaxVarintLen64),
+	}
+}
+
+func (self *eventRecorder) AcceptEvent(event []byte) error {
+	return self.record(self.now(), event)
+}
+
+func (self *eventRecorder) record(received time.Time, event []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	micros := received.UnixMicro()
+	n := binary.PutVarint(self.frameBuf, micros-self.last)
+	n += binary.PutUvarint(self.frameBuf[n:], uint64(len(event)))
+	if _, err := self.out.Write(self.frameBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := self.out.Write(event); err != nil {
+		return err
+	}
+	self.last = micros
+	self.dirty = true
+	return nil
+}
+
+func (self *eventRecorder) flush() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.dirty {
+		return nil
+	}
+	self.dirty = false
+	if err := self.out.Flush(); err != nil {
+		return err
+	}
+	return self.zip.Flush()
+}
+
+func (self *eventRecorder) flushPeriodically() {
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = self.flush()
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *eventRecorder) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	select {
+	case <-self.closed:
+		return nil
+	default:
+		close(self.closed)
+	}
+
+	err := self.out.Flush()
+	if zipErr := self.zip.Close(); err == nil {
+		err = zipErr
+	}
+	if self.file != nil {
+		if fileErr := self.file.Close(); err == nil {
+			err = fileErr
+		}
+	}
+	return err
+}
+
+// recordedEvent is a single event read from a recording
+type recordedEvent struct {
+	received time.Time
+	event    []byte
+}
+
+// eventRecordReader reads the events of a recording in the order they were received
+type eventRecordReader struct {
+	in   *bufio.Reader
+	last int64
+}
+
+func newEventRecordReader(r io.Reader) (*eventRecordReader, error) {
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, recordingMagic) {
+		return nil, errors.New("not an event recording")
+	}
+
+	zip, err := gzip.NewReader(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTruncatedRecording
+		}
+		return nil, errors.Wrap(err, "invalid event recording")
+	}
+	return &eventRecordReader{in: bufio.NewReader(zip)}, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the recording
+func (self *eventRecordReader) Next() (*recordedEvent, error) {
+	delta, err := binary.ReadVarint(self.in)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, self.frameError(err)
+	}
+
+	size, err := binary.ReadUvarint(self.in)
+	if err != nil {
+		return nil, self.frameError(err)
+	}
+	if size > recordingMaxEventSize {
+		return nil, errors.Errorf("invalid event recording, event of %v bytes exceeds the maximum size", size)
+	}
+
+	event := make([]byte, size)
+	if _, err = io.ReadFull(self.in, event); err != nil {
+		return nil, self.frameError(err)
+	}
+
+	self.last += delta
+	return &recordedEvent{
+		received: time.UnixMicro(self.last),
+		event:    event,
+	}, nil
+}
+
+func (self *eventRecordReader) frameError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errTruncatedRecording
+	}
+	return errors.Wrap(err, "invalid event recording")
+}
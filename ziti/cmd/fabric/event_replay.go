@@ -0,0 +1,198 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"context"
+	"fmt"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type eventReplayAction struct {
+	common.CommonOptions
+	eventOutputOptions
+	speed string
+}
+
+func newEventReplayCmd(p common.OptionsProvider) *cobra.Command {
+	action := &eventReplayAction{
+		CommonOptions: p(),
+	}
+
+	cmd := &cobra.Command{
+		Use:   "replay <recording>",
+		Short: "Replay events recorded with ziti fabric stream events --record-events",
+		Long: "Plays back recorded events with the same filtering, rendering and sinks as ziti fabric stream events. " +
+			"Events are played back with the time between them as recorded, scaled by --speed",
+		Example: "ziti fabric events replay incident.zev --speed 10x --pretty\n" +
+			"ziti fabric events replay incident.zev --speed max --where 'namespace == \"fabric.links\"' --sink file:links.jsonl",
+		Args: cobra.ExactArgs(1),
+		RunE: action.run,
+	}
+
+	action.addOutputFlags(cmd)
+	cmd.Flags().StringVar(&action.speed, "speed", "1x", "How fast to replay, relative to the recorded time, such as 10x or 0.5x. "+
+		"Use max to replay as fast as possible")
+	return cmd
+}
+
+func (self *eventReplayAction) run(_ *cobra.Command, args []string) error {
+	speed, err := parseReplaySpeed(self.speed)
+	if err != nil {
+		return err
+	}
+
+	output, err := self.newEventOutput(self.Out, self.Err)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = output.Close() }()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return replayRecording(ctx, args[0], speed, self.Err, func(evt *recordedEvent) error {
+		return output.AcceptEvent(evt.event)
+	})
+}
+
+// replayRecording plays back the recording at the given path. A truncated recording is played back up to the last
+// complete event, with a warning
+func replayRecording(ctx context.Context, path string, speed float64, errOut io.Writer, handler func(*recordedEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	reader, err := newEventRecordReader(file)
+	if err == nil {
+		err = newEventReplay(reader, speed).run(ctx, handler)
+	}
+	if errors.Is(err, errTruncatedRecording) {
+		_, _ = fmt.Fprintf(errOut, "warning: %v: %v\n", path, err)
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return errors.Wrapf(err, "unable to replay %v", path)
+}
+
+// parseReplaySpeed parses speeds such as 10x, 0.5x or 2. A speed of max, or 0, means as fast as possible
+func parseReplaySpeed(speed string) (float64, error) {
+	if strings.EqualFold(speed, "max") {
+		return 0, nil
+	}
+	result, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(speed), "x"), 64)
+	if err != nil || result < 0 {
+		return 0, errors.Errorf("invalid replay speed %v, expected a multiplier such as 10x, or max", speed)
+	}
+	return result, nil
+}
+
+// eventReplay plays back the events of a recording, keeping the recorded time between events divided by speed. A
+// speed of zero plays them back as fast as possible
+type eventReplay struct {
+	reader *eventRecordReader
+	speed  float64
+	now    func() time.Time
+	wait   func(ctx context.Context, d time.Duration) error
+}
+
+func newEventReplay(reader *eventRecordReader, speed float64) *eventReplay {
+	return &eventReplay{
+		reader: reader,
+		speed:  speed,
+		now:    time.Now,
+		wait:   waitOrDone,
+	}
+}
+
+func (self *eventReplay) run(ctx context.Context, handler func(*recordedEvent) error) error {
+	var startedAt, firstReceived time.Time
+	for {
+		evt, err := self.reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if firstReceived.IsZero() {
+			startedAt = self.now()
+			firstReceived = evt.received
+		} else if self.speed > 0 {
+			// schedule against the start of the replay rather than the previous event, so delays don't add up
+			offset := time.Duration(float64(evt.received.Sub(firstReceived)) / self.speed)
+			if delay := startedAt.Add(offset).Sub(self.now()); delay > 0 {
+				if err = self.wait(ctx, delay); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = handler(evt); err != nil {
+			return err
+		}
+	}
+}
+
+func waitOrDone(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replayClock tracks the recorded receive time of the event being played back, for consumers which work with
+// the time events arrive, such as the rates shown by ziti fabric top
+type replayClock struct {
+	lock sync.Mutex
+	time time.Time
+}
+
+func (self *replayClock) set(t time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.time = t
+}
+
+func (self *replayClock) now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.time
+}
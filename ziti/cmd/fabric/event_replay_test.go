@@ -0,0 +1,163 @@
+package fabric
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRecordingStart = time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func writeTestRecording(t *testing.T, path string, events ...string) {
+	recorder, err := newEventRecorder(path)
+	require.NoError(t, err)
+	for idx, evt := range events {
+		require.NoError(t, recorder.record(testRecordingStart.Add(time.Duration(idx)*time.Second), []byte(evt)))
+	}
+	require.NoError(t, recorder.Close())
+}
+
+func TestEventRecordingRoundTrip(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.zev")
+
+	events := []string{
+		`{"namespace":"fabric.circuits","event_type":"created","circuit_id":"c1"}`,
+		`{"namespace":"fabric.circuits","event_type":"deleted","circuit_id":"c1"}`,
+		`{"namespace":"fabric.links","event_type":"fault","link_id":"l1"}`,
+	}
+	writeTestRecording(t, path, events...)
+
+	file, err := os.Open(path)
+	req.NoError(err)
+	defer func() { _ = file.Close() }()
+
+	reader, err := newEventRecordReader(file)
+	req.NoError(err)
+	for idx, expected := range events {
+		evt, err := reader.Next()
+		req.NoError(err)
+		req.Equal(expected, string(evt.event))
+		req.True(testRecordingStart.Add(time.Duration(idx) * time.Second).Equal(evt.received))
+	}
+	_, err = reader.Next()
+	req.Equal(io.EOF, err)
+
+	_, err = newEventRecordReader(strings.NewReader(`{"namespace":"metrics"}`))
+	req.EqualError(err, "not an event recording")
+}
+
+func TestTruncatedEventRecording(t *testing.T) {
+	req := require.New(t)
+
+	// flushed but never closed, as when the recording process is killed
+	buf := &bytes.Buffer{}
+	buf.Write(recordingMagic)
+	recorder := newEventRecordWriter(buf)
+	req.NoError(recorder.record(testRecordingStart, []byte(`{"namespace":"fabric.routers"}`)))
+	req.NoError(recorder.flush())
+
+	reader, err := newEventRecordReader(buf)
+	req.NoError(err)
+	evt, err := reader.Next()
+	req.NoError(err)
+	req.Equal(`{"namespace":"fabric.routers"}`, string(evt.event))
+	_, err = reader.Next()
+	req.Equal(errTruncatedRecording, err)
+}
+
+func TestEventReplayKeepsRecordedTiming(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.zev")
+	writeTestRecording(t, path, `{"n":1}`, `{"n":2}`, `{"n":3}`)
+
+	file, err := os.Open(path)
+	req.NoError(err)
+	defer func() { _ = file.Close() }()
+	reader, err := newEventRecordReader(file)
+	req.NoError(err)
+
+	now := time.Unix(0, 0)
+	var waits []time.Duration
+	var replayed []string
+
+	replay := newEventReplay(reader, 10)
+	replay.now = func() time.Time { return now }
+	replay.wait = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	req.NoError(replay.run(context.Background(), func(evt *recordedEvent) error {
+		replayed = append(replayed, string(evt.event))
+		// handling takes time, which is subtracted from the next wait
+		now = now.Add(20 * time.Millisecond)
+		return nil
+	}))
+	req.Equal([]string{`{"n":1}`, `{"n":2}`, `{"n":3}`}, replayed)
+	req.Equal([]time.Duration{80 * time.Millisecond, 80 * time.Millisecond}, waits)
+}
+
+func TestEventReplayOutput(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.zev")
+	writeTestRecording(t, path,
+		`{"namespace":"fabric.circuits","event_type":"created"}`,
+		`{"namespace":"stream.gap","event_type":"reconnected"}`,
+		`{"namespace":"fabric.circuits","event_type":"failed"}`,
+	)
+
+	out := &bytes.Buffer{}
+	options := &eventOutputOptions{where: `event_type == "failed"`}
+	output, err := options.newEventOutput(out, io.Discard)
+	req.NoError(err)
+
+	req.NoError(replayRecording(context.Background(), path, 0, io.Discard, func(evt *recordedEvent) error {
+		return output.AcceptEvent(evt.event)
+	}))
+	req.NoError(output.Close())
+	req.Equal("{\"namespace\":\"stream.gap\",\"event_type\":\"reconnected\"}\n"+
+		"{\"namespace\":\"fabric.circuits\",\"event_type\":\"failed\"}\n", out.String())
+}
+
+func TestParseReplaySpeed(t *testing.T) {
+	req := require.New(t)
+	for input, expected := range map[string]float64{"10x": 10, "0.5X": 0.5, "2": 2, "max": 0, "0": 0} {
+		speed, err := parseReplaySpeed(input)
+		req.NoError(err, input)
+		req.Equal(expected, speed, input)
+	}
+	_, err := parseReplaySpeed("fast")
+	req.Error(err)
+	_, err = parseReplaySpeed("-1x")
+	req.Error(err)
+}
+
+func TestEventRecordingFlagsDontReplaceHarFlags(t *testing.T) {
+	fabricCmd := newTestFabricCmd(io.Discard, io.Discard)
+	for _, path := range [][]string{{"stream", "events"}, {"top"}, {"alert"}} {
+		cmd, _, err := fabricCmd.Find(path)
+		require.NoError(t, err)
+
+		// --record and --replay still name HAR files of the REST traffic
+		require.NotNil(t, cmd.Flags().Lookup("record"), path)
+		require.True(t, strings.Contains(cmd.Flags().Lookup("replay").Usage, "HAR"), path)
+	}
+
+	cmd, _, err := fabricCmd.Find([]string{"stream", "events"})
+	require.NoError(t, err)
+	require.NotNil(t, cmd.Flags().Lookup("record-events"))
+
+	for _, path := range [][]string{{"top"}, {"alert"}} {
+		cmd, _, err = fabricCmd.Find(path)
+		require.NoError(t, err)
+		require.NotNil(t, cmd.Flags().Lookup("replay-events"), path)
+	}
+}
@@ -0,0 +1,662 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// eventSink receives the JSON encoded events streamed from the controller
+type eventSink interface {
+	AcceptEvent(event []byte) error
+	Close() error
+}
+
+// eventSinks fans events out to multiple sinks. A failing sink is reported but doesn't affect the others
+type eventSinks struct {
+	sinks  []eventSink
+	names  []string
+	errOut io.Writer
+}
+
+func (self *eventSinks) AcceptEvent(event []byte) error {
+	for idx, sink := range self.sinks {
+		if err := sink.AcceptEvent(event); err != nil {
+			_, _ = fmt.Fprintf(self.errOut, "event sink %v: %v\n", self.names[idx], err)
+		}
+	}
+	return nil
+}
+
+func (self *eventSinks) Close() error {
+	var result error
+	for idx, sink := range self.sinks {
+		if err := sink.Close(); err != nil {
+			_, _ = fmt.Fprintf(self.errOut, "error closing event sink %v: %v\n", self.names[idx], err)
+			result = err
+		}
+	}
+	return result
+}
+
+// eventOutputOptions holds the flags shared by the commands which output events, such as stream events and events
+// replay, so live and recorded events go through the same filtering, rendering and sinks
+type eventOutputOptions struct {
+	sinkSpecs []string
+	where     string
+	pretty    bool
+}
+
+func (self *eventOutputOptions) addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&self.sinkSpecs, "sink", nil, "Where to send events, may be given multiple times. One of: stdout, "+
+		"file:<path>[?maxSize=100MB&keep=10], http(s)://<host>/<path>[?batchSize=100&flushInterval=1s&retries=5&queueSize=10000&closeTimeout=10s] "+
+		"unix:<socket path> or archive:<path>[?retention=168h]. Defaults to stdout")
+	cmd.Flags().StringVar(&self.where, "where", "", "Only output events matching the expression, for example: "+
+		"namespace == \"fabric.circuits\" && event_type == \"failed\". Fields are compared with ==, !=, <, <=, >, >=, =~ and !~ "+
+		"(regex) and combined with &&, || and !. Nested fields are separated by dots, such as tags.serviceId")
+	cmd.Flags().BoolVar(&self.pretty, "pretty", false, "Print a colorized one line summary of each event to stdout instead of JSON")
+}
+
+func (self *eventOutputOptions) newEventOutput(out, errOut io.Writer) (*eventOutput, error) {
+	result := &eventOutput{}
+	if self.where != "" {
+		filter, err := newEventFilter(self.where)
+		if err != nil {
+			return nil, err
+		}
+		result.filter = filter
+	}
+
+	var format func([]byte) string
+	if self.pretty {
+		format = formatEventLine
+	}
+
+	sinks, err := newEventSinks(self.sinkSpecs, format, out, errOut)
+	if err != nil {
+		return nil, err
+	}
+	result.sinks = sinks
+	return result, nil
+}
+
+// eventOutput passes the events matching the filter on to the sinks. Stream gap markers are always passed on, so
+// consumers know events may be missing. If a recorder is set, it gets all events, whether they match or not
+type eventOutput struct {
+	filter   *eventFilter
+	sinks    eventSink
+	recorder eventSink
+}
+
+func (self *eventOutput) AcceptEvent(event []byte) error {
+	if self.recorder != nil {
+		if err := self.recorder.AcceptEvent(event); err != nil {
+			return err
+		}
+	}
+	if self.filter != nil && !self.filter.Matches(event) && !isStreamGapEvent(event) {
+		return nil
+	}
+	return self.sinks.AcceptEvent(event)
+}
+
+func (self *eventOutput) Close() error {
+	err := self.sinks.Close()
+	if self.recorder != nil {
+		if recErr := self.recorder.Close(); recErr != nil {
+			err = errors.Wrap(recErr, "error closing recording")
+		}
+	}
+	return err
+}
+
+// newEventSinks creates a sink for each of the given specs, writing to out if none are given. If format is set, it's
+// used to render events written to stdout, other sinks always get the JSON events
+func newEventSinks(specs []string, format func([]byte) string, out, errOut io.Writer) (*eventSinks, error) {
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+
+	result := &eventSinks{errOut: errOut}
+	for _, spec := range specs {
+		sink, err := newEventSink(spec, format, out, errOut)
+		if err != nil {
+			_ = result.Close()
+			return nil, err
+		}
+		result.sinks = append(result.sinks, sink)
+		result.names = append(result.names, redactSinkSpec(spec))
+	}
+	return result, nil
+}
+
+// newEventSink creates a sink from a spec of the form:
+//
+//	stdout or -
+//	file:<path>[?maxSize=<size>&keep=<count>]
+//	http(s)://<host>/<path>[?batchSize=<count>&flushInterval=<duration>&retries=<count>&queueSize=<count>&closeTimeout=<duration>]
+//	unix:<socket path>
+//	archive:<path>[?retention=<duration>]
+func newEventSink(spec string, format func([]byte) string, out, errOut io.Writer) (eventSink, error) {
+	if spec == "stdout" || spec == "-" {
+		return &writerEventSink{out: out, format: format}, nil
+	}
+
+	sinkUrl, err := url.Parse(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid event sink %v", spec)
+	}
+
+	switch sinkUrl.Scheme {
+	case "file":
+		return newFileEventSink(sinkUrl)
+	case "http", "https":
+		return newHttpEventSink(sinkUrl, errOut)
+	case "unix":
+		return newUnixEventSink(sinkUrl, errOut)
+	case "archive":
+		return newArchiveEventSink(sinkUrl)
+	default:
+		return nil, errors.Errorf("unsupported event sink %v, expected stdout, file:, http:, https:, unix: or archive:", spec)
+	}
+}
+
+// redactSinkSpec hides credentials in sink urls, so they aren't written to logs
+func redactSinkSpec(spec string) string {
+	if sinkUrl, err := url.Parse(spec); err == nil && sinkUrl.User != nil {
+		return sinkUrl.Redacted()
+	}
+	return spec
+}
+
+func sinkPath(sinkUrl *url.URL) string {
+	if sinkUrl.Opaque != "" {
+		return sinkUrl.Opaque
+	}
+	return sinkUrl.Path
+}
+
+// writerEventSink writes each event on its own line
+type writerEventSink struct {
+	out    io.Writer
+	format func([]byte) string
+}
+
+func (self *writerEventSink) AcceptEvent(event []byte) error {
+	if self.format != nil {
+		_, err := fmt.Fprintln(self.out, self.format(event))
+		return err
+	}
+	_, err := fmt.Fprintln(self.out, string(event))
+	return err
+}
+
+func (self *writerEventSink) Close() error {
+	return nil
+}
+
+// fileEventSink appends events as JSON lines to a file. When maxSize is set, the file is rotated before it would
+// grow beyond that size, keeping the given number of older files as <path>.1 (newest) to <path>.<keep> (oldest)
+type fileEventSink struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func newFileEventSink(sinkUrl *url.URL) (*fileEventSink, error) {
+	result := &fileEventSink{
+		path: sinkPath(sinkUrl),
+		keep: 5,
+	}
+
+	if result.path == "" {
+		return nil, errors.New("file event sink requires a path, for example file:/var/log/ziti/events.jsonl")
+	}
+
+	params := sinkUrl.Query()
+	if val := params.Get("maxSize"); val != "" {
+		maxSize, err := parseByteSize(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid maxSize for file event sink %v", result.path)
+		}
+		result.maxSize = maxSize
+	}
+
+	if val := params.Get("keep"); val != "" {
+		keep, err := strconv.Atoi(val)
+		if err != nil || keep < 0 {
+			return nil, errors.Errorf("invalid keep value %v for file event sink %v", val, result.path)
+		}
+		result.keep = keep
+	}
+
+	if err := result.open(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (self *fileEventSink) open() error {
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open event file %v", self.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "unable to stat event file %v", self.path)
+	}
+
+	self.file = file
+	self.size = info.Size()
+	return nil
+}
+
+func (self *fileEventSink) AcceptEvent(event []byte) error {
+	if self.file == nil {
+		if err := self.open(); err != nil {
+			return err
+		}
+	}
+
+	lineLen := int64(len(event) + 1)
+	if self.maxSize > 0 && self.size > 0 && self.size+lineLen > self.maxSize {
+		if err := self.rotate(); err != nil {
+			return err
+		}
+	}
+
+	line := make([]byte, 0, lineLen)
+	line = append(append(line, event...), '\n')
+	n, err := self.file.Write(line)
+	self.size += int64(n)
+	return err
+}
+
+func (self *fileEventSink) rotate() error {
+	if err := self.file.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close event file %v", self.path)
+	}
+	self.file = nil
+
+	if self.keep == 0 {
+		if err := os.Remove(self.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove event file %v", self.path)
+		}
+		return self.open()
+	}
+
+	_ = os.Remove(fmt.Sprintf("%v.%v", self.path, self.keep))
+	for idx := self.keep - 1; idx >= 1; idx-- {
+		from := fmt.Sprintf("%v.%v", self.path, idx)
+		if err := os.Rename(from, fmt.Sprintf("%v.%v", self.path, idx+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to rotate event file %v", from)
+		}
+	}
+
+	if err := os.Rename(self.path, self.path+".1"); err != nil {
+		return errors.Wrapf(err, "unable to rotate event file %v", self.path)
+	}
+
+	return self.open()
+}
+
+func (self *fileEventSink) Close() error {
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// httpEventSink posts events to a webhook as JSON arrays. Events are queued and sent in batches of up to batchSize,
+// or whatever has been queued after flushInterval. Failed posts are retried with exponential backoff, after which
+// the batch is dropped. If the queue fills up because the webhook can't keep up, new events are dropped. Close sends
+// what's queued for up to closeTimeout, after which in flight posts and retries are abandoned
+type httpEventSink struct {
+	url           string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	retryDelay    time.Duration
+	closeTimeout  time.Duration
+	errOut        io.Writer
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	events  chan []byte
+	done    chan struct{}
+	dropped int64
+	failed  int64
+}
+
+func newHttpEventSink(sinkUrl *url.URL, errOut io.Writer) (*httpEventSink, error) {
+	result := &httpEventSink{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		batchSize:     100,
+		flushInterval: time.Second,
+		retries:       5,
+		retryDelay:    500 * time.Millisecond,
+		closeTimeout:  10 * time.Second,
+		errOut:        errOut,
+		done:          make(chan struct{}),
+	}
+
+	queueSize := 10000
+	params := sinkUrl.Query()
+
+	intParam := func(name string, target *int) error {
+		if val := params.Get(name); val != "" {
+			intVal, err := strconv.Atoi(val)
+			if err != nil || intVal < 0 {
+				return errors.Errorf("invalid %v value %v for http event sink", name, val)
+			}
+			*target = intVal
+		}
+		params.Del(name)
+		return nil
+	}
+
+	if err := intParam("batchSize", &result.batchSize); err != nil {
+		return nil, err
+	}
+	if err := intParam("retries", &result.retries); err != nil {
+		return nil, err
+	}
+	if err := intParam("queueSize", &queueSize); err != nil {
+		return nil, err
+	}
+
+	if val := params.Get("flushInterval"); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			return nil, errors.Errorf("invalid flushInterval value %v for http event sink", val)
+		}
+		result.flushInterval = interval
+	}
+	params.Del("flushInterval")
+
+	if val := params.Get("closeTimeout"); val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil || timeout < 0 {
+			return nil, errors.Errorf("invalid closeTimeout value %v for http event sink", val)
+		}
+		result.closeTimeout = timeout
+	}
+	params.Del("closeTimeout")
+
+	if result.batchSize < 1 {
+		result.batchSize = 1
+	}
+
+	// the remaining query parameters belong to the webhook
+	webhookUrl := *sinkUrl
+	webhookUrl.RawQuery = params.Encode()
+	result.url = webhookUrl.String()
+
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	result.events = make(chan []byte, queueSize)
+	go result.run()
+	return result, nil
+}
+
+func (self *httpEventSink) AcceptEvent(event []byte) error {
+	select {
+	case self.events <- append([]byte(nil), event...):
+		return nil
+	default:
+		self.dropped++
+		if self.dropped == 1 || self.dropped%1000 == 0 {
+			return errors.Errorf("queue full, %v events dropped", self.dropped)
+		}
+		return nil
+	}
+}
+
+func (self *httpEventSink) Close() error {
+	close(self.events)
+
+	timer := time.NewTimer(self.closeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-self.done:
+	case <-timer.C:
+		// give up on the webhook, anything still queued is dropped
+		self.cancel()
+		<-self.done
+	}
+	self.cancel()
+
+	if dropped := self.dropped + atomic.LoadInt64(&self.failed); dropped > 0 {
+		return errors.Errorf("%v events dropped", dropped)
+	}
+	return nil
+}
+
+func (self *httpEventSink) run() {
+	defer close(self.done)
+
+	ticker := time.NewTicker(self.flushInterval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case event, ok := <-self.events:
+			if !ok {
+				self.send(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= self.batchSize {
+				self.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			self.send(batch)
+			batch = nil
+		}
+	}
+}
+
+func (self *httpEventSink) send(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// Close gave up waiting, so don't even try
+	if self.ctx.Err() != nil {
+		atomic.AddInt64(&self.failed, int64(len(batch)))
+		return
+	}
+
+	body := append(append([]byte{'['}, bytes.Join(batch, []byte{','})...), ']')
+
+	delay := self.retryDelay
+	var err error
+	for attempt := 0; attempt <= self.retries; attempt++ {
+		if attempt > 0 {
+			if err = self.wait(delay); err != nil {
+				break
+			}
+			if delay *= 2; delay > 30*time.Second {
+				delay = 30 * time.Second
+			}
+		}
+
+		var retry bool
+		if retry, err = self.post(body); err == nil || !retry || self.ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		atomic.AddInt64(&self.failed, int64(len(batch)))
+		_, _ = fmt.Fprintf(self.errOut, "event sink %v: dropping %v events: %v\n", redactSinkSpec(self.url), len(batch), err)
+	}
+}
+
+// wait sleeps between retries, returning an error if the sink is closed in the meantime
+func (self *httpEventSink) wait(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-self.ctx.Done():
+		return errors.New("sink closed before the webhook was available")
+	}
+}
+
+// post sends the body, returning whether a failure is worth retrying
+func (self *httpEventSink) post(body []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(self.ctx, http.MethodPost, self.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := self.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, errors.Errorf("webhook returned %v", resp.Status)
+}
+
+// unixEventSink writes events as JSON lines to a unix socket. If the socket is unavailable, events are dropped and
+// the connection is retried, at most once a second
+type unixEventSink struct {
+	path       string
+	errOut     io.Writer
+	conn       net.Conn
+	lastDial   time.Time
+	connectErr bool
+	dropped    int64
+}
+
+func newUnixEventSink(sinkUrl *url.URL, errOut io.Writer) (*unixEventSink, error) {
+	result := &unixEventSink{
+		path:   sinkPath(sinkUrl),
+		errOut: errOut,
+	}
+	if result.path == "" {
+		return nil, errors.New("unix event sink requires a socket path, for example unix:/var/run/siem.sock")
+	}
+	return result, nil
+}
+
+func (self *unixEventSink) AcceptEvent(event []byte) error {
+	if self.conn == nil {
+		if time.Since(self.lastDial) < time.Second {
+			self.dropped++
+			return nil
+		}
+
+		self.lastDial = time.Now()
+		conn, err := net.DialTimeout("unix", self.path, 5*time.Second)
+		if err != nil {
+			self.dropped++
+			if !self.connectErr {
+				self.connectErr = true
+				return errors.Wrapf(err, "unable to connect, dropping events until the socket is available")
+			}
+			return nil
+		}
+
+		self.conn = conn
+		if self.connectErr {
+			_, _ = fmt.Fprintf(self.errOut, "event sink unix:%v: connected, %v events dropped\n", self.path, self.dropped)
+		}
+		self.connectErr = false
+		self.dropped = 0
+	}
+
+	line := make([]byte, 0, len(event)+1)
+	line = append(append(line, event...), '\n')
+	if _, err := self.conn.Write(line); err != nil {
+		_ = self.conn.Close()
+		self.conn = nil
+		self.connectErr = true
+		self.dropped++
+		return errors.Wrap(err, "write failed, reconnecting")
+	}
+	return nil
+}
+
+func (self *unixEventSink) Close() error {
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// parseByteSize parses sizes such as 512, 64KB, 100MB or 1GB. Units are powers of 1024
+func parseByteSize(val string) (int64, error) {
+	val = strings.ToUpper(strings.TrimSpace(val))
+	multiplier := int64(1)
+
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1},
+	} {
+		if strings.HasSuffix(val, unit.suffix) {
+			val = strings.TrimSpace(strings.TrimSuffix(val, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.Errorf("invalid size %v", val)
+	}
+	return size * multiplier, nil
+}
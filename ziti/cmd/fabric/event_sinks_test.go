@@ -0,0 +1,190 @@
+package fabric
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileEventSinkRotates(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	sink, err := newEventSink("file:"+path+"?maxSize=40B&keep=2", nil, nil, io.Discard)
+	req.NoError(err)
+
+	// each event is 16 bytes with the newline, so two fit in a file
+	for i := 0; i < 7; i++ {
+		req.NoError(sink.AcceptEvent([]byte(fmt.Sprintf(`{"event":"e%v"}`, i))))
+	}
+	req.NoError(sink.Close())
+
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		req.NoError(err)
+		return string(data)
+	}
+
+	req.Equal("{\"event\":\"e6\"}\n", read(path))
+	req.Equal("{\"event\":\"e4\"}\n{\"event\":\"e5\"}\n", read(path+".1"))
+	req.Equal("{\"event\":\"e2\"}\n{\"event\":\"e3\"}\n", read(path+".2"))
+	req.NoFileExists(path + ".3")
+}
+
+func TestHttpEventSinkBatchesAndRetries(t *testing.T) {
+	req := require.New(t)
+
+	var lock sync.Mutex
+	var batches [][]map[string]interface{}
+	var queries []string
+	failures := 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, batch)
+		queries = append(queries, r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	sink, err := newEventSink(server.URL+"/hook?token=abc&batchSize=2&flushInterval=1h&retries=2", nil, nil, io.Discard)
+	req.NoError(err)
+	sink.(*httpEventSink).retryDelay = time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		req.NoError(sink.AcceptEvent([]byte(fmt.Sprintf(`{"seq":%v}`, i))))
+	}
+	req.NoError(sink.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	req.Len(batches, 3)
+	req.Len(batches[0], 2)
+	req.Len(batches[1], 2)
+	req.Len(batches[2], 1)
+	req.Equal(float64(4), batches[2][0]["seq"])
+	req.Equal([]string{"token=abc", "token=abc", "token=abc"}, queries)
+}
+
+func TestHttpEventSinkCloseIsBounded(t *testing.T) {
+	req := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	errOut := &bytes.Buffer{}
+	sink, err := newEventSink(server.URL+"/hook?batchSize=2&flushInterval=1h&retries=100&closeTimeout=50ms", nil, nil, errOut)
+	req.NoError(err)
+
+	// without the close timeout, the first batch alone would be retried for hours
+	for i := 0; i < 5; i++ {
+		req.NoError(sink.AcceptEvent([]byte(fmt.Sprintf(`{"seq":%v}`, i))))
+	}
+
+	start := time.Now()
+	req.EqualError(sink.Close(), "5 events dropped")
+	req.Less(time.Since(start), 5*time.Second)
+	req.Contains(errOut.String(), "dropping 2 events")
+}
+
+func TestUnixEventSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets not supported")
+	}
+	req := require.New(t)
+
+	socketDir, err := os.MkdirTemp("", "sink")
+	req.NoError(err)
+	defer func() { _ = os.RemoveAll(socketDir) }()
+	socketPath := filepath.Join(socketDir, "events.sock")
+
+	errOut := &bytes.Buffer{}
+	sinks, err := newEventSinks([]string{"unix:" + socketPath}, nil, nil, errOut)
+	req.NoError(err)
+
+	// nothing is listening yet, so the event is dropped and reported once
+	req.NoError(sinks.AcceptEvent([]byte(`{"seq":0}`)))
+	req.Contains(errOut.String(), "unable to connect")
+
+	listener, err := net.Listen("unix", socketPath)
+	req.NoError(err)
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	sinks.sinks[0].(*unixEventSink).lastDial = time.Time{}
+	req.NoError(sinks.AcceptEvent([]byte(`{"seq":1}`)))
+	req.NoError(sinks.AcceptEvent([]byte(`{"seq":2}`)))
+	req.NoError(sinks.Close())
+
+	req.Equal(`{"seq":1}`, <-received)
+	req.Equal(`{"seq":2}`, <-received)
+	req.Contains(errOut.String(), "connected, 1 events dropped")
+}
+
+func TestMultipleEventSinks(t *testing.T) {
+	req := require.New(t)
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	out := &bytes.Buffer{}
+	sinks, err := newEventSinks([]string{"stdout", "file:" + path}, nil, out, io.Discard)
+	req.NoError(err)
+	req.NoError(sinks.AcceptEvent([]byte(`{"seq":1}`)))
+	req.NoError(sinks.Close())
+
+	data, err := os.ReadFile(path)
+	req.NoError(err)
+	req.Equal(out.String(), string(data))
+	req.Equal("{\"seq\":1}\n", out.String())
+
+	_, err = newEventSinks([]string{"ftp://example.com"}, nil, out, io.Discard)
+	req.Error(err)
+}
+
+func TestParseByteSize(t *testing.T) {
+	for val, expected := range map[string]int64{"512": 512, "64KB": 64 << 10, "100MB": 100 << 20, "1gib": 1 << 30, "10 M": 10 << 20} {
+		size, err := parseByteSize(val)
+		require.NoError(t, err, val)
+		require.Equal(t, expected, size, val)
+	}
+
+	for _, val := range []string{"", "MB", "-1", "1TB", strings.Repeat("9", 30)} {
+		_, err := parseByteSize(val)
+		require.Error(t, err, val)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/openziti/ziti/ziti/cmd/api"
 	"github.com/openziti/ziti/ziti/cmd/common"
 	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
 	"strings"
 
 	"github.com/jedib0t/go-pretty/v6/table"
@@ -103,28 +104,12 @@ func outputCircuits(o *api.Options, results *circuit.ListCircuitsOK) error {
 	t.AppendHeader(table.Row{"ID", "Client", "Service", "Terminator", "Path"})
 
 	for _, entity := range results.Payload.Data {
-		pathLabel := strings.Builder{}
-
-		if path := entity.Path; path != nil {
-			if len(path.Nodes) > 0 {
-				pathLabel.WriteString("r/")
-				pathLabel.WriteString(path.Nodes[0].Name)
-			}
-			for idx, node := range path.Nodes[1:] {
-				linkEntity := path.Links[idx]
-				pathLabel.WriteString(" -> l/")
-				pathLabel.WriteString(linkEntity.ID)
-				pathLabel.WriteString(" -> r/")
-				pathLabel.WriteString(node.Name)
-			}
-		}
-
 		t.AppendRow(table.Row{
 			valOrDefault(entity.ID),
 			entity.ClientID,
 			entity.Service.Name,
 			entity.Terminator.ID,
-			pathLabel.String(),
+			circuitPathLabel(entity.Path),
 		})
 	}
 
@@ -133,6 +118,27 @@ func outputCircuits(o *api.Options, results *circuit.ListCircuitsOK) error {
 	return nil
 }
 
+// circuitPathLabel renders a circuit path as text, such as r/a -> l/x -> r/b
+func circuitPathLabel(path *rest_model.CircuitDetailPath) string {
+	pathLabel := strings.Builder{}
+
+	if path != nil {
+		if len(path.Nodes) > 0 {
+			pathLabel.WriteString("r/")
+			pathLabel.WriteString(path.Nodes[0].Name)
+		}
+		for idx, node := range path.Nodes[1:] {
+			linkEntity := path.Links[idx]
+			pathLabel.WriteString(" -> l/")
+			pathLabel.WriteString(linkEntity.ID)
+			pathLabel.WriteString(" -> r/")
+			pathLabel.WriteString(node.Name)
+		}
+	}
+
+	return pathLabel.String()
+}
+
 func runListLinks(o *api.Options) error {
 	return WithFabricClient(o, func(client *fabric_rest_client.ZitiFabric) error {
 		result, err := client.Link.ListLinks(&link.ListLinksParams{
@@ -302,6 +308,25 @@ func outputResult[T any](val T, err error, o *api.Options, f func(o *api.Options
 	return f(o, val)
 }
 
+// listPageLimit is the page size used when fetching every entity of a type
+const listPageLimit = int64(500)
+
+// listAll fetches every entity of a type, by calling list with increasing offsets until it returns a partial page
+func listAll[T any](list func(limit, offset *int64) ([]T, error)) ([]T, error) {
+	var result []T
+	limit := listPageLimit
+	for offset := int64(0); ; offset += limit {
+		page, err := list(&limit, &offset)
+		if err != nil {
+			return nil, util.WrapIfApiError(err)
+		}
+		result = append(result, page...)
+		if int64(len(page)) < limit {
+			return result, nil
+		}
+	}
+}
+
 func valOrDefault[V any, T *V](val T) V {
 	var result V
 	if val != nil {
@@ -0,0 +1,58 @@
+package fabric
+
+import (
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func newTestFabricCmd(out io.Writer, errOut io.Writer) *cobra.Command {
+	return NewFabricCmd(common.NewOptionsProvider(out, errOut))
+}
+
+func TestListRoutersServicesAndTerminators(t *testing.T) {
+	server := apitest.NewServer(t)
+	routerId := server.Create("routers", map[string]interface{}{
+		"name":        "router-east",
+		"connected":   true,
+		"cost":        10,
+		"noTraversal": false,
+		"disabled":    false,
+		"versionInfo": map[string]interface{}{"version": "v0.27.0", "os": "linux", "arch": "amd64"},
+		"listenerAddresses": []interface{}{
+			map[string]interface{}{"address": "tls:router-east:6000", "protocol": "tls"},
+		},
+	})
+	server.Create("routers", map[string]interface{}{"name": "router-west", "connected": false, "cost": 20})
+	serviceId := server.Create("services", map[string]interface{}{"name": "echo", "terminatorStrategy": "smartrouting"})
+	server.Create("terminators", map[string]interface{}{
+		"service":     serviceId,
+		"router":      routerId,
+		"binding":     "transport",
+		"address":     "tcp:localhost:1234",
+		"instanceId":  "",
+		"cost":        0,
+		"precedence":  "default",
+		"dynamicCost": 0,
+		"hostId":      "",
+	})
+
+	output, err := apitest.Execute(newTestFabricCmd, "list", "routers")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_routers", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "list", "routers", `name = "router-west"`, "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_routers_filtered_csv", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "list", "services")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_services", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "list", "terminators", "--csv")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "list_terminators_csv", output)
+}
@@ -0,0 +1,302 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/channel/v2"
+	"github.com/openziti/fabric/event"
+	"github.com/openziti/fabric/pb/mgmt_pb"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const entityCountsEventsNs = "edge.entityCounts"
+
+var promQuantiles = map[string]string{"p50": "0.5", "p75": "0.75", "p95": "0.95", "p99": "0.99", "p999": "0.999", "p9999": "0.9999"}
+
+type metricsExporterAction struct {
+	api.Options
+	api.StreamOptions
+	listen               string
+	path                 string
+	expiry               time.Duration
+	metricsSourceFilter  string
+	metricsFilter        string
+	entityCountsInterval time.Duration
+	identityLabel        bool
+
+	registry *promRegistry
+}
+
+func newMetricsExporterCmd(p common.OptionsProvider) *cobra.Command {
+	action := &metricsExporterAction{
+		Options: api.Options{
+			CommonOptions: p(),
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "metrics-exporter",
+		Short: "Serve fabric metrics, usage and entity counts for Prometheus",
+		Long: "Subscribes to metrics, fabric.usage and edge.entityCounts events and serves them for Prometheus to scrape. " +
+			"Metrics are named and labeled the same way as by the controller's prometheus event formatter. Meters become " +
+			"gauges of their one minute rate, histograms and timers become summaries, usage becomes byte counters " +
+			"labeled by router and service, and entity counts become gauges labeled by entity type. Series for routers " +
+			"that go offline and links that fail are removed, as are series which haven't been updated within the " +
+			"expiry period",
+		Example: "ziti fabric metrics-exporter --listen :9100",
+		Args:    cobra.ExactArgs(0),
+		RunE:    action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	action.AddStreamFlags(cmd)
+
+	// the exporter is meant to run unattended, so it reconnects by default
+	reconnectFlag := cmd.Flags().Lookup("reconnect")
+	reconnectFlag.DefValue = "true"
+	_ = reconnectFlag.Value.Set("true")
+
+	cmd.Flags().StringVar(&action.listen, "listen", ":9100", "The address to serve metrics on")
+	cmd.Flags().StringVar(&action.path, "path", "/metrics", "The path to serve metrics on")
+	cmd.Flags().DurationVar(&action.expiry, "expire", 5*time.Minute, "Remove series which haven't been updated for this long. 0 keeps them forever")
+	cmd.Flags().StringVar(&action.metricsSourceFilter, "metrics-source-filter", "", "Specify which sources to export metrics from")
+	cmd.Flags().StringVar(&action.metricsFilter, "metrics-filter", "", "Specify which metrics to export")
+	cmd.Flags().DurationVar(&action.entityCountsInterval, "entity-counts-interval", time.Minute, "Specify the entity count event interval")
+	cmd.Flags().BoolVar(&action.identityLabel, "usage-identity-label", false, "Label usage counters with the client identity. "+
+		"Creates a series per identity and service, so only use with a moderate number of identities")
+	return cmd
+}
+
+func (self *metricsExporterAction) run(cmd *cobra.Command, _ []string) error {
+	self.registry = newPromRegistry(self.expiry)
+
+	metricsSubscription := &event.Subscription{
+		Type:    event.MetricsEventsNs,
+		Options: map[string]interface{}{},
+	}
+	if cmd.Flags().Changed("metrics-source-filter") {
+		metricsSubscription.Options["sourceFilter"] = self.metricsSourceFilter
+	}
+	if cmd.Flags().Changed("metrics-filter") {
+		metricsSubscription.Options["metricFilter"] = self.metricsFilter
+	}
+
+	request, err := json.Marshal(map[string]interface{}{
+		"format": "json",
+		"subscriptions": []*event.Subscription{
+			metricsSubscription,
+			{Type: event.UsageEventsNs, Options: map[string]interface{}{"version": 3}},
+			{Type: entityCountsEventsNs, Options: map[string]interface{}{"interval": self.entityCountsInterval.String()}},
+			{Type: event.RouterEventsNs},
+			{Type: event.LinkEventsNs},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", self.listen)
+	if err != nil {
+		return errors.Wrapf(err, "unable to listen on %v", self.listen)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(self.path, self)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+			cancel()
+		}
+	}()
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	_, _ = fmt.Fprintf(self.Err, "serving metrics on %v%v\n", listener.Addr(), self.path)
+
+	stream := &api.MgmtStream{
+		StreamOptions: self.StreamOptions,
+		Bind: func(binding channel.Binding) {
+			binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamEventsEventType), self)
+		},
+		Subscribe: func(ch channel.Channel) error {
+			return subscribeToEvents(ch, request, time.Duration(self.Timeout)*time.Second)
+		},
+		OnGap: func(*api.StreamGap) {
+			self.registry.add("ziti_exporter_reconnects_total", "Number of times the exporter reconnected to the controller", nil, 1)
+		},
+		ErrOut: self.Err,
+	}
+
+	err = stream.Run(ctx)
+	select {
+	case srvErr := <-serverErr:
+		return srvErr
+	default:
+		return err
+	}
+}
+
+func (self *metricsExporterAction) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = self.registry.Write(w)
+}
+
+func (self *metricsExporterAction) HandleReceive(msg *channel.Message, _ channel.Channel) {
+	_ = self.acceptEvent(msg.Body)
+}
+
+func (self *metricsExporterAction) acceptEvent(data []byte) error {
+	header := &struct {
+		Namespace string `json:"namespace"`
+	}{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return err
+	}
+
+	self.registry.add("ziti_exporter_events_total", "Number of events received from the controller",
+		map[string]string{"namespace": header.Namespace}, 1)
+
+	switch header.Namespace {
+	case event.MetricsEventsNs:
+		evt := &event.MetricsEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptMetricsEvent(evt)
+	case event.UsageEventsNs:
+		evt := &event.UsageEventV3{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptUsageEvent(evt)
+	case entityCountsEventsNs:
+		evt := &struct {
+			Counts map[string]int64 `json:"counts"`
+		}{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		for entityType, count := range evt.Counts {
+			self.registry.set("ziti_entity_count", promGauge, "Number of entities of each type", "",
+				map[string]string{"entity_type": entityType}, float64(count))
+		}
+	case event.RouterEventsNs:
+		evt := &event.RouterEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		if !evt.RouterOnline {
+			self.registry.removeMatching("source_id", evt.RouterId)
+		}
+	case event.LinkEventsNs:
+		evt := &event.LinkEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		if evt.EventType == event.LinkFault {
+			self.registry.removeMatching("link_id", evt.LinkId)
+		}
+	}
+	return nil
+}
+
+func (self *metricsExporterAction) acceptMetricsEvent(evt *event.MetricsEvent) {
+	name := promMetricName(evt.Metric)
+	help := evt.Metric
+
+	labels := map[string]string{"source_id": evt.SourceAppId}
+	for k, v := range evt.Tags {
+		labels[promLabelName(k)] = v
+	}
+	if evt.SourceEntityId != "" {
+		if strings.HasPrefix(evt.Metric, "link.") {
+			labels["link_id"] = evt.SourceEntityId
+		} else {
+			labels["entity_id"] = evt.SourceEntityId
+		}
+	}
+
+	switch evt.MetricType {
+	case "intValue", "floatValue":
+		if val, ok := evt.Metrics["value"].(float64); ok {
+			self.registry.set(name, promGauge, help, "", labels, val)
+		}
+	case "meter":
+		if val, ok := evt.Metrics["m1_rate"].(float64); ok {
+			self.registry.set(name, promGauge, help+" (one minute rate)", "", labels, val)
+		}
+		if count, ok := evt.Metrics["count"].(float64); ok {
+			self.registry.set(name+"_total", promCounter, help+" (total)", "", labels, count)
+		}
+	case "histogram", "timer":
+		for key, quantile := range promQuantiles {
+			if val, ok := evt.Metrics[key].(float64); ok {
+				quantileLabels := map[string]string{"quantile": quantile}
+				for k, v := range labels {
+					quantileLabels[k] = v
+				}
+				self.registry.set(name, promSummary, help, "", quantileLabels, val)
+			}
+		}
+		count, hasCount := evt.Metrics["count"].(float64)
+		if hasCount {
+			self.registry.set(name, promSummary, help, "_count", labels, count)
+		}
+		if mean, ok := evt.Metrics["mean"].(float64); ok && hasCount {
+			self.registry.set(name, promSummary, help, "_sum", labels, mean*count)
+		}
+	}
+}
+
+func (self *metricsExporterAction) acceptUsageEvent(evt *event.UsageEventV3) {
+	for usageType, bytes := range evt.Usage {
+		labels := map[string]string{
+			"source_id":  evt.SourceId,
+			"service_id": evt.Tags["serviceId"],
+			"usage_type": usageType,
+		}
+		if self.identityLabel {
+			labels["client_id"] = evt.Tags["clientId"]
+		}
+		self.registry.add("ziti_usage_bytes_total", "Bytes sent and received on circuits, by router, service and usage type", labels, float64(bytes))
+	}
+}
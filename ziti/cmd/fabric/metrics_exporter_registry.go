@@ -0,0 +1,249 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	promExporterPrefix = "ziti_exporter_"
+
+	promGauge   = "gauge"
+	promCounter = "counter"
+	promSummary = "summary"
+)
+
+var promInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+var promCamelCase = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+var promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type promSeries struct {
+	// suffix is appended to the family name, such as _count for summaries
+	suffix  string
+	labels  map[string]string
+	value   float64
+	updated time.Time
+}
+
+type promFamily struct {
+	name       string
+	help       string
+	metricType string
+	series     map[string]*promSeries
+}
+
+// promRegistry holds the series served by the metrics exporter, in the Prometheus text exposition format. Series
+// which aren't updated within the expiry period are dropped, so routers and links that go away don't linger
+type promRegistry struct {
+	lock     sync.Mutex
+	families map[string]*promFamily
+	expiry   time.Duration
+	now      func() time.Time
+}
+
+func newPromRegistry(expiry time.Duration) *promRegistry {
+	return &promRegistry{
+		families: map[string]*promFamily{},
+		expiry:   expiry,
+		now:      time.Now,
+	}
+}
+
+func promSeriesKey(suffix string, labels map[string]string) string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(suffix)
+	for _, k := range keys {
+		sb.WriteString("|")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(labels[k])
+	}
+	return sb.String()
+}
+
+func (self *promRegistry) getSeries(name, metricType, help, suffix string, labels map[string]string) *promSeries {
+	family, found := self.families[name]
+	if !found || family.metricType != metricType {
+		family = &promFamily{
+			name:       name,
+			help:       help,
+			metricType: metricType,
+			series:     map[string]*promSeries{},
+		}
+		self.families[name] = family
+	}
+
+	key := promSeriesKey(suffix, labels)
+	series, found := family.series[key]
+	if !found {
+		series = &promSeries{suffix: suffix, labels: labels}
+		family.series[key] = series
+	}
+	series.updated = self.now()
+	return series
+}
+
+// set sets the value of a gauge, or of a sample of a summary when a suffix or quantile label is given
+func (self *promRegistry) set(name, metricType, help, suffix string, labels map[string]string, value float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.getSeries(name, metricType, help, suffix, labels).value = value
+}
+
+// add adds to a counter
+func (self *promRegistry) add(name, help string, labels map[string]string, delta float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.getSeries(name, promCounter, help, "", labels).value += delta
+}
+
+// removeMatching drops all series with the given label value, for example when a router goes offline
+func (self *promRegistry) removeMatching(label, value string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for name, family := range self.families {
+		for key, series := range family.series {
+			if series.labels[label] == value {
+				delete(family.series, key)
+			}
+		}
+		if len(family.series) == 0 {
+			delete(self.families, name)
+		}
+	}
+}
+
+func (self *promRegistry) expire() {
+	if self.expiry <= 0 {
+		return
+	}
+
+	cutoff := self.now().Add(-self.expiry)
+	for name, family := range self.families {
+		// the exporter's own metrics describe the exporter, not the network, so they're kept
+		if strings.HasPrefix(name, promExporterPrefix) {
+			continue
+		}
+		for key, series := range family.series {
+			if series.updated.Before(cutoff) {
+				delete(family.series, key)
+			}
+		}
+		if len(family.series) == 0 {
+			delete(self.families, name)
+		}
+	}
+}
+
+// Write writes the current series in the Prometheus text format, after dropping expired series
+func (self *promRegistry) Write(w io.Writer) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expire()
+
+	var names []string
+	for name := range self.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		family := self.families[name]
+		_, _ = fmt.Fprintf(out, "# HELP %v %v\n", name, family.help)
+		_, _ = fmt.Fprintf(out, "# TYPE %v %v\n", name, family.metricType)
+
+		var keys []string
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			_, _ = fmt.Fprintf(out, "%v%v%v %v\n", name, series.suffix, formatPromLabels(series.labels), formatPromValue(series.value))
+		}
+	}
+	return out.Flush()
+}
+
+func formatPromLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, k, promLabelValueEscaper.Replace(labels[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatPromValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// promMetricName converts a ziti metric name to a Prometheus metric name, the same way the controller's prometheus
+// event formatter does, so dashboards work with either
+func promMetricName(metric string) string {
+	key := strings.ReplaceAll(metric, ":", "")
+	key = promInvalidNameChars.ReplaceAllString(key, "_")
+
+	// Prometheus complains about metrics ending in _count, so "fix" that.
+	if strings.HasSuffix(key, "_count") {
+		key = strings.TrimSuffix(key, "_count") + "_c"
+	}
+	return "ziti_" + key
+}
+
+// promLabelName converts a tag name such as sourceRouterId to a label name such as source_router_id
+func promLabelName(name string) string {
+	name = promCamelCase.ReplaceAllString(name, "${1}_${2}")
+	return strings.ToLower(promInvalidNameChars.ReplaceAllString(name, "_"))
+}
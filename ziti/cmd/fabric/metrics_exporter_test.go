@@ -0,0 +1,89 @@
+package fabric
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExporterTranslatesEvents(t *testing.T) {
+	req := require.New(t)
+
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	action := &metricsExporterAction{registry: newPromRegistry(5 * time.Minute)}
+	action.registry.now = func() time.Time { return now }
+
+	events := []string{
+		`{"namespace":"metrics","metric_type":"meter","source_id":"r1","timestamp":"2023-05-01T10:00:00Z","metric":"ingress.tx.bytesrate","metrics":{"count":1000,"m1_rate":12.5}}`,
+		`{"namespace":"metrics","metric_type":"histogram","source_id":"r1","source_entity_id":"l1","timestamp":"2023-05-01T10:00:00Z","metric":"link.latency","metrics":{"count":4,"mean":250,"p50":200,"p99":900},"tags":{"sourceRouterId":"r1","targetRouterId":"r2"}}`,
+		`{"namespace":"metrics","metric_type":"intValue","source_id":"r2","timestamp":"2023-05-01T10:00:00Z","metric":"xgress.blocked_by_remote_window_count","metrics":{"value":3}}`,
+		`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c1","usage":{"ingress.rx":100},"interval_start_utc":1682935200,"interval_length":60,"tags":{"clientId":"id1","serviceId":"svc1"}}`,
+		`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c2","usage":{"ingress.rx":50},"interval_start_utc":1682935200,"interval_length":60,"tags":{"clientId":"id2","serviceId":"svc1"}}`,
+		`{"namespace":"edge.entityCounts","timestamp":"2023-05-01T10:00:00Z","counts":{"identities":12,"services":3}}`,
+	}
+	for _, evt := range events {
+		req.NoError(action.acceptEvent([]byte(evt)), evt)
+	}
+
+	server := httptest.NewServer(action)
+	defer server.Close()
+
+	scrape := func() string {
+		resp, err := http.Get(server.URL + "/metrics")
+		req.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		req.Equal("text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		req.NoError(err)
+		return string(body)
+	}
+
+	output := scrape()
+	expected := []string{
+		"# TYPE ziti_ingress_tx_bytesrate gauge",
+		`ziti_ingress_tx_bytesrate{source_id="r1"} 12.5`,
+		"# TYPE ziti_ingress_tx_bytesrate_total counter",
+		`ziti_ingress_tx_bytesrate_total{source_id="r1"} 1000`,
+		"# TYPE ziti_link_latency summary",
+		`ziti_link_latency{link_id="l1",quantile="0.5",source_id="r1",source_router_id="r1",target_router_id="r2"} 200`,
+		`ziti_link_latency{link_id="l1",quantile="0.99",source_id="r1",source_router_id="r1",target_router_id="r2"} 900`,
+		`ziti_link_latency_count{link_id="l1",source_id="r1",source_router_id="r1",target_router_id="r2"} 4`,
+		`ziti_link_latency_sum{link_id="l1",source_id="r1",source_router_id="r1",target_router_id="r2"} 1000`,
+		`ziti_xgress_blocked_by_remote_window_c{source_id="r2"} 3`,
+		"# TYPE ziti_usage_bytes_total counter",
+		`ziti_usage_bytes_total{service_id="svc1",source_id="r1",usage_type="ingress.rx"} 150`,
+		`ziti_entity_count{entity_type="identities"} 12`,
+		`ziti_exporter_events_total{namespace="metrics"} 3`,
+	}
+	for _, line := range expected {
+		req.Contains(output, line+"\n")
+	}
+	req.NotContains(output, "client_id")
+
+	// series of a failed link and of an offline router are removed right away
+	req.NoError(action.acceptEvent([]byte(`{"namespace":"fabric.links","event_type":"fault","timestamp":"2023-05-01T10:00:01Z","link_id":"l1","src_router_id":"r1","dst_router_id":"r2"}`)))
+	req.NoError(action.acceptEvent([]byte(`{"namespace":"fabric.routers","event_type":"router-offline","timestamp":"2023-05-01T10:00:01Z","router_id":"r2","router_online":false}`)))
+	output = scrape()
+	req.NotContains(output, "ziti_link_latency")
+	req.NotContains(output, "ziti_xgress_blocked_by_remote_window_c")
+	req.Contains(output, "ziti_ingress_tx_bytesrate{")
+
+	// other series expire when they stop being updated, the exporter's own metrics stay
+	now = now.Add(10 * time.Minute)
+	output = scrape()
+	req.NotContains(output, "ziti_ingress_tx_bytesrate")
+	req.NotContains(output, "ziti_usage_bytes_total")
+	req.Contains(output, "ziti_exporter_events_total")
+	req.False(strings.Contains(output, "ziti_entity_count"))
+}
+
+func TestPromNames(t *testing.T) {
+	require.Equal(t, "ziti_ctrl_tx_bytesrate", promMetricName("ctrl.tx.bytesrate"))
+	require.Equal(t, "ziti_service_dial_c", promMetricName("service.dial-count"))
+	require.Equal(t, "source_router_id", promLabelName("sourceRouterId"))
+	require.Equal(t, `{a="x\"y\\z"}`, formatPromLabels(map[string]string{"a": `x"y\z`}))
+}
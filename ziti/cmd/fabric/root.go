@@ -36,7 +36,14 @@ func NewFabricCmd(p common.OptionsProvider) *cobra.Command {
 	fabricCmd.AddCommand(newInspectCmd(p))
 	fabricCmd.AddCommand(newDbCmd(p))
 	fabricCmd.AddCommand(newStreamCommand(p))
+	fabricCmd.AddCommand(newEventsCommand(p))
+	fabricCmd.AddCommand(newUsageCommand(p))
+	fabricCmd.AddCommand(newAlertCmd(p))
 	fabricCmd.AddCommand(newRaftCmd(p))
+	fabricCmd.AddCommand(newTopCmd(p))
+	fabricCmd.AddCommand(newShowCommand(p))
+	fabricCmd.AddCommand(newMetricsExporterCmd(p))
+	fabricCmd.AddCommand(api.NewRawRequestCmd(util.FabricAPI, p))
 	return fabricCmd
 }
 
@@ -73,6 +80,34 @@ func newUpdateCommand(p common.OptionsProvider) *cobra.Command {
 	return updateCmd
 }
 
+func newEventsCommand(p common.OptionsProvider) *cobra.Command {
+	eventsCmd := &cobra.Command{
+		Use:   "events",
+		Short: "replay, archive and query recorded fabric events",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdhelper.CheckErr(cmd.Help())
+		},
+	}
+
+	eventsCmd.AddCommand(newEventReplayCmd(p))
+	eventsCmd.AddCommand(newEventArchiveCmd(p))
+	eventsCmd.AddCommand(newEventQueryCmd(p))
+	return eventsCmd
+}
+
+func newShowCommand(p common.OptionsProvider) *cobra.Command {
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "show views of the network combining several entity types",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdhelper.CheckErr(cmd.Help())
+		},
+	}
+
+	showCmd.AddCommand(newShowTopologyCmd(p))
+	return showCmd
+}
+
 func newStreamCommand(p common.OptionsProvider) *cobra.Command {
 	streamCmd := &cobra.Command{
 		Use:   "stream",
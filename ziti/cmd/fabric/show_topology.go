@@ -0,0 +1,449 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"encoding/json"
+	"fmt"
+	fabric_rest_client "github.com/openziti/fabric/rest_client"
+	"github.com/openziti/fabric/rest_client/circuit"
+	"github.com/openziti/fabric/rest_client/link"
+	"github.com/openziti/fabric/rest_client/router"
+	"github.com/openziti/fabric/rest_model"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"sort"
+	"strings"
+)
+
+type showTopologyAction struct {
+	api.Options
+	output  string
+	service string
+}
+
+func newShowTopologyCmd(p common.OptionsProvider) *cobra.Command {
+	action := &showTopologyAction{
+		Options: api.Options{
+			CommonOptions: p(),
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "topology",
+		Short: "Show the routers and links of the network",
+		Long: "Shows which routers are connected by which links, with the state, static and full cost and latency of " +
+			"each link. Links go from the dialing router to the accepting router. Latencies are the latest link " +
+			"latency metrics reported by the routers on either end of the link. With --service, the paths of the " +
+			"current circuits for the service are overlaid on the graph. The ascii output is meant to be read, the dot " +
+			"output can be rendered with Graphviz and the json output is meant for scripts",
+		Example: "ziti fabric show topology\n" +
+			"ziti fabric show topology --service echo\n" +
+			"ziti fabric show topology -o dot | dot -Tsvg > topology.svg",
+		Args: cobra.ExactArgs(0),
+		RunE: action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	cmd.Flags().StringVarP(&action.output, "output", "o", "ascii", "Output format. One of: ascii, dot, json")
+	cmd.Flags().StringVar(&action.service, "service", "", "Overlay the paths of the current circuits for the service with this name or id")
+	return cmd
+}
+
+func (self *showTopologyAction) run(cmd *cobra.Command, _ []string) error {
+	self.Cmd = cmd
+	if self.output != "ascii" && self.output != "dot" && self.output != "json" {
+		return errors.Errorf("unsupported output format '%v', must be one of: ascii, dot, json", self.output)
+	}
+
+	var result *topology
+	err := WithFabricClient(self, func(client *fabric_rest_client.ZitiFabric) error {
+		routers, err := listAll(func(limit, offset *int64) ([]*rest_model.RouterDetail, error) {
+			page, err := client.Router.ListRouters(&router.ListRoutersParams{Limit: limit, Offset: offset, Context: self.GetContext()})
+			if err != nil {
+				return nil, err
+			}
+			return page.Payload.Data, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		links, err := client.Link.ListLinks(&link.ListLinksParams{Context: self.GetContext()})
+		if err != nil {
+			return util.WrapIfApiError(err)
+		}
+		result = newTopology(routers, links.Payload.Data)
+
+		if self.service != "" {
+			circuits, err := client.Circuit.ListCircuits(&circuit.ListCircuitsParams{Context: self.GetContext()})
+			if err != nil {
+				return util.WrapIfApiError(err)
+			}
+			result.overlay(self.service, circuits.Payload.Data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch self.output {
+	case "dot":
+		return result.writeDot(self.Out)
+	case "json":
+		encoder := json.NewEncoder(self.Out)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(result)
+	default:
+		return result.writeAscii(self.Out)
+	}
+}
+
+// topology is the graph of routers and links. Link latencies are in nanoseconds
+type topology struct {
+	Routers  []*topologyRouter  `json:"routers"`
+	Links    []*topologyLink    `json:"links"`
+	Service  string             `json:"service,omitempty"`
+	Circuits []*topologyCircuit `json:"circuits,omitempty"`
+
+	routers map[string]*topologyRouter
+}
+
+type topologyRouter struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Online      bool   `json:"online"`
+	Cost        int64  `json:"cost"`
+	NoTraversal bool   `json:"noTraversal"`
+	Disabled    bool   `json:"disabled"`
+	Circuits    int    `json:"circuits,omitempty"`
+}
+
+type topologyLink struct {
+	Id             string `json:"id"`
+	SourceRouterId string `json:"sourceRouterId"`
+	DestRouterId   string `json:"destRouterId"`
+	Protocol       string `json:"protocol"`
+	State          string `json:"state"`
+	Down           bool   `json:"down"`
+	StaticCost     int64  `json:"staticCost"`
+	Cost           int64  `json:"cost"`
+	SourceLatency  int64  `json:"sourceLatency"`
+	DestLatency    int64  `json:"destLatency"`
+	Circuits       int    `json:"circuits,omitempty"`
+}
+
+type topologyCircuit struct {
+	Id       string   `json:"id"`
+	ClientId string   `json:"clientId"`
+	Routers  []string `json:"routers"`
+	Links    []string `json:"links"`
+	Path     string   `json:"path"`
+}
+
+func newTopology(routers []*rest_model.RouterDetail, links []*rest_model.LinkDetail) *topology {
+	result := &topology{
+		Routers: []*topologyRouter{},
+		Links:   []*topologyLink{},
+		routers: map[string]*topologyRouter{},
+	}
+
+	for _, entity := range routers {
+		r := &topologyRouter{
+			Id:          valOrDefault(entity.ID),
+			Name:        valOrDefault(entity.Name),
+			Online:      valOrDefault(entity.Connected),
+			Cost:        valOrDefault(entity.Cost),
+			NoTraversal: valOrDefault(entity.NoTraversal),
+			Disabled:    valOrDefault(entity.Disabled),
+		}
+		result.Routers = append(result.Routers, r)
+		result.routers[r.Id] = r
+	}
+
+	for _, entity := range links {
+		l := &topologyLink{
+			Id:            valOrDefault(entity.ID),
+			Protocol:      valOrDefault(entity.Protocol),
+			State:         valOrDefault(entity.State),
+			Down:          valOrDefault(entity.Down),
+			StaticCost:    valOrDefault(entity.StaticCost),
+			Cost:          valOrDefault(entity.Cost),
+			SourceLatency: valOrDefault(entity.SourceLatency),
+			DestLatency:   valOrDefault(entity.DestLatency),
+		}
+		l.SourceRouterId = result.routerRef(entity.SourceRouter)
+		l.DestRouterId = result.routerRef(entity.DestRouter)
+		result.Links = append(result.Links, l)
+	}
+
+	sort.Slice(result.Routers, func(i, j int) bool {
+		if result.Routers[i].Name != result.Routers[j].Name {
+			return result.Routers[i].Name < result.Routers[j].Name
+		}
+		return result.Routers[i].Id < result.Routers[j].Id
+	})
+	sort.Slice(result.Links, func(i, j int) bool {
+		return result.Links[i].Id < result.Links[j].Id
+	})
+	return result
+}
+
+// routerRef returns the id of the referenced router, adding routers which weren't listed, such as routers deleted
+// while their links are still being torn down
+func (self *topology) routerRef(ref *rest_model.EntityRef) string {
+	if ref == nil {
+		return ""
+	}
+	if _, found := self.routers[ref.ID]; !found {
+		r := &topologyRouter{Id: ref.ID, Name: ref.Name}
+		self.Routers = append(self.Routers, r)
+		self.routers[r.Id] = r
+	}
+	return ref.ID
+}
+
+// overlay adds the paths of the circuits for the service with the given name or id, counting the circuits which
+// pass through each router and link
+func (self *topology) overlay(service string, circuits []*rest_model.CircuitDetail) {
+	self.Service = service
+	self.Circuits = []*topologyCircuit{}
+
+	links := map[string]*topologyLink{}
+	for _, l := range self.Links {
+		links[l.Id] = l
+	}
+
+	for _, entity := range circuits {
+		if entity.Service == nil || (entity.Service.ID != service && entity.Service.Name != service) {
+			continue
+		}
+		self.Service = entity.Service.Name
+
+		c := &topologyCircuit{
+			Id:       valOrDefault(entity.ID),
+			ClientId: entity.ClientID,
+			Routers:  []string{},
+			Links:    []string{},
+		}
+		if entity.Path != nil && len(entity.Path.Nodes) > 0 {
+			c.Path = circuitPathLabel(entity.Path)
+			for _, node := range entity.Path.Nodes {
+				c.Routers = append(c.Routers, node.ID)
+				if r, found := self.routers[node.ID]; found {
+					r.Circuits++
+				}
+			}
+			for _, ref := range entity.Path.Links {
+				c.Links = append(c.Links, ref.ID)
+				if l, found := links[ref.ID]; found {
+					l.Circuits++
+				}
+			}
+		}
+		self.Circuits = append(self.Circuits, c)
+	}
+
+	sort.Slice(self.Circuits, func(i, j int) bool {
+		return self.Circuits[i].Id < self.Circuits[j].Id
+	})
+}
+
+func (self *topology) routerName(id string) string {
+	if r, found := self.routers[id]; found && r.Name != "" {
+		return r.Name
+	}
+	return id
+}
+
+// writeAscii renders each router with the links to its neighbours, for example
+//
+//	r/router-a  online  cost 0
+//	└─ l/l1 ──> r/router-b  Connected  cost 12 (static 1)  latency 1.2ms / 1.4ms
+//
+// Links are listed under both of their routers, with the arrow pointing from the dialer to the acceptor
+func (self *topology) writeAscii(out io.Writer) error {
+	online, down := 0, 0
+	for _, r := range self.Routers {
+		if r.Online {
+			online++
+		}
+	}
+	for _, l := range self.Links {
+		if l.Down {
+			down++
+		}
+	}
+
+	w := &strings.Builder{}
+	_, _ = fmt.Fprintf(w, "routers: %v (%v online)  links: %v (%v down)\n", len(self.Routers), online, len(self.Links), down)
+
+	nameWidth := 0
+	for _, r := range self.Routers {
+		if len(self.routerName(r.Id)) > nameWidth {
+			nameWidth = len(self.routerName(r.Id))
+		}
+	}
+
+	for _, r := range self.Routers {
+		status := util.ColorInfo("online")
+		if !r.Online {
+			status = util.ColorError("offline")
+		}
+		_, _ = fmt.Fprintf(w, "\nr/%v  %v  cost %v", self.routerName(r.Id), status, r.Cost)
+		if r.NoTraversal {
+			w.WriteString("  no-traversal")
+		}
+		if r.Disabled {
+			w.WriteString("  " + util.ColorWarning("disabled"))
+		}
+		if r.Circuits > 0 {
+			w.WriteString("  " + util.ColorInfo(circuitCount(r.Circuits)))
+		}
+		w.WriteString("\n")
+
+		var links []*topologyLink
+		for _, l := range self.Links {
+			if l.SourceRouterId == r.Id || l.DestRouterId == r.Id {
+				links = append(links, l)
+			}
+		}
+
+		if len(links) == 0 {
+			w.WriteString("   no links\n")
+		}
+
+		for idx, l := range links {
+			branch := "├─"
+			if idx == len(links)-1 {
+				branch = "└─"
+			}
+			arrow, other := "──>", l.DestRouterId
+			if l.DestRouterId == r.Id {
+				arrow, other = "<──", l.SourceRouterId
+			}
+
+			state := l.State
+			if l.Down {
+				state = util.ColorError("down")
+			}
+
+			_, _ = fmt.Fprintf(w, "%v l/%v %v r/%-*v  %v  cost %v (static %v)  latency %v / %v", branch, l.Id, arrow,
+				nameWidth, self.routerName(other), state, l.Cost, l.StaticCost, formatLatency(l.SourceLatency), formatLatency(l.DestLatency))
+			if l.Circuits > 0 {
+				w.WriteString("  " + util.ColorInfo(circuitCount(l.Circuits)))
+			}
+			w.WriteString("\n")
+		}
+	}
+
+	if self.Service != "" {
+		_, _ = fmt.Fprintf(w, "\ncircuits for service %v: %v\n", self.Service, len(self.Circuits))
+		for _, c := range self.Circuits {
+			_, _ = fmt.Fprintf(w, "c/%v  %v  %v\n", c.Id, c.ClientId, c.Path)
+		}
+	}
+
+	_, err := io.WriteString(out, w.String())
+	return err
+}
+
+// writeDot renders the topology as a Graphviz digraph. Offline routers and down links are dashed and red, and the
+// routers and links on the paths of circuits are drawn in blue
+func (self *topology) writeDot(out io.Writer) error {
+	w := &strings.Builder{}
+	w.WriteString("digraph topology {\n")
+	w.WriteString("\trankdir=LR;\n")
+	w.WriteString("\tnode [shape=box, style=rounded];\n")
+
+	for _, r := range self.Routers {
+		lines := []string{self.routerName(r.Id), fmt.Sprintf("cost %v", r.Cost)}
+		var attrs []string
+		if !r.Online {
+			lines = append(lines, "offline")
+			attrs = append(attrs, `style="rounded,dashed"`, "color=red")
+		}
+		if r.NoTraversal {
+			lines = append(lines, "no traversal")
+		}
+		if r.Disabled {
+			lines = append(lines, "disabled")
+		}
+		if r.Circuits > 0 {
+			lines = append(lines, circuitCount(r.Circuits))
+			attrs = append(attrs, "color=blue", "penwidth=2")
+		}
+		_, _ = fmt.Fprintf(w, "\t%v [%v];\n", dotQuote(r.Id), strings.Join(append([]string{"label=" + dotLabel(lines...)}, attrs...), ", "))
+	}
+
+	for _, l := range self.Links {
+		lines := []string{
+			"l/" + l.Id,
+			fmt.Sprintf("cost %v (static %v)", l.Cost, l.StaticCost),
+			formatLatency(l.SourceLatency) + " / " + formatLatency(l.DestLatency),
+		}
+		var attrs []string
+		if l.Down {
+			lines = append(lines, "down")
+			attrs = append(attrs, "style=dashed", "color=red")
+		}
+		if l.Circuits > 0 {
+			lines = append(lines, circuitCount(l.Circuits))
+			attrs = append(attrs, "color=blue", "penwidth=3")
+		}
+		_, _ = fmt.Fprintf(w, "\t%v -> %v [%v];\n", dotQuote(l.SourceRouterId), dotQuote(l.DestRouterId),
+			strings.Join(append([]string{"label=" + dotLabel(lines...)}, attrs...), ", "))
+	}
+
+	w.WriteString("}\n")
+	_, err := io.WriteString(out, w.String())
+	return err
+}
+
+func circuitCount(count int) string {
+	if count == 1 {
+		return "1 circuit"
+	}
+	return fmt.Sprintf("%v circuits", count)
+}
+
+func formatLatency(nanos int64) string {
+	return fmt.Sprintf("%.1fms", float64(nanos)/1_000_000)
+}
+
+func dotQuote(val string) string {
+	return `"` + dotEscape(val) + `"`
+}
+
+// dotLabel quotes a multi-line label, using the dot line break escape between lines
+func dotLabel(lines ...string) string {
+	var escaped []string
+	for _, line := range lines {
+		escaped = append(escaped, dotEscape(line))
+	}
+	return `"` + strings.Join(escaped, `\n`) + `"`
+}
+
+func dotEscape(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
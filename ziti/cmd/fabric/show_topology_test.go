@@ -0,0 +1,80 @@
+package fabric
+
+import (
+	"github.com/fatih/color"
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestShowTopology(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	server := apitest.NewServer(t)
+	routerRef := func(id, name string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "name": name, "entity": "routers", "_links": map[string]interface{}{}}
+	}
+	linkRef := func(id string) map[string]interface{} {
+		return map[string]interface{}{"id": id, "entity": "links", "_links": map[string]interface{}{}}
+	}
+
+	server.Create("routers", map[string]interface{}{"id": "r1", "name": "router-east", "connected": true, "cost": 10})
+	server.Create("routers", map[string]interface{}{"id": "r2", "name": "router-west", "connected": true, "cost": 0, "noTraversal": true})
+	server.Create("routers", map[string]interface{}{"id": "r3", "name": "router-edge", "connected": false, "cost": 0})
+	server.Create("routers", map[string]interface{}{"id": "r4", "name": "router-spare", "connected": true, "cost": 0, "disabled": true})
+
+	server.Create("links", map[string]interface{}{
+		"id": "l1", "sourceRouter": routerRef("r1", "router-east"), "destRouter": routerRef("r2", "router-west"),
+		"protocol": "tls", "state": "Connected", "down": false, "staticCost": 1, "cost": 13,
+		"sourceLatency": 1_200_000, "destLatency": 1_400_000,
+	})
+	server.Create("links", map[string]interface{}{
+		"id": "l2", "sourceRouter": routerRef("r3", "router-edge"), "destRouter": routerRef("r1", "router-east"),
+		"protocol": "tls", "state": "Failed", "down": true, "staticCost": 1, "cost": 65535,
+		"sourceLatency": 0, "destLatency": 0,
+	})
+
+	server.Create("circuits", map[string]interface{}{
+		"id": "c1", "clientId": "client1",
+		"service":    map[string]interface{}{"id": "s1", "name": "echo", "entity": "services", "_links": map[string]interface{}{}},
+		"terminator": map[string]interface{}{"id": "t1", "entity": "terminators", "_links": map[string]interface{}{}},
+		"path": map[string]interface{}{
+			"nodes": []interface{}{routerRef("r1", "router-east"), routerRef("r2", "router-west")},
+			"links": []interface{}{linkRef("l1")},
+		},
+	})
+	server.Create("circuits", map[string]interface{}{
+		"id": "c2", "clientId": "client2",
+		"service":    map[string]interface{}{"id": "s2", "name": "other", "entity": "services", "_links": map[string]interface{}{}},
+		"terminator": map[string]interface{}{"id": "t2", "entity": "terminators", "_links": map[string]interface{}{}},
+		"path": map[string]interface{}{
+			"nodes": []interface{}{routerRef("r1", "router-east")},
+			"links": []interface{}{},
+		},
+	})
+
+	output, err := apitest.Execute(newTestFabricCmd, "show", "topology")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "show_topology", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "show", "topology", "--service", "echo")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "show_topology_service", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "show", "topology", "--service", "s1", "-o", "dot")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "show_topology_service_dot", output)
+
+	output, err = apitest.Execute(newTestFabricCmd, "show", "topology", "--service", "echo", "-o", "json")
+	require.NoError(t, err)
+	apitest.AssertGolden(t, "show_topology_service_json", output)
+
+	_, err = apitest.Execute(newTestFabricCmd, "show", "topology", "-o", "svg")
+	require.EqualError(t, err, "unsupported output format 'svg', must be one of: ascii, dot, json")
+}
+
+func TestDotLabel(t *testing.T) {
+	require.Equal(t, `"router \"a\"\\b\ncost 1"`, dotLabel(`router "a"\b`, "cost 1"))
+}
@@ -17,6 +17,8 @@
 package fabric
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/openziti/channel/v2"
@@ -27,11 +29,14 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 type streamEventsAction struct {
 	api.Options
+	api.StreamOptions
 	all          bool
 	apiSessions  bool
 	circuits     bool
@@ -47,6 +52,13 @@ type streamEventsAction struct {
 	metricsFilter        string
 	entityCountsInterval time.Duration
 	usageVersion         uint8
+
+	eventOutputOptions
+	output *eventOutput
+	// sink, if set, gets the events instead of the --sink outputs. Commands built on stream events, such as alert,
+	// use it to handle events themselves
+	sink   eventSink
+	record string
 }
 
 func NewStreamEventsCmd(p common.OptionsProvider) *cobra.Command {
@@ -57,31 +69,42 @@ func NewStreamEventsCmd(p common.OptionsProvider) *cobra.Command {
 	}
 
 	streamEventsCmd := &cobra.Command{
-		Use:     "events",
-		Short:   "Stream events",
-		Example: "ziti fabric stream events --circuits --metrics --metrics-filter '.*'",
-		Args:    cobra.ExactArgs(0),
-		RunE:    action.streamEvents,
+		Use:   "events",
+		Short: "Stream events",
+		Example: "ziti fabric stream events --circuits --metrics --metrics-filter '.*'\n" +
+			"ziti fabric stream events --all --sink 'file:/var/log/ziti/events.jsonl?maxSize=100MB&keep=10' --sink https://siem.example.com/hook\n" +
+			"ziti fabric stream events --circuits --links --pretty --where 'event_type == \"failed\" || event_type == \"fault\"'\n" +
+			"ziti fabric stream events --all --record-events incident.zev",
+		Args: cobra.ExactArgs(0),
+		RunE: action.streamEvents,
 	}
 
 	action.AddCommonFlags(streamEventsCmd)
-	streamEventsCmd.Flags().BoolVar(&action.all, "all", false, "Include all events")
-	streamEventsCmd.Flags().BoolVar(&action.apiSessions, "api-sessions", false, "Include api-session events")
-	streamEventsCmd.Flags().BoolVar(&action.circuits, "circuits", false, "Include circuit events")
-	streamEventsCmd.Flags().BoolVar(&action.entityCounts, "entity-counts", false, "Include entity count events")
-	streamEventsCmd.Flags().BoolVar(&action.links, "links", false, "Include link events")
-	streamEventsCmd.Flags().BoolVar(&action.metrics, "metrics", false, "Include metrics events")
-	streamEventsCmd.Flags().BoolVar(&action.routers, "routers", false, "Include router events")
-	streamEventsCmd.Flags().BoolVar(&action.services, "services", false, "Include service events")
-	streamEventsCmd.Flags().BoolVar(&action.sessions, "sessions", false, "Include session events")
-	streamEventsCmd.Flags().BoolVar(&action.usage, "usage", false, "Include usage events")
-	streamEventsCmd.Flags().DurationVar(&action.entityCountsInterval, "entity-counts-interval", 5*time.Minute, "Specify the entity count event interval")
-	streamEventsCmd.Flags().StringVar(&action.metricsSourceFilter, "metrics-source-filter", "", "Specify which sources to stream metrics from")
-	streamEventsCmd.Flags().StringVar(&action.metricsFilter, "metrics-filter", "", "Specify which metrics to stream")
-	streamEventsCmd.Flags().Uint8Var(&action.usageVersion, "usage-version", 3, "Specify which version of usage data to stream. Valid versions: [2,3]")
+	action.AddStreamFlags(streamEventsCmd)
+	action.addSubscriptionFlags(streamEventsCmd)
+	action.addOutputFlags(streamEventsCmd)
+	streamEventsCmd.Flags().StringVar(&action.record, "record-events", "", "Also record all received events, with the time they were received, "+
+		"to the given file. Recordings can be played back with ziti fabric events replay")
 	return streamEventsCmd
 }
 
+func (self *streamEventsAction) addSubscriptionFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&self.all, "all", false, "Include all events")
+	cmd.Flags().BoolVar(&self.apiSessions, "api-sessions", false, "Include api-session events")
+	cmd.Flags().BoolVar(&self.circuits, "circuits", false, "Include circuit events")
+	cmd.Flags().BoolVar(&self.entityCounts, "entity-counts", false, "Include entity count events")
+	cmd.Flags().BoolVar(&self.links, "links", false, "Include link events")
+	cmd.Flags().BoolVar(&self.metrics, "metrics", false, "Include metrics events")
+	cmd.Flags().BoolVar(&self.routers, "routers", false, "Include router events")
+	cmd.Flags().BoolVar(&self.services, "services", false, "Include service events")
+	cmd.Flags().BoolVar(&self.sessions, "sessions", false, "Include session events")
+	cmd.Flags().BoolVar(&self.usage, "usage", false, "Include usage events")
+	cmd.Flags().DurationVar(&self.entityCountsInterval, "entity-counts-interval", 5*time.Minute, "Specify the entity count event interval")
+	cmd.Flags().StringVar(&self.metricsSourceFilter, "metrics-source-filter", "", "Specify which sources to stream metrics from")
+	cmd.Flags().StringVar(&self.metricsFilter, "metrics-filter", "", "Specify which metrics to stream")
+	cmd.Flags().Uint8Var(&self.usageVersion, "usage-version", 3, "Specify which version of usage data to stream. Valid versions: [2,3]")
+}
+
 func (self *streamEventsAction) buildSubscriptions(cmd *cobra.Command) []*event.Subscription {
 	var subscriptions []*event.Subscription
 
@@ -179,19 +202,22 @@ func (self *streamEventsAction) streamEvents(cmd *cobra.Command, _ []string) err
 
 	streamEventsRequest["subscriptions"] = subscriptions
 
-	closeNotify := make(chan struct{})
-
-	bindHandler := func(binding channel.Binding) error {
-		binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamEventsEventType), self)
-		binding.AddCloseHandler(channel.CloseHandlerF(func(ch channel.Channel) {
-			close(closeNotify)
-		}))
-		return nil
+	output := &eventOutput{sinks: self.sink}
+	if self.sink == nil {
+		var err error
+		if output, err = self.newEventOutput(self.Out, self.Err); err != nil {
+			return err
+		}
 	}
+	self.output = output
+	defer func() { _ = output.Close() }()
 
-	ch, err := api.NewWsMgmtChannel(channel.BindHandlerF(bindHandler))
-	if err != nil {
-		return err
+	if self.record != "" {
+		recorder, err := newEventRecorder(self.record)
+		if err != nil {
+			return err
+		}
+		output.recorder = recorder
 	}
 
 	msgBytes, err := json.Marshal(streamEventsRequest)
@@ -203,30 +229,92 @@ func (self *streamEventsAction) streamEvents(cmd *cobra.Command, _ []string) err
 		fmt.Printf("Request: %v\n", string(msgBytes))
 	}
 
-	requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamEventsRequestType), msgBytes)
-	responseMsg, err := requestMsg.WithTimeout(time.Duration(self.Timeout) * time.Second).SendForReply(ch)
+	stream := &api.MgmtStream{
+		StreamOptions: self.StreamOptions,
+		Bind: func(binding channel.Binding) {
+			binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamEventsEventType), self)
+		},
+		Subscribe: func(ch channel.Channel) error {
+			return self.subscribe(ch, msgBytes)
+		},
+		OnGap:  self.emitGapEvent,
+		ErrOut: self.Err,
+	}
+
+	// stop on interrupt, so queued events are flushed to the sinks before exiting
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return stream.Run(ctx)
+}
+
+func (self *streamEventsAction) subscribe(ch channel.Channel, msgBytes []byte) error {
+	if err := subscribeToEvents(ch, msgBytes, time.Duration(self.Timeout)*time.Second); err != nil {
+		return err
+	}
+
+	if self.Verbose {
+		fmt.Println("event streaming started")
+	}
+	return nil
+}
+
+// subscribeToEvents sends a stream events request and waits for the controller to accept it
+func subscribeToEvents(ch channel.Channel, request []byte, timeout time.Duration) error {
+	requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamEventsRequestType), request)
+	responseMsg, err := requestMsg.WithTimeout(timeout).SendForReply(ch)
 	if err != nil {
 		return err
 	}
 
-	if responseMsg.ContentType == channel.ContentTypeResultType {
-		result := channel.UnmarshalResult(responseMsg)
-		if result.Success {
-			if self.Verbose {
-				fmt.Printf("event streaming started: %v\n", result.Message)
-			}
-		} else {
-			fmt.Printf("error starting event streaming [%s]\n", result.Message)
-			os.Exit(1)
-		}
-	} else {
+	if responseMsg.ContentType != channel.ContentTypeResultType {
 		return errors.Errorf("unexpected response type %v", responseMsg.ContentType)
 	}
 
-	<-closeNotify
+	result := channel.UnmarshalResult(responseMsg)
+	if !result.Success {
+		return &api.StreamRejectedError{Message: fmt.Sprintf("error starting event streaming [%s]", result.Message)}
+	}
 	return nil
 }
 
+// streamGapEvent marks a period in which the stream was disconnected and events may have been missed
+type streamGapEvent struct {
+	Namespace         string    `json:"namespace"`
+	EventType         string    `json:"event_type"`
+	Timestamp         time.Time `json:"timestamp"`
+	DisconnectedAt    time.Time `json:"disconnected_at"`
+	ReconnectedAt     time.Time `json:"reconnected_at"`
+	GapSeconds        float64   `json:"gap_seconds"`
+	ReconnectAttempts int       `json:"reconnect_attempts"`
+}
+
+const streamGapNamespace = "stream.gap"
+
+var streamGapEventPrefix = []byte(`{"namespace":"` + streamGapNamespace + `"`)
+
+// isStreamGapEvent checks if the event is a gap marker. Gap markers are always encoded by streamGapEvent, with the
+// namespace first, so there's no need to decode the event
+func isStreamGapEvent(event []byte) bool {
+	return bytes.HasPrefix(event, streamGapEventPrefix)
+}
+
+func (self *streamEventsAction) emitGapEvent(gap *api.StreamGap) {
+	gapEvent := &streamGapEvent{
+		Namespace:         streamGapNamespace,
+		EventType:         "reconnected",
+		Timestamp:         gap.ReconnectedAt,
+		DisconnectedAt:    gap.DisconnectedAt,
+		ReconnectedAt:     gap.ReconnectedAt,
+		GapSeconds:        gap.ReconnectedAt.Sub(gap.DisconnectedAt).Seconds(),
+		ReconnectAttempts: gap.Attempts,
+	}
+
+	if msgBytes, err := json.Marshal(gapEvent); err == nil {
+		_ = self.output.AcceptEvent(msgBytes)
+	}
+}
+
 func (self *streamEventsAction) HandleReceive(msg *channel.Message, _ channel.Channel) {
-	fmt.Println(string(msg.Body))
+	_ = self.output.AcceptEvent(msg.Body)
 }
@@ -17,7 +17,7 @@
 package fabric
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/openziti/channel/v2"
 	"github.com/openziti/channel/v2/trace/pb"
@@ -28,13 +28,16 @@ import (
 	"github.com/openziti/ziti/ziti/cmd/common"
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/proto"
-	"reflect"
+	"os"
+	"os/signal"
 	"sort"
+	"syscall"
 	"time"
 )
 
 type streamTracesAction struct {
 	api.Options
+	api.StreamOptions
 }
 
 func NewStreamTracesCmd(p common.OptionsProvider) *cobra.Command {
@@ -47,15 +50,16 @@ func NewStreamTracesCmd(p common.OptionsProvider) *cobra.Command {
 	streamTracesCmd := &cobra.Command{
 		Use:   "traces <except> [message type}",
 		Short: "Stream trace data from systems where tracing is enabled",
-		Run:   action.streamTraces,
+		RunE:  action.streamTraces,
 	}
 
 	action.AddCommonFlags(streamTracesCmd)
+	action.AddStreamFlags(streamTracesCmd)
 
 	return streamTracesCmd
 }
 
-func (self *streamTracesAction) streamTraces(_ *cobra.Command, args []string) {
+func (self *streamTracesAction) streamTraces(_ *cobra.Command, args []string) error {
 	startIndex := 0
 	request := &mgmt_pb.StreamTracesRequest{EnabledFilter: len(args) > 0}
 
@@ -71,39 +75,37 @@ func (self *streamTracesAction) streamTraces(_ *cobra.Command, args []string) {
 		for _, filterArg := range args[startIndex:] {
 			contentType, err := self.getContentType(filterArg)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			request.ContentTypes = append(request.ContentTypes, contentType)
 		}
 	}
 
-	closeNotify := make(chan struct{})
-
-	bindHandler := func(binding channel.Binding) error {
-		binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamTracesEventType), self)
-		binding.AddCloseHandler(channel.CloseHandlerF(func(ch channel.Channel) {
-			close(closeNotify)
-		}))
-		return nil
-	}
-
-	ch, err := api.NewWsMgmtChannel(channel.BindHandlerF(bindHandler))
-	if err != nil {
-		panic(err)
-	}
-
 	body, err := proto.Marshal(request)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamTracesRequestType), body)
-
-	if err = requestMsg.WithTimeout(5 * time.Second).SendAndWaitForWire(ch); err != nil {
-		panic(err)
+	stream := &api.MgmtStream{
+		StreamOptions: self.StreamOptions,
+		Bind: func(binding channel.Binding) {
+			binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamTracesEventType), self)
+		},
+		Subscribe: func(ch channel.Channel) error {
+			requestMsg := channel.NewMessage(int32(mgmt_pb.ContentType_StreamTracesRequestType), body)
+			return requestMsg.WithTimeout(5 * time.Second).SendAndWaitForWire(ch)
+		},
+		OnGap: func(gap *api.StreamGap) {
+			_, _ = fmt.Fprintf(self.Out, "--- stream reconnected at %v after %v disconnected, traces may have been missed ---\n",
+				gap.ReconnectedAt.Format(time.RFC3339), gap.ReconnectedAt.Sub(gap.DisconnectedAt).Round(time.Millisecond))
+		},
+		ErrOut: self.Err,
 	}
 
-	<-closeNotify
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return stream.Run(ctx)
 }
 
 func (self *streamTracesAction) getContentType(name string) (int32, error) {
@@ -148,67 +150,5 @@ func (self *streamTracesAction) HandleReceive(msg *channel.Message, _ channel.Ch
 		panic(err)
 	}
 
-	flow := "->"
-	if event.IsRx {
-		flow = "<-"
-	}
-	replyFor := ""
-	if event.ReplyFor != -1 {
-		replyFor = fmt.Sprintf(">%d", event.ReplyFor)
-	}
-	meta := self.DecodeTraceAndFormat(event.Decode)
-	if meta == "" {
-		meta = fmt.Sprintf("missing decode, content-type=%v", event.ContentType)
-	}
-	fmt.Printf("%8d: %-16s %8s %s #%-5d %5s | %s\n",
-		event.Timestamp, event.Identity, event.Channel, flow, event.Sequence, replyFor, meta)
-}
-
-func (self *streamTracesAction) DecodeTraceAndFormat(decode []byte) string {
-	if len(decode) > 0 {
-		meta := make(map[string]interface{})
-		err := json.Unmarshal(decode, &meta)
-		if err != nil {
-			panic(err)
-		}
-
-		out := fmt.Sprintf("%-24s", fmt.Sprintf("%-8s %s", meta[channel.DecoderFieldName], meta[channel.MessageFieldName]))
-
-		if len(meta) > 2 {
-			keys := make([]string, 0)
-			for k := range meta {
-				if k != channel.DecoderFieldName && k != channel.MessageFieldName {
-					keys = append(keys, k)
-				}
-			}
-			sort.Strings(keys)
-
-			out += " {"
-			for i := 0; i < len(keys); i++ {
-				k := keys[i]
-				if i > 0 {
-					out += " "
-				}
-				out += k
-				out += "=["
-				v := meta[k]
-				switch v.(type) {
-				case string:
-					out += v.(string)
-				case float64:
-					out += fmt.Sprintf("%0.0f", v.(float64))
-				case bool:
-					out += fmt.Sprintf("%t", v.(bool))
-				default:
-					out += fmt.Sprintf("<%s>", reflect.TypeOf(v))
-				}
-				out += "]"
-			}
-			out += "}"
-		}
-
-		return out
-	} else {
-		return ""
-	}
+	fmt.Print(api.FormatTraceMessage(event))
 }
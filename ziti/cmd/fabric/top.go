@@ -0,0 +1,539 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/channel/v2"
+	"github.com/openziti/edge-api/rest_management_api_client/identity"
+	edge_rest_model "github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/fabric/event"
+	"github.com/openziti/fabric/pb/mgmt_pb"
+	fabric_rest_client "github.com/openziti/fabric/rest_client"
+	"github.com/openziti/fabric/rest_client/circuit"
+	"github.com/openziti/fabric/rest_client/link"
+	"github.com/openziti/fabric/rest_client/router"
+	"github.com/openziti/fabric/rest_client/service"
+	"github.com/openziti/fabric/rest_model"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type topAction struct {
+	api.Options
+	api.StreamOptions
+	refreshInterval time.Duration
+	replay          string
+	speed           string
+	model           *topModel
+}
+
+func newTopCmd(p common.OptionsProvider) *cobra.Command {
+	action := &topAction{
+		Options: api.Options{
+			CommonOptions: p(),
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show live routers, links, services, identities and circuits",
+		Long: "Shows a live view of the network, built from metrics, circuit, link, router and usage events. " +
+			"Routers are listed with their throughput and link latency, links with their cost and state, services and " +
+			"identities by the bytes they send and receive, and circuits with their paths. Circuit creation and failure " +
+			"rates are shown at the top. Select a row and press enter to drill down into the related circuits",
+		Args: cobra.ExactArgs(0),
+		RunE: action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	action.AddStreamFlags(cmd)
+	cmd.Flags().DurationVar(&action.refreshInterval, "refresh", time.Second, "How often to redraw the screen")
+	cmd.Flags().StringVar(&action.replay, "replay-events", "", "Show events from a recording made with ziti fabric stream events --record-events, "+
+		"instead of connecting to the controller")
+	cmd.Flags().StringVar(&action.speed, "speed", "1x", "How fast to replay a recording, such as 10x, or max")
+	return cmd
+}
+
+func (self *topAction) run(_ *cobra.Command, _ []string) error {
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return errors.New("ziti fabric top requires an interactive terminal")
+	}
+
+	self.model = newTopModel()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// reconnect messages would garble the screen, so they're collected and shown in the status line instead
+	streamErrors := &topStatusWriter{}
+	streamDone := make(chan error, 1)
+
+	if self.replay != "" {
+		speed, err := parseReplaySpeed(self.speed)
+		if err != nil {
+			return err
+		}
+
+		// rates are calculated against the time events were recorded, not the time they're replayed
+		clock := &replayClock{}
+		self.model.now = clock.now
+
+		go func() {
+			err := replayRecording(ctx, self.replay, speed, streamErrors, func(evt *recordedEvent) error {
+				clock.set(evt.received)
+				_ = self.model.AcceptEvent(evt.event)
+				return nil
+			})
+			if err != nil {
+				streamDone <- err
+				cancel()
+			} else if ctx.Err() == nil && streamErrors.last() == "" {
+				_, _ = fmt.Fprintln(streamErrors, "replay finished")
+			}
+		}()
+	} else {
+		if err := self.loadInventory(); err != nil {
+			return err
+		}
+
+		request, err := json.Marshal(map[string]interface{}{
+			"format": "json",
+			"subscriptions": []*event.Subscription{
+				{Type: event.MetricsEventsNs, Options: map[string]interface{}{}},
+				{Type: event.CircuitEventsNs},
+				{Type: event.LinkEventsNs},
+				{Type: event.RouterEventsNs},
+				{Type: event.UsageEventsNs, Options: map[string]interface{}{"version": 3}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		stream := &api.MgmtStream{
+			StreamOptions: self.StreamOptions,
+			Bind: func(binding channel.Binding) {
+				binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamEventsEventType), self)
+			},
+			Subscribe: func(ch channel.Channel) error {
+				return subscribeToEvents(ch, request, time.Duration(self.Timeout)*time.Second)
+			},
+			OnGap: func(gap *api.StreamGap) {
+				self.model.Lock()
+				self.model.gaps++
+				self.model.Unlock()
+				streamErrors.clear()
+			},
+			ErrOut: streamErrors,
+		}
+
+		go func() {
+			streamDone <- stream.Run(ctx)
+			cancel()
+		}()
+	}
+
+	oldState, err := term.MakeRaw(stdin)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprint(self.Out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		_, _ = fmt.Fprint(self.Out, "\x1b[?25h\x1b[?1049l")
+		_ = term.Restore(stdin, oldState)
+	}()
+
+	keys := make(chan string, 16)
+	go readTopKeys(os.Stdin, keys)
+
+	ui := newTopUI(self.model)
+	ticker := time.NewTicker(self.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			width, height = 120, 40
+		}
+		self.draw(ui, width, height, streamErrors.last())
+
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+			} else if !ui.handleKey(key) {
+				cancel()
+				return nil
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			select {
+			case err = <-streamDone:
+				return err
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+	}
+}
+
+func (self *topAction) draw(ui *topUI, width, height int, status string) {
+	self.model.Lock()
+	lines := self.model.render(ui.current(), ui.breadcrumb(), width, height)
+	self.model.Unlock()
+
+	if status != "" && len(lines) > 0 {
+		lines[len(lines)-1] = util.ColorWarning(truncateTopLine(status, width))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for idx, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\x1b[K")
+		if idx < len(lines)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString("\x1b[J")
+	_, _ = fmt.Fprint(self.Out, sb.String())
+}
+
+func (self *topAction) HandleReceive(msg *channel.Message, _ channel.Channel) {
+	_ = self.model.AcceptEvent(msg.Body)
+}
+
+// loadInventory seeds the model with the current routers, links, services and circuits, so the view doesn't start
+// empty. Identity names come from the edge API when the selected login allows it
+func (self *topAction) loadInventory() error {
+	err := WithFabricClient(self, func(client *fabric_rest_client.ZitiFabric) error {
+		model := self.model
+
+		routers, err := listAll(func(limit, offset *int64) ([]*rest_model.RouterDetail, error) {
+			result, err := client.Router.ListRouters(&router.ListRoutersParams{Limit: limit, Offset: offset, Context: self.GetContext()})
+			if err != nil {
+				return nil, err
+			}
+			return result.Payload.Data, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, entity := range routers {
+			r := model.getRouter(valOrDefault(entity.ID))
+			r.name = valOrDefault(entity.Name)
+			r.online = valOrDefault(entity.Connected)
+		}
+
+		links, err := client.Link.ListLinks(&link.ListLinksParams{Context: self.GetContext()})
+		if err != nil {
+			return util.WrapIfApiError(err)
+		}
+		for _, entity := range links.Payload.Data {
+			l := model.getLink(valOrDefault(entity.ID))
+			l.srcRouter = entity.SourceRouter.ID
+			l.dstRouter = entity.DestRouter.ID
+			l.protocol = valOrDefault(entity.Protocol)
+			l.cost = valOrDefault(entity.Cost)
+			l.state = valOrDefault(entity.State)
+			l.down = valOrDefault(entity.Down)
+		}
+
+		services, err := listAll(func(limit, offset *int64) ([]*rest_model.ServiceDetail, error) {
+			result, err := client.Service.ListServices(&service.ListServicesParams{Limit: limit, Offset: offset, Context: self.GetContext()})
+			if err != nil {
+				return nil, err
+			}
+			return result.Payload.Data, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, entity := range services {
+			model.serviceNames[valOrDefault(entity.ID)] = valOrDefault(entity.Name)
+		}
+
+		result, err := client.Circuit.ListCircuits(&circuit.ListCircuitsParams{Context: self.GetContext()})
+		if err != nil {
+			return util.WrapIfApiError(err)
+		}
+		for _, entity := range result.Payload.Data {
+			c := &topCircuit{
+				id:        valOrDefault(entity.ID),
+				state:     "active",
+				clientId:  entity.ClientID,
+				serviceId: entity.Service.ID,
+			}
+			if entity.CreatedAt != nil {
+				c.createdAt = time.Time(*entity.CreatedAt)
+			}
+			if entity.Path != nil {
+				for _, node := range entity.Path.Nodes {
+					c.nodes = append(c.nodes, node.ID)
+				}
+				for _, l := range entity.Path.Links {
+					c.links = append(c.links, l.ID)
+				}
+			}
+			model.circuits[c.id] = c
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if client, err := util.NewEdgeManagementClient(self); err == nil {
+		identities, _ := listAll(func(limit, offset *int64) ([]*edge_rest_model.IdentityDetail, error) {
+			result, err := client.Identity.ListIdentities(&identity.ListIdentitiesParams{Limit: limit, Offset: offset, Context: self.GetContext()}, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Payload.Data, nil
+		})
+		for _, entity := range identities {
+			self.model.identityNames[valOrDefault(entity.ID)] = valOrDefault(entity.Name)
+		}
+	}
+	return nil
+}
+
+// topUI holds the navigation stack and turns key presses into navigation
+type topUI struct {
+	model   *topModel
+	screens []*topScreen
+	// panes remembers the sort and selection of each top level pane when switching between them
+	panes map[topPane]*topScreen
+}
+
+func newTopUI(model *topModel) *topUI {
+	result := &topUI{
+		model: model,
+		panes: map[topPane]*topScreen{},
+	}
+	result.switchPane(topPaneRouters)
+	return result
+}
+
+func (self *topUI) current() *topScreen {
+	return self.screens[len(self.screens)-1]
+}
+
+func (self *topUI) breadcrumb() string {
+	var parts []string
+	for _, screen := range self.screens[:len(self.screens)-1] {
+		if screen.filter != nil {
+			parts = append(parts, screen.filter.label)
+		} else {
+			parts = append(parts, topPaneNames[screen.pane])
+		}
+	}
+	return strings.Join(parts, " > ")
+}
+
+func (self *topUI) switchPane(pane topPane) {
+	screen, found := self.panes[pane]
+	if !found {
+		screen = defaultTopScreen(pane)
+		self.panes[pane] = screen
+	}
+	self.screens = []*topScreen{screen}
+}
+
+// handleKey applies a key press, returning false when the user wants to quit
+func (self *topUI) handleKey(key string) bool {
+	screen := self.current()
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "1", "2", "3", "4", "5":
+		self.switchPane(topPane(key[0] - '1'))
+	case "tab":
+		self.switchPane((self.screens[0].pane + 1) % topPane(len(topPaneNames)))
+	case "up", "k":
+		screen.selected--
+	case "down", "j":
+		screen.selected++
+	case "pgup":
+		screen.selected -= 10
+	case "pgdn":
+		screen.selected += 10
+	case "home", "g":
+		screen.selected = 0
+	case "end", "G":
+		screen.selected = 1 << 30
+	case "s", "S":
+		self.model.Lock()
+		columns := len(self.model.table(screen).columns)
+		self.model.Unlock()
+		if key == "s" {
+			screen.sortCol = (screen.sortCol + 1) % columns
+		} else {
+			screen.sortCol = (screen.sortCol + columns - 1) % columns
+		}
+	case "r":
+		screen.desc = !screen.desc
+	case "enter":
+		self.drillDown()
+	case "esc", "backspace":
+		if len(self.screens) > 1 {
+			self.screens = self.screens[:len(self.screens)-1]
+		}
+	}
+	if screen.selected < 0 {
+		screen.selected = 0
+	}
+	return true
+}
+
+func (self *topUI) drillDown() {
+	screen := self.current()
+
+	self.model.Lock()
+	key := self.model.selectedKey(screen)
+	var label string
+	switch screen.pane {
+	case topPaneRouters:
+		label = "router " + self.model.routerName(key)
+	case topPaneLinks:
+		label = "link " + key
+	case topPaneServices:
+		label = "service " + self.model.serviceName(key)
+	case topPaneIdentities:
+		label = "identity " + self.model.identityName(key)
+	case topPaneCircuits:
+		label = "circuit " + key
+	}
+	self.model.Unlock()
+
+	if key == "" || screen.pane == topPaneCircuitDetail {
+		return
+	}
+
+	var next *topScreen
+	if screen.pane == topPaneCircuits {
+		next = &topScreen{pane: topPaneCircuitDetail}
+	} else {
+		next = defaultTopScreen(topPaneCircuits)
+	}
+	next.filter = &topFilter{pane: screen.pane, id: key, label: label}
+	self.screens = append(self.screens, next)
+}
+
+var topKeySequences = map[string]string{
+	"\x1b[A": "up", "\x1bOA": "up",
+	"\x1b[B": "down", "\x1bOB": "down",
+	"\x1b[5~": "pgup", "\x1b[6~": "pgdn",
+	"\x1b[H": "home", "\x1b[1~": "home",
+	"\x1b[F": "end", "\x1b[4~": "end",
+	"\x1b": "esc",
+	"\r":   "enter", "\n": "enter",
+	"\t":   "tab",
+	"\x7f": "backspace", "\x08": "backspace",
+	"\x03": "ctrl-c",
+}
+
+// readTopKeys reads key presses from the raw terminal. Escape sequences are expected to arrive in a single read
+func readTopKeys(in io.Reader, keys chan<- string) {
+	buf := make([]byte, 32)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		for _, key := range parseTopKeys(string(buf[:n])) {
+			keys <- key
+		}
+	}
+}
+
+func parseTopKeys(input string) []string {
+	var result []string
+	for len(input) > 0 {
+		matched := false
+		if input[0] == '\x1b' && len(input) > 1 {
+			for seq, key := range topKeySequences {
+				if len(seq) > 1 && strings.HasPrefix(input, seq) {
+					result = append(result, key)
+					input = input[len(seq):]
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				// unknown escape sequence, skip it
+				end := strings.IndexFunc(input[1:], func(r rune) bool { return r >= '@' && r <= '~' && r != '[' && r != 'O' })
+				if end < 0 {
+					return result
+				}
+				input = input[end+2:]
+				continue
+			}
+			continue
+		}
+		if key, found := topKeySequences[input[:1]]; found {
+			result = append(result, key)
+		} else {
+			result = append(result, input[:1])
+		}
+		input = input[1:]
+	}
+	return result
+}
+
+// topStatusWriter keeps the last line written to it, so stream errors can be shown in the status line
+type topStatusWriter struct {
+	lock sync.Mutex
+	line string
+}
+
+func (self *topStatusWriter) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if line := strings.TrimSpace(string(p)); line != "" {
+		self.line = line
+	}
+	return len(p), nil
+}
+
+func (self *topStatusWriter) clear() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.line = ""
+}
+
+func (self *topStatusWriter) last() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.line
+}
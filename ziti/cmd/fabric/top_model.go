@@ -0,0 +1,408 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/fabric/event"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// topRateWindow is the window over which circuit rates and usage byte rates are calculated
+	topRateWindow = time.Minute
+
+	// topFailedCircuitRetention is how long failed circuits stay listed
+	topFailedCircuitRetention = 5 * time.Minute
+)
+
+type topRouter struct {
+	id      string
+	name    string
+	online  bool
+	txRates map[string]float64
+	rxRates map[string]float64
+}
+
+type topLink struct {
+	id        string
+	srcRouter string
+	dstRouter string
+	protocol  string
+	cost      int64
+	state     string
+	down      bool
+	latencies map[string]float64
+	txRates   map[string]float64
+}
+
+type topUsageSample struct {
+	at    time.Time
+	bytes uint64
+}
+
+// topUsage tracks the bytes sent and received through the ingress routers for a service or identity
+type topUsage struct {
+	id       string
+	bytes    uint64
+	samples  []topUsageSample
+	circuits map[string]struct{}
+}
+
+type topCircuit struct {
+	id        string
+	state     string
+	clientId  string
+	serviceId string
+	nodes     []string
+	links     []string
+	createdAt time.Time
+	failedAt  time.Time
+	cause     string
+	cost      string
+}
+
+type topCircuitEvent struct {
+	at        time.Time
+	eventType string
+}
+
+// topModel holds the network state shown by fabric top. It's updated from events and read by the renderer
+type topModel struct {
+	sync.Mutex
+	routers       map[string]*topRouter
+	links         map[string]*topLink
+	serviceNames  map[string]string
+	identityNames map[string]string
+	services      map[string]*topUsage
+	identities    map[string]*topUsage
+	circuits      map[string]*topCircuit
+	circuitEvents []topCircuitEvent
+	totalCreated  uint64
+	totalFailed   uint64
+	eventCount    uint64
+	gaps          int
+	now           func() time.Time
+}
+
+func newTopModel() *topModel {
+	return &topModel{
+		routers:       map[string]*topRouter{},
+		links:         map[string]*topLink{},
+		serviceNames:  map[string]string{},
+		identityNames: map[string]string{},
+		services:      map[string]*topUsage{},
+		identities:    map[string]*topUsage{},
+		circuits:      map[string]*topCircuit{},
+		now:           time.Now,
+	}
+}
+
+func (self *topModel) getRouter(id string) *topRouter {
+	result, found := self.routers[id]
+	if !found {
+		result = &topRouter{
+			id:      id,
+			name:    id,
+			txRates: map[string]float64{},
+			rxRates: map[string]float64{},
+		}
+		self.routers[id] = result
+	}
+	return result
+}
+
+func (self *topModel) getLink(id string) *topLink {
+	result, found := self.links[id]
+	if !found {
+		result = &topLink{
+			id:        id,
+			latencies: map[string]float64{},
+			txRates:   map[string]float64{},
+		}
+		self.links[id] = result
+	}
+	return result
+}
+
+func getTopUsage(m map[string]*topUsage, id string) *topUsage {
+	result, found := m[id]
+	if !found {
+		result = &topUsage{id: id, circuits: map[string]struct{}{}}
+		m[id] = result
+	}
+	return result
+}
+
+// AcceptEvent updates the model from a JSON event. Events of other types are ignored
+func (self *topModel) AcceptEvent(data []byte) error {
+	header := &struct {
+		Namespace string `json:"namespace"`
+	}{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return err
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	self.eventCount++
+
+	switch header.Namespace {
+	case event.MetricsEventsNs:
+		evt := &event.MetricsEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptMetricsEvent(evt)
+	case event.CircuitEventsNs:
+		evt := &event.CircuitEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptCircuitEvent(evt)
+	case event.LinkEventsNs:
+		evt := &event.LinkEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptLinkEvent(evt)
+	case event.RouterEventsNs:
+		evt := &event.RouterEvent{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		router := self.getRouter(evt.RouterId)
+		router.online = evt.RouterOnline
+		if !router.online {
+			router.txRates = map[string]float64{}
+			router.rxRates = map[string]float64{}
+		}
+	case event.UsageEventsNs:
+		evt := &event.UsageEventV3{}
+		if err := json.Unmarshal(data, evt); err != nil {
+			return err
+		}
+		self.acceptUsageEvent(evt)
+	case streamGapNamespace:
+		self.gaps++
+	}
+	return nil
+}
+
+func (self *topModel) acceptMetricsEvent(evt *event.MetricsEvent) {
+	rate, _ := evt.Metrics["m1_rate"].(float64)
+
+	switch evt.Metric {
+	case "ingress.tx.bytesrate", "egress.tx.bytesrate", "fabric.tx.bytesrate":
+		self.getRouter(evt.SourceAppId).txRates[evt.Metric] = rate
+	case "ingress.rx.bytesrate", "egress.rx.bytesrate", "fabric.rx.bytesrate":
+		self.getRouter(evt.SourceAppId).rxRates[evt.Metric] = rate
+	case "link.latency":
+		if mean, ok := evt.Metrics["mean"].(float64); ok && evt.SourceEntityId != "" {
+			self.getLink(evt.SourceEntityId).latencies[evt.SourceAppId] = mean
+		}
+	case "link.tx.bytesrate":
+		if evt.SourceEntityId != "" {
+			self.getLink(evt.SourceEntityId).txRates[evt.SourceAppId] = rate
+		}
+	}
+}
+
+func (self *topModel) acceptCircuitEvent(evt *event.CircuitEvent) {
+	now := self.now()
+	self.circuitEvents = append(self.circuitEvents, topCircuitEvent{at: now, eventType: string(evt.EventType)})
+
+	switch evt.EventType {
+	case event.CircuitCreated, event.CircuitUpdated:
+		circuit, found := self.circuits[evt.CircuitId]
+		if !found {
+			circuit = &topCircuit{id: evt.CircuitId, createdAt: evt.Timestamp}
+			self.circuits[evt.CircuitId] = circuit
+		}
+		if evt.EventType == event.CircuitCreated {
+			self.totalCreated++
+		}
+		circuit.state = "active"
+		circuit.clientId = evt.ClientId
+		circuit.serviceId = evt.ServiceId
+		circuit.nodes = evt.Path.Nodes
+		circuit.links = evt.Path.Links
+		if evt.Cost != nil {
+			circuit.cost = fmt.Sprintf("%v", *evt.Cost)
+		}
+	case event.CircuitDeleted:
+		delete(self.circuits, evt.CircuitId)
+	case event.CircuitFailed:
+		self.totalFailed++
+		circuit := &topCircuit{
+			id:        evt.CircuitId,
+			state:     "failed",
+			clientId:  evt.ClientId,
+			serviceId: evt.ServiceId,
+			nodes:     evt.Path.Nodes,
+			links:     evt.Path.Links,
+			createdAt: evt.Timestamp,
+			failedAt:  now,
+		}
+		if evt.FailureCause != nil {
+			circuit.cause = *evt.FailureCause
+		}
+		self.circuits[evt.CircuitId] = circuit
+	}
+}
+
+func (self *topModel) acceptLinkEvent(evt *event.LinkEvent) {
+	switch evt.EventType {
+	case event.LinkFault:
+		delete(self.links, evt.LinkId)
+		return
+	case event.LinkFromRouterDisconnectedDest:
+		if link, found := self.links[evt.LinkId]; found {
+			link.down = true
+		}
+		return
+	}
+
+	link := self.getLink(evt.LinkId)
+	link.srcRouter = evt.SrcRouterId
+	link.dstRouter = evt.DstRouterId
+	link.protocol = evt.Protocol
+	link.cost = int64(evt.Cost)
+	link.down = false
+	if evt.EventType == event.LinkConnected || evt.EventType == event.LinkFromRouterNew || evt.EventType == event.LinkFromRouterKnown {
+		link.state = "Connected"
+	} else {
+		link.state = "Pending"
+	}
+}
+
+func (self *topModel) acceptUsageEvent(evt *event.UsageEventV3) {
+	bytes := evt.Usage["ingress.rx"] + evt.Usage["ingress.tx"]
+	if bytes == 0 {
+		return
+	}
+
+	at := time.Unix(evt.IntervalStartUTC+int64(evt.IntervalLength), 0)
+	if serviceId := evt.Tags["serviceId"]; serviceId != "" {
+		getTopUsage(self.services, serviceId).add(evt.CircuitId, at, bytes)
+	}
+	if clientId := evt.Tags["clientId"]; clientId != "" {
+		getTopUsage(self.identities, clientId).add(evt.CircuitId, at, bytes)
+	}
+}
+
+func (self *topUsage) add(circuitId string, at time.Time, bytes uint64) {
+	self.bytes += bytes
+	self.samples = append(self.samples, topUsageSample{at: at, bytes: bytes})
+	if circuitId != "" {
+		self.circuits[circuitId] = struct{}{}
+	}
+}
+
+// rate returns the bytes per second reported within the rate window
+func (self *topUsage) rate(now time.Time) float64 {
+	cutoff := now.Add(-topRateWindow)
+	idx := sort.Search(len(self.samples), func(i int) bool {
+		return self.samples[i].at.After(cutoff)
+	})
+	self.samples = self.samples[idx:]
+
+	var total uint64
+	for _, sample := range self.samples {
+		total += sample.bytes
+	}
+	return float64(total) / topRateWindow.Seconds()
+}
+
+// prune drops circuit events outside the rate window and failed circuits older than the retention period
+func (self *topModel) prune() {
+	now := self.now()
+	cutoff := now.Add(-topRateWindow)
+	idx := sort.Search(len(self.circuitEvents), func(i int) bool {
+		return self.circuitEvents[i].at.After(cutoff)
+	})
+	self.circuitEvents = self.circuitEvents[idx:]
+
+	for id, circuit := range self.circuits {
+		if circuit.state == "failed" && now.Sub(circuit.failedAt) > topFailedCircuitRetention {
+			delete(self.circuits, id)
+		}
+	}
+}
+
+// circuitRates returns the circuits created and failed per minute over the rate window
+func (self *topModel) circuitRates() (float64, float64) {
+	var created, failed int
+	for _, evt := range self.circuitEvents {
+		switch evt.eventType {
+		case string(event.CircuitCreated):
+			created++
+		case string(event.CircuitFailed):
+			failed++
+		}
+	}
+	minutes := topRateWindow.Minutes()
+	return float64(created) / minutes, float64(failed) / minutes
+}
+
+func (self *topModel) routerName(id string) string {
+	if router, found := self.routers[id]; found && router.name != "" {
+		return router.name
+	}
+	return id
+}
+
+func (self *topModel) serviceName(id string) string {
+	if name, found := self.serviceNames[id]; found {
+		return name
+	}
+	return id
+}
+
+func (self *topModel) identityName(id string) string {
+	if name, found := self.identityNames[id]; found {
+		return name
+	}
+	return id
+}
+
+func (self *topModel) routerNames(ids []string) string {
+	var names []string
+	for _, id := range ids {
+		names = append(names, self.routerName(id))
+	}
+	return strings.Join(names, "->")
+}
+
+func sumRates(rates map[string]float64) float64 {
+	var total float64
+	for _, rate := range rates {
+		total += rate
+	}
+	return total
+}
+
+func avgRates(rates map[string]float64) (float64, bool) {
+	if len(rates) == 0 {
+		return 0, false
+	}
+	return sumRates(rates) / float64(len(rates)), true
+}
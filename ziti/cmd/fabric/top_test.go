@@ -0,0 +1,134 @@
+package fabric
+
+import (
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTopModel(t *testing.T) *topModel {
+	model := newTopModel()
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	model.now = func() time.Time { return now }
+	model.serviceNames["svc1"] = "echo"
+	model.identityNames["id1"] = "client-one"
+
+	events := []string{
+		`{"namespace":"fabric.routers","event_type":"router-online","timestamp":"2023-05-01T09:59:00Z","router_id":"r1","router_online":true}`,
+		`{"namespace":"fabric.routers","event_type":"router-online","timestamp":"2023-05-01T09:59:00Z","router_id":"r2","router_online":true}`,
+		`{"namespace":"fabric.links","event_type":"connected","timestamp":"2023-05-01T09:59:01Z","link_id":"l1","src_router_id":"r1","dst_router_id":"r2","protocol":"tls","cost":3}`,
+		`{"namespace":"metrics","metric_type":"intValue","source_id":"r1","timestamp":"2023-05-01T09:59:30Z","metric":"ingress.tx.bytesrate","metrics":{"m1_rate":2048}}`,
+		`{"namespace":"metrics","metric_type":"intValue","source_id":"r1","timestamp":"2023-05-01T09:59:30Z","metric":"fabric.tx.bytesrate","metrics":{"m1_rate":1024}}`,
+		`{"namespace":"metrics","metric_type":"intValue","source_id":"r2","timestamp":"2023-05-01T09:59:30Z","metric":"ingress.tx.bytesrate","metrics":{"m1_rate":10}}`,
+		`{"namespace":"metrics","metric_type":"histogram","source_id":"r1","source_entity_id":"l1","timestamp":"2023-05-01T09:59:30Z","metric":"link.latency","metrics":{"mean":2500000}}`,
+		`{"namespace":"fabric.circuits","event_type":"created","circuit_id":"c1","timestamp":"2023-05-01T09:59:40Z","client_id":"id1","service_id":"svc1","path":{"nodes":["r1","r2"],"links":["l1"]},"path_cost":5}`,
+		`{"namespace":"fabric.circuits","event_type":"created","circuit_id":"c2","timestamp":"2023-05-01T09:59:50Z","client_id":"id1","service_id":"svc1","path":{"nodes":["r2"],"links":[]}}`,
+		`{"namespace":"fabric.circuits","event_type":"deleted","circuit_id":"c2","timestamp":"2023-05-01T09:59:55Z","client_id":"id1","service_id":"svc1","path":{"nodes":["r2"],"links":[]}}`,
+		`{"namespace":"fabric.circuits","event_type":"failed","circuit_id":"c3","timestamp":"2023-05-01T09:59:58Z","client_id":"id2","service_id":"svc1","path":{"nodes":[],"links":[]},"failure_cause":"NO_TERMINATORS"}`,
+		`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c1","usage":{"ingress.rx":1000,"ingress.tx":2000,"fabric.tx":1000},"interval_start_utc":1682935170,"interval_length":60,"tags":{"clientId":"id1","serviceId":"svc1"}}`,
+	}
+
+	for _, evt := range events {
+		require.NoError(t, model.AcceptEvent([]byte(evt)), evt)
+	}
+	return model
+}
+
+func TestTopModelAggregatesEvents(t *testing.T) {
+	req := require.New(t)
+	model := newTestTopModel(t)
+
+	req.Len(model.routers, 2)
+	req.Equal(float64(3072), sumRates(model.routers["r1"].txRates))
+	req.Equal(int64(3), model.links["l1"].cost)
+	req.Equal("Connected", model.links["l1"].state)
+
+	req.Len(model.circuits, 2)
+	req.Equal("active", model.circuits["c1"].state)
+	req.Equal("failed", model.circuits["c3"].state)
+	req.Equal("NO_TERMINATORS", model.circuits["c3"].cause)
+
+	created, failed := model.circuitRates()
+	req.Equal(float64(2), created)
+	req.Equal(float64(1), failed)
+
+	req.Equal(uint64(3000), model.services["svc1"].bytes)
+	req.Equal(uint64(3000), model.identities["id1"].bytes)
+	req.Equal(float64(50), model.services["svc1"].rate(model.now()))
+
+	routers := model.table(defaultTopScreen(topPaneRouters))
+	req.Equal("r1", routers.rows[0].key)
+	req.Equal([]string{"r1", "r1", "yes", "3.0KB", "0B", "1", "2.5ms", "1"}, routers.rows[0].cells)
+
+	screen := defaultTopScreen(topPaneRouters)
+	screen.desc = false
+	req.Equal("r2", model.table(screen).rows[0].key)
+
+	services := model.table(defaultTopScreen(topPaneServices))
+	req.Equal([]string{"svc1", "echo", "50B", "2.9KB", "1"}, services.rows[0].cells)
+
+	// failed circuits are kept for a while, then pruned
+	model.now = func() time.Time { return time.Date(2023, 5, 1, 10, 10, 0, 0, time.UTC) }
+	model.prune()
+	req.Len(model.circuits, 1)
+	created, failed = model.circuitRates()
+	req.Equal(float64(0), created)
+	req.Equal(float64(0), failed)
+}
+
+func TestTopUINavigation(t *testing.T) {
+	req := require.New(t)
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	model := newTestTopModel(t)
+	ui := newTopUI(model)
+
+	// drill down from the busiest router into its circuits, then into a circuit
+	req.True(ui.handleKey("enter"))
+	req.Equal(topPaneCircuits, ui.current().pane)
+	req.Equal("r1", ui.current().filter.id)
+
+	lines := model.render(ui.current(), ui.breadcrumb(), 200, 20)
+	req.Len(lines, 20)
+	req.Contains(lines[3], "Routers > Circuits for router r1")
+	output := strings.Join(lines, "\n")
+	req.Contains(output, "c1")
+	req.NotContains(output, "NO_TERMINATORS")
+
+	req.True(ui.handleKey("enter"))
+	req.Equal(topPaneCircuitDetail, ui.current().pane)
+	output = strings.Join(model.render(ui.current(), ui.breadcrumb(), 200, 20), "\n")
+	req.Contains(output, "echo (svc1)")
+	req.Contains(output, "client-one (id1)")
+	req.Contains(output, "link l1 cost 3 latency 2.5ms")
+
+	req.True(ui.handleKey("esc"))
+	req.True(ui.handleKey("esc"))
+	req.Equal(topPaneRouters, ui.current().pane)
+	req.Len(ui.screens, 1)
+
+	// sort column and selection are remembered per pane
+	req.True(ui.handleKey("5"))
+	req.True(ui.handleKey("s"))
+	req.Equal(7, ui.current().sortCol)
+	req.True(ui.handleKey("1"))
+	req.True(ui.handleKey("5"))
+	req.Equal(7, ui.current().sortCol)
+
+	output = strings.Join(model.render(ui.current(), ui.breadcrumb(), 200, 20), "\n")
+	req.Contains(output, "NO_TERMINATORS")
+	req.Contains(output, "failed 1.0/min")
+
+	req.False(ui.handleKey("q"))
+}
+
+func TestParseTopKeys(t *testing.T) {
+	require.Equal(t, []string{"up", "down", "enter", "q"}, parseTopKeys("\x1b[A\x1b[B\rq"))
+	require.Equal(t, []string{"esc"}, parseTopKeys("\x1b"))
+	require.Equal(t, []string{"pgdn", "s"}, parseTopKeys("\x1b[6~s"))
+	require.Equal(t, []string{"x"}, parseTopKeys("\x1b[1;5Cx"))
+}
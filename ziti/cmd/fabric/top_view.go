@@ -0,0 +1,501 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/openziti/ziti/ziti/util"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type topPane int
+
+const (
+	topPaneRouters topPane = iota
+	topPaneLinks
+	topPaneServices
+	topPaneIdentities
+	topPaneCircuits
+	topPaneCircuitDetail
+)
+
+var topPaneNames = []string{"Routers", "Links", "Services", "Identities", "Circuits"}
+
+type topColumn struct {
+	title string
+	width int
+	right bool
+}
+
+type topRow struct {
+	key   string
+	cells []string
+	// sortKeys holds a float64 or string per column
+	sortKeys []interface{}
+	// alert rows are shown in red, such as offline routers or failed circuits
+	alert bool
+}
+
+type topTable struct {
+	title   string
+	columns []topColumn
+	rows    []topRow
+}
+
+// topFilter restricts a drill-down circuit list to circuits related to one entity
+type topFilter struct {
+	pane  topPane
+	id    string
+	label string
+}
+
+// topScreen is an entry in the navigation stack. Drilling down pushes a screen, going back pops it
+type topScreen struct {
+	pane     topPane
+	filter   *topFilter
+	sortCol  int
+	desc     bool
+	selected int
+	offset   int
+}
+
+var topSelectedColor = color.New(color.ReverseVideo)
+
+func defaultTopScreen(pane topPane) *topScreen {
+	screen := &topScreen{pane: pane, desc: true}
+	switch pane {
+	case topPaneRouters:
+		screen.sortCol = 3
+	case topPaneLinks:
+		screen.sortCol = 6
+	case topPaneServices, topPaneIdentities:
+		screen.sortCol = 2
+	case topPaneCircuits:
+		screen.sortCol = 6
+		screen.desc = false
+	}
+	return screen
+}
+
+// table builds the table for a screen. The caller must hold the model lock
+func (self *topModel) table(screen *topScreen) *topTable {
+	var result *topTable
+	switch screen.pane {
+	case topPaneRouters:
+		result = self.routersTable()
+	case topPaneLinks:
+		result = self.linksTable()
+	case topPaneServices:
+		result = self.usageTable("Services", self.services, self.serviceName)
+	case topPaneIdentities:
+		result = self.usageTable("Identities", self.identities, self.identityName)
+	case topPaneCircuits:
+		result = self.circuitsTable(screen.filter)
+	case topPaneCircuitDetail:
+		result = self.circuitDetailTable(screen.filter.id)
+		return result
+	}
+
+	if screen.sortCol >= len(result.columns) {
+		screen.sortCol = 0
+	}
+	sort.SliceStable(result.rows, func(i, j int) bool {
+		a, b := result.rows[i].sortKeys[screen.sortCol], result.rows[j].sortKeys[screen.sortCol]
+		if less, equal := compareTopSortKeys(a, b); !equal {
+			return less != screen.desc
+		}
+		return result.rows[i].key < result.rows[j].key
+	})
+	return result
+}
+
+func compareTopSortKeys(a, b interface{}) (bool, bool) {
+	if af, ok := a.(float64); ok {
+		bf, _ := b.(float64)
+		return af < bf, af == bf
+	}
+	as, bs := fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)
+	return as < bs, as == bs
+}
+
+func (self *topModel) routersTable() *topTable {
+	result := &topTable{
+		title: "Routers",
+		columns: []topColumn{
+			{title: "ID", width: 12}, {title: "Name", width: 20}, {title: "Online", width: 6},
+			{title: "Tx/s", width: 10, right: true}, {title: "Rx/s", width: 10, right: true},
+			{title: "Links", width: 5, right: true}, {title: "Latency", width: 9, right: true},
+			{title: "Circuits", width: 8, right: true},
+		},
+	}
+
+	for _, router := range self.routers {
+		var links float64
+		latencies := map[string]float64{}
+		for _, link := range self.links {
+			if link.srcRouter == router.id || link.dstRouter == router.id {
+				links++
+			}
+			if latency, found := link.latencies[router.id]; found {
+				latencies[link.id] = latency
+			}
+		}
+
+		var circuits float64
+		for _, circuit := range self.circuits {
+			if circuit.state == "active" && containsString(circuit.nodes, router.id) {
+				circuits++
+			}
+		}
+
+		tx, rx := sumRates(router.txRates), sumRates(router.rxRates)
+		latency, hasLatency := avgRates(latencies)
+		online := "no"
+		if router.online {
+			online = "yes"
+		}
+
+		result.rows = append(result.rows, topRow{
+			key: router.id,
+			cells: []string{router.id, router.name, online, formatTopRate(tx), formatTopRate(rx),
+				fmt.Sprintf("%v", links), formatTopLatency(latency, hasLatency), fmt.Sprintf("%v", circuits)},
+			sortKeys: []interface{}{router.id, router.name, online, tx, rx, links, latency, circuits},
+			alert:    !router.online,
+		})
+	}
+	return result
+}
+
+func (self *topModel) linksTable() *topTable {
+	result := &topTable{
+		title: "Links",
+		columns: []topColumn{
+			{title: "ID", width: 22}, {title: "Dialer", width: 16}, {title: "Acceptor", width: 16},
+			{title: "Protocol", width: 8}, {title: "State", width: 10}, {title: "Cost", width: 6, right: true},
+			{title: "Tx/s", width: 10, right: true}, {title: "Latency", width: 9, right: true},
+			{title: "Circuits", width: 8, right: true},
+		},
+	}
+
+	for _, link := range self.links {
+		var circuits float64
+		for _, circuit := range self.circuits {
+			if circuit.state == "active" && containsString(circuit.links, link.id) {
+				circuits++
+			}
+		}
+
+		state := link.state
+		if link.down {
+			state = "Down"
+		}
+		tx := sumRates(link.txRates)
+		latency, hasLatency := avgRates(link.latencies)
+
+		result.rows = append(result.rows, topRow{
+			key: link.id,
+			cells: []string{link.id, self.routerName(link.srcRouter), self.routerName(link.dstRouter), link.protocol, state,
+				fmt.Sprintf("%v", link.cost), formatTopRate(tx), formatTopLatency(latency, hasLatency), fmt.Sprintf("%v", circuits)},
+			sortKeys: []interface{}{link.id, self.routerName(link.srcRouter), self.routerName(link.dstRouter), link.protocol, state,
+				float64(link.cost), tx, latency, circuits},
+			alert: link.down,
+		})
+	}
+	return result
+}
+
+func (self *topModel) usageTable(title string, usages map[string]*topUsage, name func(string) string) *topTable {
+	result := &topTable{
+		title: title,
+		columns: []topColumn{
+			{title: "ID", width: 22}, {title: "Name", width: 24}, {title: "Bytes/s", width: 10, right: true},
+			{title: "Total", width: 10, right: true}, {title: "Active Circuits", width: 15, right: true},
+		},
+	}
+
+	now := self.now()
+	for _, usage := range usages {
+		var active float64
+		for circuitId := range usage.circuits {
+			if circuit, found := self.circuits[circuitId]; found && circuit.state == "active" {
+				active++
+			} else {
+				delete(usage.circuits, circuitId)
+			}
+		}
+		rate := usage.rate(now)
+		result.rows = append(result.rows, topRow{
+			key:      usage.id,
+			cells:    []string{usage.id, name(usage.id), formatTopRate(rate), formatTopBytes(float64(usage.bytes)), fmt.Sprintf("%v", active)},
+			sortKeys: []interface{}{usage.id, name(usage.id), rate, float64(usage.bytes), active},
+		})
+	}
+	return result
+}
+
+func (self *topModel) circuitsTable(filter *topFilter) *topTable {
+	result := &topTable{
+		title: "Circuits",
+		columns: []topColumn{
+			{title: "ID", width: 12}, {title: "State", width: 6}, {title: "Service", width: 18},
+			{title: "Client", width: 12}, {title: "Path", width: 36}, {title: "Cost", width: 6, right: true},
+			{title: "Age", width: 8, right: true}, {title: "Failure", width: 20},
+		},
+	}
+	if filter != nil {
+		result.title = "Circuits for " + filter.label
+	}
+
+	now := self.now()
+	for _, circuit := range self.circuits {
+		if filter != nil && !circuit.matches(filter) {
+			continue
+		}
+		age := now.Sub(circuit.createdAt)
+		result.rows = append(result.rows, topRow{
+			key: circuit.id,
+			cells: []string{circuit.id, circuit.state, self.serviceName(circuit.serviceId), self.identityName(circuit.clientId),
+				self.routerNames(circuit.nodes), circuit.cost, formatTopAge(age), circuit.cause},
+			sortKeys: []interface{}{circuit.id, circuit.state, self.serviceName(circuit.serviceId), self.identityName(circuit.clientId),
+				self.routerNames(circuit.nodes), circuit.cost, age.Seconds(), circuit.cause},
+			alert: circuit.state == "failed",
+		})
+	}
+	return result
+}
+
+func (self *topCircuit) matches(filter *topFilter) bool {
+	switch filter.pane {
+	case topPaneRouters:
+		return containsString(self.nodes, filter.id)
+	case topPaneLinks:
+		return containsString(self.links, filter.id)
+	case topPaneServices:
+		return self.serviceId == filter.id
+	case topPaneIdentities:
+		return self.clientId == filter.id
+	}
+	return true
+}
+
+func (self *topModel) circuitDetailTable(id string) *topTable {
+	result := &topTable{
+		title:   "Circuit " + id,
+		columns: []topColumn{{title: "Field", width: 12}, {title: "Value", width: 80}},
+	}
+
+	circuit, found := self.circuits[id]
+	if !found {
+		result.rows = append(result.rows, topRow{key: "state", cells: []string{"State", "closed"}})
+		return result
+	}
+
+	add := func(field, value string) {
+		result.rows = append(result.rows, topRow{key: field, cells: []string{field, value}})
+	}
+	add("State", circuit.state)
+	add("Service", fmt.Sprintf("%v (%v)", self.serviceName(circuit.serviceId), circuit.serviceId))
+	add("Client", fmt.Sprintf("%v (%v)", self.identityName(circuit.clientId), circuit.clientId))
+	add("Created", circuit.createdAt.Local().Format(time.RFC3339))
+	add("Cost", circuit.cost)
+	if circuit.cause != "" {
+		add("Failure", circuit.cause)
+	}
+	for idx, node := range circuit.nodes {
+		add(fmt.Sprintf("Hop %v", idx+1), fmt.Sprintf("router %v (%v)", self.routerName(node), node))
+		if idx < len(circuit.links) {
+			linkId := circuit.links[idx]
+			detail := "link " + linkId
+			if link, found := self.links[linkId]; found {
+				latency, hasLatency := avgRates(link.latencies)
+				detail += fmt.Sprintf(" cost %v latency %v tx %v/s", link.cost, formatTopLatency(latency, hasLatency), formatTopRate(sumRates(link.txRates)))
+			}
+			add("", detail)
+		}
+	}
+	return result
+}
+
+// render draws the screen into lines no wider than width, fitting the table rows into height lines
+func (self *topModel) render(screen *topScreen, breadcrumb string, width, height int) []string {
+	self.prune()
+
+	created, failed := self.circuitRates()
+	var active int
+	for _, circuit := range self.circuits {
+		if circuit.state == "active" {
+			active++
+		}
+	}
+
+	var lines []string
+	var tabs []string
+	for idx, name := range topPaneNames {
+		tab := fmt.Sprintf(" %v:%v ", idx+1, name)
+		if topPane(idx) == screen.pane || (screen.pane == topPaneCircuitDetail && topPane(idx) == topPaneCircuits) {
+			tab = topSelectedColor.Sprint(tab)
+		}
+		tabs = append(tabs, tab)
+	}
+	lines = append(lines, "ziti fabric top "+strings.Join(tabs, ""))
+
+	summary := fmt.Sprintf("routers %v  links %v  circuits %v active  created %.1f/min  ", len(self.routers), len(self.links), active, created)
+	failedSummary := fmt.Sprintf("failed %.1f/min", failed)
+	if failed > 0 {
+		failedSummary = util.ColorError(failedSummary)
+	}
+	summary += failedSummary + fmt.Sprintf("  total created %v failed %v  events %v", self.totalCreated, self.totalFailed, self.eventCount)
+	if self.gaps > 0 {
+		summary += util.ColorWarning(fmt.Sprintf("  reconnects %v", self.gaps))
+	}
+	lines = append(lines, summary)
+
+	table := self.table(screen)
+	title := table.title
+	if breadcrumb != "" {
+		title = breadcrumb + " > " + title
+	}
+	lines = append(lines, "", util.ColorStatus(title))
+
+	var header []string
+	for idx, column := range table.columns {
+		label := column.title
+		if idx == screen.sortCol && screen.pane != topPaneCircuitDetail {
+			if screen.desc {
+				label += "↓"
+			} else {
+				label += "↑"
+			}
+		}
+		header = append(header, padTopCell(label, column))
+	}
+	lines = append(lines, color.New(color.Bold).Sprint(truncateTopLine(strings.Join(header, " "), width)))
+
+	visible := height - len(lines) - 1
+	if visible < 1 {
+		visible = 1
+	}
+
+	if screen.selected >= len(table.rows) {
+		screen.selected = len(table.rows) - 1
+	}
+	if screen.selected < 0 {
+		screen.selected = 0
+	}
+	if screen.selected < screen.offset {
+		screen.offset = screen.selected
+	}
+	if screen.selected >= screen.offset+visible {
+		screen.offset = screen.selected - visible + 1
+	}
+
+	for idx := screen.offset; idx < len(table.rows) && idx < screen.offset+visible; idx++ {
+		var cells []string
+		for colIdx, column := range table.columns {
+			cells = append(cells, padTopCell(table.rows[idx].cells[colIdx], column))
+		}
+		line := truncateTopLine(strings.Join(cells, " "), width)
+		if idx == screen.selected && screen.pane != topPaneCircuitDetail {
+			line = topSelectedColor.Sprint(line)
+		} else if table.rows[idx].alert {
+			line = util.ColorError(line)
+		}
+		lines = append(lines, line)
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, truncateTopLine("1-5/tab: pane  ↑↓/jk: select  enter: drill down  esc: back  s/S: sort column  r: reverse  q: quit", width))
+	return lines
+}
+
+// selectedKey returns the key of the selected row, so it can be drilled into
+func (self *topModel) selectedKey(screen *topScreen) string {
+	table := self.table(screen)
+	if screen.selected >= 0 && screen.selected < len(table.rows) {
+		return table.rows[screen.selected].key
+	}
+	return ""
+}
+
+func padTopCell(val string, column topColumn) string {
+	length := utf8.RuneCountInString(val)
+	if length > column.width {
+		runes := []rune(val)
+		return string(runes[:column.width-1]) + "…"
+	}
+	padding := strings.Repeat(" ", column.width-length)
+	if column.right {
+		return padding + val
+	}
+	return val + padding
+}
+
+func truncateTopLine(line string, width int) string {
+	if width > 0 && utf8.RuneCountInString(line) > width {
+		return string([]rune(line)[:width])
+	}
+	return line
+}
+
+func formatTopRate(bytesPerSecond float64) string {
+	return formatTopBytes(bytesPerSecond)
+}
+
+func formatTopBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	idx := 0
+	for bytes >= 1024 && idx < len(units)-1 {
+		bytes /= 1024
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%.0f%v", bytes, units[idx])
+	}
+	return fmt.Sprintf("%.1f%v", bytes, units[idx])
+}
+
+func formatTopLatency(nanos float64, found bool) string {
+	if !found {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", nanos/float64(time.Millisecond))
+}
+
+func formatTopAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%vs", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%vm%vs", int(age.Minutes()), int(age.Seconds())%60)
+	}
+	return fmt.Sprintf("%vh%vm", int(age.Hours()), int(age.Minutes())%60)
+}
+
+func containsString(values []string, val string) bool {
+	for _, v := range values {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,524 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/openziti/channel/v2"
+	"github.com/openziti/fabric/event"
+	"github.com/openziti/fabric/pb/mgmt_pb"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/openziti/ziti/ziti/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	usageGroupIdentity = "identity"
+	usageGroupService  = "service"
+	usageGroupRouter   = "router"
+)
+
+type usageReportAction struct {
+	api.Options
+	api.StreamOptions
+	bucket       string
+	groupBy      []string
+	duration     time.Duration
+	output       string
+	resolveNames bool
+}
+
+func newUsageCommand(p common.OptionsProvider) *cobra.Command {
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "report on circuit usage",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdhelper.CheckErr(cmd.Help())
+		},
+	}
+
+	usageCmd.AddCommand(newUsageReportCmd(p))
+	return usageCmd
+}
+
+func newUsageReportCmd(p common.OptionsProvider) *cobra.Command {
+	action := &usageReportAction{
+		Options: api.Options{
+			CommonOptions: p(),
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "report [recording]",
+		Short: "Aggregate fabric.usage events into a usage report",
+		Long: "Aggregates the bytes sent and received on circuits, as reported by fabric.usage events, by time bucket " +
+			"and by identity, service and/or router. Events are read from a recording made with ziti fabric stream " +
+			"events --record-events or, if no recording is given, streamed from the controller until --duration has passed or " +
+			"the command is interrupted. Identities are the client identities which dialed the services. Ingress bytes " +
+			"are counted at the router the client is connected to and egress bytes at the router the service is hosted " +
+			"from. Ids are resolved to names using the management API",
+		Example: "ziti fabric usage report incident.zev --bucket day -o csv > usage.csv\n" +
+			"ziti fabric usage report --duration 1h --group-by service,router -o json",
+		Args: cobra.MaximumNArgs(1),
+		RunE: action.run,
+	}
+
+	action.AddCommonFlags(cmd)
+	action.AddStreamFlags(cmd)
+	cmd.Flags().StringVar(&action.bucket, "bucket", "hour", "Time bucket to aggregate by. One of: hour, day")
+	cmd.Flags().StringSliceVar(&action.groupBy, "group-by", []string{usageGroupIdentity, usageGroupService},
+		"What to aggregate by, in addition to the time bucket. Any of: identity, service, router")
+	cmd.Flags().DurationVar(&action.duration, "duration", 0, "How long to collect usage from the controller. 0 collects until interrupted")
+	cmd.Flags().StringVarP(&action.output, "output", "o", "table", "Output format. One of: table, csv, json")
+	cmd.Flags().BoolVar(&action.resolveNames, "resolve-names", true, "Look up identity, service and router names")
+	return cmd
+}
+
+func (self *usageReportAction) run(cmd *cobra.Command, args []string) error {
+	self.Cmd = cmd
+	if self.output != "table" && self.output != "csv" && self.output != "json" {
+		return errors.Errorf("unsupported output format '%v', must be one of: table, csv, json", self.output)
+	}
+
+	report, err := newUsageReport(self.bucket, self.groupBy)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if len(args) == 1 {
+		err = replayRecording(ctx, args[0], 0, self.Err, func(evt *recordedEvent) error {
+			return report.AcceptEvent(evt.event)
+		})
+	} else {
+		err = self.collect(ctx, report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.gaps > 0 {
+		_, _ = fmt.Fprintf(self.Err, "warning: the event stream was interrupted %v time(s), usage may be incomplete\n", report.gaps)
+	}
+
+	names := newUsageNames()
+	if self.resolveNames {
+		if err = names.resolve(self, report); err != nil {
+			_, _ = fmt.Fprintf(self.Err, "warning: unable to resolve names, showing ids only (%v)\n", err)
+		}
+	}
+
+	switch self.output {
+	case "json":
+		return report.writeJSON(self.Out, names)
+	default:
+		self.OutputCSV = self.output == "csv"
+		api.RenderTable(&self.Options, report.table(names), nil)
+		return nil
+	}
+}
+
+func (self *usageReportAction) collect(ctx context.Context, report *usageReport) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"format": "json",
+		"subscriptions": []*event.Subscription{
+			{Type: event.UsageEventsNs, Options: map[string]interface{}{"version": 3}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if self.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.duration)
+		defer cancel()
+		_, _ = fmt.Fprintf(self.Err, "collecting usage for %v\n", self.duration)
+	} else {
+		_, _ = fmt.Fprintln(self.Err, "collecting usage until interrupted")
+	}
+
+	stream := &api.MgmtStream{
+		StreamOptions: self.StreamOptions,
+		Bind: func(binding channel.Binding) {
+			binding.AddReceiveHandler(int32(mgmt_pb.ContentType_StreamEventsEventType), channel.ReceiveHandlerF(func(msg *channel.Message, _ channel.Channel) {
+				_ = report.AcceptEvent(msg.Body)
+			}))
+		},
+		Subscribe: func(ch channel.Channel) error {
+			return subscribeToEvents(ch, request, time.Duration(self.Timeout)*time.Second)
+		},
+		OnGap: func(*api.StreamGap) {
+			report.addGap()
+		},
+		ErrOut: self.Err,
+	}
+	return stream.Run(ctx)
+}
+
+type usageReportKey struct {
+	bucket     time.Time
+	identityId string
+	serviceId  string
+	routerId   string
+}
+
+type usageReportRow struct {
+	usageReportKey
+	circuits map[string]struct{}
+	bytes    map[string]uint64
+}
+
+// usageReportTypes are the usage types included in reports. Fabric usage is left out, as it's the same traffic
+// counted again on each link of the path
+var usageReportTypes = []string{"ingress.rx", "ingress.tx", "egress.rx", "egress.tx"}
+
+// usageReport aggregates usage events by time bucket and the selected dimensions
+type usageReport struct {
+	lock     sync.Mutex
+	bucket   string
+	identity bool
+	service  bool
+	router   bool
+	rows     map[usageReportKey]*usageReportRow
+	gaps     int
+}
+
+func newUsageReport(bucket string, groupBy []string) (*usageReport, error) {
+	if bucket != "hour" && bucket != "day" {
+		return nil, errors.Errorf("unsupported bucket '%v', must be one of: hour, day", bucket)
+	}
+
+	result := &usageReport{
+		bucket: bucket,
+		rows:   map[usageReportKey]*usageReportRow{},
+	}
+	for _, group := range groupBy {
+		switch strings.TrimSpace(group) {
+		case usageGroupIdentity:
+			result.identity = true
+		case usageGroupService:
+			result.service = true
+		case usageGroupRouter:
+			result.router = true
+		default:
+			return nil, errors.Errorf("unsupported group '%v', must be any of: identity, service, router", group)
+		}
+	}
+	return result, nil
+}
+
+func (self *usageReport) addGap() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.gaps++
+}
+
+// AcceptEvent adds the event to the report if it's a usage event. Both version 2 and version 3 usage events are
+// accepted, so older recordings can be reported on as well
+func (self *usageReport) AcceptEvent(data []byte) error {
+	header := &struct {
+		Namespace string `json:"namespace"`
+		Version   uint32 `json:"version"`
+	}{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return err
+	}
+
+	if header.Namespace == streamGapNamespace {
+		self.addGap()
+		return nil
+	}
+
+	if header.Namespace != event.UsageEventsNs {
+		return nil
+	}
+
+	evt := &event.UsageEventV3{}
+	if header.Version < 3 {
+		v2 := &event.UsageEvent{}
+		if err := json.Unmarshal(data, v2); err != nil {
+			return err
+		}
+		evt.SourceId = v2.SourceId
+		evt.CircuitId = v2.CircuitId
+		evt.IntervalStartUTC = v2.IntervalStartUTC
+		evt.Tags = v2.Tags
+		evt.Usage = map[string]uint64{strings.TrimPrefix(v2.EventType, "usage."): v2.Usage}
+	} else if err := json.Unmarshal(data, evt); err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.accept(evt)
+	return nil
+}
+
+func (self *usageReport) accept(evt *event.UsageEventV3) {
+	key := usageReportKey{bucket: self.bucketOf(time.Unix(evt.IntervalStartUTC, 0).UTC())}
+	if self.identity {
+		key.identityId = evt.Tags["clientId"]
+	}
+	if self.service {
+		key.serviceId = evt.Tags["serviceId"]
+	}
+	if self.router {
+		key.routerId = evt.SourceId
+	}
+
+	row, found := self.rows[key]
+	if !found {
+		row = &usageReportRow{
+			usageReportKey: key,
+			circuits:       map[string]struct{}{},
+			bytes:          map[string]uint64{},
+		}
+		self.rows[key] = row
+	}
+
+	counted := false
+	for _, usageType := range usageReportTypes {
+		if val, ok := evt.Usage[usageType]; ok {
+			row.bytes[usageType] += val
+			counted = true
+		}
+	}
+	if counted {
+		row.circuits[evt.CircuitId] = struct{}{}
+	} else if len(row.circuits) == 0 {
+		// only fabric usage, which isn't reported
+		delete(self.rows, key)
+	}
+}
+
+func (self *usageReport) bucketOf(t time.Time) time.Time {
+	if self.bucket == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func (self *usageReport) sortedRows(names *usageNames) []*usageReportRow {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var result []*usageReportRow
+	for _, row := range self.rows {
+		result = append(result, row)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if !a.bucket.Equal(b.bucket) {
+			return a.bucket.Before(b.bucket)
+		}
+		if a.identityId != b.identityId {
+			return names.identity(a.identityId) < names.identity(b.identityId)
+		}
+		if a.serviceId != b.serviceId {
+			return names.service(a.serviceId) < names.service(b.serviceId)
+		}
+		return names.router(a.routerId) < names.router(b.routerId)
+	})
+	return result
+}
+
+func (self *usageReport) table(names *usageNames) table.Writer {
+	t := table.NewWriter()
+	t.SetStyle(table.StyleRounded)
+
+	header := table.Row{"Bucket"}
+	if self.identity {
+		header = append(header, "Identity ID", "Identity")
+	}
+	if self.service {
+		header = append(header, "Service ID", "Service")
+	}
+	if self.router {
+		header = append(header, "Router ID", "Router")
+	}
+	header = append(header, "Circuits", "Ingress Rx Bytes", "Ingress Tx Bytes", "Egress Rx Bytes", "Egress Tx Bytes")
+	t.AppendHeader(header)
+
+	for _, row := range self.sortedRows(names) {
+		cells := table.Row{row.bucket.Format(time.RFC3339)}
+		if self.identity {
+			cells = append(cells, row.identityId, names.identity(row.identityId))
+		}
+		if self.service {
+			cells = append(cells, row.serviceId, names.service(row.serviceId))
+		}
+		if self.router {
+			cells = append(cells, row.routerId, names.router(row.routerId))
+		}
+		cells = append(cells, len(row.circuits))
+		for _, usageType := range usageReportTypes {
+			cells = append(cells, row.bytes[usageType])
+		}
+		t.AppendRow(cells)
+	}
+	return t
+}
+
+type usageReportJsonRow struct {
+	Bucket         time.Time `json:"bucket"`
+	IdentityId     *string   `json:"identity_id,omitempty"`
+	Identity       *string   `json:"identity,omitempty"`
+	ServiceId      *string   `json:"service_id,omitempty"`
+	Service        *string   `json:"service,omitempty"`
+	RouterId       *string   `json:"router_id,omitempty"`
+	Router         *string   `json:"router,omitempty"`
+	Circuits       int       `json:"circuits"`
+	IngressRxBytes uint64    `json:"ingress_rx_bytes"`
+	IngressTxBytes uint64    `json:"ingress_tx_bytes"`
+	EgressRxBytes  uint64    `json:"egress_rx_bytes"`
+	EgressTxBytes  uint64    `json:"egress_tx_bytes"`
+}
+
+func (self *usageReport) writeJSON(out io.Writer, names *usageNames) error {
+	strPtr := func(s string) *string { return &s }
+
+	result := []*usageReportJsonRow{}
+	for _, row := range self.sortedRows(names) {
+		jsonRow := &usageReportJsonRow{
+			Bucket:         row.bucket,
+			Circuits:       len(row.circuits),
+			IngressRxBytes: row.bytes["ingress.rx"],
+			IngressTxBytes: row.bytes["ingress.tx"],
+			EgressRxBytes:  row.bytes["egress.rx"],
+			EgressTxBytes:  row.bytes["egress.tx"],
+		}
+		if self.identity {
+			jsonRow.IdentityId = strPtr(row.identityId)
+			jsonRow.Identity = strPtr(names.identity(row.identityId))
+		}
+		if self.service {
+			jsonRow.ServiceId = strPtr(row.serviceId)
+			jsonRow.Service = strPtr(names.service(row.serviceId))
+		}
+		if self.router {
+			jsonRow.RouterId = strPtr(row.routerId)
+			jsonRow.Router = strPtr(names.router(row.routerId))
+		}
+		result = append(result, jsonRow)
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// usageNames maps ids to names. Ids which can't be resolved are used as their own name
+type usageNames struct {
+	identities map[string]string
+	services   map[string]string
+	routers    map[string]string
+}
+
+func newUsageNames() *usageNames {
+	return &usageNames{
+		identities: map[string]string{},
+		services:   map[string]string{},
+		routers:    map[string]string{},
+	}
+}
+
+func usageName(names map[string]string, id string) string {
+	if name, found := names[id]; found {
+		return name
+	}
+	return id
+}
+
+func (self *usageNames) identity(id string) string {
+	return usageName(self.identities, id)
+}
+
+func (self *usageNames) service(id string) string {
+	return usageName(self.services, id)
+}
+
+func (self *usageNames) router(id string) string {
+	return usageName(self.routers, id)
+}
+
+// resolve looks up the names of the routers, services and identities in the report. Only the ids which appear in the
+// report are looked up, in batches, rather than listing every entity
+func (self *usageNames) resolve(o *usageReportAction, report *usageReport) error {
+	identityIds := map[string]struct{}{}
+	serviceIds := map[string]struct{}{}
+	routerIds := map[string]struct{}{}
+	for _, row := range report.rows {
+		if report.identity && row.identityId != "" {
+			identityIds[row.identityId] = struct{}{}
+		}
+		if report.service && row.serviceId != "" {
+			serviceIds[row.serviceId] = struct{}{}
+		}
+		if report.router && row.routerId != "" {
+			routerIds[row.routerId] = struct{}{}
+		}
+	}
+
+	if err := o.lookupNames(util.FabricAPI, "routers", routerIds, self.routers); err != nil {
+		return err
+	}
+	if err := o.lookupNames(util.FabricAPI, "services", serviceIds, self.services); err != nil {
+		return err
+	}
+	return o.lookupNames(util.EdgeAPI, "identities", identityIds, self.identities)
+}
+
+func (self *usageReportAction) lookupNames(apiType util.API, entityType string, ids map[string]struct{}, names map[string]string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var sortedIds []string
+	for id := range ids {
+		sortedIds = append(sortedIds, id)
+	}
+	sort.Strings(sortedIds)
+
+	entityIds, err := api.GetEntityIds(apiType, entityType, &self.Options, sortedIds...)
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedIds {
+		if name, found := entityIds.NameForId(id); found {
+			names[id] = name
+		}
+	}
+	return nil
+}
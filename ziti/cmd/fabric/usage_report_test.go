@@ -0,0 +1,120 @@
+package fabric
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/openziti/ziti/ziti/cmd/api"
+	"github.com/openziti/ziti/ziti/cmd/api/apitest"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+var testUsageEvents = []string{
+	// 2023-05-01T10:00:00Z, ingress router r1
+	`{"namespace":"fabric.usage","version":3,"source_id":"r1","circuit_id":"c1","usage":{"ingress.rx":100,"ingress.tx":1000,"fabric.tx":100},"interval_start_utc":1682935200,"interval_length":60,"tags":{"clientId":"id1","serviceId":"svc1","hostId":"h1"}}`,
+	// same hour, egress router r2
+	`{"namespace":"fabric.usage","version":3,"source_id":"r2","circuit_id":"c1","usage":{"egress.rx":1000,"egress.tx":100},"interval_start_utc":1682935260,"interval_length":60,"tags":{"clientId":"id1","serviceId":"svc1","hostId":"h1"}}`,
+	// transit router only reports fabric usage, which isn't counted
+	`{"namespace":"fabric.usage","version":3,"source_id":"r3","circuit_id":"c1","usage":{"fabric.rx":100,"fabric.tx":100},"interval_start_utc":1682935260,"interval_length":60,"tags":{"clientId":"id2","serviceId":"svc1"}}`,
+	// a second circuit in the next hour, as a version 2 event
+	`{"namespace":"fabric.usage","version":2,"event_type":"usage.ingress.rx","source_id":"r1","circuit_id":"c2","usage":50,"interval_start_utc":1682938800,"interval_length":60,"tags":{"clientId":"id1","serviceId":"svc1"}}`,
+	`{"namespace":"stream.gap","event_type":"reconnected"}`,
+	`{"namespace":"fabric.circuits","event_type":"created","circuit_id":"c3"}`,
+}
+
+func TestUsageReportAggregates(t *testing.T) {
+	req := require.New(t)
+
+	report, err := newUsageReport("hour", []string{"identity", "service"})
+	req.NoError(err)
+	for _, evt := range testUsageEvents {
+		req.NoError(report.AcceptEvent([]byte(evt)), evt)
+	}
+	req.Equal(1, report.gaps)
+
+	names := newUsageNames()
+	names.identities["id1"] = "alice"
+	names.services["svc1"] = "echo"
+
+	out := &bytes.Buffer{}
+	req.NoError(report.writeJSON(out, names))
+
+	var rows []map[string]interface{}
+	req.NoError(json.Unmarshal(out.Bytes(), &rows))
+	req.Len(rows, 2)
+	req.Equal(map[string]interface{}{
+		"bucket":           "2023-05-01T10:00:00Z",
+		"identity_id":      "id1",
+		"identity":         "alice",
+		"service_id":       "svc1",
+		"service":          "echo",
+		"circuits":         float64(1),
+		"ingress_rx_bytes": float64(100),
+		"ingress_tx_bytes": float64(1000),
+		"egress_rx_bytes":  float64(1000),
+		"egress_tx_bytes":  float64(100),
+	}, rows[0])
+	req.Equal("2023-05-01T11:00:00Z", rows[1]["bucket"])
+	req.Equal(float64(50), rows[1]["ingress_rx_bytes"])
+
+	report, err = newUsageReport("day", []string{"router"})
+	req.NoError(err)
+	for _, evt := range testUsageEvents {
+		req.NoError(report.AcceptEvent([]byte(evt)))
+	}
+
+	names.routers["r1"] = "edge-a"
+	req.Equal("Bucket,Router ID,Router,Circuits,Ingress Rx Bytes,Ingress Tx Bytes,Egress Rx Bytes,Egress Tx Bytes\n"+
+		"2023-05-01T00:00:00Z,r1,edge-a,2,150,1000,0,0\n"+
+		"2023-05-01T00:00:00Z,r2,r2,1,0,0,1000,100", report.table(names).RenderCSV())
+}
+
+func TestUsageReportOptions(t *testing.T) {
+	_, err := newUsageReport("week", nil)
+	require.EqualError(t, err, "unsupported bucket 'week', must be one of: hour, day")
+	_, err = newUsageReport("hour", []string{"tenant"})
+	require.EqualError(t, err, "unsupported group 'tenant', must be any of: identity, service, router")
+}
+
+func TestUsageReportResolvesOnlyReportedIds(t *testing.T) {
+	req := require.New(t)
+	server := apitest.NewServer(t)
+	api.ResetIdCache()
+	defer api.ResetIdCache()
+
+	server.Create("routers", map[string]interface{}{"id": "r1", "name": "edge-a"})
+	server.Create("routers", map[string]interface{}{"id": "r9", "name": "unused"})
+	server.Create("services", map[string]interface{}{"id": "svc1", "name": "echo"})
+	server.Create("identities", map[string]interface{}{"id": "id1", "name": "alice", "type": "User"})
+	server.Create("identities", map[string]interface{}{"id": "id9", "name": "unused", "type": "User"})
+
+	recording := filepath.Join(t.TempDir(), "usage.zev")
+	writeTestRecording(t, recording, testUsageEvents...)
+
+	output, err := apitest.Execute(newTestFabricCmd, "usage", "report", recording, "--group-by", "identity,service,router", "-o", "json")
+	req.NoError(err)
+
+	var rows []*usageReportJsonRow
+	req.NoError(json.Unmarshal([]byte(output), &rows))
+	names := map[string]string{}
+	for _, row := range rows {
+		names[*row.IdentityId] = *row.Identity
+		names[*row.ServiceId] = *row.Service
+		names[*row.RouterId] = *row.Router
+	}
+	req.Equal("alice", names["id1"])
+	req.Equal("echo", names["svc1"])
+	req.Equal("edge-a", names["r1"])
+	req.Equal("r2", names["r2"])
+
+	// one batched lookup per type, for the ids in the report only
+	routerRequests := server.RequestsTo(http.MethodGet, apitest.FabricPath+"/routers")
+	req.Len(routerRequests, 1)
+	req.Equal(`id in ["r1","r2"] or name in ["r1","r2"]`, routerRequests[0].Query.Get("filter"))
+	req.Len(server.RequestsTo(http.MethodGet, apitest.FabricPath+"/services"), 1)
+	identityRequests := server.RequestsTo(http.MethodGet, apitest.EdgeManagementPath+"/identities")
+	req.Len(identityRequests, 1)
+	req.Equal(`id in ["id1"] or name in ["id1"]`, identityRequests[0].Query.Get("filter"))
+}
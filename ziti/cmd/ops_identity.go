@@ -0,0 +1,508 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/openziti/foundation/v2/term"
+	"github.com/openziti/identity"
+	cmdhelper "github.com/openziti/ziti/ziti/cmd/helpers"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"time"
+)
+
+// NewCmdOpsIdentity creates the command group for working with identity files
+func NewCmdOpsIdentity(out io.Writer, errOut io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "identity",
+		Short: "Inspect, create and convert Ziti identity files",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdhelper.CheckErr(cmd.Help())
+		},
+	}
+
+	cmd.AddCommand(newCmdOpsIdentityInspect(out, errOut))
+	cmd.AddCommand(newCmdOpsIdentityWrap(out, errOut))
+	cmd.AddCommand(newCmdOpsIdentityExport(out, errOut))
+	cmd.AddCommand(NewUnwrapIdentityFileCommand(out, errOut))
+
+	return cmd
+}
+
+// OpsIdentityInspectOptions contains the command line options for the "ops identity inspect" command
+type OpsIdentityInspectOptions struct {
+	CommonOptions
+}
+
+func newCmdOpsIdentityInspect(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &OpsIdentityInspectOptions{
+		CommonOptions: CommonOptions{
+			Out: out,
+			Err: errOut,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "inspect <identity_file>",
+		Short: "Show the certificate, key and controller details of a Ziti identity file and validate its certificate chain",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := options.Run()
+			cmdhelper.CheckErr(err)
+		},
+	}
+
+	return cmd
+}
+
+// Run implements this command
+func (o *OpsIdentityInspectOptions) Run() error {
+	config, err := loadIdentityConfigFile(o.Args[0])
+	if err != nil {
+		return err
+	}
+
+	certs, err := identity.LoadCert(config.ID.Cert)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load certificate from identity file %v", o.Args[0])
+	}
+	if len(certs) == 0 {
+		return errors.Errorf("no certificate found in identity file %v", o.Args[0])
+	}
+	cert := certs[0]
+
+	var caCerts []*x509.Certificate
+	if config.ID.CA != "" {
+		if caCerts, err = identity.LoadCert(config.ID.CA); err != nil {
+			return errors.Wrapf(err, "unable to load CA bundle from identity file %v", o.Args[0])
+		}
+	}
+
+	ok := color.New(color.FgGreen, color.Bold).Sprint("OK")
+	fail := color.New(color.FgRed, color.Bold).Sprint("FAIL")
+
+	_, _ = fmt.Fprintf(o.Out, "Controller:   %v\n", valueOrNone(config.ZtAPI))
+	_, _ = fmt.Fprintf(o.Out, "Subject:      %v\n", cert.Subject.String())
+	_, _ = fmt.Fprintf(o.Out, "Issuer:       %v\n", cert.Issuer.String())
+	_, _ = fmt.Fprintf(o.Out, "Serial:       %v\n", cert.SerialNumber.String())
+	_, _ = fmt.Fprintf(o.Out, "SANs:         %v\n", valueOrNone(strings.Join(certSans(cert), ", ")))
+	_, _ = fmt.Fprintf(o.Out, "Key Type:     %v\n", describePublicKey(cert.PublicKey))
+	_, _ = fmt.Fprintf(o.Out, "Not Before:   %v\n", cert.NotBefore.UTC().Format(time.RFC3339))
+
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		_, _ = fmt.Fprintf(o.Out, "Not After:    %v (%v, expired %v ago)\n", cert.NotAfter.UTC().Format(time.RFC3339), fail, now.Sub(cert.NotAfter).Round(time.Second))
+	} else {
+		_, _ = fmt.Fprintf(o.Out, "Not After:    %v (expires in %v)\n", cert.NotAfter.UTC().Format(time.RFC3339), cert.NotAfter.Sub(now).Round(time.Second))
+	}
+
+	_, _ = fmt.Fprintf(o.Out, "CA Bundle:    %v certificate(s)\n", len(caCerts))
+	for _, caCert := range caCerts {
+		_, _ = fmt.Fprintf(o.Out, "              %v (expires %v)\n", caCert.Subject.String(), caCert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	valid := true
+
+	if key, err := identity.LoadKey(config.ID.Key); err != nil {
+		valid = false
+		_, _ = fmt.Fprintf(o.Out, "Private Key:  %v (%v)\n", fail, err)
+	} else if err = checkKeyMatchesCert(key, cert); err != nil {
+		valid = false
+		_, _ = fmt.Fprintf(o.Out, "Private Key:  %v (%v)\n", fail, err)
+	} else {
+		_, _ = fmt.Fprintf(o.Out, "Private Key:  %v (matches certificate)\n", ok)
+	}
+
+	if chains, err := verifyIdentityChain(cert, certs[1:], caCerts); err != nil {
+		valid = false
+		_, _ = fmt.Fprintf(o.Out, "Chain:        %v (%v)\n", fail, err)
+	} else {
+		var names []string
+		for _, chainCert := range chains[0] {
+			names = append(names, chainCert.Subject.CommonName)
+		}
+		_, _ = fmt.Fprintf(o.Out, "Chain:        %v (%v)\n", ok, strings.Join(names, " -> "))
+	}
+
+	if !valid {
+		return errors.Errorf("identity file %v is not valid", o.Args[0])
+	}
+	return nil
+}
+
+// OpsIdentityWrapOptions contains the command line options for the "ops identity wrap" command
+type OpsIdentityWrapOptions struct {
+	CommonOptions
+	certFile   string
+	keyFile    string
+	caFile     string
+	controller string
+	output     string
+}
+
+func newCmdOpsIdentityWrap(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &OpsIdentityWrapOptions{
+		CommonOptions: CommonOptions{
+			Out: out,
+			Err: errOut,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "wrap --cert <file> --key <file> [--ca <file>] [--controller <url>] [-o <identity_file>]",
+		Short: "wrap a certificate, private key and CA bundle into a Ziti identity file (the reverse of unwrap)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := options.Run()
+			cmdhelper.CheckErr(err)
+		},
+	}
+
+	cmd.Flags().StringVar(&options.certFile, "cert", "", "PEM certificate file")
+	cmd.Flags().StringVar(&options.keyFile, "key", "", "PEM private key file")
+	cmd.Flags().StringVar(&options.caFile, "ca", "", "PEM CA bundle file")
+	cmd.Flags().StringVar(&options.controller, "controller", "", "Controller client API URL to store as ztAPI, ex: https://ctrl.example.com:1280")
+	cmd.Flags().StringVarP(&options.output, "output", "o", "", "identity file to write, defaults to stdout")
+	_ = cmd.MarkFlagRequired("cert")
+	_ = cmd.MarkFlagRequired("key")
+
+	return cmd
+}
+
+// Run implements this command
+func (o *OpsIdentityWrapOptions) Run() error {
+	readPem := func(file string) (string, error) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", errors.Wrapf(err, "error opening file %v", file)
+		}
+		return identity.StoragePem + ":" + string(data), nil
+	}
+
+	config := &IdentityConfigFile{
+		ZtAPI: o.controller,
+	}
+
+	var err error
+	if config.ID.Cert, err = readPem(o.certFile); err != nil {
+		return err
+	}
+
+	if config.ID.Key, err = readPem(o.keyFile); err != nil {
+		return err
+	}
+
+	if o.caFile != "" {
+		if config.ID.CA, err = readPem(o.caFile); err != nil {
+			return err
+		}
+	}
+
+	certs, err := identity.LoadCert(config.ID.Cert)
+	if err != nil || len(certs) == 0 {
+		return errors.Errorf("no PEM certificate found in %v", o.certFile)
+	}
+
+	key, err := identity.LoadKey(config.ID.Key)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load private key from %v", o.keyFile)
+	}
+
+	if err = checkKeyMatchesCert(key, certs[0]); err != nil {
+		return errors.Wrapf(err, "private key %v does not belong to certificate %v", o.keyFile, o.certFile)
+	}
+
+	if o.caFile != "" {
+		if _, err = identity.LoadCert(config.ID.CA); err != nil {
+			return errors.Wrapf(err, "unable to load CA bundle from %v", o.caFile)
+		}
+	}
+
+	identityJson, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if o.output == "" {
+		_, err = fmt.Fprintln(o.Out, string(identityJson))
+		return err
+	}
+
+	if err = os.WriteFile(o.output, identityJson, 0600); err != nil {
+		return errors.Wrapf(err, "error writing identity file %v", o.output)
+	}
+	_, _ = fmt.Fprintf(o.Out, "identity written to %v\n", o.output)
+	return nil
+}
+
+// OpsIdentityExportOptions contains the command line options for the "ops identity export" command
+type OpsIdentityExportOptions struct {
+	CommonOptions
+	pkcs12File   string
+	password     string
+	passwordFile string
+}
+
+// pkcs12PasswordEnvVar may hold the password for "ops identity export", so it doesn't have to be given on the command line
+const pkcs12PasswordEnvVar = "ZITI_PKCS12_PASSWORD"
+
+func newCmdOpsIdentityExport(out io.Writer, errOut io.Writer) *cobra.Command {
+	options := &OpsIdentityExportOptions{
+		CommonOptions: CommonOptions{
+			Out: out,
+			Err: errOut,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "export <identity_file> --pkcs12 <file>",
+		Short: "export the certificate, private key and CA bundle of a Ziti identity file to a password protected PKCS#12 file",
+		Long: "Exports the certificate, private key and CA bundle of a Ziti identity file to a PKCS#12 file, encrypted " +
+			"with AES-256. The password is read from --password, --password-file or the " + pkcs12PasswordEnvVar +
+			" environment variable, in that order, and is prompted for otherwise",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			options.Cmd = cmd
+			options.Args = args
+			err := options.Run()
+			cmdhelper.CheckErr(err)
+		},
+	}
+
+	cmd.Flags().StringVar(&options.pkcs12File, "pkcs12", "", "PKCS#12 (.p12) file to write")
+	cmd.Flags().StringVar(&options.password, "password", "", "password protecting the PKCS#12 file")
+	cmd.Flags().StringVar(&options.passwordFile, "password-file", "", "file containing the password protecting the PKCS#12 file")
+	_ = cmd.MarkFlagRequired("pkcs12")
+
+	return cmd
+}
+
+// Run implements this command
+func (o *OpsIdentityExportOptions) Run() error {
+	identityFile := o.Args[0]
+
+	config, err := loadIdentityConfigFile(identityFile)
+	if err != nil {
+		return err
+	}
+
+	certs, err := identity.LoadCert(config.ID.Cert)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load certificate from identity file %v", identityFile)
+	}
+	if len(certs) == 0 {
+		return errors.Errorf("no certificate found in identity file %v", identityFile)
+	}
+
+	key, err := identity.LoadKey(config.ID.Key)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load private key from identity file %v", identityFile)
+	}
+
+	if err = checkKeyMatchesCert(key, certs[0]); err != nil {
+		return errors.Wrapf(err, "invalid identity file %v", identityFile)
+	}
+
+	// include any intermediates from the certificate field, followed by the CA bundle, skipping duplicates
+	caCerts := certs[1:]
+	if config.ID.CA != "" {
+		bundle, err := identity.LoadCert(config.ID.CA)
+		if err != nil {
+			return errors.Wrapf(err, "unable to load CA bundle from identity file %v", identityFile)
+		}
+		for _, caCert := range bundle {
+			duplicate := false
+			for _, existing := range caCerts {
+				if existing.Equal(caCert) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				caCerts = append(caCerts, caCert)
+			}
+		}
+	}
+
+	password, err := o.getPassword()
+	if err != nil {
+		return err
+	}
+
+	data, err := pkcs12.Modern.Encode(key, certs[0], caCerts, password)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode PKCS#12 file")
+	}
+
+	if err = os.WriteFile(o.pkcs12File, data, 0600); err != nil {
+		return errors.Wrapf(err, "error writing PKCS#12 file %v", o.pkcs12File)
+	}
+
+	_, _ = fmt.Fprintf(o.Out, "identity exported to %v\n", o.pkcs12File)
+	return nil
+}
+
+// getPassword returns the password from --password, --password-file or the environment, prompting for it if none
+// of them are set
+func (o *OpsIdentityExportOptions) getPassword() (string, error) {
+	if o.password != "" {
+		return o.password, nil
+	}
+
+	if o.passwordFile != "" {
+		data, err := os.ReadFile(o.passwordFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read password file %v", o.passwordFile)
+		}
+		password := strings.TrimRight(string(data), "\r\n")
+		if password == "" {
+			return "", errors.Errorf("password file %v is empty", o.passwordFile)
+		}
+		return password, nil
+	}
+
+	if password := os.Getenv(pkcs12PasswordEnvVar); password != "" {
+		return password, nil
+	}
+
+	password, err := term.PromptPassword("Enter PKCS#12 password: ", false)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("a password is required to export an identity")
+	}
+
+	verifyPassword, err := term.PromptPassword("Enter password again: ", false)
+	if err != nil {
+		return "", err
+	}
+	if verifyPassword != password {
+		return "", errors.New("passwords did not match")
+	}
+	return password, nil
+}
+
+func loadIdentityConfigFile(identityFile string) (*IdentityConfigFile, error) {
+	identityJson, err := os.ReadFile(identityFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening file %v", identityFile)
+	}
+
+	config := &IdentityConfigFile{}
+	if err = json.Unmarshal(identityJson, config); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling identity config JSON")
+	}
+	return config, nil
+}
+
+// verifyIdentityChain verifies the certificate against the self-signed certificates in the CA bundle, using the
+// remaining certificates from the certificate field and the bundle as intermediates
+func verifyIdentityChain(cert *x509.Certificate, extraCerts []*x509.Certificate, caCerts []*x509.Certificate) ([][]*x509.Certificate, error) {
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+
+	for _, extraCert := range extraCerts {
+		intermediates.AddCert(extraCert)
+	}
+
+	hasRoot := false
+	for _, caCert := range caCerts {
+		if caCert.CheckSignatureFrom(caCert) == nil {
+			roots.AddCert(caCert)
+			hasRoot = true
+		} else {
+			intermediates.AddCert(caCert)
+		}
+	}
+
+	if !hasRoot {
+		return nil, errors.New("no root CA in CA bundle")
+	}
+
+	return cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+}
+
+func checkKeyMatchesCert(key crypto.PrivateKey, cert *x509.Certificate) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.Errorf("unsupported private key type %T", key)
+	}
+
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	return nil
+}
+
+func describePublicKey(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %v", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("EC %v", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+func certSans(cert *x509.Certificate) []string {
+	var result []string
+	for _, name := range cert.DNSNames {
+		result = append(result, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		result = append(result, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		result = append(result, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		result = append(result, "URI:"+uri.String())
+	}
+	return result
+}
+
+func valueOrNone(val string) string {
+	if val == "" {
+		return "<none>"
+	}
+	return val
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestIdentityPem(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	} else {
+		template.DNSNames = []string{cn + ".example.com"}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, cn+".cert"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, cn+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return cert, key
+}
+
+func TestOpsIdentityWrapInspectExport(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+
+	caCert, caKey := writeTestIdentityPem(t, dir, "ca", nil, nil)
+	cert, key := writeTestIdentityPem(t, dir, "client", caCert, caKey)
+	writeTestIdentityPem(t, dir, "other-ca", nil, nil)
+
+	identityFile := filepath.Join(dir, "client.json")
+
+	out := &bytes.Buffer{}
+	wrap := &OpsIdentityWrapOptions{
+		CommonOptions: CommonOptions{Out: out, Err: out},
+		certFile:      filepath.Join(dir, "client.cert"),
+		keyFile:       filepath.Join(dir, "client.key"),
+		caFile:        filepath.Join(dir, "ca.cert"),
+		controller:    "https://ctrl.example.com:1280",
+		output:        identityFile,
+	}
+	req.NoError(wrap.Run())
+
+	config, err := loadIdentityConfigFile(identityFile)
+	req.NoError(err)
+	req.Equal("https://ctrl.example.com:1280", config.ZtAPI)
+	req.True(strings.HasPrefix(config.ID.Cert, "pem:"))
+	req.True(strings.HasPrefix(config.ID.Key, "pem:"))
+	req.True(strings.HasPrefix(config.ID.CA, "pem:"))
+
+	out.Reset()
+	inspect := &OpsIdentityInspectOptions{CommonOptions: CommonOptions{Out: out, Err: out, Args: []string{identityFile}}}
+	req.NoError(inspect.Run())
+	req.Contains(out.String(), "Controller:   https://ctrl.example.com:1280")
+	req.Contains(out.String(), "Subject:      CN=client")
+	req.Contains(out.String(), "SANs:         DNS:client.example.com")
+	req.Contains(out.String(), "Key Type:     EC P-256")
+	req.Contains(out.String(), "(client -> ca)")
+
+	p12File := filepath.Join(dir, "client.p12")
+	export := &OpsIdentityExportOptions{
+		CommonOptions: CommonOptions{Out: out, Err: out, Args: []string{identityFile}},
+		pkcs12File:    p12File,
+		password:      "s3cret",
+	}
+	req.NoError(export.Run())
+
+	data, err := os.ReadFile(p12File)
+	req.NoError(err)
+	exportedKey, exportedCert, exportedCaCerts, err := pkcs12.DecodeChain(data, "s3cret")
+	req.NoError(err)
+	req.True(cert.Equal(exportedCert))
+	req.Len(exportedCaCerts, 1)
+	req.True(caCert.Equal(exportedCaCerts[0]))
+	req.True(key.Equal(exportedKey))
+
+	_, _, _, err = pkcs12.DecodeChain(data, "wrong")
+	req.ErrorIs(err, pkcs12.ErrIncorrectPassword)
+
+	// the password may also come from a file or the environment
+	passwordFile := filepath.Join(dir, "password")
+	req.NoError(os.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+	export.password = ""
+	export.passwordFile = passwordFile
+	req.NoError(export.Run())
+	data, err = os.ReadFile(p12File)
+	req.NoError(err)
+	_, _, _, err = pkcs12.DecodeChain(data, "from-file")
+	req.NoError(err)
+
+	t.Setenv(pkcs12PasswordEnvVar, "from-env")
+	export.passwordFile = ""
+	req.NoError(export.Run())
+	data, err = os.ReadFile(p12File)
+	req.NoError(err)
+	_, _, _, err = pkcs12.DecodeChain(data, "from-env")
+	req.NoError(err)
+
+	// an identity whose CA bundle does not contain its issuer fails chain validation
+	wrongCaFile := filepath.Join(dir, "wrong-ca.json")
+	wrap.caFile = filepath.Join(dir, "other-ca.cert")
+	wrap.output = wrongCaFile
+	req.NoError(wrap.Run())
+
+	out.Reset()
+	inspect.Args = []string{wrongCaFile}
+	req.Error(inspect.Run())
+	req.Contains(out.String(), "Private Key:  ")
+	req.Contains(out.String(), "Chain:        ")
+	req.NotContains(out.String(), "(client -> ca)")
+
+	// a key which doesn't belong to the certificate is rejected
+	wrap.keyFile = filepath.Join(dir, "ca.key")
+	wrap.caFile = filepath.Join(dir, "ca.cert")
+	req.Error(wrap.Run())
+}
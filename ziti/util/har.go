@@ -0,0 +1,434 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openziti/edge/controller/env"
+	"github.com/openziti/ziti/common/version"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const harRedacted = "REDACTED"
+
+var harRedactedHeaders = map[string]bool{
+	strings.ToLower(env.ZitiSession): true,
+	"authorization":                  true,
+	"cookie":                         true,
+	"set-cookie":                     true,
+}
+
+var harRedactedFields = map[string]bool{
+	"password": true,
+	"token":    true,
+}
+
+// Har is the subset of the HTTP Archive 1.2 format needed to record and replay controller REST traffic
+type Har struct {
+	Log *HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string      `json:"version"`
+	Creator HarCreator  `json:"creator"`
+	Entries []*HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectUrl string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HarContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HarTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// LoadHar reads a HAR file
+func LoadHar(path string) (*Har, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read HAR file %v", path)
+	}
+	har := &Har{}
+	if err = json.Unmarshal(data, har); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse HAR file %v", path)
+	}
+	if har.Log == nil {
+		return nil, errors.Errorf("HAR file %v has no log section", path)
+	}
+	return har, nil
+}
+
+var harTransports = struct {
+	sync.Mutex
+	recorder *harRecorder
+	replayer *harReplayer
+}{}
+
+// NewHarTransport wraps the given transport so that traffic is recorded to, or replayed from, a HAR file if one
+// was requested with --record or --replay. Otherwise the given transport is returned unchanged
+func NewHarTransport(next http.RoundTripper) (http.RoundTripper, error) {
+	harTransports.Lock()
+	defer harTransports.Unlock()
+
+	if common.CliReplayFile != "" {
+		if harTransports.replayer == nil || harTransports.replayer.path != common.CliReplayFile {
+			har, err := LoadHar(common.CliReplayFile)
+			if err != nil {
+				return nil, err
+			}
+			harTransports.replayer = &harReplayer{path: common.CliReplayFile, har: har, used: map[*HarEntry]bool{}}
+		}
+		return harTransports.replayer, nil
+	}
+
+	if common.CliRecordFile != "" {
+		if harTransports.recorder == nil || harTransports.recorder.path != common.CliRecordFile {
+			harTransports.recorder = &harRecorder{
+				path: common.CliRecordFile,
+				har: &Har{
+					Log: &HarLog{
+						Version: "1.2",
+						Creator: HarCreator{Name: "ziti", Version: version.GetVersion()},
+						Entries: []*HarEntry{},
+					},
+				},
+			}
+		}
+		return &harRecordingTransport{recorder: harTransports.recorder, next: next}, nil
+	}
+
+	return next, nil
+}
+
+// configureRestyHarTransport must be called after the resty client's TLS settings are configured, since resty can
+// only change TLS settings on an *http.Transport
+func configureRestyHarTransport(client *resty.Client) error {
+	if common.CliReplayFile == "" && common.CliRecordFile == "" {
+		return nil
+	}
+	next := client.GetClient().Transport
+	switch next.(type) {
+	case *harReplayer, *harRecordingTransport:
+		return nil
+	}
+	if next == nil {
+		next = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	transport, err := NewHarTransport(next)
+	if err != nil {
+		return err
+	}
+	client.SetTransport(transport)
+	return nil
+}
+
+// getReplayIdentity provides an identity pointing at the recorded controller when --replay is used, so that
+// recordings are replayed offline, whichever login is selected, and on machines which have never logged in to
+// that controller. It returns nil if nothing is being replayed
+func getReplayIdentity() (RestClientIdentity, error) {
+	if common.CliReplayFile == "" {
+		return nil, nil
+	}
+	har, err := LoadHar(common.CliReplayFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			continue
+		}
+		baseUrl := u.Scheme + "://" + u.Host
+		if strings.HasPrefix(u.Path, "/edge/management/v1") {
+			baseUrl += "/edge/management/v1"
+		}
+		return &RestClientEdgeIdentity{Url: baseUrl}, nil
+	}
+	return nil, errors.Errorf("no requests recorded in %v", common.CliReplayFile)
+}
+
+type harRecorder struct {
+	sync.Mutex
+	path string
+	har  *Har
+}
+
+// add records an entry. The file is rewritten after every entry, since many commands exit without cleanup on error
+func (self *harRecorder) add(entry *HarEntry) error {
+	self.Lock()
+	defer self.Unlock()
+
+	self.har.Log.Entries = append(self.har.Log.Entries, entry)
+	data, err := json.MarshalIndent(self.har, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(self.path, data, 0600)
+}
+
+type harRecordingTransport struct {
+	recorder *harRecorder
+	next     http.RoundTripper
+}
+
+func (self *harRecordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	entry := &HarEntry{
+		StartedDateTime: time.Now().Format(time.RFC3339Nano),
+		Request: HarRequest{
+			Method:      r.Method,
+			Url:         r.URL.String(),
+			HttpVersion: r.Proto,
+			Cookies:     []HarNameValue{},
+			Headers:     toHarHeaders(r.Header),
+			QueryString: []HarNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+
+	for k, vals := range r.URL.Query() {
+		for _, v := range vals {
+			entry.Request.QueryString = append(entry.Request.QueryString, HarNameValue{Name: k, Value: v})
+		}
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		entry.Request.BodySize = len(body)
+		entry.Request.PostData = &HarPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Text:     redactHarBody(body),
+		}
+	}
+
+	start := time.Now()
+	resp, err := self.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+	entry.Time = elapsed
+	entry.Timings = HarTimings{Wait: elapsed}
+	entry.Response = HarResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprintf("%d", resp.StatusCode))),
+		HttpVersion: resp.Proto,
+		Cookies:     []HarNameValue{},
+		Headers:     toHarHeaders(resp.Header),
+		Content: HarContent{
+			Size:     len(body),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     redactHarBody(body),
+		},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+
+	if err = self.recorder.add(entry); err != nil {
+		return nil, errors.Wrapf(err, "unable to write HAR file %v", self.recorder.path)
+	}
+
+	return resp, nil
+}
+
+// harReplayer answers requests from a HAR file. Requests are matched on method, path and query. Matching entries
+// are used in the order they were recorded, with the last one being reused once they have all been used
+type harReplayer struct {
+	sync.Mutex
+	path string
+	har  *Har
+	used map[*HarEntry]bool
+}
+
+func (self *harReplayer) RoundTrip(r *http.Request) (*http.Response, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if r.Body != nil {
+		_ = r.Body.Close()
+	}
+
+	var match *HarEntry
+	for _, entry := range self.har.Log.Entries {
+		if self.matches(entry, r) {
+			match = entry
+			if !self.used[entry] {
+				break
+			}
+		}
+	}
+
+	if match == nil {
+		return nil, errors.Errorf("no recorded response found for %v %v in %v", r.Method, r.URL.RequestURI(), common.CliReplayFile)
+	}
+	self.used[match] = true
+
+	header := http.Header{}
+	for _, h := range match.Response.Headers {
+		header.Add(h.Name, h.Value)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", match.Response.Status, match.Response.StatusText),
+		StatusCode:    match.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(match.Response.Content.Text)),
+		ContentLength: int64(len(match.Response.Content.Text)),
+		Request:       r,
+	}, nil
+}
+
+func (self *harReplayer) matches(entry *HarEntry, r *http.Request) bool {
+	if !strings.EqualFold(entry.Request.Method, r.Method) {
+		return false
+	}
+	u, err := url.Parse(entry.Request.Url)
+	if err != nil {
+		return false
+	}
+	return u.Path == r.URL.Path && u.Query().Encode() == r.URL.Query().Encode()
+}
+
+func toHarHeaders(header http.Header) []HarNameValue {
+	result := []HarNameValue{}
+	for k, vals := range header {
+		for _, v := range vals {
+			if harRedactedHeaders[strings.ToLower(k)] {
+				v = harRedacted
+			}
+			result = append(result, HarNameValue{Name: k, Value: v})
+		}
+	}
+	return result
+}
+
+// redactHarBody blanks out credentials in JSON bodies, such as the session token returned by the controller
+func redactHarBody(body []byte) string {
+	var val interface{}
+	if err := json.Unmarshal(body, &val); err != nil {
+		return string(body)
+	}
+	if !redactHarValue(val) {
+		return string(body)
+	}
+	redacted, err := json.Marshal(val)
+	if err != nil {
+		return string(body)
+	}
+	return string(redacted)
+}
+
+func redactHarValue(val interface{}) bool {
+	redacted := false
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if _, isString := child.(string); isString && harRedactedFields[k] {
+				v[k] = harRedacted
+				redacted = true
+			} else if redactHarValue(child) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactHarValue(child) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"github.com/openziti/edge/controller/env"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetHarTransports() {
+	harTransports.recorder = nil
+	harTransports.replayer = nil
+	common.CliRecordFile = ""
+	common.CliReplayFile = ""
+}
+
+func TestHarRecordAndReplay(t *testing.T) {
+	req := require.New(t)
+	defer resetHarTransports()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"name":"` + r.URL.Query().Get("filter") + `","token":"secret"}}`))
+	}))
+	defer server.Close()
+
+	harFile := filepath.Join(t.TempDir(), "session.har")
+
+	resetHarTransports()
+	common.CliRecordFile = harFile
+	transport, err := NewHarTransport(http.DefaultTransport)
+	req.NoError(err)
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/edge/management/v1/services?filter=foo", nil)
+	req.NoError(err)
+	request.Header.Set(env.ZitiSession, "secret-session")
+	resp, err := (&http.Client{Transport: transport}).Do(request)
+	req.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	req.NoError(err)
+	req.Contains(string(body), `"secret"`)
+
+	recorded, err := os.ReadFile(harFile)
+	req.NoError(err)
+	req.False(strings.Contains(string(recorded), "secret"))
+
+	server.Close()
+
+	resetHarTransports()
+	common.CliReplayFile = harFile
+	transport, err = NewHarTransport(http.DefaultTransport)
+	req.NoError(err)
+
+	resp, err = (&http.Client{Transport: transport}).Get("https://other-host/edge/management/v1/services?filter=foo")
+	req.NoError(err)
+	req.Equal(http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	req.NoError(err)
+	req.Contains(string(body), `"name":"foo"`)
+
+	_, err = (&http.Client{Transport: transport}).Get("https://other-host/edge/management/v1/services?filter=bar")
+	req.Error(err)
+
+	replayIdentity, err := getReplayIdentity()
+	req.NoError(err)
+	baseUrl, err := replayIdentity.GetBaseUrlForApi(EdgeAPI)
+	req.NoError(err)
+	req.Equal(server.URL+"/edge/management/v1", baseUrl)
+
+	// replays stay offline, even when there is a saved login
+	t.Setenv("ZITI_HOME", t.TempDir())
+	req.NoError(PersistRestClientConfig(&RestClientConfig{
+		EdgeIdentities: map[string]*RestClientEdgeIdentity{
+			"default": {Url: "https://saved-controller:1280/edge/management/v1", Token: "token"},
+		},
+	}))
+	ClearSelectedIdentity()
+	defer ClearSelectedIdentity()
+
+	for _, api := range []API{EdgeAPI, FabricAPI} {
+		selected, err := LoadSelectedIdentityForApi(api)
+		req.NoError(err)
+		req.Equal(replayIdentity, selected)
+		ClearSelectedIdentity()
+	}
+
+	common.CliReplayFile = filepath.Join(t.TempDir(), "missing.har")
+	_, err = LoadSelectedIdentity()
+	req.Error(err)
+}
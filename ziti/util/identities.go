@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -108,6 +109,10 @@ func (self *RestClientEdgeIdentity) NewClient(timeout time.Duration, verbose boo
 	}
 	client.SetTimeout(timeout)
 	client.SetDebug(verbose)
+	configureRestyRetries(client, CliRetryPolicy(), verbose)
+	if err := configureRestyHarTransport(client); err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
@@ -202,6 +207,10 @@ func (self *RestClientFabricIdentity) NewClient(timeout time.Duration, verbose b
 	client.SetTLSClientConfig(id.ClientTLSConfig())
 	client.SetTimeout(timeout)
 	client.SetDebug(verbose)
+	configureRestyRetries(client, CliRetryPolicy(), verbose)
+	if err := configureRestyHarTransport(client); err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
@@ -315,8 +324,23 @@ func PersistRestClientConfig(config *RestClientConfig) error {
 
 var selectedIdentity RestClientIdentity
 
+// ClearSelectedIdentity forces the selected identity to be reloaded from the CLI config on next use. This is needed
+// when the config changes within a single process, as happens in tests
+func ClearSelectedIdentity() {
+	selectedIdentity = nil
+}
+
 func LoadSelectedIdentity() (RestClientIdentity, error) {
 	if selectedIdentity == nil {
+		replayIdentity, err := getReplayIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if replayIdentity != nil {
+			selectedIdentity = replayIdentity
+			return selectedIdentity, nil
+		}
+
 		config, configFile, err := LoadRestClientConfig()
 		if err != nil {
 			return nil, err
@@ -331,6 +355,19 @@ func LoadSelectedIdentity() (RestClientIdentity, error) {
 	return selectedIdentity, nil
 }
 
+// LoadEdgeIdentity returns the saved edge login with the given name, independent of which login is currently selected
+func LoadEdgeIdentity(id string) (RestClientIdentity, error) {
+	config, configFile, err := LoadRestClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientIdentity, found := config.EdgeIdentities[id]
+	if !found {
+		return nil, errors.Errorf("no identity '%v' found in cli config %v", id, configFile)
+	}
+	return clientIdentity, nil
+}
+
 func LoadSelectedRWIdentity() (RestClientIdentity, error) {
 	id, err := LoadSelectedIdentity()
 	if err != nil {
@@ -349,6 +386,15 @@ func LoadSelectedIdentityForApi(api API) (RestClientIdentity, error) {
 
 	if api == FabricAPI {
 		if selectedIdentity == nil {
+			replayIdentity, err := getReplayIdentity()
+			if err != nil {
+				return nil, err
+			}
+			if replayIdentity != nil {
+				selectedIdentity = replayIdentity
+				return selectedIdentity, nil
+			}
+
 			config, configFile, err := LoadRestClientConfig()
 			if err != nil {
 				return nil, err
@@ -389,10 +435,12 @@ func newRestClientResponseF(clientOpts ClientOpts) func(*http.Response, error) {
 				return
 			}
 
-			resp.Body = io.NopCloser(resp.Body)
 			bodyContent, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			// put back what was read, so the client can still process the response
+			resp.Body = io.NopCloser(bytes.NewReader(bodyContent))
 			if err != nil {
-				_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "could not read response body: %v", err)
+				_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "could not read response body: %v\n", err)
 				return
 			}
 			bodyStr := string(bodyContent)
@@ -407,44 +455,64 @@ func newRestClientRequestF(clientOpts ClientOpts, readOnly bool) func(*http.Requ
 			return errors.New("this login is marked read-only, only GET operations are allowed")
 		}
 		if clientOpts.OutputRequestJson() {
-			if request == nil || request.Body == nil {
+			if request == nil || request.Body == nil || request.Body == http.NoBody {
 				_, _ = fmt.Fprint(clientOpts.OutputWriter(), "<empty request body>\n")
 				return nil
 			}
 
+			if request.GetBody == nil {
+				_, _ = fmt.Fprint(clientOpts.ErrOutputWriter(), "could not copy request body: body is not replayable\n")
+				return nil
+			}
+
 			body, err := request.GetBody()
-			if err == nil {
-				_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "could not copy request body: %v", err)
+			if err != nil {
+				_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "could not copy request body: %v\n", err)
 				return nil
 			}
 			bodyContent, err := io.ReadAll(body)
 			if err != nil {
-				bodyStr := string(bodyContent)
-				_, _ = fmt.Fprint(clientOpts.OutputWriter(), bodyStr, "\n")
+				_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "could not read request body: %v\n", err)
 				return nil
 			}
+			_, _ = fmt.Fprint(clientOpts.OutputWriter(), string(bodyContent), "\n")
 		}
 		return nil
 	}
 }
 
+// NewRestClientHttpClient returns an http client for sending raw requests with the identity's TLS configuration. As
+// with the generated clients, the read-only restriction of the login is enforced by the client. The session
+// credentials to send are given by the identity's NewWsHeader
+func NewRestClientHttpClient(clientOpts ClientOpts, clientIdentity RestClientIdentity) (*http.Client, error) {
+	return newRestClientTransport(clientOpts, clientIdentity)
+}
+
 func newRestClientTransport(clientOpts ClientOpts, clientIdentity RestClientIdentity) (*http.Client, error) {
+	timeout := clientOpts.RequestTimeout()
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+
 	httpClientTransport := &edgeTransport{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
+				Timeout:   timeout,
 				KeepAlive: 10 * time.Second,
 			}).DialContext,
 
 			ForceAttemptHTTP2:     true,
 			MaxIdleConns:          10,
 			IdleConnTimeout:       10 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
+			TLSHandshakeTimeout:   timeout,
 			ExpectContinueTimeout: 1 * time.Second,
 		},
 		ResponseFunc: newRestClientResponseF(clientOpts),
 		RequestFunc:  newRestClientRequestF(clientOpts, clientIdentity.IsReadOnly()),
+		RetryFunc:    newRestClientRetryF(clientOpts),
+		Timeout:      timeout,
+		RetryPolicy:  clientOpts.RequestRetryPolicy(),
 	}
 
 	tlsClientConfig, err := clientIdentity.NewTlsClientConfig()
@@ -454,9 +522,44 @@ func newRestClientTransport(clientOpts ClientOpts, clientIdentity RestClientIden
 
 	httpClientTransport.TLSClientConfig = tlsClientConfig
 
+	if httpClientTransport.Next, err = NewHarTransport(httpClientTransport.Transport); err != nil {
+		return nil, err
+	}
+
+	// the timeout is applied per attempt by the transport, so that retries aren't cut short
 	httpClient := &http.Client{
 		Transport: httpClientTransport,
-		Timeout:   10 * time.Second,
 	}
 	return httpClient, nil
 }
+
+func newRestClientRetryF(clientOpts ClientOpts) func(*http.Request, *http.Response, error, int, time.Duration) {
+	return func(request *http.Request, resp *http.Response, err error, attempt int, delay time.Duration) {
+		if !clientOpts.IsVerbose() {
+			return
+		}
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+		}
+		_, _ = fmt.Fprintf(clientOpts.ErrOutputWriter(), "%v %v failed (%v), retry %v of %v in %v\n",
+			request.Method, request.URL, reason, attempt, clientOpts.RequestRetryPolicy().MaxRetries, delay.Round(time.Millisecond))
+	}
+}
+
+// newTransientFailureRetryCondition makes resty clients retry idempotent requests which fail with a transient status.
+// Connection errors are retried by resty itself, see configureRestyRetries
+func newTransientFailureRetryCondition(client *resty.Client, verbose bool) resty.RetryConditionFunc {
+	return func(resp *resty.Response) (bool, error) {
+		if resp == nil || resp.Request == nil || resp.RawResponse == nil {
+			return false, nil
+		}
+		retry := IsIdempotentMethod(resp.Request.Method) && IsTransientStatus(resp.StatusCode())
+		if retry && verbose {
+			client.Log.Printf("%v %v failed (%v), retrying", resp.Request.Method, resp.Request.URL, resp.Status())
+		}
+		return retry, nil
+	}
+}
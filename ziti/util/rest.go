@@ -21,6 +21,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Jeffail/gabs"
@@ -80,13 +81,18 @@ func DownloadFile(filepath string, url string) (err error) {
 	return nil
 }
 
-// Use a 2-second timeout with a retry count of 5
+// Use a 2-second timeout with a retry count of 5. Requests are recorded or replayed if --record or --replay was
+// given. Callers set TLS options after creating the client, so the HAR transport is only put in place when the first
+// request is sent
 func NewClient() *resty.Client {
 	return resty.
 		New().
 		SetTimeout(2 * time.Second).
 		SetRetryCount(5).
-		SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+		SetRedirectPolicy(resty.FlexibleRedirectPolicy(15)).
+		OnBeforeRequest(func(client *resty.Client, _ *resty.Request) error {
+			return configureRestyHarTransport(client)
+		})
 }
 
 func getRequest(verbose bool) *resty.Request {
@@ -700,6 +706,18 @@ type edgeTransport struct {
 	*http.Transport
 	RequestFunc  func(*http.Request) error
 	ResponseFunc func(*http.Response, error)
+	RetryFunc    func(r *http.Request, resp *http.Response, err error, attempt int, delay time.Duration)
+	Timeout      time.Duration
+	RetryPolicy  RetryPolicy
+	// Next, if set, is used to send requests instead of the embedded transport
+	Next http.RoundTripper
+}
+
+func (edgeTransport *edgeTransport) next() http.RoundTripper {
+	if edgeTransport.Next != nil {
+		return edgeTransport.Next
+	}
+	return edgeTransport.Transport
 }
 
 func (edgeTransport *edgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -709,7 +727,7 @@ func (edgeTransport *edgeTransport) RoundTrip(r *http.Request) (*http.Response,
 		}
 	}
 
-	resp, err := edgeTransport.Transport.RoundTrip(r)
+	resp, err := edgeTransport.roundTripWithRetries(r)
 
 	if edgeTransport.ResponseFunc != nil {
 		edgeTransport.ResponseFunc(resp, err)
@@ -718,6 +736,85 @@ func (edgeTransport *edgeTransport) RoundTrip(r *http.Request) (*http.Response,
 	return resp, err
 }
 
+func (edgeTransport *edgeTransport) roundTripWithRetries(r *http.Request) (*http.Response, error) {
+	policy := edgeTransport.RetryPolicy
+	if ctxPolicy, ok := RetryPolicyFromContext(r.Context()); ok {
+		policy = ctxPolicy
+	}
+
+	replayable := r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+	canRetry := IsIdempotentMethod(r.Method) && replayable
+
+	for attempt := 0; ; attempt++ {
+		req := r
+		if attempt > 0 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+
+		resp, err := edgeTransport.roundTripAttempt(req)
+
+		if !canRetry || attempt >= policy.MaxRetries || !isTransientFailure(r, resp, err) {
+			return resp, err
+		}
+
+		delay := policy.Delay(attempt, resp)
+		if edgeTransport.RetryFunc != nil {
+			edgeTransport.RetryFunc(r, resp, err, attempt+1, delay)
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// roundTripAttempt applies the timeout to a single attempt, rather than to the request as a whole, so that
+// a slow attempt doesn't use up the time available for retries
+func (edgeTransport *edgeTransport) roundTripAttempt(r *http.Request) (*http.Response, error) {
+	if edgeTransport.Timeout <= 0 {
+		return edgeTransport.next().RoundTrip(r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), edgeTransport.Timeout)
+	resp, err := edgeTransport.next().RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func isTransientFailure(r *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// if the caller gave up, retrying won't help
+		return r.Context().Err() == nil
+	}
+	return IsTransientStatus(resp.StatusCode)
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (self *cancelOnCloseBody) Close() error {
+	defer self.cancel()
+	return self.ReadCloser.Close()
+}
+
 type ApiErrorPayload interface {
 	GetPayload() *rest_model.APIErrorEnvelope
 }
@@ -767,6 +864,9 @@ type ClientOpts interface {
 	OutputResponseJson() bool
 	OutputWriter() io.Writer
 	ErrOutputWriter() io.Writer
+	RequestTimeout() time.Duration
+	RequestRetryPolicy() RetryPolicy
+	IsVerbose() bool
 }
 
 func NewEdgeManagementClient(clientOpts ClientOpts) (*rest_management_api_client.ZitiEdgeManagement, error) {
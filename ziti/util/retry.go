@@ -0,0 +1,158 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"gopkg.in/resty.v1"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRequestTimeout = 10 * time.Second
+	DefaultMaxRetries     = 3
+)
+
+// RetryPolicy controls how idempotent REST requests which fail with a transient error are retried
+type RetryPolicy struct {
+	MaxRetries   int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// CliRetryPolicy returns the default retry policy, with the number of retries selected with --max-retries
+func CliRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = common.CliMaxRetries
+	return policy
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:   DefaultMaxRetries,
+		InitialDelay: 250 * time.Millisecond,
+		MaxDelay:     5 * time.Second,
+	}
+}
+
+// Delay returns how long to wait before the given retry attempt (starting at zero). The delay grows exponentially,
+// is randomized to avoid many clients retrying in lockstep, and will honor a Retry-After header if one is present
+func (self RetryPolicy) Delay(attempt int, resp *http.Response) time.Duration {
+	backoff := math.Min(float64(self.MaxDelay), float64(self.InitialDelay)*math.Exp2(float64(attempt)))
+	half := int64(backoff / 2)
+	delay := time.Duration(half)
+	if half > 0 {
+		delay += time.Duration(rand.Int63n(half))
+	}
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			if retryAfter := time.Duration(seconds) * time.Second; retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+	}
+
+	if delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+	return delay
+}
+
+// configureRestyRetries makes a resty client retry requests according to the retry policy. Idempotent requests are
+// retried when they fail with a connection error or a transient status. Other requests are only ever sent once
+func configureRestyRetries(client *resty.Client, policy RetryPolicy, verbose bool) {
+	// resty counts the first attempt as well as the retries
+	client.SetRetryCount(policy.MaxRetries + 1)
+	client.SetRetryWaitTime(policy.InitialDelay)
+	client.SetRetryMaxWaitTime(policy.MaxDelay)
+	client.AddRetryCondition(newTransientFailureRetryCondition(client, verbose))
+
+	// resty retries every request which fails with an error, whatever the retry conditions say, unless the request
+	// context has been cancelled. Requests which aren't idempotent get a context which is cancelled when sending them
+	// fails, so that they aren't sent again
+	client.OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+		if !IsIdempotentMethod(r.Method) {
+			if _, found := r.Context().Value(stopRetriesKey{}).(context.CancelFunc); !found {
+				ctx, cancel := context.WithCancel(r.Context())
+				r.SetContext(context.WithValue(ctx, stopRetriesKey{}, cancel))
+			}
+		}
+		return nil
+	})
+
+	next := client.GetClient().Transport
+	if next == nil {
+		next = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	client.SetTransport(&stopRetriesTransport{next: next})
+}
+
+type stopRetriesKey struct{}
+
+// stopRetriesTransport cancels the context of requests which fail to send, if they were marked by
+// configureRestyRetries as not to be retried
+type stopRetriesTransport struct {
+	next http.RoundTripper
+}
+
+func (self *stopRetriesTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := self.next.RoundTrip(r)
+	if err != nil {
+		if cancel, ok := r.Context().Value(stopRetriesKey{}).(context.CancelFunc); ok {
+			cancel()
+		}
+	}
+	return resp, err
+}
+
+type retryPolicyKey struct{}
+
+// ContextWithRetryPolicy returns a context which overrides the retry policy of requests made with it
+func ContextWithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func RetryPolicyFromContext(ctx context.Context) (RetryPolicy, bool) {
+	policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy)
+	return policy, ok
+}
+
+// IsIdempotentMethod returns true for the HTTP methods which can safely be sent more than once
+func IsIdempotentMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// IsTransientStatus returns true for response codes which are expected to go away on their own, such as those
+// returned while a controller is restarting or a cluster is electing a new leader
+func IsTransientStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
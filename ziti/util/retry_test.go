@@ -0,0 +1,158 @@
+package util
+
+import (
+	"context"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/resty.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRetryTransport() *edgeTransport {
+	return &edgeTransport{
+		Transport: &http.Transport{},
+		Timeout:   time.Second,
+		RetryPolicy: RetryPolicy{
+			MaxRetries:   3,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     5 * time.Millisecond,
+		},
+	}
+}
+
+func TestTransportRetriesTransientFailures(t *testing.T) {
+	req := require.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var retries []int
+	transport := newTestRetryTransport()
+	transport.RetryFunc = func(_ *http.Request, _ *http.Response, _ error, attempt int, _ time.Duration) {
+		retries = append(retries, attempt)
+	}
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL)
+	req.NoError(err)
+	req.Equal(http.StatusOK, resp.StatusCode)
+	req.Equal(int32(3), atomic.LoadInt32(&calls))
+	req.Equal([]int{1, 2}, retries)
+}
+
+func TestTransportDoesNotRetryNonIdempotentRequests(t *testing.T) {
+	req := require.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTestRetryTransport()}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	req.NoError(err)
+	req.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	req.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTransportGivesUpAfterMaxRetries(t *testing.T) {
+	req := require.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTestRetryTransport()}
+	resp, err := client.Get(server.URL)
+	req.NoError(err)
+	req.Equal(http.StatusBadGateway, resp.StatusCode)
+	req.Equal(int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestRetryPolicyDelayIsBounded(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := policy.Delay(attempt, nil)
+		require.True(t, delay > 0)
+		require.True(t, delay <= policy.MaxDelay)
+	}
+}
+
+func newTestRestyClient(t *testing.T, maxRetries int, handler http.HandlerFunc) (*resty.Client, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	oldMaxRetries := common.CliMaxRetries
+	common.CliMaxRetries = maxRetries
+	t.Cleanup(func() { common.CliMaxRetries = oldMaxRetries })
+
+	identity := &RestClientEdgeIdentity{Url: server.URL + "/edge/management/v1"}
+	client, err := identity.NewClient(time.Second, false)
+	require.NoError(t, err)
+	return client, server.URL
+}
+
+func closeConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+}
+
+func TestRestyClientRetriesTransientFailures(t *testing.T) {
+	req := require.New(t)
+
+	var calls int32
+	client, url := newTestRestyClient(t, 1, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	resp, err := client.R().Get(url)
+	req.NoError(err)
+	req.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+	req.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.R().SetBody("{}").Post(url)
+	req.NoError(err)
+	req.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+	req.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRestyClientOnlyRetriesIdempotentRequestsOnConnectionErrors(t *testing.T) {
+	req := require.New(t)
+
+	var calls int32
+	client, url := newTestRestyClient(t, 1, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		closeConnection(w)
+	})
+
+	_, err := client.R().Get(url)
+	req.Error(err)
+	req.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = client.R().SetBody("{}").Post(url)
+	req.Error(err)
+	req.NotErrorIs(err, context.Canceled)
+	req.Equal(int32(1), atomic.LoadInt32(&calls))
+}